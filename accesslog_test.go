@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Capture the access log for the duration of a test
+func captureAccessLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	oldLog := accessLog
+	accessLog = newLogger(&buf, "", 0)
+	AccessLogEnabled = true
+	t.Cleanup(func() {
+		accessLog = oldLog
+		AccessLogEnabled = false
+	})
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	output := captureAccessLog(t)
+	r := setupRouter(false)
+
+	store.Upload(context.Background(), testBucket, "__test/abc.webp", strings.NewReader("webp"), UploadOptions{ContentType: "image/webp"})
+	req, _ := http.NewRequest("GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp?fields=size", nil)
+	req.Header.Set("X-Request-ID", "req-456")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Len(t, lines, 1)
+
+	var record AccessRecord
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "req-456", record.RequestID)
+	assert.Equal(t, "GET", record.Method)
+	assert.Equal(t, "/faceclaim/metadata/:bucket/:charid/:key", record.Route)
+	assert.Equal(t, "/faceclaim/metadata/"+testBucket+"/__test/abc.webp?fields=size", record.Path)
+	assert.Equal(t, 200, record.Status)
+	assert.Equal(t, w.Body.Len(), record.ResponseBytes)
+	assert.GreaterOrEqual(t, record.LatencyMS, 0.0)
+	assert.Equal(t, "none", record.Token)
+}
+
+func TestAccessLogRequestBytes(t *testing.T) {
+	useFakeBackends(t)
+	output := captureAccessLog(t)
+	r := setupRouter(false)
+
+	body := `{"enabled": false}`
+	performRequest(r, "POST", "/admin/maintenance", strings.NewReader(body))
+
+	var record AccessRecord
+	json.Unmarshal(output.Bytes(), &record)
+	assert.Equal(t, int64(len(body)), record.RequestBytes)
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	output := captureAccessLog(t)
+	AccessLogEnabled = false
+	r := setupRouter(false)
+
+	performRequest(r, "GET", "/faceclaim/job/missing", nil)
+	assert.Empty(t, output.String())
+}
+
+func TestRedactedPath(t *testing.T) {
+	assert.Equal(t, "/faceclaim/job/1", redactedPath("/faceclaim/job/1", ""))
+	assert.Equal(t, "/faceclaim/job/1?verbose=1", redactedPath("/faceclaim/job/1", "verbose=1"))
+	assert.Equal(t, "/faceclaim/job/1", redactedPath("/faceclaim/job/1", "access_token=abc"))
+	assert.Equal(t, "/faceclaim/job/1", redactedPath("/faceclaim/job/1", "X-Goog-Signature=abc"))
+}
+
+func TestTokenIdentity(t *testing.T) {
+	assert.Equal(t, "none", tokenIdentity(""))
+	assert.Len(t, tokenIdentity("hunter2"), 8)
+	assert.NotContains(t, tokenIdentity("hunter2"), "hunter2")
+	assert.Equal(t, tokenIdentity("hunter2"), tokenIdentity("hunter2"))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// A MessageAction names what a background message asks the workers to do.
+type MessageAction string
+
+const (
+	ActionDeleteSingle MessageAction = "delete_single"
+	ActionDeleteGroup  MessageAction = "delete_group"
+
+	// Published for other services; this one doesn't consume it
+	ActionFaceclaimUploaded MessageAction = "faceclaim_uploaded"
+)
+
+// The version of the envelope and payloads this build publishes. Consumers
+// refuse messages newer than they understand, so they're redelivered to one
+// that does.
+const messageVersion = 1
+
+// The topic each action is published to.
+var actionTopics = map[MessageAction]string{
+	ActionDeleteSingle:      "delete-single-faceclaim",
+	ActionDeleteGroup:       "delete-faceclaim-group",
+	ActionFaceclaimUploaded: "faceclaim-uploaded",
+}
+
+// LegacyMessageFields copies each payload's fields to the top level of its
+// envelope, where consumers that predate the envelope read them. It's on
+// until they've all moved over. Read from LEGACY_MESSAGE_FIELDS.
+var LegacyMessageFields = true
+
+// PublishUploadEvents publishes a FaceclaimUploaded after each upload, for
+// analytics and cache warmers. Read from PUBLISH_UPLOAD_EVENTS.
+var PublishUploadEvents bool
+
+// Reads LEGACY_MESSAGE_FIELDS and PUBLISH_UPLOAD_EVENTS.
+func prepareMessages() error {
+	LegacyMessageFields = true
+	if value, ok := os.LookupEnv("LEGACY_MESSAGE_FIELDS"); ok {
+		legacy, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("LEGACY_MESSAGE_FIELDS: %v", err)
+		}
+		LegacyMessageFields = legacy
+	}
+	PublishUploadEvents = false
+	if value, ok := os.LookupEnv("PUBLISH_UPLOAD_EVENTS"); ok {
+		publish, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("PUBLISH_UPLOAD_EVENTS: %v", err)
+		}
+		PublishUploadEvents = publish
+	}
+	return nil
+}
+
+// A Message is the payload of a background action.
+type Message interface {
+	Action() MessageAction
+
+	// The bucket and character the action is on, for logs and tags
+	target() (bucket, charid string)
+}
+
+// A DeleteSingle deletes one object.
+type DeleteSingle struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+func (DeleteSingle) Action() MessageAction { return ActionDeleteSingle }
+
+func (m DeleteSingle) target() (string, string) {
+	return m.Bucket, DeleteMessage{Key: m.Key}.charid()
+}
+
+// A DeleteGroup deletes everything under a character's prefix.
+type DeleteGroup struct {
+	Bucket string `json:"bucket"`
+	CharID string `json:"charid"`
+}
+
+func (DeleteGroup) Action() MessageAction { return ActionDeleteGroup }
+
+func (m DeleteGroup) target() (string, string) {
+	return m.Bucket, m.CharID
+}
+
+// A FaceclaimUploaded announces a stored faceclaim. Bytes is the WebP's size,
+// not counting a kept original or variants.
+type FaceclaimUploaded struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	CharID string `json:"charid"`
+	Guild  string `json:"guild"`
+	User   string `json:"user"`
+	Bytes  int64  `json:"bytes"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+func (FaceclaimUploaded) Action() MessageAction { return ActionFaceclaimUploaded }
+
+func (m FaceclaimUploaded) target() (string, string) {
+	return m.Bucket, m.CharID
+}
+
+// Reports whether a message is a deletion, which may be journaled and
+// retried if it can't be published.
+func isDeletion(message Message) bool {
+	switch message.(type) {
+	case DeleteSingle, DeleteGroup:
+		return true
+	}
+	return false
+}
+
+// A MessageEnvelope wraps every background message: the action, the version
+// of its payload, and the ID of the request that published it.
+type MessageEnvelope struct {
+	Action    MessageAction   `json:"action"`
+	Version   int             `json:"version"`
+	RequestID string          `json:"request_id,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Encodes a message in its envelope, with the request ID from ctx.
+func encodeMessage(ctx context.Context, message Message) ([]byte, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %v", err)
+	}
+	envelope := JSON{
+		"action":  message.Action(),
+		"version": messageVersion,
+		"payload": json.RawMessage(payload),
+	}
+	if id := requestID(ctx); id != "" {
+		envelope["request_id"] = id
+	}
+	if LegacyMessageFields {
+		var fields JSON
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %v", err)
+		}
+		for key, value := range fields {
+			if _, ok := envelope[key]; !ok {
+				envelope[key] = value
+			}
+		}
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %v", err)
+	}
+	return data, nil
+}
+
+// An unsupportedMessageError means a message's action or version is newer
+// than this build understands.
+type unsupportedMessageError struct {
+	reason string
+}
+
+func (e *unsupportedMessageError) Error() string {
+	return e.reason
+}
+
+// Decodes a message from its envelope. Messages published before the envelope,
+// which have no action, are read as the DeleteMessage they were. Malformed
+// messages are invalidDeleteErrors, and ones from a newer build are
+// unsupportedMessageErrors.
+func decodeMessage(data []byte) (Message, error) {
+	var envelope MessageEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, &invalidDeleteError{err.Error()}
+	}
+	if envelope.Action == "" {
+		var legacy DeleteMessage
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, &invalidDeleteError{err.Error()}
+		}
+		return legacy.message()
+	}
+	if envelope.Version < 1 {
+		return nil, &invalidDeleteError{fmt.Sprintf("invalid message version %v", envelope.Version)}
+	}
+	if envelope.Version > messageVersion {
+		return nil, &unsupportedMessageError{fmt.Sprintf("message version %v is newer than %v", envelope.Version, messageVersion)}
+	}
+
+	var message Message
+	switch envelope.Action {
+	case ActionDeleteSingle:
+		message = &DeleteSingle{}
+	case ActionDeleteGroup:
+		message = &DeleteGroup{}
+	case ActionFaceclaimUploaded:
+		message = &FaceclaimUploaded{}
+	default:
+		return nil, &unsupportedMessageError{fmt.Sprintf("unknown action %q", envelope.Action)}
+	}
+	if err := json.Unmarshal(envelope.Payload, message); err != nil {
+		return nil, &invalidDeleteError{fmt.Sprintf("%v payload: %v", envelope.Action, err)}
+	}
+	// Handed on by value, as they're published
+	switch m := message.(type) {
+	case *DeleteSingle:
+		return *m, nil
+	case *DeleteGroup:
+		return *m, nil
+	case *FaceclaimUploaded:
+		return *m, nil
+	}
+	return message, nil
+}
+
+// Carries out a message, returning how many objects it deleted.
+func applyMessage(ctx context.Context, message Message) (int, error) {
+	switch m := message.(type) {
+	case DeleteSingle:
+		return applyDeleteSingle(ctx, m)
+	case DeleteGroup:
+		return applyDeleteGroup(ctx, m)
+	}
+	return 0, &unsupportedMessageError{fmt.Sprintf("no handler for %v", message.Action())}
+}
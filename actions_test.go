@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Publish messages without the legacy fields for the duration of a test
+func useEnvelopeOnly(t *testing.T) {
+	LegacyMessageFields = false
+	t.Cleanup(func() { LegacyMessageFields = true })
+}
+
+// The wire format of each message, which consumers depend on
+func TestMessageWireFormat(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-1")
+	for _, test := range []struct {
+		message  Message
+		legacy   string
+		envelope string
+	}{
+		{
+			DeleteSingle{Bucket: testBucket, Key: "__test/abc.webp"},
+			`{"action":"delete_single","bucket":"` + testBucket + `","key":"__test/abc.webp","payload":{"bucket":"` + testBucket + `","key":"__test/abc.webp"},"request_id":"req-1","version":1}`,
+			`{"action":"delete_single","payload":{"bucket":"` + testBucket + `","key":"__test/abc.webp"},"request_id":"req-1","version":1}`,
+		},
+		{
+			DeleteGroup{Bucket: testBucket, CharID: testCharID},
+			`{"action":"delete_group","bucket":"` + testBucket + `","charid":"__test","payload":{"bucket":"` + testBucket + `","charid":"__test"},"request_id":"req-1","version":1}`,
+			`{"action":"delete_group","payload":{"bucket":"` + testBucket + `","charid":"__test"},"request_id":"req-1","version":1}`,
+		},
+	} {
+		data, err := encodeMessage(ctx, test.message)
+		assert.NoError(t, err)
+		assert.JSONEq(t, test.legacy, string(data), "The payload's fields are copied up for old consumers")
+		assert.Contains(t, actionTopics, test.message.Action())
+
+		LegacyMessageFields = false
+		data, err = encodeMessage(ctx, test.message)
+		LegacyMessageFields = true
+		assert.NoError(t, err)
+		assert.JSONEq(t, test.envelope, string(data))
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	useEnvelopeOnly(t)
+
+	for _, message := range []Message{
+		DeleteSingle{Bucket: testBucket, Key: "__test/abc.webp"},
+		DeleteGroup{Bucket: testBucket, CharID: testCharID},
+	} {
+		data, err := encodeMessage(context.Background(), message)
+		assert.NoError(t, err)
+		decoded, err := decodeMessage(data)
+		assert.NoError(t, err)
+		assert.Equal(t, message, decoded)
+
+		assert.NoError(t, publishMessage(context.Background(), message, nil))
+	}
+	published := publisher.published()
+	if assert.Len(t, published, 2) {
+		assert.Equal(t, "delete-single-faceclaim", published[0].Topic)
+		assert.Equal(t, "__test/abc.webp", published[0].Data["key"])
+		assert.Equal(t, "delete-faceclaim-group", published[1].Topic)
+		assert.Equal(t, testCharID, published[1].Data["charid"])
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	// Messages from before the envelope
+	message, err := decodeMessage([]byte(`{"bucket":"` + testBucket + `","charid":"__test"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, DeleteGroup{Bucket: testBucket, CharID: testCharID}, message)
+
+	var unsupported *unsupportedMessageError
+	_, err = decodeMessage([]byte(`{"action":"delete_single","version":2,"payload":{}}`))
+	assert.ErrorAs(t, err, &unsupported, "Newer versions are left for newer consumers")
+	_, err = decodeMessage([]byte(`{"action":"cdn_purge","version":1,"payload":{}}`))
+	assert.ErrorAs(t, err, &unsupported)
+
+	var invalid *invalidDeleteError
+	for _, data := range []string{`[]`, `{"action":"delete_single","version":0,"payload":{}}`, `{"action":"delete_group","version":1,"payload":[]}`, `{}`} {
+		_, err = decodeMessage([]byte(data))
+		assert.ErrorAs(t, err, &invalid, data)
+	}
+}
+
+func TestPushEnvelopes(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	key := usePushAuth(t)
+	router := setupRouter(false)
+	token := signRS256(key, "key-1", identityClaims(testBotAccount))
+	objects := seedBatch(t, router, 2)
+
+	useEnvelopeOnly(t)
+	data, _ := encodeMessage(context.Background(), DeleteSingle{Bucket: testBucket, Key: objects[0]})
+	w := pushMessage(router, token, "a", json.RawMessage(data))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.False(t, store.exists(testBucket, objects[0]))
+
+	w = pushMessage(router, token, "b", json.RawMessage(`{"action":"delete_group","version":2,"payload":{}}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, "Unsupported messages are redelivered")
+	assert.Contains(t, w.Body.String(), "unsupported_message")
+	assert.True(t, store.exists(testBucket, objects[1]))
+}
+
+func TestPrepareMessages(t *testing.T) {
+	defer os.Unsetenv("LEGACY_MESSAGE_FIELDS")
+
+	assert.NoError(t, prepareMessages())
+	assert.True(t, LegacyMessageFields)
+	os.Setenv("LEGACY_MESSAGE_FIELDS", "false")
+	assert.NoError(t, prepareMessages())
+	assert.False(t, LegacyMessageFields)
+	os.Setenv("LEGACY_MESSAGE_FIELDS", "sometimes")
+	assert.Error(t, prepareMessages())
+
+	os.Unsetenv("LEGACY_MESSAGE_FIELDS")
+	prepareMessages()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sync"
+)
+
+// AdminPort is the localhost-only port serving pprof, expvar, and a config
+// dump. The admin listener is disabled when it's empty.
+var AdminPort string
+
+// Reads ADMIN_PORT.
+func prepareAdmin() {
+	AdminPort = os.Getenv("ADMIN_PORT")
+}
+
+var publishGauges sync.Once
+
+// Returns the current job gauges.
+func gauges() map[string]interface{} {
+	active, queued := uploads.stats()
+	return map[string]interface{}{
+		"job_slots_in_use": len(jobSlots),
+		"job_slots":        cap(jobSlots),
+		"jobs":             Jobs.counts(),
+		"auth_ban_clients": authBans.size(),
+		"uploads_active":   active,
+		"uploads_queued":   queued,
+	}
+}
+
+// Returns the admin handler. It's only ever served on localhost.
+func adminMux() *http.ServeMux {
+	publishGauges.Do(func() {
+		expvar.Publish("gauges", expvar.Func(func() interface{} { return gauges() }))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"config": configSummary(),
+			"gauges": gauges(),
+		})
+	})
+	return mux
+}
+
+// Starts the admin listener on localhost if AdminPort is set, returning its
+// server, or nil if it's disabled. The server's Addr is the bound address.
+func startAdminServer() (*http.Server, error) {
+	if AdminPort == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", AdminPort))
+	if err != nil {
+		return nil, fmt.Errorf("admin listener: %v", err)
+	}
+
+	server := &http.Server{Addr: ln.Addr().String(), Handler: adminMux()}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("Admin listener stopped:", err)
+		}
+	}()
+	log.Println("Admin listener on", server.Addr)
+	return server, nil
+}
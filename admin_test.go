@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminServerDisabled(t *testing.T) {
+	AdminPort = ""
+	server, err := startAdminServer()
+	assert.Nil(t, err)
+	assert.Nil(t, server, "The admin listener should only start when ADMIN_PORT is set")
+}
+
+func TestAdminServer(t *testing.T) {
+	AdminPort = "0" // Any free port
+	defer func() { AdminPort = "" }()
+
+	server, err := startAdminServer()
+	assert.Nil(t, err)
+	if !assert.NotNil(t, server) {
+		return
+	}
+	defer server.Close()
+	assert.True(t, strings.HasPrefix(server.Addr, "127.0.0.1:"), "The admin listener should be bound to localhost")
+
+	resp, err := http.Get(fmt.Sprintf("http://%v/debug/pprof/profile?seconds=1", server.Addr))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Get(fmt.Sprintf("http://%v/debug/config", server.Addr))
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var dump struct {
+		Config map[string]interface{}
+		Gauges map[string]interface{}
+	}
+	assert.Nil(t, json.Unmarshal(body, &dump))
+	assert.Equal(t, "0", dump.Config["admin_port"])
+	assert.Equal(t, float64(maxConcurrentJobs), dump.Gauges["job_slots"])
+
+	resp, err = http.Get(fmt.Sprintf("http://%v/debug/vars", server.Addr))
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), `"gauges"`)
+}
+
+func TestAdminRoutesNotPublic(t *testing.T) {
+	r := setupRouter(false)
+	w := performRequest(r, "GET", "/debug/pprof/", nil)
+	assert.Equal(t, 404, w.Code)
+}
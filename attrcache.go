@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Object attributes are cached for AttrCacheTTL, for up to AttrCacheSize
+// objects, so repeated existence and metadata checks of the same faceclaims
+// don't each cost a GCS request. A size of 0 disables the cache.
+var (
+	AttrCacheSize = 1000
+	AttrCacheTTL  = 30 * time.Second
+)
+
+// attrCache holds the attributes of recently looked up objects.
+var attrCache = newAttrLRU(AttrCacheSize, AttrCacheTTL)
+
+// Reads ATTR_CACHE_SIZE and ATTR_CACHE_TTL.
+func prepareAttrCache() error {
+	AttrCacheSize, AttrCacheTTL = 1000, 30*time.Second
+
+	if value, ok := os.LookupEnv("ATTR_CACHE_SIZE"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("ATTR_CACHE_SIZE must be a non-negative integer")
+		}
+		AttrCacheSize = n
+	}
+	if value, ok := os.LookupEnv("ATTR_CACHE_TTL"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.New("ATTR_CACHE_TTL must be a positive duration, e.g. \"30s\"")
+		}
+		AttrCacheTTL = d
+	}
+	attrCache = newAttrLRU(AttrCacheSize, AttrCacheTTL)
+	return nil
+}
+
+// Fetches an object's attributes, from the cache if they were looked up
+// recently. Only objects that exist are cached. The attributes are shared, so
+// they mustn't be modified.
+func cachedObjectAttrs(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	if attrs, ok := attrCache.get(bucket, object); ok {
+		recordAttrCacheLookup(true)
+		return attrs, nil
+	}
+	recordAttrCacheLookup(false)
+
+	attrs, err := getObjectAttrs(ctx, bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	attrCache.add(bucket, object, attrs)
+	return attrs, nil
+}
+
+// An attrLRU is a size-bounded cache of object attributes whose entries
+// expire after ttl. When it's full, the least recently used entry is evicted.
+type attrLRU struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type attrEntry struct {
+	key     string
+	attrs   *storage.ObjectAttrs
+	expires time.Time
+}
+
+func newAttrLRU(size int, ttl time.Duration) *attrLRU {
+	return &attrLRU{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Objects are keyed by bucket and name. Names can't contain newlines, so the
+// key is unambiguous.
+func attrKey(bucket, object string) string {
+	return bucket + "\n" + object
+}
+
+// Returns an object's cached attributes, if they haven't expired.
+func (c *attrLRU) get(bucket, object string) (*storage.ObjectAttrs, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	element, ok := c.entries[attrKey(bucket, object)]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*attrEntry)
+	if c.now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, entry.key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.attrs, true
+}
+
+// Caches an object's attributes, evicting the least recently used entry if
+// the cache is full.
+func (c *attrLRU) add(bucket, object string, attrs *storage.ObjectAttrs) {
+	if c.size == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	key := attrKey(bucket, object)
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*attrEntry)
+		entry.attrs, entry.expires = attrs, expires
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*attrEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&attrEntry{key, attrs, expires})
+}
+
+// Forgets an object, e.g. because it was just written or deleted.
+func (c *attrLRU) invalidate(bucket, object string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, ok := c.entries[attrKey(bucket, object)]; ok {
+		c.order.Remove(element)
+		delete(c.entries, element.Value.(*attrEntry).key)
+	}
+}
+
+// Forgets every object in a bucket whose name starts with prefix, e.g. a
+// character whose faceclaims are all being deleted.
+func (c *attrLRU) invalidatePrefix(bucket, prefix string) {
+	c.Lock()
+	defer c.Unlock()
+
+	keyPrefix := attrKey(bucket, prefix)
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, keyPrefix) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Returns the number of cached objects.
+func (c *attrLRU) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
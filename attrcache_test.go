@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the attribute cache's hit and miss counts
+func attrCacheLookups() (float64, float64) {
+	return testutil.ToFloat64(attrCacheLookupsTotal.WithLabelValues("hit")),
+		testutil.ToFloat64(attrCacheLookupsTotal.WithLabelValues("miss"))
+}
+
+func TestAttrCacheHit(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	ctx := context.Background()
+	store.Upload(ctx, testBucket, "__test/cached.webp", strings.NewReader("x"), UploadOptions{ContentType: "image/webp"})
+
+	hits, misses := attrCacheLookups()
+	_, err := cachedObjectAttrs(ctx, testBucket, "__test/cached.webp")
+	assert.NoError(t, err)
+
+	// The second lookup doesn't reach the store
+	store.err = errors.New("storage is down")
+	attrs, err := cachedObjectAttrs(ctx, testBucket, "__test/cached.webp")
+	assert.NoError(t, err)
+	assert.Equal(t, "image/webp", attrs.ContentType)
+	assert.Equal(t, hits+1, testutil.ToFloat64(attrCacheLookupsTotal.WithLabelValues("hit")))
+	assert.Equal(t, misses+1, testutil.ToFloat64(attrCacheLookupsTotal.WithLabelValues("miss")))
+}
+
+func TestAttrCacheMissAfterDelete(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	ctx := context.Background()
+	store.Upload(ctx, testBucket, "__test/cached.webp", strings.NewReader("x"), UploadOptions{})
+	cachedObjectAttrs(ctx, testBucket, "__test/cached.webp")
+
+	assert.NoError(t, deleteObject(ctx, testBucket, "__test/cached.webp"))
+	_, misses := attrCacheLookups()
+	_, err := cachedObjectAttrs(ctx, testBucket, "__test/cached.webp")
+	assert.ErrorIs(t, err, storage.ErrObjectNotExist)
+	assert.Equal(t, misses+1, testutil.ToFloat64(attrCacheLookupsTotal.WithLabelValues("miss")))
+}
+
+func TestAttrCacheMissAfterUpload(t *testing.T) {
+	useFakeBackends(t)
+	ctx := context.Background()
+	assert.NoError(t, uploadObject(ctx, strings.NewReader("x"), testBucket, "__test/cached.webp", UploadOptions{}))
+	before, _ := cachedObjectAttrs(ctx, testBucket, "__test/cached.webp")
+
+	assert.NoError(t, uploadObject(ctx, strings.NewReader("xy"), testBucket, "__test/cached.webp", UploadOptions{}))
+	after, err := cachedObjectAttrs(ctx, testBucket, "__test/cached.webp")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), before.Size)
+	assert.Equal(t, int64(2), after.Size)
+}
+
+func TestAttrCacheMetadataRoute(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	store.Upload(context.Background(), testBucket, "__test/abc.webp", strings.NewReader("x"), UploadOptions{})
+
+	hits, _ := attrCacheLookups()
+	performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp", nil)
+	w := performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, hits+1, testutil.ToFloat64(attrCacheLookupsTotal.WithLabelValues("hit")))
+}
+
+func TestAttrCacheExpires(t *testing.T) {
+	cache := newAttrLRU(10, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.add("bucket", "object", &storage.ObjectAttrs{})
+	_, ok := cache.get("bucket", "object")
+	assert.True(t, ok)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.get("bucket", "object")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.len())
+}
+
+func TestAttrCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newAttrLRU(2, time.Minute)
+	cache.add("bucket", "a", &storage.ObjectAttrs{})
+	cache.add("bucket", "b", &storage.ObjectAttrs{})
+	cache.get("bucket", "a")
+	cache.add("bucket", "c", &storage.ObjectAttrs{})
+
+	_, ok := cache.get("bucket", "b")
+	assert.False(t, ok)
+	_, ok = cache.get("bucket", "a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, cache.len())
+}
+
+func TestAttrCacheInvalidatePrefix(t *testing.T) {
+	cache := newAttrLRU(10, time.Minute)
+	cache.add("bucket", "char1/a.webp", &storage.ObjectAttrs{})
+	cache.add("bucket", "char1/b.webp", &storage.ObjectAttrs{})
+	cache.add("bucket", "char2/a.webp", &storage.ObjectAttrs{})
+	cache.add("other", "char1/a.webp", &storage.ObjectAttrs{})
+
+	cache.invalidatePrefix("bucket", "char1/")
+	assert.Equal(t, 2, cache.len())
+	_, ok := cache.get("bucket", "char2/a.webp")
+	assert.True(t, ok)
+	_, ok = cache.get("other", "char1/a.webp")
+	assert.True(t, ok)
+}
+
+func TestAttrCacheDisabled(t *testing.T) {
+	cache := newAttrLRU(0, time.Minute)
+	cache.add("bucket", "object", &storage.ObjectAttrs{})
+	_, ok := cache.get("bucket", "object")
+	assert.False(t, ok)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// How many objects an audit looks up at once.
+const auditConcurrency = 16
+
+// An AuditRequest is the POST body for /faceclaim/audit.
+type AuditRequest struct {
+	Bucket string `json:"bucket"`
+
+	// The faceclaim URLs the database refers to
+	URLs []string `json:"urls" binding:"required"`
+
+	// Whether to also list the faceclaims under the URLs' characters that
+	// aren't among the URLs
+	IncludeExtra bool `json:"include_extra"`
+}
+
+// An AuditEntry is the outcome of checking one URL: "ok", "missing",
+// "invalid" (not a URL in the bucket), or "error". Extra objects found under
+// the URLs' characters are reported as "extra".
+type AuditEntry struct {
+	URL    string `json:"url"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	index int // The URL's position in the request
+}
+
+// An AuditResult is the response body for /faceclaim/audit.
+type AuditResult struct {
+	Bucket  string       `json:"bucket"`
+	Checked int          `json:"checked"`
+	Missing []string     `json:"missing"`
+	Invalid []string     `json:"invalid,omitempty"`
+	Errors  []AuditEntry `json:"errors,omitempty"`
+	Extra   []string     `json:"extra,omitempty"`
+}
+
+// Checks that the objects behind a list of faceclaim URLs exist, so broken
+// references can be cleaned up. Clients sending large lists can ask for
+// Accept: application/x-ndjson to get each entry as soon as it's checked.
+func auditFaceclaims(c *gin.Context) {
+	var request AuditRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Bucket == "" {
+		request.Bucket = currentConfig().FaceclaimBucket
+	}
+	tagRequest(c, "bucket", request.Bucket)
+	ctx := c.Request.Context()
+
+	if strings.Contains(c.GetHeader("Accept"), "application/x-ndjson") {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		emit := func(entry AuditEntry) {
+			encoder.Encode(entry)
+			c.Writer.Flush()
+		}
+
+		auditURLs(ctx, request.Bucket, request.URLs, emit)
+		if request.IncludeExtra {
+			extra, err := extraFaceclaims(ctx, request.Bucket, request.URLs)
+			if err != nil {
+				c.Error(err)
+				emit(AuditEntry{Status: "error", Error: err.Error()})
+			}
+			for _, url := range extra {
+				emit(AuditEntry{URL: url, Status: "extra"})
+			}
+		}
+		return
+	}
+
+	var entries []AuditEntry
+	auditURLs(ctx, request.Bucket, request.URLs, func(entry AuditEntry) {
+		entries = append(entries, entry)
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].index < entries[j].index })
+
+	result := AuditResult{Bucket: request.Bucket, Checked: len(entries), Missing: []string{}}
+	for _, entry := range entries {
+		switch entry.Status {
+		case "missing":
+			result.Missing = append(result.Missing, entry.URL)
+		case "invalid":
+			result.Invalid = append(result.Invalid, entry.URL)
+		case "error":
+			result.Errors = append(result.Errors, entry)
+		}
+	}
+	if request.IncludeExtra {
+		extra, err := extraFaceclaims(ctx, request.Bucket, request.URLs)
+		if abortIfTimedOut(c) {
+			return
+		}
+		if err != nil {
+			c.Error(err)
+			abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result.Extra = extra
+	}
+	respond(c, http.StatusOK, result)
+}
+
+// Looks up the object behind each URL, auditConcurrency at a time, passing
+// each outcome to emit as it's known. emit is never called concurrently.
+func auditURLs(ctx context.Context, bucket string, urls []string, emit func(AuditEntry)) {
+	pending := make(chan AuditEntry)
+	results := make(chan AuditEntry)
+
+	var wg sync.WaitGroup
+	for i := 0; i < auditConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range pending {
+				results <- checkObject(ctx, bucket, entry)
+			}
+		}()
+	}
+	go func() {
+		for i, url := range urls {
+			pending <- AuditEntry{URL: url, index: i}
+		}
+		close(pending)
+		wg.Wait()
+		close(results)
+	}()
+
+	for entry := range results {
+		emit(entry)
+	}
+}
+
+// Classifies a URL by whether its object exists.
+func checkObject(ctx context.Context, bucket string, entry AuditEntry) AuditEntry {
+	object := objectName(bucket, entry.URL)
+	if object == "" || strings.Contains(object, "://") {
+		entry.Status = "invalid"
+		return entry
+	}
+
+	_, err := cachedObjectAttrs(ctx, bucket, object)
+	switch {
+	case err == nil:
+		entry.Status = "ok"
+	case errors.Is(err, storage.ErrObjectNotExist):
+		entry.Status = "missing"
+	default:
+		entry.Status = "error"
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// Returns the URLs of the faceclaims under the given URLs' characters that
+// aren't among them. Kept originals and size variants go with their
+// faceclaims, so they aren't reported.
+func extraFaceclaims(ctx context.Context, bucket string, urls []string) ([]string, error) {
+	referenced := make(map[string]bool)
+	charids := make(map[string]bool)
+	for _, url := range urls {
+		object := objectName(bucket, url)
+		if charid, _, found := strings.Cut(object, "/"); found && !strings.Contains(object, "://") {
+			referenced[object] = true
+			charids[charid] = true
+		}
+	}
+
+	extra := []string{}
+	for charid := range charids {
+		objects, err := Store.List(ctx, bucket, charid+"/")
+		if err != nil {
+			return nil, fmt.Errorf("extraFaceclaims: %v", err)
+		}
+		for _, attrs := range objects {
+			if isFaceclaim(attrs) && !referenced[attrs.Name] {
+				extra = append(extra, objectURL(bucket, attrs.Name))
+			}
+		}
+	}
+	sort.Strings(extra)
+	return extra, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Seed three of a character's faceclaims, two of which are referenced, and
+// return the audit URLs: live, dead, and one pointing at another bucket.
+func seedAudit(store *memStorage) []string {
+	for _, object := range []string{"__test/live1.webp", "__test/live2.webp", "__test/extra.webp"} {
+		store.Upload(context.Background(), testBucket, object, strings.NewReader("x"), UploadOptions{ContentType: "image/webp"})
+	}
+	return []string{
+		fmt.Sprintf("https://%v/__test/live1.webp", testBucket),
+		fmt.Sprintf("https://%v/__test/dead.webp", testBucket),
+		"__test/live2.webp",
+		"__gone/dead.webp",
+		"https://pcs.botch.lol/__test/live1.webp",
+	}
+}
+
+func postAudit(r http.Handler, request AuditRequest, accept string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest("POST", "/faceclaim/audit", bytes.NewReader(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuditClassifiesURLs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	urls := seedAudit(store)
+
+	w := postAudit(r, AuditRequest{URLs: urls, IncludeExtra: true}, "")
+	assert.Equal(t, 200, w.Code)
+
+	var result AuditResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, 5, result.Checked)
+	assert.Equal(t, []string{urls[1], urls[3]}, result.Missing)
+	assert.Equal(t, []string{urls[4]}, result.Invalid)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, []string{fmt.Sprintf("https://%v/__test/extra.webp", testBucket)}, result.Extra)
+}
+
+func TestAuditOmitsExtraByDefault(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := postAudit(r, AuditRequest{URLs: seedAudit(store)}, "")
+
+	var result AuditResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Nil(t, result.Extra)
+}
+
+func TestAuditStreamsEntries(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	urls := seedAudit(store)
+
+	w := postAudit(r, AuditRequest{URLs: urls, IncludeExtra: true}, "application/x-ndjson")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	statuses := make(map[string]string)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var entry AuditEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		statuses[entry.URL] = entry.Status
+	}
+	assert.Equal(t, map[string]string{
+		urls[0]: "ok",
+		urls[1]: "missing",
+		urls[2]: "ok",
+		urls[3]: "missing",
+		urls[4]: "invalid",
+		fmt.Sprintf("https://%v/__test/extra.webp", testBucket): "extra",
+	}, statuses)
+}
+
+func TestAuditReportsLookupErrors(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	store.err = errors.New("storage is down")
+
+	w := postAudit(r, AuditRequest{URLs: []string{"__test/live1.webp"}}, "")
+
+	var result AuditResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Empty(t, result.Missing)
+	assert.Len(t, result.Errors, 1)
+	assert.Equal(t, "storage is down", result.Errors[0].Error)
+}
+
+func TestAuditChecksManyURLs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	var urls []string
+	for i := 0; i < auditConcurrency*5; i++ {
+		object := fmt.Sprintf("__test/%v.webp", i)
+		if i%2 == 0 {
+			store.Upload(context.Background(), testBucket, object, strings.NewReader("x"), UploadOptions{ContentType: "image/webp"})
+		}
+		urls = append(urls, object)
+	}
+
+	w := postAudit(r, AuditRequest{URLs: urls}, "")
+
+	var result AuditResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, len(urls), result.Checked)
+	assert.Len(t, result.Missing, len(urls)/2)
+	assert.Equal(t, "__test/1.webp", result.Missing[0], "Missing URLs should keep the request's order")
+}
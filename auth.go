@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The authentication modes. With the token mode, requests must present
+// API_TOKEN. With the JWT and Google OIDC modes, they present a Bearer JWT or
+// Google identity token, though API_TOKEN still works if it's set.
+const (
+	authModeToken      = "token"
+	authModeJWT        = "jwt"
+	authModeGoogleOIDC = "google-oidc"
+)
+
+// AuthMode is how requests are authenticated.
+var AuthMode = authModeToken
+
+// JWTAuth verifies JWTs when AuthMode is authModeJWT.
+var JWTAuth *jwtVerifier
+
+// OIDCAuth verifies Google identity tokens when AuthMode is
+// authModeGoogleOIDC.
+var OIDCAuth *oidcVerifier
+
+// Where Google publishes the keys it signs identity tokens with, and the
+// issuers those tokens name.
+var (
+	googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+	googleIssuers  = []string{"https://accounts.google.com", "accounts.google.com"}
+)
+
+// The scopes routes require. The static token has all of them.
+const (
+	scopeRead      = "faceclaim:read"
+	scopeWrite     = "faceclaim:write"
+	scopeLogRead   = "logs:read"
+	scopeLogWrite  = "logs:write"
+	scopeLogDelete = "log:delete"
+	scopeAdmin     = "admin"
+)
+
+var allScopes = []string{scopeRead, scopeWrite, scopeLogRead, scopeLogWrite, scopeLogDelete, scopeAdmin}
+
+// Returns the scope a route requires. Unknown routes require nothing, so they
+// fall through to a 404.
+func routeScope(route string) string {
+	switch {
+	case strings.HasPrefix(route, "/admin/"):
+		return scopeAdmin
+	case route == "/log/upload", route == "/log/raw/:name":
+		return scopeLogWrite
+	case route == "/log/list":
+		return scopeLogRead
+	case route == "/log/*name":
+		return scopeLogDelete
+	case route == "/faceclaim/upload", route == "/faceclaim/reconcile", route == "/faceclaim/delete-batch",
+		route == "/faceclaim/:bucket/:charid/:key", route == "/faceclaim/rename",
+		route == "/faceclaim/manifest/:bucket", route == "/faceclaim/refresh/:bucket/:charid/:key",
+		route == "/faceclaim/trim/:bucket/:charid",
+		strings.HasPrefix(route, "/faceclaim/delete/"), strings.HasPrefix(route, "/faceclaim/hold/"):
+		return scopeWrite
+	case strings.HasPrefix(route, "/faceclaim/"):
+		return scopeRead
+	}
+	return ""
+}
+
+// Reads AUTH_MODE and the settings for its mode.
+func prepareAuth() error {
+	AuthMode = authModeToken
+	JWTAuth, OIDCAuth = nil, nil
+	if mode, ok := os.LookupEnv("AUTH_MODE"); ok && mode != "" {
+		AuthMode = strings.ToLower(mode)
+	}
+	switch AuthMode {
+	case authModeToken:
+		return nil
+	case authModeJWT:
+		return prepareJWTAuth()
+	case authModeGoogleOIDC:
+		return prepareOIDCAuth()
+	}
+	return fmt.Errorf("AUTH_MODE: unknown mode %q", AuthMode)
+}
+
+// Reads JWT_SECRET or JWT_JWKS_URL, plus JWT_ISSUER, JWT_AUDIENCE, and
+// JWT_LEEWAY (default 30s).
+func prepareJWTAuth() error {
+	verifier := &jwtVerifier{
+		audience: os.Getenv("JWT_AUDIENCE"),
+		leeway:   30 * time.Second,
+		now:      time.Now,
+	}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		verifier.issuers = []string{issuer}
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		verifier.secret = []byte(secret)
+	}
+	if url := os.Getenv("JWT_JWKS_URL"); url != "" {
+		verifier.keys = newJWKSCache(url)
+	}
+	if verifier.secret == nil && verifier.keys == nil {
+		return errors.New("AUTH_MODE=jwt requires JWT_SECRET or JWT_JWKS_URL")
+	}
+	if verifier.audience == "" {
+		return errors.New("AUTH_MODE=jwt requires JWT_AUDIENCE")
+	}
+	if value, ok := os.LookupEnv("JWT_LEEWAY"); ok {
+		leeway, err := time.ParseDuration(value)
+		if err != nil || leeway < 0 {
+			return fmt.Errorf("JWT_LEEWAY: must be a non-negative duration, e.g. 30s")
+		}
+		verifier.leeway = leeway
+	}
+	JWTAuth = verifier
+	return nil
+}
+
+// Reads OIDC_AUDIENCE, usually the service's URL, and OIDC_ALLOWED_EMAILS,
+// the comma-separated service accounts allowed to call it.
+func prepareOIDCAuth() error {
+	audience := os.Getenv("OIDC_AUDIENCE")
+	if audience == "" {
+		return errors.New("AUTH_MODE=google-oidc requires OIDC_AUDIENCE")
+	}
+	var emails []string
+	for _, email := range strings.Split(os.Getenv("OIDC_ALLOWED_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	if len(emails) == 0 {
+		return errors.New("AUTH_MODE=google-oidc requires OIDC_ALLOWED_EMAILS")
+	}
+	OIDCAuth = newOIDCVerifier(newJWKSCache(googleCertsURL), audience, emails)
+	return nil
+}
+
+// The credentials a request can authenticate with, as recorded in its context
+// under credentialKey. Its scopes are recorded under scopesKey.
+const (
+	credentialPrimary   = "primary"
+	credentialSecondary = "secondary"
+	credentialKey       = "credential"
+	scopesKey           = "scopes"
+)
+
+// VerifyAuth authenticates each request, then checks that it has the scope
+// its route requires. Requests using the secondary token are told it's on its
+// way out with an X-Token-Deprecated header.
+func VerifyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Internal routes are called by Google services, which authenticate
+		// with their own credentials
+		if strings.HasPrefix(c.FullPath(), "/internal/") {
+			c.Next()
+			return
+		}
+
+		// Banned clients are turned away without looking at their token
+		client := clientIP(c)
+		if remaining, banned := authBans.banned(client); banned {
+			recordAuthRejection("banned")
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+			abortWith(c, http.StatusTooManyRequests, gin.H{"error": "Too many failed authentication attempts"})
+			return
+		}
+
+		credential, scopes, ok := authenticate(c)
+		if !ok {
+			recordAuthRejection("invalid")
+			if authBans.fail(client) {
+				recordAuthBan()
+				log.Printf("Banning %v for %v after repeated authentication failures", client, authBans.cooldown)
+			}
+			abortWith(c, http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		authBans.forgive(client)
+		c.Set(credentialKey, credential)
+		c.Set(scopesKey, scopes)
+		recordCredential(credential)
+		if credential == credentialSecondary {
+			c.Header("X-Token-Deprecated", "true")
+		}
+		if scope := routeScope(c.FullPath()); scope != "" && !contains(scopes, scope) {
+			abortWith(c, http.StatusForbidden, gin.H{"error": fmt.Sprintf("Missing scope %v", scope)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Returns the credential a request authenticated with and its scopes, or
+// false if it isn't authenticated.
+func authenticate(c *gin.Context) (string, []string, bool) {
+	header := c.Request.Header.Get("Authorization")
+
+	var verify func(ctx context.Context, token string) ([]string, error)
+	switch {
+	case AuthMode == authModeJWT && JWTAuth != nil:
+		verify = JWTAuth.scopes
+	case AuthMode == authModeGoogleOIDC && OIDCAuth != nil:
+		verify = OIDCAuth.scopes
+	}
+
+	if verify != nil {
+		if raw := strings.TrimPrefix(header, "Bearer "); raw != header && strings.Count(raw, ".") == 2 {
+			scopes, err := verify(c.Request.Context(), raw)
+			if err == nil {
+				return AuthMode, scopes, true
+			}
+			log.Println("Rejected bearer token:", err)
+		}
+		// The static tokens are still accepted, but an unset one mustn't
+		// let in requests without credentials
+		if header == "" {
+			return "", nil, false
+		}
+	}
+
+	credential, ok := matchAPIToken(header)
+	if !ok {
+		return "", nil, false
+	}
+	return credential, allScopes, true
+}
+
+// Returns the credential a request authenticated with, if it did.
+func requestCredential(c *gin.Context) string {
+	return c.GetString(credentialKey)
+}
+
+// Reports whether the request authenticated with a scope.
+func hasScope(c *gin.Context, scope string) bool {
+	scopes, _ := c.Get(scopesKey)
+	list, _ := scopes.([]string)
+	return contains(list, scope)
+}
+
+// Reports whether list includes s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtClaims are the registered claims we check, plus our scopes.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Scopes    json.RawMessage `json:"scopes"`
+
+	// Google identity tokens name the service account they were minted for
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// The aud claim is either a string or a list of them.
+func (c jwtClaims) audiences() []string {
+	return stringOrList(c.Audience)
+}
+
+// The scopes claim is either a list or a space-separated string.
+func (c jwtClaims) scopes() []string {
+	return stringOrList(c.Scopes)
+}
+
+// Decodes a claim that may be a single (space-separated) string or a list.
+func stringOrList(raw json.RawMessage) []string {
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list
+	}
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return strings.Fields(single)
+	}
+	return nil
+}
+
+// jwtVerifier checks JWTs signed with HS256 using a shared secret, or with
+// RS256 using a key from a JWKS.
+type jwtVerifier struct {
+	secret   []byte
+	keys     *jwksCache
+	issuers  []string // Any of them; empty accepts all
+	audience string
+	leeway   time.Duration // Tolerated clock skew
+	now      func() time.Time
+}
+
+// Verifies a JWT's signature and claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return jwtClaims{}, fmt.Errorf("header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, fmt.Errorf("signature: %v", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// Each algorithm is only accepted with the key type it belongs to, so a
+	// public key can't be passed off as an HMAC secret
+	switch {
+	case header.Alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return jwtClaims{}, errors.New("bad signature")
+		}
+	case header.Alg == "RS256" && v.keys != nil:
+		key, err := v.keys.key(ctx, header.Kid)
+		if err != nil {
+			return jwtClaims{}, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return jwtClaims{}, errors.New("bad signature")
+		}
+	default:
+		return jwtClaims{}, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return jwtClaims{}, fmt.Errorf("claims: %v", err)
+	}
+	return claims, v.checkClaims(claims)
+}
+
+// Returns the scopes a verified JWT grants.
+func (v *jwtVerifier) scopes(ctx context.Context, token string) ([]string, error) {
+	claims, err := v.verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return claims.scopes(), nil
+}
+
+// Checks a token's expiry, issuer, and audience.
+func (v *jwtVerifier) checkClaims(claims jwtClaims) error {
+	now := v.now()
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-v.leeway)) {
+		return errors.New("token isn't valid yet")
+	}
+	if len(v.issuers) > 0 && !contains(v.issuers, claims.Issuer) {
+		return fmt.Errorf("wrong issuer %q", claims.Issuer)
+	}
+	for _, aud := range claims.audiences() {
+		if aud == v.audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("wrong audience %v", claims.audiences())
+}
+
+// oidcVerifier checks Google identity tokens, which are JWTs signed with
+// Google's keys, and only accepts those minted for allowed service accounts.
+type oidcVerifier struct {
+	jwt     *jwtVerifier
+	allowed map[string]bool
+}
+
+func newOIDCVerifier(keys *jwksCache, audience string, emails []string) *oidcVerifier {
+	allowed := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		allowed[strings.ToLower(email)] = true
+	}
+	return &oidcVerifier{
+		jwt: &jwtVerifier{
+			keys:     keys,
+			issuers:  googleIssuers,
+			audience: audience,
+			leeway:   30 * time.Second,
+			now:      time.Now,
+		},
+		allowed: allowed,
+	}
+}
+
+// Verifies an identity token. Allowed service accounts are trusted with
+// every scope.
+func (v *oidcVerifier) scopes(ctx context.Context, token string) ([]string, error) {
+	claims, err := v.jwt.verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.EmailVerified || !v.allowed[strings.ToLower(claims.Email)] {
+		return nil, fmt.Errorf("%q isn't an allowed caller", claims.Email)
+	}
+	return allScopes, nil
+}
+
+// Decodes a base64url JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// How long a fetched JWKS is used before it's fetched again, and how often an
+// unknown key ID can trigger an early refetch.
+const (
+	jwksCacheTTL      = time.Hour
+	jwksRefetchWindow = time.Minute
+)
+
+// jwksCache holds the RSA keys from a JWKS URL, refetching them when they
+// expire or a token names a key it hasn't seen, e.g. after a rotation.
+type jwksCache struct {
+	sync.Mutex
+	url     string
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url}
+}
+
+// Returns the key with the given ID.
+func (j *jwksCache) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	key, ok := j.keys[kid]
+	stale := time.Since(j.fetched) > jwksCacheTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if stale || time.Since(j.fetched) > jwksRefetchWindow {
+		keys, err := fetchJWKS(ctx, j.url)
+		if err != nil {
+			// Keep using what we had if the endpoint is down
+			if ok {
+				log.Println("Unable to refresh JWKS:", err)
+				return key, nil
+			}
+			return nil, err
+		}
+		j.keys, j.fetched = keys, time.Now()
+	}
+	if key, ok = j.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// Fetches the RSA keys in a JWKS.
+func fetchJWKS(ctx context.Context, url string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetchJWKS: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetchJWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchJWKS: %v returned %v", url, resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("fetchJWKS: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJWTSecret = "jwt-secret"
+
+// Sign claims with HS256 and the test secret
+func signHS256(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign claims with RS256 and the given key
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Claims for a token that's valid for the next hour
+func validClaims(scopes ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    "dashboard",
+		"aud":    "inconnu-api",
+		"sub":    "someone",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"scopes": scopes,
+	}
+}
+
+// Switch to the JWT mode with the test secret for the duration of a test
+func useJWTAuth(t *testing.T, env map[string]string) {
+	env["AUTH_MODE"] = "jwt"
+	if _, ok := env["JWT_JWKS_URL"]; !ok {
+		env["JWT_SECRET"] = testJWTSecret
+	}
+	env["JWT_ISSUER"] = "dashboard"
+	env["JWT_AUDIENCE"] = "inconnu-api"
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	t.Cleanup(func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+		prepareAuth()
+	})
+	assert.NoError(t, prepareAuth())
+}
+
+func requestWithAuth(r http.Handler, method, path, auth string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", auth)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestJWTAuth(t *testing.T) {
+	useFakeBackends(t)
+	useJWTAuth(t, map[string]string{})
+	r := setupRouter(false)
+	path := "/faceclaim/metadata/" + testBucket + "/__test/abc.webp"
+
+	token := signHS256(validClaims(scopeRead))
+	assert.Equal(t, 404, requestWithAuth(r, "GET", path, "Bearer "+token).Code)
+	assert.Equal(t, 401, requestWithAuth(r, "GET", path, "").Code, "With no API_TOKEN, there's no static fallback")
+}
+
+func TestJWTExpired(t *testing.T) {
+	useJWTAuth(t, map[string]string{})
+	r := setupRouter(false)
+	path := "/faceclaim/metadata/" + testBucket + "/__test/abc.webp"
+
+	claims := validClaims(scopeRead)
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, 401, requestWithAuth(r, "GET", path, "Bearer "+signHS256(claims)).Code)
+
+	// Clocks that are a little off are tolerated
+	claims["exp"] = time.Now().Add(-10 * time.Second).Unix()
+	_, err := JWTAuth.verify(context.Background(), signHS256(claims))
+	assert.NoError(t, err)
+
+	delete(claims, "exp")
+	_, err = JWTAuth.verify(context.Background(), signHS256(claims))
+	assert.EqualError(t, err, "token has no expiry")
+}
+
+func TestJWTWrongAudience(t *testing.T) {
+	useJWTAuth(t, map[string]string{})
+	r := setupRouter(false)
+	path := "/faceclaim/metadata/" + testBucket + "/__test/abc.webp"
+
+	claims := validClaims(scopeRead)
+	claims["aud"] = []string{"someone-else"}
+	assert.Equal(t, 401, requestWithAuth(r, "GET", path, "Bearer "+signHS256(claims)).Code)
+
+	claims = validClaims(scopeRead)
+	claims["iss"] = "impostor"
+	assert.Equal(t, 401, requestWithAuth(r, "GET", path, "Bearer "+signHS256(claims)).Code)
+}
+
+func TestJWTBadSignature(t *testing.T) {
+	useJWTAuth(t, map[string]string{})
+
+	token := signHS256(validClaims(allScopes...))
+	_, err := JWTAuth.verify(context.Background(), token[:len(token)-2]+"xx")
+	assert.Error(t, err)
+
+	// Unsigned tokens are never accepted
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, _ := json.Marshal(validClaims(allScopes...))
+	_, err = JWTAuth.verify(context.Background(), header+"."+base64.RawURLEncoding.EncodeToString(payload)+".")
+	assert.Error(t, err)
+}
+
+func TestJWTLimitedScopes(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useJWTAuth(t, map[string]string{})
+	r := setupRouter(false)
+	token := "Bearer " + signHS256(validClaims(scopeRead))
+
+	w := requestWithAuth(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp", token)
+	assert.Equal(t, 404, w.Code)
+
+	w = requestWithAuth(r, "DELETE", "/faceclaim/delete/"+testBucket+"/__test/all", token)
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), scopeWrite)
+
+	w = requestWithAuth(r, "POST", "/admin/maintenance", token)
+	assert.Equal(t, 403, w.Code)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestJWTFallsBackToToken(t *testing.T) {
+	useFakeBackends(t)
+	useJWTAuth(t, map[string]string{"API_TOKEN": "hunter2"})
+	r := setupRouter(false)
+
+	w := requestWithAuth(r, "DELETE", "/faceclaim/delete/"+testBucket+"/__test/all", "hunter2")
+	assert.Equal(t, 200, w.Code)
+	w = requestWithAuth(r, "DELETE", "/faceclaim/delete/"+testBucket+"/__test/all", "Bearer not.a.jwt")
+	assert.Equal(t, 401, w.Code)
+}
+
+// Serve a JWKS holding the key's public half as "key-1", counting fetches
+func serveJWKS(key *rsa.PrivateKey) (*httptest.Server, *int32) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	return server, &fetches
+}
+
+func TestJWKS(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server, fetches := serveJWKS(key)
+	defer server.Close()
+	useJWTAuth(t, map[string]string{"JWT_JWKS_URL": server.URL})
+
+	for i := 0; i < 3; i++ {
+		_, err := JWTAuth.verify(context.Background(), signRS256(key, "key-1", validClaims(scopeRead)))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(fetches), "The JWKS should be cached")
+
+	// An unknown key ID doesn't trigger another fetch right away
+	_, err := JWTAuth.verify(context.Background(), signRS256(key, "key-2", validClaims(scopeRead)))
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(fetches))
+
+	// Without a secret, HS256 tokens are refused
+	_, err = JWTAuth.verify(context.Background(), signHS256(validClaims(scopeRead)))
+	assert.Error(t, err)
+}
+
+func TestPrepareAuth(t *testing.T) {
+	t.Cleanup(func() {
+		os.Unsetenv("AUTH_MODE")
+		os.Unsetenv("JWT_SECRET")
+		prepareAuth()
+	})
+
+	assert.NoError(t, prepareAuth())
+	assert.Equal(t, authModeToken, AuthMode)
+
+	os.Setenv("AUTH_MODE", "jwt")
+	assert.Error(t, prepareAuth(), "JWT mode needs a key")
+	os.Setenv("JWT_SECRET", "secret")
+	assert.Error(t, prepareAuth(), "JWT mode needs an audience")
+
+	os.Setenv("AUTH_MODE", "magic")
+	assert.Error(t, prepareAuth())
+}
+
+const (
+	testServiceURL = "https://inconnu-api.a.run.app"
+	testBotAccount = "inconnu-bot@inconnu.iam.gserviceaccount.com"
+)
+
+// Claims for a Google identity token minted for the given account
+func identityClaims(email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            testServiceURL,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+// Switch to the Google OIDC mode with a verifier that trusts the key instead
+// of Google's
+func useOIDCAuth(t *testing.T, key *rsa.PrivateKey) {
+	server, _ := serveJWKS(key)
+	AuthMode = authModeGoogleOIDC
+	OIDCAuth = newOIDCVerifier(newJWKSCache(server.URL), testServiceURL, []string{testBotAccount})
+	t.Cleanup(func() {
+		server.Close()
+		prepareAuth()
+	})
+}
+
+func TestOIDCAuth(t *testing.T) {
+	useFakeBackends(t)
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	useOIDCAuth(t, key)
+	r := setupRouter(false)
+	path := "/faceclaim/delete/" + testBucket + "/__test/all"
+
+	token := signRS256(key, "key-1", identityClaims(testBotAccount))
+	assert.Equal(t, 200, requestWithAuth(r, "DELETE", path, "Bearer "+token).Code)
+
+	// Google's other issuer spelling is accepted, too
+	claims := identityClaims(testBotAccount)
+	claims["iss"] = "accounts.google.com"
+	assert.Equal(t, 200, requestWithAuth(r, "DELETE", path, "Bearer "+signRS256(key, "key-1", claims)).Code)
+}
+
+func TestOIDCWrongAudience(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	useOIDCAuth(t, key)
+	r := setupRouter(false)
+
+	claims := identityClaims(testBotAccount)
+	claims["aud"] = "https://someone-else.a.run.app"
+	w := requestWithAuth(r, "DELETE", "/faceclaim/delete/"+testBucket+"/__test/all", "Bearer "+signRS256(key, "key-1", claims))
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestOIDCUnlistedEmail(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	useOIDCAuth(t, key)
+	r := setupRouter(false)
+	path := "/faceclaim/delete/" + testBucket + "/__test/all"
+
+	token := signRS256(key, "key-1", identityClaims("intruder@elsewhere.iam.gserviceaccount.com"))
+	assert.Equal(t, 401, requestWithAuth(r, "DELETE", path, "Bearer "+token).Code)
+
+	claims := identityClaims(testBotAccount)
+	claims["email_verified"] = false
+	assert.Equal(t, 401, requestWithAuth(r, "DELETE", path, "Bearer "+signRS256(key, "key-1", claims)).Code)
+
+	// Tokens signed by anyone but Google are refused
+	impostor, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token = signRS256(impostor, "key-1", identityClaims(testBotAccount))
+	assert.Equal(t, 401, requestWithAuth(r, "DELETE", path, "Bearer "+token).Code)
+}
+
+func TestPrepareOIDCAuth(t *testing.T) {
+	t.Cleanup(func() {
+		os.Unsetenv("AUTH_MODE")
+		os.Unsetenv("OIDC_AUDIENCE")
+		os.Unsetenv("OIDC_ALLOWED_EMAILS")
+		prepareAuth()
+	})
+
+	os.Setenv("AUTH_MODE", "google-oidc")
+	assert.Error(t, prepareAuth(), "The audience is required")
+	os.Setenv("OIDC_AUDIENCE", testServiceURL)
+	assert.Error(t, prepareAuth(), "The allowlist is required")
+
+	os.Setenv("OIDC_ALLOWED_EMAILS", " "+testBotAccount+", other@example.com")
+	assert.NoError(t, prepareAuth())
+	if assert.NotNil(t, OIDCAuth) {
+		assert.True(t, OIDCAuth.allowed[testBotAccount])
+		assert.Equal(t, googleCertsURL, OIDCAuth.jwt.keys.url)
+	}
+}
+
+// Set the primary and secondary tokens for the duration of a test
+func useTokenPair(t *testing.T, primary, secondary string) {
+	os.Setenv("API_TOKEN_PRIMARY", primary)
+	os.Setenv("API_TOKEN_SECONDARY", secondary)
+	t.Cleanup(func() {
+		os.Unsetenv("API_TOKEN_PRIMARY")
+		os.Unsetenv("API_TOKEN_SECONDARY")
+	})
+}
+
+func TestPrimaryToken(t *testing.T) {
+	useTokenPair(t, "new-token", "old-token")
+	r := setupRouter(false)
+	var credential string
+	r.GET("/whoami", func(c *gin.Context) { credential = requestCredential(c) })
+	before := testutil.ToFloat64(authCredentialsTotal.WithLabelValues(credentialPrimary))
+
+	w := requestWithAuth(r, "GET", "/whoami", "new-token")
+
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("X-Token-Deprecated"))
+	assert.Equal(t, credentialPrimary, credential)
+	assert.Equal(t, before+1, testutil.ToFloat64(authCredentialsTotal.WithLabelValues(credentialPrimary)))
+}
+
+func TestSecondaryToken(t *testing.T) {
+	useTokenPair(t, "new-token", "old-token")
+	r := setupRouter(false)
+	var credential string
+	r.GET("/whoami", func(c *gin.Context) { credential = requestCredential(c) })
+	before := testutil.ToFloat64(authCredentialsTotal.WithLabelValues(credentialSecondary))
+
+	w := requestWithAuth(r, "GET", "/whoami", "old-token")
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-Token-Deprecated"))
+	assert.Equal(t, credentialSecondary, credential)
+	assert.Equal(t, before+1, testutil.ToFloat64(authCredentialsTotal.WithLabelValues(credentialSecondary)))
+
+	assert.Equal(t, 401, requestWithAuth(r, "GET", "/whoami", "").Code)
+	assert.Equal(t, 401, requestWithAuth(r, "GET", "/whoami", "older-token").Code)
+}
+
+func TestSecondaryTokenWithJWT(t *testing.T) {
+	useJWTAuth(t, map[string]string{})
+	useTokenPair(t, "", "old-token")
+	r := setupRouter(false)
+	path := "/faceclaim/job/deadbeef"
+
+	assert.Equal(t, 404, requestWithAuth(r, "GET", path, "old-token").Code)
+	assert.Equal(t, 401, requestWithAuth(r, "GET", path, "").Code, "An empty primary shouldn't let anyone in")
+}
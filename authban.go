@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients that fail authentication AuthBanThreshold times within
+// AuthBanWindow are turned away for AuthBanDuration. A threshold of 0
+// disables banning.
+var (
+	AuthBanThreshold  = 10
+	AuthBanWindow     = time.Minute
+	AuthBanDuration   = 15 * time.Minute
+	AuthBanMaxClients = 10000
+)
+
+// authBans tracks failed authentication by client IP.
+var authBans = newBanList(AuthBanThreshold, AuthBanWindow, AuthBanDuration, AuthBanMaxClients)
+
+// Reads AUTH_BAN_THRESHOLD, AUTH_BAN_WINDOW, AUTH_BAN_DURATION, and
+// AUTH_BAN_MAX_CLIENTS.
+func prepareAuthBans() error {
+	AuthBanThreshold, AuthBanMaxClients = 10, 10000
+	AuthBanWindow, AuthBanDuration = time.Minute, 15*time.Minute
+
+	counts := map[string]*int{
+		"AUTH_BAN_THRESHOLD":   &AuthBanThreshold,
+		"AUTH_BAN_MAX_CLIENTS": &AuthBanMaxClients,
+	}
+	for name, count := range counts {
+		if value, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%v must be a non-negative integer", name)
+			}
+			*count = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"AUTH_BAN_WINDOW":   &AuthBanWindow,
+		"AUTH_BAN_DURATION": &AuthBanDuration,
+	}
+	for name, duration := range durations {
+		if value, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%v must be a positive duration, e.g. \"1m\"", name)
+			}
+			*duration = d
+		}
+	}
+	authBans = newBanList(AuthBanThreshold, AuthBanWindow, AuthBanDuration, AuthBanMaxClients)
+	return nil
+}
+
+// A banList counts failures per client and bans clients with too many. It
+// holds at most maxClients entries; when it's full, the least recently seen
+// client is forgotten.
+type banList struct {
+	sync.Mutex
+	threshold  int
+	window     time.Duration
+	cooldown   time.Duration
+	maxClients int
+	clients    map[string]*clientFailures
+	now        func() time.Time
+}
+
+type clientFailures struct {
+	count       int
+	windowStart time.Time
+	lastSeen    time.Time
+	bannedUntil time.Time
+}
+
+func newBanList(threshold int, window, cooldown time.Duration, maxClients int) *banList {
+	return &banList{
+		threshold:  threshold,
+		window:     window,
+		cooldown:   cooldown,
+		maxClients: maxClients,
+		clients:    make(map[string]*clientFailures),
+		now:        time.Now,
+	}
+}
+
+// Returns how much longer a client is banned for, or false if it isn't.
+func (b *banList) banned(client string) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	record, ok := b.clients[client]
+	if !ok {
+		return 0, false
+	}
+	remaining := record.bannedUntil.Sub(b.now())
+	return remaining, remaining > 0
+}
+
+// Records a failure, returning true if it got the client banned.
+func (b *banList) fail(client string) bool {
+	if b.threshold == 0 || b.maxClients == 0 {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now()
+	record, ok := b.clients[client]
+	if !ok {
+		b.makeRoom(now)
+		record = &clientFailures{windowStart: now}
+		b.clients[client] = record
+	}
+	if now.Sub(record.windowStart) > b.window {
+		record.count, record.windowStart = 0, now
+	}
+	record.count++
+	record.lastSeen = now
+	if record.count >= b.threshold {
+		record.count, record.windowStart = 0, now
+		record.bannedUntil = now.Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+// Forgets a client's failures, e.g. once it authenticates.
+func (b *banList) forgive(client string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.clients, client)
+}
+
+// Makes room for a new client by sweeping out clients that are neither banned
+// nor within their window, then, if that isn't enough, the least recently
+// seen one.
+func (b *banList) makeRoom(now time.Time) {
+	if len(b.clients) < b.maxClients {
+		return
+	}
+	var oldest string
+	for client, record := range b.clients {
+		if now.After(record.bannedUntil) && now.Sub(record.windowStart) > b.window {
+			delete(b.clients, client)
+			continue
+		}
+		if oldest == "" || record.lastSeen.Before(b.clients[oldest].lastSeen) {
+			oldest = client
+		}
+	}
+	if len(b.clients) >= b.maxClients {
+		delete(b.clients, oldest)
+	}
+}
+
+// Returns the number of clients being tracked.
+func (b *banList) size() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.clients)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Install a ban list with a controllable clock for the duration of a test
+func useBanList(t *testing.T, threshold int, window, cooldown time.Duration, maxClients int) *time.Time {
+	now := time.Now()
+	bans := newBanList(threshold, window, cooldown, maxClients)
+	bans.now = func() time.Time { return now }
+	old := authBans
+	authBans = bans
+	t.Cleanup(func() { authBans = old })
+	return &now
+}
+
+// Make a request from the given address with the given token
+func requestFrom(r http.Handler, addr, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/faceclaim/job/deadbeef", nil)
+	req.RemoteAddr = addr + ":1234"
+	req.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthBan(t *testing.T) {
+	os.Setenv("API_TOKEN", "hunter2")
+	defer os.Unsetenv("API_TOKEN")
+	now := useBanList(t, 5, time.Minute, 10*time.Minute, 100)
+	r := setupRouter(false)
+	bans := testutil.ToFloat64(authBansTotal)
+	banned := testutil.ToFloat64(authRejectionsTotal.WithLabelValues("banned"))
+
+	// A scan with junk tokens
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 401, requestFrom(r, "203.0.113.7", fmt.Sprintf("guess-%v", i)).Code)
+	}
+	assert.Equal(t, bans+1, testutil.ToFloat64(authBansTotal))
+
+	// Even the right token is refused while the ban lasts
+	w := requestFrom(r, "203.0.113.7", "hunter2")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "600", w.Header().Get("Retry-After"))
+	assert.Equal(t, banned+1, testutil.ToFloat64(authRejectionsTotal.WithLabelValues("banned")))
+
+	// Other clients are unaffected
+	assert.Equal(t, 404, requestFrom(r, "198.51.100.2", "hunter2").Code)
+
+	// The ban expires
+	*now = now.Add(10*time.Minute + time.Second)
+	assert.Equal(t, 404, requestFrom(r, "203.0.113.7", "hunter2").Code)
+}
+
+func TestAuthBanWindow(t *testing.T) {
+	os.Setenv("API_TOKEN", "hunter2")
+	defer os.Unsetenv("API_TOKEN")
+	now := useBanList(t, 3, time.Minute, time.Hour, 100)
+	r := setupRouter(false)
+
+	// Failures spread out beyond the window don't add up
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 401, requestFrom(r, "203.0.113.7", "guess").Code)
+		*now = now.Add(31 * time.Second)
+	}
+
+	// A success clears the slate
+	requestFrom(r, "203.0.113.7", "guess")
+	requestFrom(r, "203.0.113.7", "hunter2")
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 401, requestFrom(r, "203.0.113.7", "guess").Code)
+	}
+	assert.Equal(t, 429, requestFrom(r, "203.0.113.7", "guess").Code)
+}
+
+func TestBanListBounded(t *testing.T) {
+	now := time.Now()
+	bans := newBanList(2, time.Minute, time.Hour, 3)
+	bans.now = func() time.Time { return now }
+
+	bans.fail("a")
+	bans.fail("a") // Banned
+	for _, client := range []string{"b", "c", "d", "e"} {
+		now = now.Add(time.Second)
+		bans.fail(client)
+	}
+	assert.Equal(t, 3, bans.size())
+
+	// The least recently seen clients made way for new ones
+	_, banned := bans.banned("a")
+	assert.False(t, banned)
+
+	// Clients whose windows have passed are swept out first
+	now = now.Add(2 * time.Minute)
+	bans.fail("f")
+	assert.Equal(t, 1, bans.size())
+}
+
+func TestPrepareAuthBans(t *testing.T) {
+	t.Cleanup(func() {
+		os.Setenv("AUTH_BAN_THRESHOLD", "0")
+		os.Unsetenv("AUTH_BAN_WINDOW")
+		prepareAuthBans()
+	})
+
+	os.Setenv("AUTH_BAN_THRESHOLD", "20")
+	os.Setenv("AUTH_BAN_WINDOW", "5m")
+	assert.NoError(t, prepareAuthBans())
+	assert.Equal(t, 20, authBans.threshold)
+	assert.Equal(t, 5*time.Minute, authBans.window)
+
+	os.Setenv("AUTH_BAN_WINDOW", "0s")
+	assert.Error(t, prepareAuthBans())
+	os.Setenv("AUTH_BAN_THRESHOLD", "-1")
+	assert.Error(t, prepareAuthBans())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+)
+
+// A BatchItem is the outcome of one item of a multi-item operation. Failures
+// carry an error code and message.
+type BatchItem struct {
+	Key     string `json:"key"`
+	Status  string `json:"status"`
+	Code    string `json:"error_code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// A BatchResult is how every multi-item operation reports its items: how many
+// succeeded, how many failed, and each one's outcome.
+type BatchResult struct {
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Results   []BatchItem `json:"results"`
+}
+
+// Records an item's outcome. Items with an error code failed.
+func (b *BatchResult) add(item BatchItem) {
+	if item.Code != "" {
+		b.Failed++
+	} else {
+		b.Succeeded++
+	}
+	b.Results = append(b.Results, item)
+}
+
+// Records an item that succeeded, with a status saying how.
+func (b *BatchResult) succeed(key, status string) {
+	b.add(BatchItem{Key: key, Status: status})
+}
+
+// Records an item that failed.
+func (b *BatchResult) fail(key, status string, err error) {
+	b.add(BatchItem{Key: key, Status: status, Code: batchErrorCode(err), Message: err.Error()})
+}
+
+// Returns the status to respond with: ok (200, or 201 for routes that create)
+// if nothing failed, 207 if some items did, and if they all did, 502 when GCS
+// or Pub/Sub was to blame and 500 otherwise.
+func (b BatchResult) httpStatus(ok int) int {
+	switch {
+	case b.Failed == 0:
+		return ok
+	case b.Succeeded > 0:
+		return http.StatusMultiStatus
+	}
+	for _, item := range b.Results {
+		if item.Code != "" && !upstreamErrorCodes[item.Code] {
+			return http.StatusInternalServerError
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// The error codes that mean a dependency failed rather than us.
+var upstreamErrorCodes = map[string]bool{
+	"storage_error":         true,
+	"publish_failed":        true,
+	"upstream_rate_limited": true,
+}
+
+// Classifies an item's error with the same codes single-item routes use.
+func batchErrorCode(err error) string {
+	var conflictErr *ConflictError
+	var integrityErr *IntegrityError
+	var rateLimitErr *RateLimitError
+	var poolErr *UploadPoolError
+	var journalErr *JournalFullError
+	var publishErr *PublishError
+	var deletingErr *DeletionInProgressError
+	switch {
+	case errors.As(err, &conflictErr):
+		return "conflict"
+	case errors.Is(err, storage.ErrObjectNotExist):
+		return "not_found"
+	case errors.As(err, &integrityErr):
+		return "storage_error"
+	case errors.As(err, &rateLimitErr):
+		return "upstream_rate_limited"
+	case errors.As(err, &poolErr):
+		return "uploads_busy"
+	case errors.As(err, &journalErr):
+		return "delete_queue_full"
+	case errors.As(err, &publishErr):
+		return "publish_failed"
+	case errors.As(err, &deletingErr):
+		return "deletion_in_progress"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	}
+	return "internal"
+}
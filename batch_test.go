@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchStatus(t *testing.T) {
+	var result BatchResult
+	assert.Equal(t, 200, result.httpStatus(200), "Nothing to do is a success")
+
+	result.succeed("a", "deleted")
+	assert.Equal(t, 201, result.httpStatus(201))
+
+	result.fail("b", "failed", &IntegrityError{Object: "b", Reason: "bad CRC32C"})
+	assert.Equal(t, 207, result.httpStatus(200))
+
+	upstream := BatchResult{}
+	upstream.fail("a", "failed", &PublishError{Topic: "t", Err: errors.New("unavailable")})
+	upstream.fail("b", "failed", &IntegrityError{Object: "b", Reason: "bad CRC32C"})
+	assert.Equal(t, 502, upstream.httpStatus(200))
+
+	upstream.fail("c", "failed", errors.New("something else"))
+	assert.Equal(t, 500, upstream.httpStatus(200))
+}
+
+func TestBatchErrorCode(t *testing.T) {
+	for err, code := range map[error]string{
+		&ConflictError{Bucket: "b", Key: "k"}:                     "conflict",
+		fmt.Errorf("Attrs: %w", storage.ErrObjectNotExist):        "not_found",
+		&UploadPoolError{Reason: "full"}:                          "uploads_busy",
+		&JournalFullError{Reason: "full"}:                         "delete_queue_full",
+		fmt.Errorf("cwebp: %w", context.DeadlineExceeded):         "timeout",
+		&PublishError{Topic: "t", Err: errors.New("unavailable")}: "publish_failed",
+		errors.New("unexpected"):                                  "internal",
+	} {
+		assert.Equal(t, code, batchErrorCode(err), err.Error())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Create a fixed gradient image whose hash was verified against the
+// reference implementation
+func gradientImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 8), uint8(y * 10), uint8(255 - x*4), 255})
+		}
+	}
+	return img
+}
+
+func TestEncodeBlurHash(t *testing.T) {
+	hash, err := encodeBlurHash(gradientImage(), 4, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "LxH28X2zw$XAmIWYjuf8gJfjfQfj", hash)
+
+	_, err = encodeBlurHash(gradientImage(), 0, 3)
+	assert.NotNil(t, err, "encodeBlurHash() should reject invalid component counts")
+}
+
+func TestAnalyzeImageBlurHash(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+
+	// The image is within the sample size, so the hash shouldn't change
+	blurHash, _ := analyzeImage(buf.Bytes())
+	assert.Equal(t, "LxH28X2zw$XAmIWYjuf8gJfjfQfj", blurHash)
+
+	// Undecodable data degrades to an empty hash
+	blurHash, _ = analyzeImage([]byte("not an image"))
+	assert.Equal(t, "", blurHash)
+}
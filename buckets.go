@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The URL template of buckets served from their own names.
+const defaultURLTemplate = "https://{bucket}/{object}"
+
+// A BucketProfile holds a faceclaim bucket's own policies, which override the
+// global defaults for uploads to it.
+type BucketProfile struct {
+	// How objects' public URLs are built, from {bucket} and {object}, e.g.
+	// "https://cdn.inconnu.app/{object}". It must end with {object}.
+	URLTemplate string `json:"url_template"`
+
+	// The quality uploads are encoded at, instead of WEBP_QUALITY
+	Quality int `json:"quality"`
+
+	// The Cache-Control objects are stored with, if any
+	CacheControl string `json:"cache_control"`
+
+	// Whether every upload gets a signed URL, as for buckets that aren't
+	// public
+	SignedURLs bool `json:"signed_urls"`
+
+	// The storage class uploads use unless they ask for one, instead of
+	// FACECLAIM_STORAGE_CLASS
+	StorageClass string `json:"storage_class"`
+}
+
+// Reads BUCKETS_JSON, which maps bucket names to their profiles. The buckets
+// it names are allowed alongside ALLOWED_BUCKETS.
+func loadBucketProfiles(cfg *Config) error {
+	raw, ok := os.LookupEnv("BUCKETS_JSON")
+	if !ok || strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	profiles := make(map[string]BucketProfile)
+	if err := json.Unmarshal([]byte(raw), &profiles); err != nil {
+		return fmt.Errorf("BUCKETS_JSON: %v", err)
+	}
+	for bucket, profile := range profiles {
+		if err := validateBucketName(bucket); err != nil {
+			return fmt.Errorf("BUCKETS_JSON: %v", err)
+		}
+		if profile.URLTemplate != "" && !strings.HasSuffix(profile.URLTemplate, "{object}") {
+			return fmt.Errorf("BUCKETS_JSON: %v's url_template must end with {object}", bucket)
+		}
+		if profile.Quality < 0 || profile.Quality > 100 {
+			return fmt.Errorf("BUCKETS_JSON: %v's quality must be between 1 and 100", bucket)
+		}
+		if profile.StorageClass != "" {
+			class, err := parseStorageClass(profile.StorageClass)
+			if err != nil {
+				return fmt.Errorf("BUCKETS_JSON: %v: %v", bucket, err)
+			}
+			profile.StorageClass = class
+			profiles[bucket] = profile
+		}
+	}
+	cfg.Buckets = profiles
+	return nil
+}
+
+// Returns a bucket's profile, with the global defaults for whatever it
+// doesn't set. Buckets without one get the defaults.
+func (c *Config) bucketProfile(bucket string) BucketProfile {
+	profile := c.Buckets[bucket]
+	if profile.URLTemplate == "" {
+		profile.URLTemplate = defaultURLTemplate
+	}
+	if profile.Quality == 0 {
+		profile.Quality = c.WebPQuality
+	}
+	if profile.StorageClass == "" {
+		profile.StorageClass = FaceclaimStorageClass
+	}
+	return profile
+}
+
+// Returns the prefix of the URLs of a bucket's objects.
+func (p BucketProfile) urlPrefix(bucket string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(p.URLTemplate, "{object}"), "{bucket}", bucket)
+}
+
+// Returns the public URL of an object, as its bucket's profile builds it.
+func objectURL(bucket, object string) string {
+	return currentConfig().bucketProfile(bucket).urlPrefix(bucket) + object
+}
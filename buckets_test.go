@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A second bucket, served from a CDN
+const cdnBucket = "cdn-faceclaims"
+
+// Load BUCKETS_JSON into the config for the duration of a test
+func useBucketProfiles(t *testing.T, raw string) {
+	t.Setenv("BUCKETS_JSON", raw)
+	useConfig(t, func(cfg *Config) {
+		if err := loadBucketProfiles(cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBucketProfileURLs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useBucketProfiles(t, `{
+		"`+testBucket+`": {},
+		"`+cdnBucket+`": {"url_template": "https://cdn.example/{bucket}/{object}", "quality": 60, "cache_control": "public, max-age=86400"}
+	}`)
+	r := setupRouter(false)
+
+	plain := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	cdn := uploadTestImage(t, r, createFaceclaimRequest(cdnBucket))
+
+	assert.True(t, strings.HasPrefix(plain.URL, "https://"+testBucket+"/"), plain.URL)
+	assert.True(t, strings.HasPrefix(cdn.URL, "https://cdn.example/"+cdnBucket+"/"), cdn.URL)
+
+	// The profile's settings are applied to what's stored
+	key := objectName(cdnBucket, cdn.URL)
+	attrs, err := store.Attrs(context.Background(), cdnBucket, key)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "public, max-age=86400", attrs.CacheControl)
+		assert.Equal(t, "60", attrs.Metadata["quality"])
+	}
+	attrs, err = store.Attrs(context.Background(), testBucket, objectName(testBucket, plain.URL))
+	if assert.NoError(t, err) {
+		assert.Empty(t, attrs.CacheControl)
+		assert.Equal(t, strconv.Itoa(currentConfig().WebPQuality), attrs.Metadata["quality"], "Buckets without a quality use WEBP_QUALITY")
+	}
+}
+
+func TestBucketProfileAllowsBucket(t *testing.T) {
+	useFakeBackends(t)
+	useBucketProfiles(t, `{"`+cdnBucket+`": {}}`)
+	useConfig(t, func(cfg *Config) { cfg.AllowedBuckets = []string{"other-bucket"} })
+
+	assert.NoError(t, validateBucket(cdnBucket))
+	assert.NoError(t, validateBucket("other-bucket"))
+	assert.Error(t, validateBucket("unknown-bucket"))
+}
+
+func TestBucketProfileSignedURLs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.private = map[string]bool{cdnBucket: true}
+	useBucketProfiles(t, `{"`+cdnBucket+`": {"signed_urls": true}}`)
+	r := setupRouter(false)
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(cdnBucket))
+	assert.Contains(t, response.SignedURL, "https://signed.example/"+cdnBucket+"/")
+	assert.Zero(t, store.publicChecks, "The bucket isn't checked for public access")
+}
+
+func TestBucketProfileInvalid(t *testing.T) {
+	tests := map[string]string{
+		"malformed":        `{"`,
+		"invalid bucket":   `{"Bad_Bucket": {}}`,
+		"template":         `{"` + cdnBucket + `": {"url_template": "https://{object}/x"}}`,
+		"quality":          `{"` + cdnBucket + `": {"quality": 101}}`,
+		"storage class":    `{"` + cdnBucket + `": {"storage_class": "frozen"}}`,
+		"negative quality": `{"` + cdnBucket + `": {"quality": -1}}`,
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("BUCKETS_JSON", raw)
+			assert.Error(t, loadBucketProfiles(&Config{}))
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BucketStatsInterval is how often each bucket is listed in full to count its
+// objects and bytes; zero disables it. Read from BUCKET_STATS_INTERVAL.
+var BucketStatsInterval = 15 * time.Minute
+
+// Reads BUCKET_STATS_INTERVAL, which defaults to 15m.
+func prepareBucketStats() error {
+	BucketStatsInterval = 15 * time.Minute
+	if value, ok := os.LookupEnv("BUCKET_STATS_INTERVAL"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return errors.New("BUCKET_STATS_INTERVAL must be a duration, e.g. \"15m\"")
+		}
+		BucketStatsInterval = d
+	}
+	bucketStats = newBucketStatsCache()
+	return nil
+}
+
+// BucketStats are a bucket's size as of its last listing. If the latest
+// refresh failed, Error says why, and the rest are from the one before.
+type BucketStats struct {
+	Bucket        string    `json:"bucket"`
+	Objects       int64     `json:"objects"`
+	Bytes         int64     `json:"bytes"`
+	LargestObject string    `json:"largest_object,omitempty"`
+	LargestBytes  int64     `json:"largest_bytes"`
+	LastModified  time.Time `json:"last_modified"`
+	Refreshed     time.Time `json:"refreshed"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// A BucketsReport is the response body for /admin/buckets.
+type BucketsReport struct {
+	Buckets []BucketStats `json:"buckets"`
+
+	// When the last refresh finished, and how long ago. The stats are stale
+	// if any bucket hasn't been listed successfully in two intervals.
+	Refreshed  *time.Time `json:"refreshed"`
+	AgeSeconds float64    `json:"age_seconds"`
+	Stale      bool       `json:"stale"`
+
+	IntervalSeconds float64 `json:"interval_seconds"`
+}
+
+// Holds the stats from the last refresh, so requests never list a bucket.
+type bucketStatsCache struct {
+	sync.Mutex
+	stats     map[string]BucketStats
+	refreshed time.Time
+}
+
+func newBucketStatsCache() *bucketStatsCache {
+	return &bucketStatsCache{stats: make(map[string]BucketStats)}
+}
+
+var bucketStats = newBucketStatsCache()
+
+// The buckets whose stats are kept: every accepted bucket, or only
+// FACECLAIM_BUCKET when any bucket is accepted.
+func statsBuckets() []string {
+	cfg := currentConfig()
+	if buckets := cfg.acceptedBuckets(); len(buckets) > 0 {
+		return buckets
+	}
+	return []string{cfg.FaceclaimBucket}
+}
+
+// Lists each bucket and replaces its stats. A bucket that can't be listed
+// keeps its previous stats, with the error.
+func (b *bucketStatsCache) refresh(ctx context.Context) {
+	buckets := statsBuckets()
+	fresh := make(map[string]BucketStats, len(buckets))
+	for _, bucket := range buckets {
+		stats, err := measureBucket(ctx, bucket)
+		if err != nil {
+			log.Printf("Unable to measure %v: %v\n", bucket, err)
+			b.Lock()
+			stats = b.stats[bucket]
+			b.Unlock()
+			stats.Bucket, stats.Error = bucket, err.Error()
+		} else {
+			setBucketStats(stats)
+		}
+		fresh[bucket] = stats
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.stats, b.refreshed = fresh, time.Now()
+}
+
+// Lists a bucket in full and sums it up.
+func measureBucket(ctx context.Context, bucket string) (BucketStats, error) {
+	objects, err := Store.List(ctx, bucket, "")
+	if err != nil {
+		return BucketStats{}, err
+	}
+	stats := BucketStats{Bucket: bucket, Refreshed: time.Now()}
+	for _, attrs := range objects {
+		stats.Objects++
+		stats.Bytes += attrs.Size
+		if attrs.Size > stats.LargestBytes || stats.LargestObject == "" {
+			stats.LargestObject, stats.LargestBytes = attrs.Name, attrs.Size
+		}
+		if attrs.Updated.After(stats.LastModified) {
+			stats.LastModified = attrs.Updated
+		}
+	}
+	return stats, nil
+}
+
+// Returns the cached stats, in the order the buckets are configured.
+func (b *bucketStatsCache) report(now time.Time) BucketsReport {
+	b.Lock()
+	defer b.Unlock()
+	report := BucketsReport{Buckets: []BucketStats{}, IntervalSeconds: BucketStatsInterval.Seconds()}
+	report.Stale = b.refreshed.IsZero()
+	for _, bucket := range statsBuckets() {
+		if stats, ok := b.stats[bucket]; ok {
+			report.Buckets = append(report.Buckets, stats)
+			report.Stale = report.Stale || now.Sub(stats.Refreshed) > 2*BucketStatsInterval
+		}
+	}
+	if !b.refreshed.IsZero() {
+		refreshed := b.refreshed
+		report.Refreshed, report.AgeSeconds = &refreshed, now.Sub(refreshed).Seconds()
+	}
+	return report
+}
+
+// Reports each configured bucket's object count, total bytes, largest object,
+// and last modification, as of the background refresher's last run.
+func getBucketStats(c *gin.Context) {
+	respond(c, http.StatusOK, bucketStats.report(time.Now()))
+}
+
+// Refreshes the bucket stats now and every BucketStatsInterval until the
+// context is cancelled.
+func watchBucketStats(ctx context.Context) {
+	ticker := time.NewTicker(BucketStatsInterval)
+	defer ticker.Stop()
+	for {
+		bucketStats.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
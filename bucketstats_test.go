@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Store objects of the given sizes, modified a minute apart from start
+func seedBucketStats(store *memStorage, bucket string, start time.Time, sizes map[string]int) {
+	i := 0
+	for name, size := range sizes {
+		store.Upload(context.Background(), bucket, name, bytes.NewReader(make([]byte, size)), UploadOptions{})
+		store.objects[bucket+"/"+name].attrs.Updated = start.Add(time.Duration(i) * time.Minute)
+		i++
+	}
+}
+
+func fetchBucketStats(t *testing.T, r http.Handler) BucketsReport {
+	w := performRequest(r, "GET", "/admin/buckets", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report BucketsReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	return report
+}
+
+func TestBucketStats(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	t.Setenv("BUCKET_STATS_INTERVAL", "1m")
+	t.Cleanup(func() { prepareBucketStats() })
+	assert.NoError(t, prepareBucketStats())
+	useConfig(t, func(cfg *Config) { cfg.AllowedBuckets = []string{"pcs.botch.lol"} })
+	r := setupRouter(false)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seedBucketStats(store, testBucket, start, map[string]int{"a.webp": 10})
+	seedBucketStats(store, "pcs.botch.lol", start, map[string]int{"b.webp": 5})
+	seedBucketStats(store, testBucket, start.Add(time.Hour), map[string]int{"big.webp": 300})
+
+	// Nothing's known until the refresher runs, and requests don't list
+	report := fetchBucketStats(t, r)
+	assert.True(t, report.Stale)
+	assert.Nil(t, report.Refreshed)
+	assert.Empty(t, report.Buckets)
+	assert.Zero(t, store.lists)
+
+	bucketStats.refresh(context.Background())
+	assert.Equal(t, 2, store.lists)
+	store.Upload(context.Background(), testBucket, "later.webp", bytes.NewReader(make([]byte, 1000)), UploadOptions{})
+
+	report = fetchBucketStats(t, r)
+	assert.False(t, report.Stale)
+	assert.NotNil(t, report.Refreshed)
+	assert.Equal(t, float64(60), report.IntervalSeconds)
+	if assert.Len(t, report.Buckets, 2) {
+		other, faceclaims := report.Buckets[0], report.Buckets[1]
+		assert.Equal(t, "pcs.botch.lol", other.Bucket)
+		assert.Equal(t, int64(1), other.Objects)
+		assert.Equal(t, int64(5), other.Bytes)
+
+		assert.Equal(t, testBucket, faceclaims.Bucket)
+		assert.Equal(t, int64(2), faceclaims.Objects, "The cached stats are served")
+		assert.Equal(t, int64(310), faceclaims.Bytes)
+		assert.Equal(t, "big.webp", faceclaims.LargestObject)
+		assert.Equal(t, int64(300), faceclaims.LargestBytes)
+		assert.True(t, start.Add(time.Hour).Equal(faceclaims.LastModified))
+		assert.Empty(t, faceclaims.Error)
+	}
+	assert.Equal(t, float64(2), testutil.ToFloat64(bucketObjects.WithLabelValues(testBucket)))
+	assert.Equal(t, float64(310), testutil.ToFloat64(bucketBytes.WithLabelValues(testBucket)))
+	assert.Equal(t, float64(300), testutil.ToFloat64(bucketLargestObjectBytes.WithLabelValues(testBucket)))
+	assert.Equal(t, float64(start.Add(time.Hour).Unix()), testutil.ToFloat64(bucketLastModifiedSeconds.WithLabelValues(testBucket)))
+
+	// Stats go stale after two intervals without a refresh
+	assert.False(t, bucketStats.report(time.Now().Add(90*time.Second)).Stale)
+	assert.True(t, bucketStats.report(time.Now().Add(3*time.Minute)).Stale)
+
+	// A failed listing keeps the last numbers, and they still age
+	store.Lock()
+	store.err = errors.New("GCS is down")
+	store.Unlock()
+	bucketStats.refresh(context.Background())
+	report = bucketStats.report(time.Now())
+	if assert.Len(t, report.Buckets, 2) {
+		assert.Equal(t, int64(310), report.Buckets[1].Bytes)
+		assert.Equal(t, "GCS is down", report.Buckets[1].Error)
+	}
+	assert.True(t, bucketStats.report(time.Now().Add(3*time.Minute)).Stale)
+	assert.Equal(t, float64(310), testutil.ToFloat64(bucketBytes.WithLabelValues(testBucket)))
+}
+
+func TestPrepareBucketStats(t *testing.T) {
+	t.Cleanup(func() { prepareBucketStats() })
+
+	assert.NoError(t, prepareBucketStats())
+	assert.Equal(t, 15*time.Minute, BucketStatsInterval)
+	t.Setenv("BUCKET_STATS_INTERVAL", "0")
+	assert.NoError(t, prepareBucketStats())
+	assert.Zero(t, BucketStatsInterval)
+	t.Setenv("BUCKET_STATS_INTERVAL", "hourly")
+	assert.Error(t, prepareBucketStats())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Growing a fresh buffer for each download, conversion, and upload was where
+// most of an upload's allocations went, so the pipeline reuses pooled ones.
+const (
+	// New buffers start big enough for a typical image
+	pooledBufferSize = 1 << 20
+
+	// Bigger buffers are left to the GC, so one huge image doesn't stay
+	// pinned in the pool
+	maxPooledBufferSize = 16 << 20
+
+	copyBufferSize = 32 << 10
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return bytes.NewBuffer(make([]byte, 0, pooledBufferSize)) },
+}
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// Returns an empty buffer from the pool. Return it with putBuffer once
+// nothing refers to its contents.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Returns a buffer to the pool.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// io.Copy, with a pooled copy buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
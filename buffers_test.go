@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// copyConverter passes images through unchanged, so benchmarks measure the
+// pipeline rather than an encoder.
+type copyConverter struct{}
+
+func (copyConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// A photo-sized fixture that doesn't compress away to nothing. It's already
+// WebP, so copyConverter's output passes as converted.
+func benchmarkImage(b *testing.B) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	for y := 0; y < 600; y++ {
+		for x := 0; x < 800; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * y), uint8(x ^ y), uint8(x + y*3), 255})
+		}
+	}
+	return encodeLosslessWebP(img)
+}
+
+func BenchmarkProcessImage(b *testing.B) {
+	store, _ := useFakeBackends(b)
+	ImageConverter = copyConverter{}
+	useConfig(b, func(cfg *Config) { cfg.CharMaxImages = 0 })
+
+	// Served with a length, as CDNs do
+	fixture := benchmarkImage(b)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(fixture)))
+		w.Write(fixture)
+	}))
+	defer server.Close()
+	request := *createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := processImage(context.Background(), request); err != nil {
+			b.Fatal(err)
+		}
+		store.objects = make(map[string]*memObject)
+	}
+}
+
+func TestPooledBuffersStartEmpty(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString("leftovers")
+	putBuffer(buf)
+
+	for i := 0; i < 10; i++ {
+		buf := getBuffer()
+		if buf.Len() != 0 {
+			t.Fatalf("pooled buffer holds %q", buf.String())
+		}
+		defer putBuffer(buf)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// A CharLimitError is returned when a character already has the maximum
+// number of faceclaims.
+type CharLimitError struct {
+	CharID string
+	Count  int
+	Limit  int
+}
+
+func (e *CharLimitError) Error() string {
+	return fmt.Sprintf("%v already has %v of %v faceclaim images", e.CharID, e.Count, e.Limit)
+}
+
+// Reads CHAR_MAX_IMAGES, which caps how many faceclaims a character may have.
+// It defaults to 20, and 0 means unlimited.
+func loadCharLimit(cfg *Config) error {
+	if value, ok := os.LookupEnv("CHAR_MAX_IMAGES"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("CHAR_MAX_IMAGES must be a non-negative integer")
+		}
+		cfg.CharMaxImages = n
+	}
+	return nil
+}
+
+// characterLocks serializes uploads to the same character within this
+// process. Uploads handled by other instances are caught by the recount in
+// confirmCharacterLimit.
+var characterLocks = newKeyedMutex()
+
+type keyedMutex struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Locks the key, returning the function that unlocks it.
+func (m *keyedMutex) lock(key string) func() {
+	m.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.waiters++
+	m.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(m.locks, key)
+		}
+		m.Unlock()
+	}
+}
+
+// Returns a character's faceclaims, oldest first. Kept originals and size
+// variants aren't included.
+func characterFaceclaims(bucket, charid string) ([]*storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// Always listed afresh, since the limit mustn't be checked against a
+	// listing that misses another instance's uploads
+	objects, err := Store.List(ctx, bucket, charid+"/")
+	if err != nil {
+		return nil, fmt.Errorf("characterFaceclaims: %v", err)
+	}
+	return faceclaimsIn(objects), nil
+}
+
+// Works out how to make room for another of a character's faceclaims,
+// without changing anything. At the cap, the oldest faceclaims that aren't
+// held are to be evicted if evict is set; otherwise, or if too many are held,
+// a CharLimitError is returned.
+func planCharacterSlot(bucket, charid string, evict bool) ([]*storage.ObjectAttrs, error) {
+	limit := currentConfig().CharMaxImages
+	if limit == 0 {
+		return nil, nil
+	}
+	faceclaims, err := characterFaceclaims(bucket, charid)
+	if err != nil {
+		return nil, err
+	}
+	excess := len(faceclaims) - limit + 1
+	if excess <= 0 {
+		return nil, nil
+	}
+	var evictable []*storage.ObjectAttrs
+	for _, attrs := range faceclaims {
+		if !isHeld(attrs) {
+			evictable = append(evictable, attrs)
+		}
+	}
+	if !evict || len(evictable) < excess {
+		return nil, &CharLimitError{CharID: charid, Count: len(faceclaims), Limit: limit}
+	}
+	return evictable[:excess], nil
+}
+
+// Deletes the faceclaims planCharacterSlot chose to make room, with their kept
+// originals and variants. It's only called once the new faceclaim is stored
+// and counted, so a failed upload never costs the character an image.
+// Returns the names of the faceclaims evicted, even if it fails partway.
+func evictFaceclaims(bucket string, evictions []*storage.ObjectAttrs) ([]string, error) {
+	if len(evictions) == 0 {
+		return nil, nil
+	}
+
+	var evicted []string
+	for _, attrs := range evictions {
+		for _, name := range faceclaimObjects(attrs.Name, attrs.Metadata) {
+			if err := deleteObject(context.Background(), bucket, name); err != nil {
+				return evicted, fmt.Errorf("evict: %v", err)
+			}
+		}
+		log.Println("Evicted", attrs.Name, "to make room for a new faceclaim")
+		evicted = append(evicted, attrs.Name)
+	}
+	guildUsage.invalidate(bucket)
+	return evicted, nil
+}
+
+// Recounts a character's faceclaims after an upload, not counting those it's
+// about to evict. If a concurrent upload elsewhere pushed the character past
+// the cap, a CharLimitError is returned so the caller can roll back its own
+// upload before evicting anything.
+func confirmCharacterLimit(bucket, charid string, evictions []*storage.ObjectAttrs) error {
+	limit := currentConfig().CharMaxImages
+	if limit == 0 {
+		return nil
+	}
+	faceclaims, err := characterFaceclaims(bucket, charid)
+	if err != nil {
+		// The upload itself succeeded, so it stands
+		log.Println("Unable to recount faceclaims:", err)
+		return nil
+	}
+	evicting := make(map[string]bool, len(evictions))
+	for _, attrs := range evictions {
+		evicting[attrs.Name] = true
+	}
+	count := 0
+	for _, attrs := range faceclaims {
+		if !evicting[attrs.Name] {
+			count++
+		}
+	}
+	if count > limit {
+		return &CharLimitError{CharID: charid, Count: count - 1, Limit: limit}
+	}
+	return nil
+}
+
+// Returns a faceclaim's object name followed by those of its kept original
+// and size variants.
+func faceclaimObjects(object string, metadata map[string]string) []string {
+	objects := []string{object}
+	if original := metadata["original_object"]; original != "" {
+		objects = append(objects, original)
+	}
+	return append(objects, variantObjectNames(object, metadata)...)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Apply a per-character cap for the duration of a test
+func useCharLimit(t *testing.T, limit int) {
+	useConfig(t, func(cfg *Config) { cfg.CharMaxImages = limit })
+}
+
+func TestCharLimitRejectsUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useCharLimit(t, 2)
+	r := setupRouter(false)
+
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 409, w.Code)
+	assert.Len(t, store.keys(testBucket), 2)
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, float64(2), response["count"])
+	assert.Equal(t, float64(2), response["limit"])
+}
+
+func TestCharLimitEvictsOldest(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useCharLimit(t, 2)
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	request.Variants = []string{"16"}
+	oldest := uploadTestImage(t, r, request)
+	second := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	request = createFaceclaimRequest(testBucket)
+	request.EvictOldest = true
+	newest := uploadTestImage(t, r, request)
+
+	assert.Equal(t, []string{oldest.URL}, newest.Evicted)
+
+	// The evicted faceclaim's original and variant go with it
+	assert.ElementsMatch(t, []string{
+		objectKey(testBucket, second.URL),
+		objectKey(testBucket, newest.URL),
+	}, store.keys(testBucket))
+}
+
+func TestCharLimitEvictsOnlyAfterUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useCharLimit(t, 2)
+	r := setupRouter(false)
+	oldest := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	// The upload fails, so nothing is evicted
+	store.rejectUpload = func(bucket, object string) bool { return true }
+	request := createFaceclaimRequest(testBucket)
+	request.EvictOldest = true
+	w := postTestImage(r, request)
+	assert.NotEqual(t, 201, w.Code)
+	assert.True(t, store.exists(testBucket, oldest), "The oldest faceclaim should survive a failed upload")
+	assert.Len(t, store.keys(testBucket), 2)
+
+	// Another instance fills the slot mid-upload, so the upload is rolled
+	// back, still without evicting
+	store.rejectUpload = nil
+	store.beforeUpload = func(bucket, object string) {
+		store.Upload(context.Background(), bucket, testCharID+"/other.webp", bytes.NewReader(nil), UploadOptions{ContentType: "image/webp"})
+	}
+	w = postTestImage(r, request)
+	assert.Equal(t, 409, w.Code)
+	assert.True(t, store.exists(testBucket, oldest), "The oldest faceclaim should survive a rollback")
+	assert.Len(t, store.keys(testBucket), 3)
+}
+
+func TestConfirmCharacterLimit(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useCharLimit(t, 2)
+
+	// Simulate another instance uploading between the count and the upload
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("__test/%v.webp", i)
+		store.Upload(context.Background(), testBucket, name, bytes.NewReader(nil), UploadOptions{ContentType: "image/webp"})
+	}
+	assert.IsType(t, &CharLimitError{}, confirmCharacterLimit(testBucket, "__test", nil))
+
+	// Faceclaims about to be evicted don't count
+	evicting := []*storage.ObjectAttrs{{Name: "__test/0.webp"}}
+	assert.Nil(t, confirmCharacterLimit(testBucket, "__test", evicting))
+
+	store.Delete(context.Background(), testBucket, "__test/0.webp")
+	assert.Nil(t, confirmCharacterLimit(testBucket, "__test", nil))
+}
+
+func TestLoadCharLimit(t *testing.T) {
+	defer os.Unsetenv("CHAR_MAX_IMAGES")
+
+	cfg := newConfig()
+	assert.Nil(t, loadCharLimit(cfg))
+	assert.Equal(t, 20, cfg.CharMaxImages)
+
+	os.Setenv("CHAR_MAX_IMAGES", "5")
+	assert.Nil(t, loadCharLimit(cfg))
+	assert.Equal(t, 5, cfg.CharMaxImages)
+
+	os.Setenv("CHAR_MAX_IMAGES", "lots")
+	assert.NotNil(t, loadCharLimit(newConfig()))
+}
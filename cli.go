@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// A command runs with its own arguments, writing its result to stdout.
+type command func(args []string, stdout io.Writer) error
+
+var commands = map[string]command{
+	"serve":      cmdServe,
+	"upload":     cmdUpload,
+	"delete":     cmdDelete,
+	"purge-logs": cmdPurgeLogs,
+}
+
+// Runs the command named by the first argument, returning the process exit
+// code. Without a command, the server is started. Failures are written to
+// stderr as JSON.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("inconnu-api", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	check := flags.Bool("check-config", false, "Validate the config and its dependencies, then exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *check || os.Getenv("RUN_MODE") == "check" {
+		return checkConfig(stdout)
+	}
+
+	name, args := "serve", flags.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		writeJSON(stderr, JSON{"error": fmt.Sprintf("unknown command %q", name)})
+		return 2
+	}
+	if err := cmd(args, stdout); err != nil {
+		writeJSON(stderr, JSON{"error": err.Error()})
+		return 1
+	}
+	return 0
+}
+
+// Writes a value as indented JSON.
+func writeJSON(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// Starts the API server.
+func cmdServe(args []string, stdout io.Writer) error {
+	if err := prepareEnvVars(); err != nil {
+		return err
+	}
+	detectEncoderVersion(context.Background())
+	logStartupBanner()
+	if _, err := startAdminServer(); err != nil {
+		return err
+	}
+	configReload := make(chan os.Signal, 1)
+	signal.Notify(configReload, syscall.SIGHUP)
+	go watchConfigReload(context.Background(), configReload)
+	if APITokenSecret != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go watchAPIToken(context.Background(), reload)
+	}
+	if deleteJournal != nil {
+		go drainJournal(context.Background(), deleteJournal, DeleteJournalRetry)
+	}
+	go watchBucketAccess(context.Background())
+	if len(DeleteSubscriptions) > 0 {
+		go watchQueueStatus(context.Background())
+	}
+	if SelfTest {
+		go runSelfTest(context.Background())
+	}
+	if UsageSnapshotInterval > 0 {
+		go watchUsage(context.Background())
+	}
+	if BucketStatsInterval > 0 {
+		go watchBucketStats(context.Background())
+	}
+
+	r := setupRouter(true)
+	return r.Run(":" + currentConfig().Port)
+}
+
+// Uploads a faceclaim the same way /faceclaim/upload does.
+func cmdUpload(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	var request FaceclaimRequest
+	flags.StringVar(&request.CharID, "charid", "", "The character's database ID (required)")
+	flags.StringVar(&request.ImageURL, "url", "", "The URL of the image to upload (required)")
+	flags.StringVar(&request.Bucket, "bucket", "", "The bucket to upload to, if not the default")
+	flags.IntVar(&request.Guild, "guild", 0, "The Discord server the character belongs to")
+	flags.IntVar(&request.User, "user", 0, "The Discord user who owns the character")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if request.CharID == "" || request.ImageURL == "" {
+		return errors.New("upload: --charid and --url are required")
+	}
+	if err := prepareEnvVars(); err != nil {
+		return err
+	}
+	if err := validateCharID(request.CharID); err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), UploadTimeout)
+	defer cancel()
+
+	detectEncoderVersion(ctx)
+	response, err := processImage(ctx, request)
+	if err != nil {
+		return err
+	}
+	writeJSON(stdout, response)
+	return nil
+}
+
+// Queues deletions the same way the delete routes do: a single faceclaim if
+// --key is given, or all of the character's faceclaims otherwise.
+func cmdDelete(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("delete", flag.ContinueOnError)
+	bucket := flags.String("bucket", "", "The bucket to delete from (required)")
+	charid := flags.String("charid", "", "The character's database ID (required)")
+	key := flags.String("key", "", "The faceclaim to delete, e.g. 63b1e5d6e3d1c1a2b3c4d5e6.webp")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *bucket == "" || *charid == "" {
+		return errors.New("delete: --bucket and --charid are required")
+	}
+	if err := prepareEnvVars(); err != nil {
+		return err
+	}
+	if err := validateCharID(*charid); err != nil {
+		return fmt.Errorf("delete: %v", err)
+	}
+	if *key != "" {
+		if err := validateKey(*key); err != nil {
+			return fmt.Errorf("delete: %v", err)
+		}
+	}
+
+	var result DeleteResult
+	var err error
+	if *key != "" {
+		result, err = queueFaceclaimDeletion(context.Background(), *bucket, *charid, *key)
+	} else {
+		result, err = queueCharacterDeletion(context.Background(), *bucket, *charid)
+	}
+	if err != nil {
+		return err
+	}
+	writeJSON(stdout, result)
+	return nil
+}
+
+// Deletes archived log files older than --older-than.
+func cmdPurgeLogs(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("purge-logs", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", 0, "Delete logs older than this, e.g. 720h (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *olderThan <= 0 {
+		return errors.New("purge-logs: --older-than must be a positive duration")
+	}
+	if err := prepareEnvVars(); err != nil {
+		return err
+	}
+
+	result, err := purgeLogs(*olderThan)
+	if err != nil {
+		return err
+	}
+	writeJSON(stdout, struct {
+		Bucket string `json:"bucket"`
+		BatchResult
+	}{logBucket, result})
+	if result.Failed > 0 {
+		return fmt.Errorf("purge-logs: %v of %v deletions failed", result.Failed, len(result.Results))
+	}
+	return nil
+}
+
+// Deletes the log files uploaded more than olderThan ago. A deletion that
+// fails doesn't stop the rest. Under the dated layout, only dated logs are
+// considered, and only the days up to the cutoff are listed.
+func purgeLogs(olderThan time.Duration) (BatchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var objects []*storage.ObjectAttrs
+	var err error
+	if LogLayout == logLayoutDated {
+		objects, err = datedLogsBefore(ctx, time.Now().Add(-olderThan))
+	} else {
+		objects, err = Store.List(ctx, logBucket, "")
+	}
+	if err != nil {
+		return BatchResult{}, fmt.Errorf("purgeLogs: %v", err)
+	}
+
+	result := BatchResult{Results: []BatchItem{}}
+	for _, attrs := range objects {
+		if time.Since(attrs.Created) <= olderThan {
+			continue
+		}
+		if err := deleteObject(ctx, logBucket, attrs.Name); err != nil {
+			result.fail(attrs.Name, "failed", err)
+			continue
+		}
+		result.succeed(attrs.Name, "deleted")
+	}
+	log.Printf("Purged %v logs older than %v, %v failed\n", result.Succeeded, olderThan, result.Failed)
+	return result, nil
+}
+
+// Lists the dated logs that might be older than cutoff: every log from the
+// days before its day, and the logs from its day.
+func datedLogsBefore(ctx context.Context, cutoff time.Time) ([]*storage.ObjectAttrs, error) {
+	day := datedLogPrefix(cutoff)
+	objects, err := Store.ListBefore(ctx, logBucket, "logs/", day)
+	if err != nil {
+		return nil, err
+	}
+	sameDay, err := Store.List(ctx, logBucket, day)
+	if err != nil {
+		return nil, err
+	}
+	return append(objects, sameDay...), nil
+}
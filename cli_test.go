@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCmdUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useRequiredEnv(t)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	defer server.Close()
+
+	var out bytes.Buffer
+	err := cmdUpload([]string{"--charid", "__test", "--url", server.URL, "--bucket", testBucket}, &out)
+	assert.Nil(t, err)
+
+	var response FaceclaimResponse
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &response))
+	assert.True(t, store.exists(testBucket, objectKey(testBucket, response.URL)))
+	assert.NotEmpty(t, response.BlurHash)
+}
+
+func TestCmdUploadRequiresFlags(t *testing.T) {
+	useFakeBackends(t)
+	useRequiredEnv(t)
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 1, run([]string{"upload", "--charid", "__test"}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "--url")
+	assert.Empty(t, out.String())
+}
+
+func TestCmdDelete(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	useRequiredEnv(t)
+	r := setupRouter(false)
+
+	first := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	var out bytes.Buffer
+	key := objectKey(testBucket, first.URL)[len("__test/"):]
+	assert.Nil(t, cmdDelete([]string{"--bucket", testBucket, "--charid", "__test", "--key", key}, &out))
+	assert.Len(t, store.keys(testBucket), 1)
+
+	var result DeleteResult
+	json.Unmarshal(out.Bytes(), &result)
+	assert.False(t, result.AlreadyQueued)
+
+	out.Reset()
+	assert.Nil(t, cmdDelete([]string{"--bucket", testBucket, "--charid", "__test"}, &out))
+	assert.Empty(t, store.keys(testBucket))
+	assert.Equal(t, "delete-faceclaim-group", publisher.published()[1].Topic)
+}
+
+func TestCmdPurgeLogs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useRequiredEnv(t)
+
+	ctx := context.Background()
+	store.Upload(ctx, logBucket, "old.log", bytes.NewReader([]byte("old")), UploadOptions{ContentType: "text/plain"})
+	store.objects[logBucket+"/old.log"].attrs.Created = time.Now().Add(-48 * time.Hour)
+	store.Upload(ctx, logBucket, "new.log", bytes.NewReader([]byte("new")), UploadOptions{ContentType: "text/plain"})
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, run([]string{"purge-logs", "--older-than", "24h"}, &out, &out))
+	assert.Equal(t, []string{"new.log"}, store.keys(logBucket))
+
+	var result BatchResult
+	json.Unmarshal(out.Bytes(), &result)
+	assert.Equal(t, []BatchItem{{Key: "old.log", Status: "deleted"}}, result.Results)
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 2, run([]string{"frobnicate"}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "unknown command")
+}
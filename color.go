@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// Each channel is quantized to this many bits when bucketing colors. Four bits
+// keeps similar shades together without muddying distinct ones.
+const colorQuantizationBits = 4
+
+// Computes the dominant color of an image sample as a hex string (#rrggbb).
+// Pixels are bucketed by quantized color, weighted by opacity, and the average
+// color of the heaviest bucket wins. A fully transparent image has no dominant
+// color, so an empty string is returned and the bot falls back to its palette.
+func computeDominantColor(sample *image.RGBA) string {
+	type bucket struct {
+		weight  uint64
+		r, g, b uint64
+	}
+	shift := 8 - colorQuantizationBits
+	buckets := make(map[uint32]*bucket)
+
+	var dominant *bucket
+	bounds := sample.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := sample.RGBAAt(x, y)
+			if p.A == 0 {
+				continue
+			}
+			// image.RGBA is alpha-premultiplied; recover the straight color
+			r := uint32(p.R) * 255 / uint32(p.A)
+			g := uint32(p.G) * 255 / uint32(p.A)
+			b := uint32(p.B) * 255 / uint32(p.A)
+
+			key := (r>>shift)<<16 | (g>>shift)<<8 | b>>shift
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			weight := uint64(p.A)
+			bk.weight += weight
+			bk.r += uint64(r) * weight
+			bk.g += uint64(g) * weight
+			bk.b += uint64(b) * weight
+
+			if dominant == nil || bk.weight > dominant.weight {
+				dominant = bk
+			}
+		}
+	}
+
+	if dominant == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", dominant.r/dominant.weight, dominant.g/dominant.weight, dominant.b/dominant.weight)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Create a 64x64 image filled with a single color
+func solidImage(c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestDominantColorSolidRed(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(color.RGBA{255, 0, 0, 255}))
+
+	_, dominantColor := analyzeImage(buf.Bytes())
+	assert.Equal(t, "#ff0000", dominantColor)
+}
+
+func TestDominantColorMajority(t *testing.T) {
+	// Three quarters blue, one quarter red
+	img := solidImage(color.RGBA{0, 0, 255, 255})
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	assert.Equal(t, "#0000ff", computeDominantColor(img))
+}
+
+func TestDominantColorGrayscale(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	assert.Equal(t, "#808080", computeDominantColor(downsample(img, analysisSampleSize)))
+}
+
+func TestDominantColorTransparent(t *testing.T) {
+	img := solidImage(color.RGBA{0, 0, 0, 0})
+	assert.Equal(t, "", computeDominantColor(img))
+
+	// Translucent pixels still report their straight (unpremultiplied) color
+	img = solidImage(color.NRGBA{255, 0, 0, 128})
+	assert.Equal(t, "#ff0000", computeDominantColor(img))
+}
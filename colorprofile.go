@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// A ColorSpaceError means a source image is in a color space the pipeline
+// can't convert, such as CMYK.
+type ColorSpaceError struct {
+	Space string
+}
+
+func (e *ColorSpaceError) Error() string {
+	return fmt.Sprintf("%v images aren't supported; convert the image to RGB first", e.Space)
+}
+
+// Rejects source images the pipeline can't convert to sRGB.
+func checkColorSpace(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// Left for decoding to report
+		return nil
+	}
+	if config.ColorModel == color.CMYKModel {
+		return &ColorSpaceError{Space: "CMYK"}
+	}
+	return nil
+}
+
+// Returns the ICC profile embedded in a JPEG, PNG, or WebP, or nil if there
+// isn't one.
+func embeddedProfile(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return jpegProfile(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return pngProfile(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return webpProfile(data)
+	}
+	return nil
+}
+
+// Reassembles a JPEG's ICC profile from its APP2 segments, which each carry
+// a sequence number so profiles too big for one segment can be split.
+func jpegProfile(data []byte) []byte {
+	type chunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []chunk
+	marker := []byte("ICC_PROFILE\x00")
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		if data[i+1] == 0xda || data[i+1] == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		segment := data[i+4 : end]
+		if data[i+1] == 0xe2 && bytes.HasPrefix(segment, marker) && len(segment) >= len(marker)+2 {
+			chunks = append(chunks, chunk{segment[len(marker)], segment[len(marker)+2:]})
+		}
+		i = end
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+	var profile []byte
+	for _, c := range chunks {
+		profile = append(profile, c.data...)
+	}
+	return profile
+}
+
+// Returns a PNG's iCCP profile, which is zlib-compressed after its name.
+func pngProfile(data []byte) []byte {
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		if length < 0 || i+12+length > len(data) || kind == "IDAT" {
+			break
+		}
+		if kind == "iCCP" {
+			body := data[i+8 : i+8+length]
+			name := bytes.IndexByte(body, 0)
+			if name < 0 || name+2 > len(body) || body[name+1] != 0 {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(body[name+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(io.LimitReader(r, 4<<20))
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		i += 12 + length
+	}
+	return nil
+}
+
+// Returns a WebP's ICCP chunk.
+func webpProfile(data []byte) []byte {
+	for i := 12; i+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if length < 0 || i+8+length > len(data) {
+			break
+		}
+		if string(data[i:i+4]) == "ICCP" {
+			return data[i+8 : i+8+length]
+		}
+		// Chunks are padded to an even length
+		i += 8 + length + length%2
+	}
+	return nil
+}
+
+// A toneCurve maps an encoded channel value, from 0 to 1, to linear light.
+type toneCurve func(float64) float64
+
+// An rgbProfile is an ICC profile of the matrix/TRC kind: per-channel tone
+// curves, then a matrix to the D50 XYZ connection space.
+type rgbProfile struct {
+	toXYZ  [3][3]float64
+	curves [3]toneCurve
+}
+
+// Parses the parts of an RGB ICC profile needed to convert from it. Profiles
+// of other kinds return an error.
+func parseICCProfile(profile []byte) (*rgbProfile, error) {
+	if len(profile) < 132 || string(profile[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if string(profile[16:20]) != "RGB " {
+		return nil, fmt.Errorf("unsupported %q color space", profile[16:20])
+	}
+	if string(profile[20:24]) != "XYZ " {
+		return nil, errors.New("only XYZ connection spaces are supported")
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for n := 0; n < count; n++ {
+		entry := 132 + n*12
+		if entry+12 > len(profile) {
+			return nil, errors.New("truncated tag table")
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, errors.New("tag out of bounds")
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	var p rgbProfile
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := parseXYZ(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		for row := range xyz {
+			p.toXYZ[row][i] = xyz[row]
+		}
+	}
+	for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseCurve(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		p.curves[i] = curve
+	}
+	return &p, nil
+}
+
+// Reads an s15Fixed16Number.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// Parses an XYZType tag.
+func parseXYZ(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, errors.New("missing or invalid")
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+// Parses a curveType or parametricCurveType tag.
+func parseCurve(tag []byte) (toneCurve, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("missing or invalid")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, nil
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		case len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 {
+				pos := x * float64(n-1)
+				i := int(pos)
+				if i >= n-1 {
+					return table[n-1]
+				}
+				frac := pos - float64(i)
+				return table[i]*(1-frac) + table[i+1]*frac
+			}, nil
+		}
+	case "para":
+		counts := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		kind := binary.BigEndian.Uint16(tag[8:])
+		n, ok := counts[kind]
+		if !ok || len(tag) < 12+4*n {
+			break
+		}
+		var g [7]float64
+		for i := 0; i < n; i++ {
+			g[i] = s15Fixed16(tag[12+4*i:])
+		}
+		gamma, a, b, c, d, e, f := g[0], g[1], g[2], g[3], g[4], g[5], g[6]
+		switch kind {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, gamma)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, gamma) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, gamma)
+				}
+				return c * x
+			}, nil
+		case 4:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, gamma) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+	return nil, errors.New("unsupported curve")
+}
+
+// sRGB's primaries, adapted to D50 as in its ICC profile: the columns map
+// linear sRGB to the connection space.
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+var xyzToSRGB = invert3(srgbToXYZ)
+
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// Reports whether a profile is sRGB, or close enough that converting from it
+// wouldn't change any pixel.
+func (p *rgbProfile) isSRGB() bool {
+	for row := range p.toXYZ {
+		for col := range p.toXYZ[row] {
+			if math.Abs(p.toXYZ[row][col]-srgbToXYZ[row][col]) > 0.002 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for _, x := range []float64{0.02, 0.1, 0.25, 0.5, 0.75, 0.9} {
+			if math.Abs(curve(x)-srgbDecode(x)) > 0.002 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Converts an image from its embedded profile to sRGB, returning it as a PNG
+// with no profile and true. The converter drops profiles, so without this,
+// images in other color spaces, like Display P3 photos from iPhones, come out
+// with their colors shifted. Images without a profile, with an sRGB one, or
+// with one that isn't the matrix/TRC kind cameras and phones embed are
+// returned untouched with false.
+func convertToSRGB(data, profile []byte) ([]byte, bool, error) {
+	if profile == nil {
+		return data, false, nil
+	}
+	p, err := parseICCProfile(profile)
+	if err != nil {
+		// Worst case, colors are a little off, as they always were
+		return data, false, nil
+	}
+	if p.isSRGB() {
+		return data, false, nil
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, false, err
+	}
+	bounds := img.Bounds()
+	converted := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Copy(converted, image.Point{}, img, bounds, draw.Src, nil)
+	p.transform(converted)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, converted); err != nil {
+		return nil, false, fmt.Errorf("png.Encode: %v", err)
+	}
+	return buf.Bytes(), true, nil
+}
+
+// Converts an image's pixels, in place, from the profile's color space to
+// sRGB. Colors outside sRGB's gamut are clipped.
+func (p *rgbProfile) transform(img *image.NRGBA) {
+	// Every channel value is 8-bit, so the curves are tabulated
+	var linear [3][256]float64
+	for ch := range linear {
+		for v := range linear[ch] {
+			linear[ch][v] = p.curves[ch](float64(v) / 255)
+		}
+	}
+	m := multiply3(xyzToSRGB, p.toXYZ)
+	const steps = 4096
+	var encode [steps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(srgbEncode(float64(i)/steps) * 255))
+	}
+	quantize := func(v float64) uint8 {
+		if v <= 0 {
+			return 0
+		}
+		if v >= 1 {
+			return 255
+		}
+		return encode[int(math.Round(v*steps))]
+	}
+
+	for y := 0; y < img.Rect.Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+img.Rect.Dx()*4]
+		for i := 0; i+4 <= len(row); i += 4 {
+			r, g, b := linear[0][row[i]], linear[1][row[i+1]], linear[2][row[i+2]]
+			row[i] = quantize(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+			row[i+1] = quantize(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+			row[i+2] = quantize(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+		}
+	}
+}
+
+func multiply3(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	return [3][3]float64{
+		{(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det, (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det, (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det},
+		{(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det, (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det, (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det},
+		{(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det, (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det, (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det},
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Display P3's primaries, adapted to D50, as columns
+var displayP3ToXYZ = [3][3]float64{
+	{0.515102, 0.291965, 0.157153},
+	{0.241196, 0.692245, 0.066561},
+	{-0.001053, 0.041887, 0.784077},
+}
+
+// Build a matrix/TRC ICC profile with the given primaries and the sRGB tone
+// curve, as Display P3 uses
+func matrixProfile(toXYZ [3][3]float64) []byte {
+	fixed := func(v float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(v*65536+0.5*sign(v))))
+	}
+	var tags [][2]interface{}
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := append([]byte("XYZ "), 0, 0, 0, 0)
+		for row := 0; row < 3; row++ {
+			tag = append(tag, fixed(toXYZ[row][i])...)
+		}
+		tags = append(tags, [2]interface{}{name, tag})
+	}
+	curve := append([]byte("para"), 0, 0, 0, 0, 0, 3, 0, 0)
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		curve = append(curve, fixed(v)...)
+	}
+	for _, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, [2]interface{}{name, curve})
+	}
+
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB XYZ ")
+	copy(header[36:], "acsp")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, tag := range tags {
+		body := tag[1].([]byte)
+		table = append(table, tag[0].(string)...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(data)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(body)))
+		data = append(data, body...)
+	}
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func sign(v float64) float64 {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+// Encode an image as a PNG with the profile in an iCCP chunk
+func pngWithProfile(img image.Image, profile []byte) []byte {
+	var encoded bytes.Buffer
+	png.Encode(&encoded, img)
+	data := encoded.Bytes()
+
+	var compressed bytes.Buffer
+	z := zlib.NewWriter(&compressed)
+	z.Write(profile)
+	z.Close()
+	body := append([]byte("icc\x00\x00"), compressed.Bytes()...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(chunk, "iCCP"...)
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// After the signature and IHDR
+	ihdrEnd := 8 + 8 + 13 + 4
+	return append(append(append([]byte(nil), data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+}
+
+func TestConvertDisplayP3(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{128, 128, 128, 255})
+	img.SetNRGBA(0, 1, color.NRGBA{0, 255, 0, 255})
+	img.SetNRGBA(1, 1, color.NRGBA{255, 255, 255, 128})
+	source := pngWithProfile(img, matrixProfile(displayP3ToXYZ))
+	assert.NotNil(t, embeddedProfile(source))
+
+	w := postImageBytes(r, createFaceclaimRequest(testBucket), source)
+	assert.Equal(t, 201, w.Code)
+	key := objectKey(testBucket, getFaceclaimResponse(w.Body).URL)
+	attrs, _ := store.Attrs(context.Background(), testBucket, key)
+	assert.Equal(t, "true", attrs.Metadata["color_converted"])
+
+	data, _ := store.Download(context.Background(), testBucket, key)
+	converted, err := decodeImage(data)
+	if !assert.Nil(t, err) {
+		return
+	}
+	// Expected values from a reference P3 to sRGB conversion. Gray and white
+	// are the same in both, and P3's pure green is clipped to sRGB's.
+	for _, tc := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{0, 0, color.NRGBA{215, 93, 31, 255}},
+		{1, 0, color.NRGBA{128, 128, 128, 255}},
+		{0, 1, color.NRGBA{0, 255, 0, 255}},
+		{1, 1, color.NRGBA{255, 255, 255, 128}},
+	} {
+		got := color.NRGBAModel.Convert(converted.At(tc.x, tc.y)).(color.NRGBA)
+		for i, pair := range [][2]uint8{{got.R, tc.want.R}, {got.G, tc.want.G}, {got.B, tc.want.B}, {got.A, tc.want.A}} {
+			assert.InDelta(t, pair[1], pair[0], 2, "Channel %v of pixel (%v, %v): got %v, want %v", i, tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestSRGBProfileUntouched(t *testing.T) {
+	var encoded bytes.Buffer
+	png.Encode(&encoded, gradientImage())
+	source := pngWithProfile(gradientImage(), matrixProfile(srgbToXYZ))
+
+	data, converted, err := convertToSRGB(source, embeddedProfile(source))
+	assert.Nil(t, err)
+	assert.False(t, converted)
+	assert.Equal(t, source, data)
+
+	data, converted, err = convertToSRGB(encoded.Bytes(), embeddedProfile(encoded.Bytes()))
+	assert.Nil(t, err)
+	assert.False(t, converted, "Images without a profile are left alone")
+}
+
+func TestRejectCMYK(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	// The headers of a baseline JPEG with four components, up to the start of
+	// its scan, which is all it takes to tell it's CMYK
+	cmyk := []byte{0xff, 0xd8, 0xff, 0xc0, 0x00, 0x14, 0x08, 0x00, 0x10, 0x00, 0x10, 0x04,
+		0x01, 0x11, 0x00, 0x02, 0x11, 0x00, 0x03, 0x11, 0x00, 0x04, 0x11, 0x00,
+		0xff, 0xda, 0x00, 0x02}
+	w := postImageBytes(r, createFaceclaimRequest(testBucket), cmyk)
+
+	assert.Equal(t, 415, w.Code)
+	assert.Contains(t, w.Body.String(), "unsupported_color_space")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Responses smaller than this go out uncompressed, since gzip would save
+// little or even add bytes.
+const minCompressSize = 1024
+
+// Compress gzips a route's responses for clients that accept it. The body is
+// held back until it reaches minCompressSize, so small responses are sent as
+// they are; streamed responses are compressed from their first flush.
+func Compress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		writer := &gzipWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		defer func() {
+			writer.finish()
+			c.Writer = writer.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// Reports whether an Accept-Encoding header allows gzip, honoring q=0.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "x-gzip" {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimSpace(params), "=")
+		if ok && strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter buffers a response until it's big enough to compress, then
+// gzips it. Until then, the status is recorded but nothing is sent.
+type gzipWriter struct {
+	gin.ResponseWriter
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	passthrough bool
+	wroteHeader bool
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(data)
+	case w.passthrough:
+		return w.ResponseWriter.Write(data)
+	}
+	w.buf.Write(data)
+	if w.buf.Len() >= minCompressSize {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Headers are sent once it's decided whether to compress.
+func (w *gzipWriter) WriteHeaderNow() {
+	if w.gz != nil || w.passthrough {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+	w.wroteHeader = true
+}
+
+func (w *gzipWriter) Written() bool {
+	return w.wroteHeader || w.buf.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// Flushing commits to compression, so streamed responses reach the client as
+// they're written.
+func (w *gzipWriter) Flush() {
+	if w.gz == nil && !w.passthrough {
+		if err := w.start(); err != nil {
+			return
+		}
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Sends the headers and whatever's buffered, compressing from here on unless
+// the handler already encoded the body itself.
+func (w *gzipWriter) start() error {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || !bodyAllowed(w.Status()) {
+		w.passthrough = true
+	} else {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+
+	pending := w.buf.Bytes()
+	w.buf = bytes.Buffer{}
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err := w.Write(pending)
+	return err
+}
+
+// Ends the response: small bodies are sent as they are, and compressed ones
+// get their gzip footer.
+func (w *gzipWriter) finish() {
+	switch {
+	case w.gz != nil:
+		w.gz.Close()
+	case w.passthrough:
+	default:
+		w.passthrough = true
+		if w.wroteHeader || w.buf.Len() > 0 {
+			w.ResponseWriter.WriteHeaderNow()
+		}
+		if w.buf.Len() > 0 {
+			w.ResponseWriter.Write(w.buf.Bytes())
+		}
+	}
+}
+
+// Reports whether a status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
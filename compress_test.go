@@ -0,0 +1,86 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressLargeListing(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	for i := 0; i < 200; i++ {
+		object := testObjectKey(uint64(i))
+		metadata := UploadOptions{ContentType: "image/webp", Metadata: map[string]string{"blurhash": "LEHV6nWB2yk8pyo0adR*.7kCMdnj"}}
+		assert.Nil(t, store.Upload(context.Background(), testBucket, object, strings.NewReader("webp"), metadata))
+	}
+	path := "/faceclaim/list/" + testBucket + "/" + testCharID
+
+	plain := performRequest(r, "GET", path, nil)
+	assert.Equal(t, 200, plain.Code)
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", plain.Header().Get("Vary"))
+
+	compressed := getWithHeaders(r, path, map[string]string{"Accept-Encoding": "br, gzip;q=0.8"})
+	assert.Equal(t, 200, compressed.Code)
+	assert.Equal(t, "gzip", compressed.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", compressed.Header().Get("Vary"))
+	assert.Empty(t, compressed.Header().Get("Content-Length"))
+	assert.Less(t, compressed.Body.Len(), plain.Body.Len()/2)
+
+	reader, err := gzip.NewReader(compressed.Body)
+	if assert.Nil(t, err) {
+		body, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, plain.Body.String(), string(body))
+	}
+
+	refused := getWithHeaders(r, path, map[string]string{"Accept-Encoding": "gzip;q=0"})
+	assert.Empty(t, refused.Header().Get("Content-Encoding"))
+	assert.Equal(t, plain.Body.Len(), refused.Body.Len())
+}
+
+func TestCompressSkipsSmallResponses(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := getWithHeaders(r, "/faceclaim/list/"+testBucket+"/"+testCharID, map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.JSONEq(t, `{"charid":"`+testCharID+`","faceclaims":[]}`, w.Body.String())
+}
+
+func TestCompressSkipsImageProxy(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useProxyImages(t)
+	r := setupRouter(false)
+	path := seedImage(store, strings.Repeat("webp bytes", 200))
+
+	w := getWithHeaders(r, path, map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Header().Get("Vary"))
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                 false,
+		"gzip":             true,
+		"GZIP":             true,
+		"deflate, gzip":    true,
+		"gzip;q=0":         false,
+		"gzip; q=0.5":      true,
+		"x-gzip":           true,
+		"br":               false,
+		"identity, br;q=1": false,
+		"gzipped, deflate": false,
+	}
+	for header, want := range tests {
+		assert.Equal(t, want, acceptsGzip(header), header)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The topics the delete routes publish to.
+var deleteTopics = []string{"delete-single-faceclaim", "delete-faceclaim-group"}
+
+// The bucket log files are archived to.
+const logBucket = "inconnu-logs"
+
+// A Config holds the settings read from the environment that can change
+// while the server runs, along with the port and the default bucket. Handlers
+// never see one change under them: a new Config is swapped in whole, and
+// those in use are never modified.
+type Config struct {
+	Port            string
+	FaceclaimBucket string
+	KeepOriginals   bool
+
+	// Limits
+	CharMaxImages int
+	DefaultQuota  GuildQuota
+	GuildQuotas   map[string]GuildQuota
+	MinDimension  int
+	MaxImageBytes int64
+	MaxPixels     int64
+
+	// AllowedBuckets limits which buckets faceclaims can be uploaded to,
+	// read from, or deleted from, alongside FaceclaimBucket. When it's
+	// empty, any validly named bucket can be.
+	AllowedBuckets []string
+
+	// Buckets holds the buckets with policies of their own, which are also
+	// allowed
+	Buckets map[string]BucketProfile
+
+	// Quality defaults
+	WebPQuality      int
+	WebPQualityFloor int
+}
+
+// Returns a Config with the defaults for everything that's optional.
+func newConfig() *Config {
+	return &Config{
+		Port:             "8080", // $PORT doesn't need to explicitly be set
+		CharMaxImages:    20,
+		MaxImageBytes:    25 << 20,
+		MaxPixels:        40_000_000,
+		GuildQuotas:      make(map[string]GuildQuota),
+		WebPQuality:      99,
+		WebPQualityFloor: 50,
+	}
+}
+
+// The Config in effect.
+var liveConfig atomic.Value
+
+// Returns the Config in effect. Callers mustn't modify it.
+func currentConfig() *Config {
+	cfg, _ := liveConfig.Load().(*Config)
+	if cfg == nil {
+		return newConfig()
+	}
+	return cfg
+}
+
+// Makes a Config the one in effect.
+func setConfig(cfg *Config) {
+	liveConfig.Store(cfg)
+}
+
+// Reads and validates the settings from the environment. An API token must
+// be available from API_TOKEN, API_TOKEN_PRIMARY, or API_TOKEN_SECRET, but
+// it's read on each request, not kept here.
+func LoadConfig() (*Config, error) {
+	cfg := newConfig()
+	if port, ok := os.LookupEnv("PORT"); ok {
+		cfg.Port = port
+	}
+	_, hasToken := os.LookupEnv("API_TOKEN")
+	_, hasPrimary := os.LookupEnv("API_TOKEN_PRIMARY")
+	if !hasToken && !hasPrimary && os.Getenv("API_TOKEN_SECRET") == "" {
+		return nil, errors.New("API_TOKEN is not set!")
+	}
+	bucket, ok := os.LookupEnv("FACECLAIM_BUCKET")
+	if !ok {
+		return nil, errors.New("FACECLAIM_BUCKET is not set!")
+	}
+	cfg.FaceclaimBucket = bucket
+	if keep, ok := os.LookupEnv("KEEP_ORIGINALS"); ok {
+		var err error
+		if cfg.KeepOriginals, err = strconv.ParseBool(keep); err != nil {
+			return nil, fmt.Errorf("KEEP_ORIGINALS: %v", err)
+		}
+	}
+
+	loaders := []func(*Config) error{
+		loadQuotas,
+		loadCharLimit,
+		loadDimensions,
+		loadImageSize,
+		loadAllowedBuckets,
+		loadBucketProfiles,
+		loadQuality,
+		loadTargetSize,
+	}
+	for _, load := range loaders {
+		if err := load(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// Returns the settings a reload can change, keyed as in configSummary.
+func (c *Config) reloadable() map[string]interface{} {
+	return map[string]interface{}{
+		"faceclaim_bucket":   c.FaceclaimBucket,
+		"keep_originals":     c.KeepOriginals,
+		"char_max_images":    c.CharMaxImages,
+		"guild_max_images":   c.DefaultQuota.MaxImages,
+		"guild_max_bytes":    c.DefaultQuota.MaxBytes,
+		"guild_quotas":       c.GuildQuotas,
+		"min_dimension":      c.MinDimension,
+		"max_image_bytes":    c.MaxImageBytes,
+		"max_pixels":         c.MaxPixels,
+		"allowed_buckets":    c.AllowedBuckets,
+		"buckets":            c.Buckets,
+		"webp_quality":       c.WebPQuality,
+		"webp_quality_floor": c.WebPQualityFloor,
+	}
+}
+
+// Returns the keys of the reloadable settings that differ between two
+// Configs, sorted. Values are compared as printed, so an empty list or map is
+// the same as none.
+func changedSettings(old, new *Config) []string {
+	before, after := old.reloadable(), new.reloadable()
+	var changed []string
+	for key, value := range after {
+		if fmt.Sprint(before[key]) != fmt.Sprint(value) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Returns the resolved configuration, with secrets redacted.
+func configSummary() map[string]interface{} {
+	cfg := currentConfig()
+	token := "unset"
+	if currentAPIToken() != "" {
+		token = "redacted"
+	}
+	secondary := "unset"
+	if os.Getenv("API_TOKEN_SECONDARY") != "" {
+		secondary = "redacted"
+	}
+	moderation := "disabled"
+	if ImageModerator != nil {
+		moderation = "vision"
+	}
+	var watermarks []string
+	for name := range Watermarks {
+		watermarks = append(watermarks, name)
+	}
+	sort.Strings(watermarks)
+
+	return map[string]interface{}{
+		"project":              ProjectID,
+		"port":                 cfg.Port,
+		"api_token":            token,
+		"api_token_secondary":  secondary,
+		"auth_mode":            AuthMode,
+		"auth_ban_threshold":   AuthBanThreshold,
+		"auth_ban_window":      AuthBanWindow.String(),
+		"auth_ban_duration":    AuthBanDuration.String(),
+		"api_token_secret":     APITokenSecret,
+		"faceclaim_bucket":     cfg.FaceclaimBucket,
+		"jobs_bucket":          Jobs.bucket,
+		"log_bucket":           logBucket,
+		"keep_originals":       cfg.KeepOriginals,
+		"moderation":           moderation,
+		"moderation_threshold": ModerationThreshold.String(),
+		"watermarks":           watermarks,
+		"guild_max_images":     cfg.DefaultQuota.MaxImages,
+		"guild_max_bytes":      cfg.DefaultQuota.MaxBytes,
+		"guild_quota_count":    len(cfg.GuildQuotas),
+		"char_max_images":      cfg.CharMaxImages,
+		"webp_quality":         cfg.WebPQuality,
+		"webp_quality_floor":   cfg.WebPQualityFloor,
+		"buckets":              cfg.Buckets,
+		"cwebp_version":        EncoderVersion,
+		"cwebp_method":         cwebpMethod,
+		"self_test":            SelfTest,
+		"min_dimension":        cfg.MinDimension,
+		"max_image_bytes":      cfg.MaxImageBytes,
+		"max_pixels":           cfg.MaxPixels,
+		"fetch_allowed_hosts":  FetchAllowedHosts,
+		"max_fetch_redirects":  FetchMaxRedirects,
+		"image_types":          supportedTypeNames(),
+		"faceclaim_storage":    FaceclaimStorageClass,
+		"log_storage":          LogStorageClass,
+		"log_layout":           LogLayout,
+		"log_max_bytes":        MaxRawLogBytes,
+		"min_savings_percent":  MinSavingsPercent,
+		"backup_bucket":        BackupBucket,
+		"backup_prefix":        BackupPrefix,
+		"key_pattern":          KeyPattern.String(),
+		"allow_test_charid":    AllowTestCharID,
+		"deterministic_ids":    DeterministicIDs,
+		"request_timeout":      RequestTimeout.String(),
+		"upload_timeout":       UploadTimeout.String(),
+		"upload_concurrency":   UploadConcurrency,
+		"upload_queue_size":    UploadQueueSize,
+		"upload_queue_wait":    UploadQueueWait.String(),
+		"attr_cache_size":      AttrCacheSize,
+		"attr_cache_ttl":       AttrCacheTTL.String(),
+		"maintenance":          maintenanceMode.Load(),
+		"read_only":            readOnlyMode.Load(),
+		"admin_port":           AdminPort,
+		"trusted_proxies":      TrustedProxies,
+		"trusted_platform":     TrustedPlatform,
+		"pubsub_push":          PushAuth != nil,
+		"gcs_notify":           GCSNotifyToken != "",
+		"mongo":                Records != nil,
+		"delete_journal":       DeleteJournalPath,
+		"delete_journal_size":  DeleteJournalSize,
+		"delete_journal_retry": DeleteJournalRetry.String(),
+		"delete_lock_ttl":      DeleteLockTTL.String(),
+		"delete_lock_wait":     DeleteLockWait.String(),
+		"delete_subscriptions": DeleteSubscriptions,
+		"delete_backlog_max":   DeleteBacklogMax,
+		"backlog_max_age":      DeleteBacklogMaxAge.String(),
+		"legacy_msg_fields":    LegacyMessageFields,
+		"usage_snapshot":       UsageSnapshotInterval.String(),
+		"usage_object":         usageObjectSummary(),
+		"bucket_stats":         BucketStatsInterval.String(),
+		"metadata_max_bytes":   MetadataMaxBytes,
+		"upload_events":        PublishUploadEvents,
+		"tracing":              TracingEnabled,
+		"debug_dump":           debugDump.Load(),
+		"proxy_images":         ProxyImages,
+		"list_cache_ttl":       ListCacheTTL.String(),
+		"strict_public_check":  StrictPublicCheck,
+		"public_check_ttl":     PublicCheckInterval.String(),
+	}
+}
+
+// Logs the resolved configuration as a single JSON line.
+func logStartupBanner() {
+	summary, err := json.Marshal(configSummary())
+	if err != nil {
+		log.Println("Unable to summarize config:", err)
+		return
+	}
+	log.Println("Starting with config:", string(summary))
+}
+
+// Validates the configuration and verifies that the buckets, topics, and
+// converter it depends on are usable, writing a report to w. Returns the
+// process exit code: 0 if every check passed, 1 otherwise.
+func checkConfig(w io.Writer) int {
+	if err := prepareEnvVars(); err != nil {
+		fmt.Fprintln(w, "FAIL config:", err)
+		return 1
+	}
+	fmt.Fprintln(w, "ok   config")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	failed := false
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %v: %v\n", name, err)
+			failed = true
+		} else {
+			fmt.Fprintf(w, "ok   %v\n", name)
+		}
+	}
+
+	buckets := []string{currentConfig().FaceclaimBucket, logBucket}
+	if Jobs.bucket != "" {
+		buckets = append(buckets, Jobs.bucket)
+	}
+	for _, bucket := range buckets {
+		report("bucket "+bucket, Store.CheckBucket(ctx, bucket))
+	}
+	for _, topic := range deleteTopics {
+		report("topic "+topic, MessagePublisher.CheckTopic(ctx, topic))
+	}
+	report("converter", checkConverter(ctx))
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// Converts a tiny image to make sure the converter runs.
+func checkConverter(ctx context.Context) error {
+	var src bytes.Buffer
+	if err := png.Encode(&src, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		return fmt.Errorf("png.Encode: %v", err)
+	}
+	var dst bytes.Buffer
+	if err := ImageConverter.Convert(ctx, &src, &dst, currentConfig().WebPQuality); err != nil {
+		return err
+	}
+	if dst.Len() == 0 {
+		return errors.New("the converter produced no output")
+	}
+	return nil
+}
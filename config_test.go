@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenConverter fails every conversion, like a missing cwebp binary.
+type brokenConverter struct{}
+
+func (brokenConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	return errors.New("cwebp: not found")
+}
+
+// Swap in a changed copy of the config for the duration of a test
+func useConfig(t testing.TB, change func(cfg *Config)) {
+	old := currentConfig()
+	cfg := *old
+	change(&cfg)
+	setConfig(&cfg)
+	t.Cleanup(func() { setConfig(old) })
+}
+
+// Set the required env vars for the duration of a test
+func useRequiredEnv(t *testing.T) {
+	os.Setenv("API_TOKEN", "")
+	os.Setenv("FACECLAIM_BUCKET", testBucket)
+	t.Cleanup(func() {
+		os.Unsetenv("API_TOKEN")
+		os.Unsetenv("FACECLAIM_BUCKET")
+	})
+}
+
+func TestCheckConfigHealthy(t *testing.T) {
+	useFakeBackends(t)
+	useRequiredEnv(t)
+
+	var report bytes.Buffer
+	assert.Equal(t, 0, checkConfig(&report))
+	assert.NotContains(t, report.String(), "FAIL")
+	assert.Contains(t, report.String(), "ok   bucket "+testBucket)
+	assert.Contains(t, report.String(), "ok   topic delete-faceclaim-group")
+	assert.Contains(t, report.String(), "ok   converter")
+}
+
+func TestCheckConfigInvalid(t *testing.T) {
+	useFakeBackends(t)
+
+	var report bytes.Buffer
+	assert.Equal(t, 1, checkConfig(&report))
+	assert.Contains(t, report.String(), "FAIL config")
+}
+
+func TestCheckConfigUnreachable(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	useRequiredEnv(t)
+
+	store.missing = map[string]bool{testBucket: true}
+	publisher.err = errors.New("permission denied")
+	ImageConverter = brokenConverter{}
+
+	var report bytes.Buffer
+	assert.Equal(t, 1, checkConfig(&report))
+	assert.Contains(t, report.String(), "FAIL bucket "+testBucket)
+	assert.Contains(t, report.String(), "ok   bucket "+logBucket)
+	assert.Contains(t, report.String(), "FAIL topic delete-single-faceclaim")
+	assert.Contains(t, report.String(), "FAIL converter")
+}
+
+func TestConfigSummaryRedactsSecrets(t *testing.T) {
+	os.Setenv("API_TOKEN", "hunter2")
+	defer os.Unsetenv("API_TOKEN")
+
+	summary, err := json.Marshal(configSummary())
+	assert.Nil(t, err)
+	assert.NotContains(t, string(summary), "hunter2")
+	assert.Contains(t, string(summary), `"api_token":"redacted"`)
+	assert.Contains(t, string(summary), `"faceclaim_bucket":"`+testBucket+`"`)
+}
+
+// Uploads race config reloads and token refreshes. Under -race, this fails if
+// handlers read any setting that a reload writes in place.
+func TestConfigReloadUnderLoad(t *testing.T) {
+	useFakeBackends(t)
+	useRequiredEnv(t)
+	useSecretToken(t, "hunter2")
+	useConfig(t, func(cfg *Config) {})
+	os.Setenv("PORT", "9999")
+	t.Cleanup(func() {
+		os.Unsetenv("PORT")
+		os.Unsetenv("KEEP_ORIGINALS")
+	})
+	r := setupRouter(false)
+
+	var image bytes.Buffer
+	png.Encode(&image, gradientImage())
+	server := serveImage(image.Bytes())
+	defer server.Close()
+
+	stop, reloads := make(chan struct{}), make(chan int)
+	go func() {
+		count := 0
+		for {
+			select {
+			case <-stop:
+				reloads <- count
+				return
+			default:
+			}
+			os.Setenv("KEEP_ORIGINALS", strconv.FormatBool(count%2 == 0))
+			_, _, err := reloadConfig()
+			assert.NoError(t, err)
+			assert.NoError(t, refreshAPIToken(context.Background()))
+			count++
+		}
+	}()
+
+	// 16 uploads, within the character's limit of 20
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				request := createFaceclaimRequest(testBucket)
+				request.ImageURL = server.URL
+				body, _ := json.Marshal(request)
+				req, _ := http.NewRequest("POST", "/faceclaim/upload", bytes.NewReader(body))
+				req.Header.Set("Authorization", "hunter2")
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				assert.Equal(t, 201, w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+
+	assert.Positive(t, <-reloads)
+	assert.Equal(t, "8080", currentConfig().Port, "Reloads shouldn't move the listener")
+	assert.Equal(t, testBucket, currentConfig().FaceclaimBucket)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// How many objects a Content-Type fix lists at a time. Its progress, and
+	// the token to resume it from, is updated after each page.
+	contentTypePageSize = 500
+
+	// How many GCS requests a second a Content-Type fix makes by default.
+	defaultContentTypeRate = 10
+)
+
+// A ContentTypeRequest is the POST body for /admin/fix-content-type.
+type ContentTypeRequest struct {
+	Bucket string `json:"bucket" binding:"required"`
+	Prefix string `json:"prefix"`
+
+	// Report what would be fixed without changing anything
+	DryRun bool `json:"dry_run"`
+
+	// The page to start from, to resume a fix that was interrupted
+	PageToken string `json:"page_token"`
+
+	// How many GCS requests to make a second. Defaults to 10.
+	Rate int `json:"rate" binding:"min=0"`
+}
+
+// A ContentTypeError is an object that couldn't be checked or fixed.
+type ContentTypeError struct {
+	Object string `json:"object"`
+	Error  string `json:"error"`
+}
+
+// A ContentTypeResult counts the objects a Content-Type fix has checked:
+// those whose type was wrong, and of them those that were fixed; those whose
+// type couldn't be told; and those that couldn't be checked or fixed.
+type ContentTypeResult struct {
+	Bucket   string             `json:"bucket"`
+	Prefix   string             `json:"prefix,omitempty"`
+	DryRun   bool               `json:"dry_run"`
+	Checked  int                `json:"checked"`
+	Mistyped int                `json:"mistyped"`
+	Fixed    int                `json:"fixed"`
+	Unknown  int                `json:"unknown"`
+	Failed   int                `json:"failed"`
+	Errors   []ContentTypeError `json:"errors,omitempty"`
+
+	// The page the fix will go on to, to resume it from if it's interrupted.
+	// Empty once it's done.
+	PageToken string `json:"page_token,omitempty"`
+}
+
+// Sets the Content-Type of the objects in a bucket, or under a prefix, whose
+// type is missing or doesn't match their extension, as with some uploaded by
+// early versions. Objects without a known extension are sniffed if they have
+// no type. It runs in the background, returning a job whose progress has the
+// page token to resume from.
+func fixContentTypes(c *gin.Context) {
+	var request ContentTypeRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBucketName(request.Bucket); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Rate == 0 {
+		request.Rate = defaultContentTypeRate
+	}
+	tagRequest(c, "bucket", request.Bucket)
+
+	job := startTrackedJob(func(progress func(interface{})) (interface{}, error) {
+		// The job outlives the request and may take a long time, so it isn't
+		// given a deadline
+		return fixBucketContentTypes(context.Background(), request, func(result ContentTypeResult) {
+			progress(result)
+		})
+	})
+	respond(c, http.StatusAccepted, job)
+}
+
+// Works through a bucket a page at a time, passing the running result to
+// progress after each.
+func fixBucketContentTypes(ctx context.Context, request ContentTypeRequest, progress func(ContentTypeResult)) (ContentTypeResult, error) {
+	result := ContentTypeResult{
+		Bucket:    request.Bucket,
+		Prefix:    request.Prefix,
+		DryRun:    request.DryRun,
+		PageToken: request.PageToken,
+	}
+	limiter := time.NewTicker(time.Second / time.Duration(request.Rate))
+	defer limiter.Stop()
+	wait := func() error {
+		select {
+		case <-limiter.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		if err := wait(); err != nil {
+			return result, err
+		}
+		objects, next, err := Store.ListPage(ctx, request.Bucket, request.Prefix, result.PageToken, contentTypePageSize)
+		if err != nil {
+			return result, fmt.Errorf("fixBucketContentTypes: %v", err)
+		}
+		for _, attrs := range objects {
+			result.Checked++
+			expected, err := expectedContentType(ctx, attrs, wait)
+			switch {
+			case err != nil:
+			case expected == "":
+				result.Unknown++
+			case expected != attrs.ContentType:
+				result.Mistyped++
+				if request.DryRun {
+					break
+				}
+				if err = wait(); err != nil {
+					break
+				}
+				if _, err = Store.SetContentType(ctx, request.Bucket, attrs.Name, expected); err == nil {
+					attrCache.invalidate(request.Bucket, attrs.Name)
+					log.Printf("Set %v's Content-Type from %q to %v\n", attrs.Name, attrs.ContentType, expected)
+					result.Fixed++
+				}
+			}
+			if err != nil {
+				result.Failed++
+				result.Errors = append(result.Errors, ContentTypeError{Object: attrs.Name, Error: err.Error()})
+			}
+		}
+		result.PageToken = next
+		progress(result)
+		if next == "" {
+			return result, nil
+		}
+	}
+}
+
+// The Content-Types of the extensions this service stores.
+var extensionTypes = map[string]string{
+	"webp": "image/webp",
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+	"bmp":  "image/bmp",
+}
+
+// Returns the Content-Type an object should have, going by its extension.
+// Objects with another extension are sniffed if they have no type, or the
+// catch-all application/octet-stream; wait is called before downloading
+// them. Empty means it can't be told.
+func expectedContentType(ctx context.Context, attrs *storage.ObjectAttrs, wait func() error) (string, error) {
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(attrs.Name), "."))
+	if contentType, ok := extensionTypes[extension]; ok {
+		return contentType, nil
+	}
+	if attrs.ContentType != "" && attrs.ContentType != "application/octet-stream" {
+		return "", nil
+	}
+	if err := wait(); err != nil {
+		return "", err
+	}
+	data, err := Store.Download(ctx, attrs.Bucket, attrs.Name)
+	if err != nil {
+		return "", err
+	}
+	if contentType := sniffImageType(data); supportedImageTypes[contentType] != "" {
+		return contentType, nil
+	}
+	return "", nil
+}
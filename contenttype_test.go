@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Seed the fake bucket with objects typed rightly and wrongly
+func seedContentTypes(store *memStorage) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	store.Upload(ctx, testBucket, "__test/a.webp", strings.NewReader("webp"), UploadOptions{})
+	store.Upload(ctx, testBucket, "__test/a.orig.png", strings.NewReader("png"), UploadOptions{ContentType: "application/octet-stream"})
+	store.Upload(ctx, testBucket, "__test/b.webp", strings.NewReader("webp"), UploadOptions{ContentType: "image/webp"})
+	store.Upload(ctx, testBucket, "__test/c", bytes.NewReader(buf.Bytes()), UploadOptions{})
+	store.Upload(ctx, testBucket, "__test/notes.txt", strings.NewReader("text"), UploadOptions{})
+}
+
+func contentType(store *memStorage, object string) string {
+	attrs, _ := store.Attrs(context.Background(), testBucket, object)
+	return attrs.ContentType
+}
+
+func TestFixContentType(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	seedContentTypes(store)
+	r := setupRouter(false)
+
+	body := strings.NewReader(`{"bucket": "` + testBucket + `", "rate": 1000}`)
+	w := performRequest(r, "POST", "/admin/fix-content-type", body)
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	status := waitForJob(t, r, job.ID)
+	assert.Equal(t, string(JobSucceeded), status["status"], status["error"])
+
+	var result ContentTypeResult
+	data, _ := json.Marshal(status["result"])
+	json.Unmarshal(data, &result)
+	assert.Equal(t, 5, result.Checked)
+	assert.Equal(t, 3, result.Mistyped)
+	assert.Equal(t, 3, result.Fixed)
+	assert.Equal(t, 1, result.Unknown, "Text can't be told from its bytes")
+	assert.Zero(t, result.Failed)
+	assert.Empty(t, result.PageToken)
+
+	assert.Equal(t, "image/webp", contentType(store, "__test/a.webp"))
+	assert.Equal(t, "image/png", contentType(store, "__test/a.orig.png"))
+	assert.Equal(t, "image/png", contentType(store, "__test/c"), "Objects without an extension are sniffed")
+	assert.Empty(t, contentType(store, "__test/notes.txt"))
+}
+
+func TestFixContentTypeDryRun(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	seedContentTypes(store)
+
+	request := ContentTypeRequest{Bucket: testBucket, Prefix: "__test/a", DryRun: true, Rate: 1000}
+	var pages int
+	result, err := fixBucketContentTypes(context.Background(), request, func(ContentTypeResult) { pages++ })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pages)
+	assert.Equal(t, 2, result.Checked)
+	assert.Equal(t, 2, result.Mistyped)
+	assert.Zero(t, result.Fixed)
+	assert.Empty(t, contentType(store, "__test/a.webp"), "Nothing changes in a dry run")
+}
+
+func TestFixContentTypeResume(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	seedContentTypes(store)
+
+	// The objects up to the token were done before it was interrupted
+	request := ContentTypeRequest{Bucket: testBucket, PageToken: "__test/a.webp", Rate: 1000}
+	result, err := fixBucketContentTypes(context.Background(), request, func(ContentTypeResult) {})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Checked)
+	assert.Equal(t, 1, result.Fixed)
+	assert.Empty(t, contentType(store, "__test/a.webp"))
+	assert.Equal(t, "application/octet-stream", contentType(store, "__test/a.orig.png"))
+	assert.Equal(t, "image/png", contentType(store, "__test/c"))
+}
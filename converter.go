@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nickalie/go-webpbin"
+)
+
+// A Converter encodes source images as WebP at the given quality, from 1 to
+// 100. Cancelling the context abandons the conversion.
+type Converter interface {
+	Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error
+}
+
+// ImageConverter is the Converter used by the faceclaim pipeline.
+var ImageConverter Converter = cwebpConverter{}
+
+// Reads WEBP_QUALITY, the quality new uploads are encoded at, which defaults
+// to 99.
+func loadQuality(cfg *Config) error {
+	if value, ok := os.LookupEnv("WEBP_QUALITY"); ok {
+		quality, err := strconv.Atoi(value)
+		if err != nil || quality < 1 || quality > 100 {
+			return errors.New("WEBP_QUALITY must be between 1 and 100")
+		}
+		cfg.WebPQuality = quality
+	}
+	return nil
+}
+
+// cwebpConverter shells out to cwebp, downloading it first if necessary.
+type cwebpConverter struct{}
+
+func (cwebpConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("cwebp: %w", err)
+	}
+	path, err := cwebpBinary()
+	if err != nil {
+		return fmt.Errorf("cwebp: %v", err)
+	}
+	args := []string{"-quiet", "-q", strconv.Itoa(quality), "-m", strconv.Itoa(cwebpMethod), "-o", "-", "--", "-"}
+	if err := runProcess(ctx, path, args, src, dst); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("cwebp: %w", ctx.Err())
+		}
+		return fmt.Errorf("cwebp: %v", err)
+	}
+	return nil
+}
+
+func (cwebpConverter) Version(ctx context.Context) (string, error) {
+	path, err := cwebpBinary()
+	if err != nil {
+		return "", fmt.Errorf("cwebp: %v", err)
+	}
+	var out bytes.Buffer
+	if err := runProcess(ctx, path, []string{"-version"}, nil, &out); err != nil {
+		return "", fmt.Errorf("cwebp: %v", err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// The compression effort cwebp is run with, from 0 (fastest) to 6. This is
+// cwebp's default, passed explicitly so the recorded settings are the ones
+// used.
+const cwebpMethod = 4
+
+// A versionedConverter can report the version of the encoder behind it.
+type versionedConverter interface {
+	Version(ctx context.Context) (string, error)
+}
+
+// EncoderVersion is the version of the encoder ImageConverter runs, captured
+// at startup. webpbin downloads whichever cwebp it likes, so recording it
+// shows whether a quality regression came with a new encoder.
+var EncoderVersion = "unknown"
+
+// Captures EncoderVersion from ImageConverter and logs it. A converter that
+// can't say leaves it "unknown".
+func detectEncoderVersion(ctx context.Context) {
+	EncoderVersion = "unknown"
+	versioned, ok := ImageConverter.(versionedConverter)
+	if !ok {
+		return
+	}
+	version, err := versioned.Version(ctx)
+	if err != nil {
+		log.Println("Unable to read the encoder's version:", err)
+		return
+	}
+	if version != "" {
+		EncoderVersion = version
+	}
+	log.Println("Encoding with cwebp", EncoderVersion)
+}
+
+// EncoderSettings are the effective settings an object was encoded with.
+type EncoderSettings struct {
+	Version  string `json:"version"`
+	Quality  int    `json:"quality"`
+	Method   int    `json:"method"`
+	Lossless bool   `json:"lossless"`
+	// How the image was resized before encoding: "none", or "fit:<size>"
+	// for variants scaled to fit a square of that size
+	Resize string `json:"resize"`
+}
+
+// Returns the settings of an encode at quality, resized as described.
+func encoderSettings(quality int, resize string) EncoderSettings {
+	return EncoderSettings{
+		Version: EncoderVersion,
+		Quality: quality,
+		Method:  cwebpMethod,
+		Resize:  resize,
+	}
+}
+
+// Stamps the settings into object metadata. The quality goes in "quality",
+// as it always has; the rest are prefixed with "encoder_".
+func (s EncoderSettings) stamp(metadata map[string]string) {
+	metadata["quality"] = strconv.Itoa(s.Quality)
+	metadata["encoder_version"] = s.Version
+	metadata["encoder_method"] = strconv.Itoa(s.Method)
+	metadata["encoder_lossless"] = strconv.FormatBool(s.Lossless)
+	metadata["encoder_resize"] = s.Resize
+}
+
+// Reads the settings stamped into object metadata, or nil for objects
+// encoded before they were recorded.
+func stampedSettings(metadata map[string]string) *EncoderSettings {
+	version, ok := metadata["encoder_version"]
+	if !ok {
+		return nil
+	}
+	s := EncoderSettings{Version: version, Resize: metadata["encoder_resize"]}
+	s.Quality, _ = strconv.Atoi(metadata["quality"])
+	s.Method, _ = strconv.Atoi(metadata["encoder_method"])
+	s.Lossless, _ = strconv.ParseBool(metadata["encoder_lossless"])
+	return &s
+}
+
+// Reports the encoder's version and the settings new uploads are encoded
+// with.
+func getVersion(c *gin.Context) {
+	respond(c, http.StatusOK, gin.H{
+		"cwebp":   EncoderVersion,
+		"encoder": encoderSettings(currentConfig().WebPQuality, "none"),
+	})
+}
+
+// Returns the path to cwebp. Tests swap it for a stand-in.
+var cwebpBinary = ensureCWebP
+
+var (
+	cwebpOnce sync.Once
+	cwebpPath string
+	cwebpErr  error
+)
+
+// Returns the path to cwebp, downloading it on first use unless
+// SKIP_DOWNLOAD is set (as it is in the container, which installs it).
+func ensureCWebP() (string, error) {
+	cwebpOnce.Do(func() {
+		cwebp := webpbin.NewCWebP()
+		cwebpPath = cwebp.Path()
+		if _, err := os.Stat(cwebpPath); err == nil {
+			return
+		}
+		// Running it is the only way webpbin exposes to fetch it
+		if _, err := cwebp.Version(); err != nil {
+			cwebpErr = fmt.Errorf("webpbin: %v", err)
+			return
+		}
+		cwebpPath = cwebp.Path()
+	})
+	return cwebpPath, cwebpErr
+}
+
+// The processes runProcess has started and not yet reaped, by PID.
+var processes = struct {
+	sync.Mutex
+	live map[int]struct{}
+}{live: make(map[int]struct{})}
+
+// Returns the PIDs of the processes that haven't been reaped yet.
+func liveProcesses() []int {
+	processes.Lock()
+	defer processes.Unlock()
+	var pids []int
+	for pid := range processes.live {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// Runs a program in its own process group, feeding it stdin and copying its
+// output to stdout. If the context is cancelled first, the whole group is
+// killed, so helpers it spawned don't outlive it either. The process is
+// always waited on, so it never lingers as a zombie.
+func runProcess(ctx context.Context, path string, args []string, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	pid := cmd.Process.Pid
+	processes.Lock()
+	processes.live[pid] = struct{}{}
+	processes.Unlock()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// A negative PID signals the group, whose ID is the child's PID
+		syscall.Kill(-pid, syscall.SIGKILL)
+		err = <-done
+	}
+
+	processes.Lock()
+	delete(processes.live, pid)
+	processes.Unlock()
+
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %v", err, msg)
+		}
+		return err
+	}
+	return nil
+}
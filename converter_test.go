@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Stand in for cwebp with a script that reads its input slowly, and spawns a
+// helper, so conversions can be cancelled part way through
+func useSlowCWebP(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "cwebp")
+	body := "#!/bin/sh\nsleep 30 &\nwhile dd bs=4096 count=1 of=/dev/null 2>/dev/null; do sleep 0.01; done\nwait\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cwebpBinary = func() (string, error) { return script, nil }
+	t.Cleanup(func() { cwebpBinary = ensureCWebP })
+}
+
+// A 4MB PNG, left uncompressed so it's quick to make
+func largeImage() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 1024, 1024))
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	encoder.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func TestConvertCancelledKillsProcess(t *testing.T) {
+	useSlowCWebP(t)
+	src := largeImage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- cwebpConverter{}.Convert(ctx, bytes.NewReader(src), io.Discard, currentConfig().WebPQuality)
+	}()
+
+	var pids []int
+	eventually(t, func() bool {
+		pids = liveProcesses()
+		return len(pids) == 1
+	})
+	if len(pids) == 0 {
+		t.FailNow()
+	}
+	cancel()
+
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The conversion wasn't abandoned")
+	}
+	assert.Empty(t, liveProcesses())
+	// Once reaped, the PID no longer exists, even as a zombie
+	assert.ErrorIs(t, syscall.Kill(pids[0], 0), syscall.ESRCH)
+}
+
+func TestConvertDeadlineKillsProcess(t *testing.T) {
+	useSlowCWebP(t)
+	src := largeImage()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := cwebpConverter{}.Convert(ctx, bytes.NewReader(src), io.Discard, currentConfig().WebPQuality)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, liveProcesses())
+}
+
+func TestRunProcessReportsFailure(t *testing.T) {
+	err := runProcess(context.Background(), "/bin/sh", []string{"-c", "echo bad input >&2; exit 2"}, nil, io.Discard)
+	assert.ErrorContains(t, err, "bad input")
+	assert.Empty(t, liveProcesses())
+}
+
+func TestCWebPVersion(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "cwebp")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n[ \"$1\" = -version ] && echo 1.3.2\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cwebpBinary = func() (string, error) { return script, nil }
+	t.Cleanup(func() { cwebpBinary = ensureCWebP })
+
+	version, err := cwebpConverter{}.Version(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "1.3.2", version)
+}
+
+func TestEncoderSettingsRecorded(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	detectEncoderVersion(context.Background())
+	t.Cleanup(func() { EncoderVersion = "unknown" })
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16"}
+	response := uploadTestImage(t, r, request)
+	key := objectKey(testBucket, response.URL)
+
+	attrs, _ := store.Attrs(context.Background(), testBucket, key)
+	assert.Equal(t, "fake 1.0", attrs.Metadata["encoder_version"])
+	assert.Equal(t, strconv.Itoa(currentConfig().WebPQuality), attrs.Metadata["quality"])
+	assert.Equal(t, strconv.Itoa(cwebpMethod), attrs.Metadata["encoder_method"])
+	assert.Equal(t, "false", attrs.Metadata["encoder_lossless"])
+	assert.Equal(t, "none", attrs.Metadata["encoder_resize"])
+
+	variant, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.Variants["16"]))
+	assert.Equal(t, "fake 1.0", variant.Metadata["encoder_version"])
+	assert.Equal(t, "fit:16", variant.Metadata["encoder_resize"])
+
+	w := performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/"+key, nil)
+	assert.Equal(t, 200, w.Code)
+	var metadata FaceclaimMetadata
+	json.Unmarshal(w.Body.Bytes(), &metadata)
+	assert.Equal(t, &EncoderSettings{Version: "fake 1.0", Quality: currentConfig().WebPQuality, Method: cwebpMethod, Resize: "none"}, metadata.Encoder)
+
+	w = performRequest(r, "GET", "/version", nil)
+	assert.Equal(t, 200, w.Code)
+	var version struct {
+		CWebP   string          `json:"cwebp"`
+		Encoder EncoderSettings `json:"encoder"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &version)
+	assert.Equal(t, "fake 1.0", version.CWebP)
+	assert.Equal(t, EncoderSettings{Version: "fake 1.0", Quality: currentConfig().WebPQuality, Method: cwebpMethod, Resize: "none"}, version.Encoder)
+}
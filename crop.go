@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// A Crop is the region of the source image to keep, in pixels from its
+// top-left corner. It's applied after the image is turned upright, and before
+// it's watermarked or converted.
+type Crop struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Checks what can be checked without the image.
+func (c Crop) validate() error {
+	if c.X < 0 || c.Y < 0 {
+		return errors.New("crop x and y can't be negative")
+	}
+	if c.Width <= 0 || c.Height <= 0 {
+		return errors.New("crop width and height must be positive")
+	}
+	return nil
+}
+
+func (c Crop) rect() image.Rectangle {
+	return image.Rect(c.X, c.Y, c.X+c.Width, c.Y+c.Height)
+}
+
+// Formats the crop for object metadata, so re-encoding can apply it again.
+func (c Crop) String() string {
+	return fmt.Sprintf("%v,%v,%v,%v", c.X, c.Y, c.Width, c.Height)
+}
+
+// Parses a crop from object metadata.
+func parseCrop(value string) (Crop, error) {
+	var c Crop
+	if _, err := fmt.Sscanf(value, "%d,%d,%d,%d", &c.X, &c.Y, &c.Width, &c.Height); err != nil {
+		return Crop{}, fmt.Errorf("invalid crop %q: %v", value, err)
+	}
+	return c, c.validate()
+}
+
+// A CropError means a crop doesn't fit within the image.
+type CropError struct {
+	Crop   Crop
+	Width  int
+	Height int
+}
+
+func (e *CropError) Error() string {
+	return fmt.Sprintf("the crop (%v,%v %vx%v) doesn't fit within the %vx%v image",
+		e.Crop.X, e.Crop.Y, e.Crop.Width, e.Crop.Height, e.Width, e.Height)
+}
+
+// Crops an image, returning the region as a PNG. Regions that don't fit
+// within the image are rejected with a CropError.
+func cropImage(data []byte, crop Crop) ([]byte, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	region := crop.rect().Add(bounds.Min)
+	if !region.In(bounds) {
+		return nil, &CropError{Crop: crop, Width: bounds.Dx(), Height: bounds.Dy()}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, crop.Width, crop.Height))
+	draw.Copy(dst, image.Point{}, img, region, draw.Src, nil)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, fmt.Errorf("png.Encode: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// How an image is fitted: "contain" keeps its aspect ratio, and "square"
+// center-crops it to the largest square it holds, for use as an avatar.
+const (
+	fitContain = "contain"
+	fitSquare  = "square"
+)
+
+// Checks a requested fit. Empty means contain.
+func validateFit(fit string) error {
+	switch fit {
+	case "", fitContain, fitSquare:
+		return nil
+	}
+	return fmt.Errorf("unknown fit %q; must be %v or %v", fit, fitContain, fitSquare)
+}
+
+// A FitError means an image can't be fitted as requested.
+type FitError struct {
+	Fit    string
+	Reason string
+}
+
+func (e *FitError) Error() string {
+	return fmt.Sprintf("can't fit the image to %v: %v", e.Fit, e.Reason)
+}
+
+// Returns the largest square centered in a width x height image.
+func squareCrop(width, height int) Crop {
+	if width > height {
+		return Crop{X: (width - height) / 2, Width: height, Height: height}
+	}
+	return Crop{Y: (height - width) / 2, Width: width, Height: width}
+}
+
+// Center-crops an image to a square, returning it as a PNG. Images already
+// square are returned as is. Only the first frame of an animated image would
+// survive, so animated WebPs are rejected with a FitError.
+func squareImage(data []byte) ([]byte, error) {
+	if isAnimatedWebP(data) {
+		return nil, &FitError{Fit: fitSquare, Reason: "animated WebPs can't be cropped"}
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image.DecodeConfig: %v", err)
+	}
+	if config.Width == config.Height {
+		return data, nil
+	}
+	return cropImage(data, squareCrop(config.Width, config.Height))
+}
+
+// Reports whether data is an animated WebP: one with a VP8X header whose
+// animation flag is set.
+func isAnimatedWebP(data []byte) bool {
+	if len(data) < 21 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" || string(data[12:16]) != "VP8X" {
+		return false
+	}
+	return data[20]&0x02 != 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadCrop(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Crop = &Crop{X: 4, Y: 2, Width: 10, Height: 8}
+	response := uploadTestImage(t, r, request)
+	assert.Equal(t, 10, response.Width)
+	assert.Equal(t, 8, response.Height)
+
+	key := objectKey(testBucket, response.URL)
+	data, _ := store.Download(context.Background(), testBucket, key)
+	img, err := decodeImage(data)
+	if !assert.Nil(t, err) {
+		return
+	}
+	source := gradientImage()
+	for _, p := range [][2]int{{0, 0}, {9, 7}, {3, 5}} {
+		r1, g1, b1, _ := img.At(p[0], p[1]).RGBA()
+		r2, g2, b2, _ := source.At(p[0]+4, p[1]+2).RGBA()
+		assert.Equal(t, [3]uint32{r2, g2, b2}, [3]uint32{r1, g1, b1}, "Pixel %v should come from the cropped region", p)
+	}
+
+	attrs, _ := store.Attrs(context.Background(), testBucket, key)
+	crop, err := parseCrop(attrs.Metadata["crop"])
+	assert.Nil(t, err)
+	assert.Equal(t, *request.Crop, crop)
+}
+
+func TestUploadCropOutOfBounds(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Crop = &Crop{X: 30, Y: 0, Width: 10, Height: 10}
+	w := postTestImage(r, request)
+
+	assert.Equal(t, 400, w.Code)
+	var body struct {
+		Code   string `json:"code"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, "crop_out_of_bounds", body.Code)
+	assert.Equal(t, 32, body.Width)
+	assert.Equal(t, 24, body.Height)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestUploadRejectsInvalidCrop(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	for _, crop := range []Crop{{X: -1, Width: 1, Height: 1}, {Width: 0, Height: 5}} {
+		request := createFaceclaimRequest(testBucket)
+		request.Crop = &crop
+		assert.Equal(t, 400, postTestImage(r, request).Code, crop)
+	}
+}
+
+// Post an upload of the given source bytes
+func postImageBytes(r http.Handler, request *FaceclaimRequest, data []byte) *httptest.ResponseRecorder {
+	server := serveImage(data)
+	defer server.Close()
+
+	request.ImageURL = server.URL
+	body, _ := json.Marshal(request)
+	return performRequest(r, "POST", "/faceclaim/upload", bytes.NewReader(body))
+}
+
+func TestUploadSquare(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	for name, size := range map[string]image.Point{"landscape": {32, 24}, "portrait": {20, 30}} {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, size.X, size.Y)))
+		request := createFaceclaimRequest(testBucket)
+		request.Fit = "square"
+		w := postImageBytes(r, request, buf.Bytes())
+
+		assert.Equal(t, 201, w.Code, name)
+		response := getFaceclaimResponse(w.Body)
+		side := size.X
+		if size.Y < side {
+			side = size.Y
+		}
+		assert.Equal(t, side, response.Width, name)
+		assert.Equal(t, response.Width, response.Height, name)
+		attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+		assert.Equal(t, "square", attrs.Metadata["fit"], name)
+	}
+}
+
+func TestSquareCrop(t *testing.T) {
+	assert.Equal(t, Crop{X: 4, Width: 24, Height: 24}, squareCrop(32, 24))
+	assert.Equal(t, Crop{Y: 5, Width: 20, Height: 20}, squareCrop(20, 30))
+	assert.Equal(t, Crop{Width: 8, Height: 8}, squareCrop(8, 8))
+}
+
+func TestUploadSquareRejectsAnimation(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	// A VP8X header with the animation flag set
+	animated := []byte("RIFF\x1a\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\x1f\x00\x00\x1f\x00\x00")
+	request := createFaceclaimRequest(testBucket)
+	request.Fit = "square"
+	w := postImageBytes(r, request, animated)
+
+	assert.Equal(t, 422, w.Code)
+	assert.Contains(t, w.Body.String(), "unsupported_fit")
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestUploadRejectsUnknownFit(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Fit = "cover"
+	assert.Equal(t, 400, postTestImage(r, request).Code)
+}
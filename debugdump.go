@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// While debug dumps are on, the bodies of requests to dumpRoutes and their
+// responses are logged, for reproducing client-side encoding bugs.
+var debugDump atomic.Bool
+
+// Dumped bodies are cut off after this many bytes.
+const maxDumpSize = 4096
+
+// The routes whose bodies may be dumped. Log uploads are multipart files and
+// are never dumped.
+var dumpRoutes = map[string]bool{
+	"/faceclaim/upload":                      true,
+	"/faceclaim/delete/:bucket/:charid/all":  true,
+	"/faceclaim/delete/:bucket/:charid/:key": true,
+}
+
+// debugLog receives the dumps, separately from the standard logger.
+var debugLog = newLogger(os.Stderr, "DEBUG ", log.Ltime|log.Lmicroseconds)
+
+// Reads DEBUG_DUMP, which turns debug dumps on at startup.
+func prepareDebugDump() error {
+	enabled := false
+	if value, ok := os.LookupEnv("DEBUG_DUMP"); ok {
+		var err error
+		if enabled, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("DEBUG_DUMP: %v", err)
+		}
+	}
+	debugDump.Store(enabled)
+	return nil
+}
+
+// DebugDump logs the request and response bodies of allowlisted routes while
+// debug dumps are on.
+func DebugDump() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !debugDump.Load() || !dumpRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		var request []byte
+		if c.Request.Body != nil {
+			request, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(request))
+		}
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		debugLog.Printf("%v %v request_id=%v headers=%v body=%v",
+			c.Request.Method, c.Request.URL.Path, requestID(c.Request.Context()),
+			redactedHeaders(c.Request.Header), truncateDump(request, len(request)))
+		debugLog.Printf("%v %v request_id=%v status=%v body=%v",
+			c.Request.Method, c.Request.URL.Path, requestID(c.Request.Context()),
+			writer.Status(), truncateDump(writer.body.Bytes(), writer.Size()))
+	}
+}
+
+// Returns the headers as a string, with the Authorization header redacted.
+func redactedHeaders(header http.Header) string {
+	var parts []string
+	for name, values := range header {
+		value := strings.Join(values, ",")
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			value = "[redacted]"
+		}
+		parts = append(parts, fmt.Sprintf("%v: %v", name, value))
+	}
+	sort.Strings(parts)
+	return "{" + strings.Join(parts, "; ") + "}"
+}
+
+// Quotes a body for the log, cutting it off at maxDumpSize bytes. The total is
+// the body's full size, which may be more than was captured.
+func truncateDump(body []byte, total int) string {
+	if total > maxDumpSize {
+		return fmt.Sprintf("%q... (%v bytes truncated)", body[:maxDumpSize], total-maxDumpSize)
+	}
+	return fmt.Sprintf("%q", body)
+}
+
+// capturingWriter keeps a copy of the first maxDumpSize+1 bytes of the
+// response, enough to tell whether it needs truncating.
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	if remaining := maxDumpSize + 1 - w.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		w.body.Write(data[:remaining])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// A DebugDumpRequest is the POST body for /admin/debug-dump.
+type DebugDumpRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// Turns debug dumps on or off.
+func setDebugDump(c *gin.Context) {
+	var request DebugDumpRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	debugDump.Store(*request.Enabled)
+	respond(c, http.StatusOK, gin.H{"debug_dump": *request.Enabled})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Capture debug dumps for the duration of a test
+func captureDebugLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	oldLog := debugLog
+	debugLog = newLogger(&buf, "", 0)
+	t.Cleanup(func() {
+		debugLog = oldLog
+		debugDump.Store(false)
+	})
+	return &buf
+}
+
+func TestDebugDumpRedactsAuthorization(t *testing.T) {
+	useFakeBackends(t)
+	output := captureDebugLog(t)
+	os.Setenv("API_TOKEN", "hunter2")
+	defer os.Unsetenv("API_TOKEN")
+	r := setupRouter(false)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "hunter2")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Off by default
+	request("DELETE", "/faceclaim/delete/"+testBucket+"/__test/a.webp", "")
+	assert.Empty(t, output.String())
+
+	w := request("POST", "/admin/debug-dump", `{"enabled": true}`)
+	assert.Equal(t, 200, w.Code)
+
+	request("DELETE", "/faceclaim/delete/"+testBucket+"/__test/b.webp", "")
+	assert.Contains(t, output.String(), "Authorization: [redacted]")
+	assert.Contains(t, output.String(), `Deleted __test/b.webp`)
+	assert.NotContains(t, output.String(), "hunter2")
+}
+
+func TestDebugDumpTruncates(t *testing.T) {
+	useFakeBackends(t)
+	output := captureDebugLog(t)
+	debugDump.Store(true)
+	r := setupRouter(false)
+
+	body := fmt.Sprintf(`{"charid": "__test", "image_url": "%v"}`, strings.Repeat("a", 5000))
+	performRequest(r, "POST", "/faceclaim/upload", strings.NewReader(body))
+
+	assert.Contains(t, output.String(), fmt.Sprintf("(%v bytes truncated)", len(body)-maxDumpSize))
+	assert.NotContains(t, output.String(), strings.Repeat("a", maxDumpSize))
+}
+
+func TestDebugDumpSkipsLogUploads(t *testing.T) {
+	useFakeBackends(t)
+	output := captureDebugLog(t)
+	debugDump.Store(true)
+	r := setupRouter(false)
+
+	performRequest(r, "POST", "/log/upload", strings.NewReader("--boundary--"))
+	assert.Empty(t, output.String())
+}
+
+func TestDebugDumpRedactsSignedURLs(t *testing.T) {
+	useFakeBackends(t)
+	output := captureDebugLog(t)
+	debugDump.Store(true)
+	r := setupRouter(false)
+
+	body := `{"charid": "__test", "image_url": "` + signedURL + `"}`
+	performRequest(r, "POST", "/faceclaim/upload", strings.NewReader(body))
+
+	assert.Contains(t, output.String(), "X-Goog-Signature=[redacted]")
+	assert.NotContains(t, output.String(), "deadbeef")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Deletes issued within this window of an identical one are assumed to be
+// duplicates, e.g. from a double-clicked button.
+const deleteDedupeWindow = 30 * time.Second
+
+// recentDeletes holds the delete keys queued within the dedupe window.
+var recentDeletes = newRecentSet(deleteDedupeWindow)
+
+// A recentSet remembers keys for a limited time.
+type recentSet struct {
+	sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func newRecentSet(ttl time.Duration) *recentSet {
+	return &recentSet{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// Adds a key to the set, returning false if it was already present. Expired
+// keys are swept out along the way.
+func (s *recentSet) add(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for k, t := range s.seen {
+		if now.Sub(t) > s.ttl {
+			delete(s.seen, k)
+		}
+	}
+	if _, ok := s.seen[key]; ok {
+		return false
+	}
+	s.seen[key] = now
+	return true
+}
+
+// Removes a key, so that a failed operation can be retried immediately.
+func (s *recentSet) remove(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.seen, key)
+}
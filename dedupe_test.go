@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Perform a delete, returning the status code and whether it was a duplicate
+func performDelete(t *testing.T, path string) (int, bool) {
+	w := performRequest(setupRouter(false), "DELETE", path, nil)
+	var body struct {
+		AlreadyQueued bool `json:"already_queued"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body.AlreadyQueued
+}
+
+func TestDuplicateSingleDelete(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	path := fmt.Sprintf("/faceclaim/delete/%v/__test/abc123.webp", testBucket)
+
+	code, duplicate := performDelete(t, path)
+	assert.Equal(t, 200, code)
+	assert.False(t, duplicate)
+
+	code, duplicate = performDelete(t, path)
+	assert.Equal(t, 200, code)
+	assert.True(t, duplicate)
+
+	messages := publisher.published()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, testBucket+"/__test/abc123.webp", messages[0].Attributes["dedupe_key"])
+}
+
+func TestDuplicateGroupDelete(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	path := fmt.Sprintf("/faceclaim/delete/%v/__test/all", testBucket)
+
+	_, duplicate := performDelete(t, path)
+	assert.False(t, duplicate)
+	_, duplicate = performDelete(t, path)
+	assert.True(t, duplicate)
+
+	assert.Len(t, publisher.published(), 1)
+}
+
+func TestFailedDeleteCanBeRetried(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	path := fmt.Sprintf("/faceclaim/delete/%v/__test/abc123.webp", testBucket)
+
+	publisher.err = errors.New("pubsub is down")
+	code, _ := performDelete(t, path)
+	assert.Equal(t, 500, code)
+
+	publisher.err = nil
+	code, duplicate := performDelete(t, path)
+	assert.Equal(t, 200, code)
+	assert.False(t, duplicate)
+	assert.Len(t, publisher.published(), 1)
+}
+
+func TestRecentSetExpiry(t *testing.T) {
+	set := newRecentSet(10 * time.Millisecond)
+	assert.True(t, set.add("key"))
+	assert.False(t, set.add("key"))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, set.add("key"))
+}
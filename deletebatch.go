@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// The most keys a batch delete takes.
+const maxDeleteBatch = 50
+
+// How many faceclaims a synchronous batch delete deletes at once.
+const deleteBatchConcurrency = 8
+
+// A DeleteBatchRequest is the POST body for /faceclaim/delete-batch.
+type DeleteBatchRequest struct {
+	Bucket string `json:"bucket"`
+
+	// Faceclaims to delete, as object names ("charid/key.webp") or the URLs
+	// returned by /faceclaim/upload
+	Keys []string `json:"keys" binding:"required"`
+}
+
+// A DeleteBatchResult is the response body for /faceclaim/delete-batch. Each
+// key's status is queued, already_queued, deleted (with ?sync=true), or held;
+// keys that fail are invalid, not_found, or failed.
+type DeleteBatchResult struct {
+	Bucket string `json:"bucket"`
+	Sync   bool   `json:"sync"`
+	BatchResult
+}
+
+// Deletes a chosen set of faceclaims, along with their kept originals and
+// size variants. Each deletion is queued like a single delete, unless
+// ?sync=true, in which case they're deleted here, concurrently.
+func deleteFaceclaimBatch(c *gin.Context) {
+	var request DeleteBatchRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	synchronous, err := strconv.ParseBool(c.DefaultQuery("sync", "false"))
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "sync must be true or false"})
+		return
+	}
+	if request.Bucket == "" {
+		request.Bucket = currentConfig().FaceclaimBucket
+	}
+	tagRequest(c, "bucket", request.Bucket)
+	if err := validateBucket(request.Bucket); err != nil {
+		abortWith(c, bucketErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Keys) == 0 || len(request.Keys) > maxDeleteBatch {
+		abortWith(c, http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("keys must list between 1 and %v faceclaims", maxDeleteBatch),
+		})
+		return
+	}
+
+	result, err := deleteBatch(c.Request.Context(), request.Bucket, request.Keys, synchronous)
+	if abortIfTimedOut(c) || abortIfJournalFull(c, err) {
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Keys that were never there, or never could be, aren't a server error
+	status := result.httpStatus(http.StatusOK)
+	if result.Succeeded == 0 {
+		switch {
+		case onlyCodes(result.BatchResult, "not_found"):
+			status = http.StatusNotFound
+		case onlyCodes(result.BatchResult, "invalid_key", "not_found"):
+			status = http.StatusBadRequest
+		}
+	}
+	respond(c, status, result)
+}
+
+// Reports whether every failed item failed with one of the given codes.
+func onlyCodes(result BatchResult, codes ...string) bool {
+	for _, item := range result.Results {
+		if item.Code == "" {
+			continue
+		}
+		found := false
+		for _, code := range codes {
+			found = found || item.Code == code
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Deletes or queues the deletion of each key's faceclaim, reporting each in
+// the order given. Repeated keys are reported once. Only a full delete
+// journal stops the batch, since the rest would only fill it further.
+func deleteBatch(ctx context.Context, bucket string, keys []string, synchronous bool) (DeleteBatchResult, error) {
+	result := DeleteBatchResult{Bucket: bucket, Sync: synchronous, BatchResult: BatchResult{Results: []BatchItem{}}}
+
+	items := make([]BatchItem, 0, len(keys))
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		object := objectName(bucket, key)
+		if seen[object] {
+			continue
+		}
+		seen[object] = true
+		item := BatchItem{Key: object}
+		if err := validateObjectName(object); err != nil {
+			item.Status, item.Code, item.Message = "invalid", "invalid_key", err.Error()
+		}
+		items = append(items, item)
+	}
+
+	if synchronous {
+		var wg sync.WaitGroup
+		pending := make(chan int)
+		for i := 0; i < deleteBatchConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range pending {
+					items[i] = deleteBatchItem(ctx, bucket, items[i])
+				}
+			}()
+		}
+		for i, item := range items {
+			if item.Code == "" {
+				pending <- i
+			}
+		}
+		close(pending)
+		wg.Wait()
+	} else {
+		for i, item := range items {
+			if item.Code != "" {
+				continue
+			}
+			var err error
+			if items[i], err = queueBatchItem(ctx, bucket, item); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, item := range items {
+		result.add(item)
+	}
+	if result.Succeeded > 0 {
+		guildUsage.invalidate(bucket)
+	}
+	log.Printf("Batch deleted %v faceclaims from %v, %v failed\n", result.Succeeded, bucket, result.Failed)
+	return result, nil
+}
+
+// Checks that an object name is a charid and a faceclaim key.
+func validateObjectName(object string) error {
+	charid, key, ok := strings.Cut(object, "/")
+	if !ok {
+		return fmt.Errorf("%q isn't a faceclaim key", object)
+	}
+	if err := validateCharID(charid); err != nil {
+		return err
+	}
+	return validateKey(key)
+}
+
+// Queues a faceclaim's deletion as a single delete would. A full delete
+// journal is returned as an error, rather than as the item's failure.
+func queueBatchItem(ctx context.Context, bucket string, item BatchItem) (BatchItem, error) {
+	if _, err := cachedObjectAttrs(ctx, bucket, item.Key); err != nil {
+		return failedBatchItem(item.Key, err), nil
+	}
+	charid, key, _ := strings.Cut(item.Key, "/")
+	deleted, err := queueFaceclaimDeletion(ctx, bucket, charid, key)
+	recordDelete(bucket, "batch", err)
+	var journalErr *JournalFullError
+	switch {
+	case errors.As(err, &journalErr):
+		return item, err
+	case err != nil:
+		return failedBatchItem(item.Key, err), nil
+	case deleted.AlreadyQueued:
+		item.Status = "already_queued"
+	case len(deleted.Skipped) > 0:
+		item.Status = "held"
+	default:
+		item.Status = "queued"
+	}
+	return item, nil
+}
+
+// Deletes a faceclaim, its kept original, and its variants here and now.
+func deleteBatchItem(ctx context.Context, bucket string, item BatchItem) BatchItem {
+	attrs, err := getObjectAttrs(ctx, bucket, item.Key)
+	if err != nil {
+		return failedBatchItem(item.Key, err)
+	}
+	if isHeld(attrs) {
+		item.Status = "held"
+		return item
+	}
+	for _, name := range faceclaimObjects(item.Key, attrs.Metadata) {
+		if err := deleteObject(ctx, bucket, name); err != nil {
+			recordDelete(bucket, "batch", err)
+			return failedBatchItem(item.Key, err)
+		}
+	}
+	recordDelete(bucket, "batch", nil)
+	item.Status = "deleted"
+	return item
+}
+
+// Reports a key that couldn't be deleted, saying whether it was missing.
+func failedBatchItem(key string, err error) BatchItem {
+	status := "failed"
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		status = "not_found"
+	}
+	return BatchItem{Key: key, Status: status, Code: batchErrorCode(err), Message: err.Error()}
+}
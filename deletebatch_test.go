@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postDeleteBatch(r http.Handler, query string, request DeleteBatchRequest) (*httptest.ResponseRecorder, DeleteBatchResult) {
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/delete-batch"+query, bytes.NewReader(body))
+	var result DeleteBatchResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w, result
+}
+
+// Upload n faceclaims to the test character, returning their object names
+func seedBatch(t *testing.T, r http.Handler, n int) []string {
+	var objects []string
+	for i := 0; i < n; i++ {
+		objects = append(objects, objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL))
+	}
+	return objects
+}
+
+func TestDeleteBatchMixed(t *testing.T) {
+	for _, query := range []string{"", "?sync=true"} {
+		t.Run(query, func(t *testing.T) {
+			store, publisher := useFakeBackends(t)
+			r := setupRouter(false)
+			objects := seedBatch(t, r, 3)
+			missing := testObjectKey(1)
+
+			// Kept: the last faceclaim. URLs and object names both work.
+			keys := []string{objects[0], "https://" + testBucket + "/" + objects[1], missing, "__test/../x.webp", objects[0]}
+			w, result := postDeleteBatch(r, query, DeleteBatchRequest{Keys: keys})
+
+			assert.Equal(t, 207, w.Code, w.Body.String())
+			assert.Equal(t, query != "", result.Sync)
+			assert.Equal(t, 2, result.Succeeded)
+			assert.Equal(t, 2, result.Failed)
+			status := "queued"
+			if result.Sync {
+				status = "deleted"
+			}
+			if assert.Len(t, result.Results, 4, "The repeated key is reported once") {
+				assert.Equal(t, BatchItem{Key: objects[0], Status: status}, result.Results[0])
+				assert.Equal(t, BatchItem{Key: objects[1], Status: status}, result.Results[1])
+				assert.Equal(t, "not_found", result.Results[2].Status)
+				assert.Equal(t, "not_found", result.Results[2].Code)
+				assert.Equal(t, "invalid_key", result.Results[3].Code)
+			}
+
+			assert.Equal(t, []string{objects[2]}, store.keys(testBucket))
+			if result.Sync {
+				assert.Empty(t, publisher.published())
+			} else {
+				assert.Len(t, publisher.published(), 2, "One message per deleted key")
+			}
+		})
+	}
+}
+
+func TestDeleteBatchHeld(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	objects := seedBatch(t, r, 2)
+	setTestHold(t, r, "POST", objects[0])
+
+	w, result := postDeleteBatch(r, "?sync=true", DeleteBatchRequest{Keys: objects})
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "held", result.Results[0].Status)
+	assert.Equal(t, "deleted", result.Results[1].Status)
+	assert.Equal(t, []string{objects[0]}, store.keys(testBucket))
+}
+
+func TestDeleteBatchAllMissing(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	w, result := postDeleteBatch(r, "", DeleteBatchRequest{Keys: []string{testObjectKey(1), testObjectKey(2)}})
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, 2, result.Failed)
+}
+
+func TestDeleteBatchRejectsBadRequests(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	tooMany := make([]string, maxDeleteBatch+1)
+	for i := range tooMany {
+		tooMany[i] = testObjectKey(uint64(i))
+	}
+
+	for name, request := range map[string]DeleteBatchRequest{
+		"no keys":    {Keys: []string{}},
+		"too many":   {Keys: tooMany},
+		"bad bucket": {Bucket: "gs://..", Keys: []string{testObjectKey(1)}},
+		"all bad":    {Keys: []string{"nope"}},
+	} {
+		w, _ := postDeleteBatch(r, "", request)
+		assert.Equal(t, 400, w.Code, name)
+	}
+	w, _ := postDeleteBatch(r, "?sync=maybe", DeleteBatchRequest{Keys: []string{testObjectKey(1)}})
+	assert.Equal(t, 400, w.Code)
+}
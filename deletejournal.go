@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// When DeleteJournalPath is set, deletions that can't be published are
+// written there instead, and retried every DeleteJournalRetry until they go
+// through. At most DeleteJournalSize wait at once; past that, deletions fail
+// with a JournalFullError.
+var (
+	DeleteJournalPath  string
+	DeleteJournalSize  = 1000
+	DeleteJournalRetry = 30 * time.Second
+)
+
+// deleteJournal holds the deletions waiting to be published. It's nil unless
+// DELETE_JOURNAL_PATH is set.
+var deleteJournal *journal
+
+// Reads DELETE_JOURNAL_PATH, DELETE_JOURNAL_SIZE, and DELETE_JOURNAL_RETRY,
+// then loads any deletions journaled before a restart.
+func prepareDeleteJournal() error {
+	DeleteJournalPath, DeleteJournalSize, DeleteJournalRetry = "", 1000, 30*time.Second
+	deleteJournal = nil
+
+	if value, ok := os.LookupEnv("DELETE_JOURNAL_SIZE"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return errors.New("DELETE_JOURNAL_SIZE must be a positive integer")
+		}
+		DeleteJournalSize = n
+	}
+	if value, ok := os.LookupEnv("DELETE_JOURNAL_RETRY"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.New("DELETE_JOURNAL_RETRY must be a positive duration, e.g. \"30s\"")
+		}
+		DeleteJournalRetry = d
+	}
+	DeleteJournalPath = os.Getenv("DELETE_JOURNAL_PATH")
+	if DeleteJournalPath == "" {
+		return nil
+	}
+	j, err := openJournal(DeleteJournalPath, DeleteJournalSize)
+	if err != nil {
+		return err
+	}
+	deleteJournal = j
+	return nil
+}
+
+// A JournalFullError means a deletion couldn't be published, and there was no
+// room to journal it either.
+type JournalFullError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *JournalFullError) Error() string {
+	return "unable to queue the deletion: " + e.Reason
+}
+
+// Responds with a 503 and a Retry-After if err is a JournalFullError,
+// returning whether it did.
+func abortIfJournalFull(c *gin.Context, err error) bool {
+	var fullErr *JournalFullError
+	if !errors.As(err, &fullErr) {
+		return false
+	}
+	seconds := int((fullErr.RetryAfter + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	abortWith(c, http.StatusServiceUnavailable, gin.H{"error": err.Error(), "code": "delete_queue_full"})
+	return true
+}
+
+// A journalEntry is a message that couldn't be published, as it would have
+// been.
+type journalEntry struct {
+	Topic      string            `json:"topic"`
+	Data       json.RawMessage   `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+	Queued     time.Time         `json:"queued"`
+}
+
+// A journal is a bounded queue of messages, mirrored to a file of JSON lines
+// so it survives restarts. The file is rewritten in full on every change,
+// which is cheap at the sizes it's bounded to.
+type journal struct {
+	sync.Mutex
+	path    string
+	size    int
+	entries []journalEntry
+
+	// Held while draining, so only one drain runs at a time
+	draining sync.Mutex
+}
+
+// Opens the journal at path, loading the entries left in it. Malformed lines,
+// e.g. from a crash mid-write, are skipped.
+func openJournal(path string, size int) (*journal, error) {
+	j := &journal{path: path, size: size}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("openJournal: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Println("Skipping malformed journal entry:", err)
+			continue
+		}
+		j.entries = append(j.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("openJournal: %v", err)
+	}
+	if len(j.entries) > 0 {
+		log.Printf("Loaded %v journaled deletions from %v\n", len(j.entries), path)
+	}
+	setJournalDepth(len(j.entries))
+	return j, nil
+}
+
+// Appends an entry, failing with a JournalFullError if the journal is full.
+func (j *journal) add(entry journalEntry) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if len(j.entries) >= j.size {
+		return &JournalFullError{Reason: "the delete journal is full", RetryAfter: DeleteJournalRetry}
+	}
+	if err := j.write(append(j.entries, entry)); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, entry)
+	setJournalDepth(len(j.entries))
+	return nil
+}
+
+// Returns the number of entries waiting.
+func (j *journal) len() int {
+	j.Lock()
+	defer j.Unlock()
+	return len(j.entries)
+}
+
+// Replaces the file with the given entries. They're written to a temporary
+// file that's renamed into place, so a crash leaves one version or the other.
+func (j *journal) write(entries []journalEntry) error {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("journal.write: %v", err)
+	}
+	encoder := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			f.Close()
+			return fmt.Errorf("journal.write: %v", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("journal.write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("journal.write: %v", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("journal.write: %v", err)
+	}
+	return nil
+}
+
+// Tries each entry once, in order, removing those that went through. An entry
+// is published if Pub/Sub is back, or else carried out here. Entries that can
+// never succeed are logged and dropped. Returns the number removed.
+func (j *journal) drain(ctx context.Context) int {
+	j.draining.Lock()
+	defer j.draining.Unlock()
+
+	// Entries are only appended while draining, so the ones tried here stay
+	// at the front
+	j.Lock()
+	pending := append([]journalEntry(nil), j.entries...)
+	j.Unlock()
+	if len(pending) == 0 {
+		return 0
+	}
+
+	var kept []journalEntry
+	for _, entry := range pending {
+		if !replayEntry(ctx, entry) {
+			kept = append(kept, entry)
+		}
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	remaining := append(kept, j.entries[len(pending):]...)
+	if err := j.write(remaining); err != nil {
+		// The file still lists the drained entries, so they'd be repeated
+		// after a restart, which deleting tolerates
+		log.Println("Unable to update the delete journal:", err)
+	}
+	j.entries = remaining
+	setJournalDepth(len(j.entries))
+	removed := len(pending) - len(kept)
+	if removed > 0 {
+		log.Printf("Drained %v journaled deletions; %v remain\n", removed, len(remaining))
+	}
+	return removed
+}
+
+// Publishes or carries out a journaled deletion, returning whether it's done
+// with.
+func replayEntry(ctx context.Context, entry journalEntry) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	err := MessagePublisher.Publish(ctx, entry.Topic, entry.Data, entry.Attributes)
+	if err == nil {
+		return true
+	}
+
+	message, err := decodeMessage(entry.Data)
+	if err == nil {
+		_, err = applyMessage(ctx, message)
+	}
+	var invalid *invalidDeleteError
+	var unsupported *unsupportedMessageError
+	switch {
+	case err == nil:
+		bucket, _ := message.target()
+		guildUsage.invalidate(bucket)
+		return true
+	case errors.As(err, &invalid), errors.As(err, &unsupported):
+		log.Printf("Dropping journal entry %s: %v\n", entry.Data, err)
+		return true
+	default:
+		log.Printf("Unable to replay journal entry %s: %v\n", entry.Data, err)
+		return false
+	}
+}
+
+// Drains the journal now, to replay what a previous run left, then every
+// interval until ctx is done.
+func drainJournal(ctx context.Context, j *journal, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		j.drain(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Journal failed publishes to a fresh file for the duration of a test,
+// returning its path
+func useDeleteJournal(t *testing.T, size int) string {
+	path := filepath.Join(t.TempDir(), "deletes.jsonl")
+	j, err := openJournal(path, size)
+	assert.NoError(t, err)
+	deleteJournal = j
+	t.Cleanup(func() { deleteJournal = nil })
+	return path
+}
+
+func TestJournalReplaysAfterRestart(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	path := useDeleteJournal(t, 10)
+	store.Upload(context.Background(), testBucket, "__test/abc.webp", strings.NewReader("x"), UploadOptions{})
+	store.Upload(context.Background(), testBucket, "__test/def.webp", strings.NewReader("x"), UploadOptions{})
+
+	// With Pub/Sub down, deletions are accepted and journaled
+	publisher.err = errors.New("pubsub is down")
+	code, _ := performDelete(t, fmt.Sprintf("/faceclaim/delete/%v/__test/abc.webp", testBucket))
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = performDelete(t, fmt.Sprintf("/faceclaim/delete/%v/__test/all", testBucket))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, deleteJournal.len())
+	assert.Empty(t, publisher.published())
+
+	// A restarted process finds them in the file
+	restarted, err := openJournal(path, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, restarted.len())
+
+	// Once Pub/Sub is back, they're published in order
+	publisher.err = nil
+	assert.Equal(t, 2, restarted.drain(context.Background()))
+	messages := publisher.published()
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "delete-single-faceclaim", messages[0].Topic)
+		assert.Equal(t, "__test/abc.webp", messages[0].Data["key"])
+		assert.Equal(t, testBucket+"/__test/abc.webp", messages[0].Attributes["dedupe_key"])
+		assert.Equal(t, "delete-faceclaim-group", messages[1].Topic)
+	}
+	assert.Empty(t, store.keys(testBucket))
+
+	// And the file is emptied, so they aren't replayed again
+	restarted, err = openJournal(path, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, restarted.len())
+}
+
+func TestJournalDeletesDirectly(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	useDeleteJournal(t, 10)
+	store.Upload(context.Background(), testBucket, "__test/abc.webp", strings.NewReader("x"), UploadOptions{})
+
+	publisher.err = errors.New("pubsub is down")
+	code, _ := performDelete(t, fmt.Sprintf("/faceclaim/delete/%v/__test/abc.webp", testBucket))
+	assert.Equal(t, http.StatusOK, code)
+
+	// Pub/Sub is still down, so the drain deletes the object itself
+	assert.Equal(t, 1, deleteJournal.drain(context.Background()))
+	assert.False(t, store.exists(testBucket, "__test/abc.webp"))
+	assert.Equal(t, 0, deleteJournal.len())
+}
+
+func TestJournalKeepsFailedEntries(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	path := useDeleteJournal(t, 10)
+
+	publisher.err = errors.New("pubsub is down")
+	code, _ := performDelete(t, fmt.Sprintf("/faceclaim/delete/%v/__test/abc.webp", testBucket))
+	assert.Equal(t, http.StatusOK, code)
+
+	store.err = errors.New("storage is down")
+	assert.Equal(t, 0, deleteJournal.drain(context.Background()))
+	assert.Equal(t, 1, deleteJournal.len())
+	restarted, err := openJournal(path, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restarted.len())
+}
+
+func TestJournalFull(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	useDeleteJournal(t, 1)
+
+	publisher.err = errors.New("pubsub is down")
+	code, _ := performDelete(t, fmt.Sprintf("/faceclaim/delete/%v/__test/abc.webp", testBucket))
+	assert.Equal(t, http.StatusOK, code)
+
+	w := performRequest(setupRouter(false), "DELETE", fmt.Sprintf("/faceclaim/delete/%v/__test/def.webp", testBucket), nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"delete_queue_full"`)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, 1, deleteJournal.len())
+
+	// The refused deletion can be retried right away
+	publisher.err = nil
+	code, duplicate := performDelete(t, fmt.Sprintf("/faceclaim/delete/%v/__test/def.webp", testBucket))
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, duplicate)
+}
+
+func TestJournalSkipsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deletes.jsonl")
+	contents := `{"topic":"delete-single-faceclaim","data":{"bucket":"b","key":"__test/abc.webp"}}` + "\n" + `{"topic":"delete-sin` + "\n"
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+
+	j, err := openJournal(path, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, j.len())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeleteLockTTL is how long a character's group deletion keeps uploads to it
+// out, unless the deletion is seen to finish first. Read from DELETE_LOCK_TTL.
+var DeleteLockTTL = 10 * time.Second
+
+// DeleteLockWait is how long an upload waits for a character's deletion to
+// finish before giving up. Read from DELETE_LOCK_WAIT.
+var DeleteLockWait = 2 * time.Second
+
+// Reads DELETE_LOCK_TTL and DELETE_LOCK_WAIT.
+func prepareDeleteLocks() error {
+	DeleteLockTTL, DeleteLockWait = 10*time.Second, 2*time.Second
+	if value, ok := os.LookupEnv("DELETE_LOCK_TTL"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.New("DELETE_LOCK_TTL must be a positive duration, e.g. \"10s\"")
+		}
+		DeleteLockTTL = d
+	}
+	if value, ok := os.LookupEnv("DELETE_LOCK_WAIT"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return errors.New("DELETE_LOCK_WAIT must be a duration, e.g. \"2s\"")
+		}
+		DeleteLockWait = d
+	}
+	deletionLocks = newDeletionLockSet()
+	return nil
+}
+
+// A DeletionInProgressError means an upload gave up waiting for its
+// character's deletion to finish.
+type DeletionInProgressError struct {
+	Bucket     string
+	CharID     string
+	RetryAfter time.Duration
+}
+
+func (e *DeletionInProgressError) Error() string {
+	return fmt.Sprintf("deletion in progress: %v's faceclaims in %v are being deleted", e.CharID, e.Bucket)
+}
+
+// Responds with a 409 and a Retry-After if err is a DeletionInProgressError,
+// returning whether it did.
+func abortIfDeleting(c *gin.Context, err error) bool {
+	var deletingErr *DeletionInProgressError
+	if !errors.As(err, &deletingErr) {
+		return false
+	}
+	seconds := int((deletingErr.RetryAfter + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	abortWith(c, http.StatusConflict, gin.H{"error": err.Error(), "code": "deletion_in_progress", "retry_after": seconds})
+	return true
+}
+
+// A deletionLockSet marks the characters whose faceclaims are being deleted
+// as a group, so a fresh upload isn't swept up with them. Marks expire, so a
+// deletion that's never seen to finish, because it's handled elsewhere or
+// this process crashed partway, doesn't lock the character out for good.
+type deletionLockSet struct {
+	sync.Mutex
+	until   map[string]time.Time
+	changed chan struct{} // Closed, and replaced, whenever a mark is released
+}
+
+func newDeletionLockSet() *deletionLockSet {
+	return &deletionLockSet{until: make(map[string]time.Time), changed: make(chan struct{})}
+}
+
+// The characters being deleted, by bucket/charid.
+var deletionLocks = newDeletionLockSet()
+
+// Marks a character as being deleted for DeleteLockTTL.
+func (s *deletionLockSet) acquire(bucket, charid string) {
+	s.Lock()
+	defer s.Unlock()
+	s.until[bucket+"/"+charid] = time.Now().Add(DeleteLockTTL)
+}
+
+// Clears a character's mark, waking any uploads waiting on it.
+func (s *deletionLockSet) release(bucket, charid string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.until[bucket+"/"+charid]; !ok {
+		return
+	}
+	delete(s.until, bucket+"/"+charid)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Returns when a character's mark expires, and a channel closed when any mark
+// is released. ok is false if the character isn't marked.
+func (s *deletionLockSet) check(bucket, charid string) (until time.Time, changed <-chan struct{}, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	until, ok = s.until[bucket+"/"+charid]
+	if ok && !time.Now().Before(until) {
+		delete(s.until, bucket+"/"+charid)
+		return time.Time{}, nil, false
+	}
+	return until, s.changed, ok
+}
+
+// Waits up to DeleteLockWait for a character's deletion to finish, returning
+// a DeletionInProgressError if it doesn't.
+func (s *deletionLockSet) wait(ctx context.Context, bucket, charid string) error {
+	deadline := time.Now().Add(DeleteLockWait)
+	for {
+		until, changed, ok := s.check(bucket, charid)
+		if !ok {
+			return nil
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			return &DeletionInProgressError{Bucket: bucket, CharID: charid, RetryAfter: until.Sub(now)}
+		}
+		next := until
+		if deadline.Before(next) {
+			next = deadline
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("deletionLockSet.wait: %w", ctx.Err())
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
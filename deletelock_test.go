@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Set the deletion lock's TTL and wait for the duration of a test
+func useDeleteLocks(t *testing.T, ttl, wait time.Duration) {
+	DeleteLockTTL, DeleteLockWait = ttl, wait
+	t.Cleanup(func() { DeleteLockTTL, DeleteLockWait = 10*time.Second, 2*time.Second })
+}
+
+func TestUploadDuringGroupDeleteRejected(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useDeleteLocks(t, time.Minute, 50*time.Millisecond)
+	r := setupRouter(false)
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	w := performRequest(r, "DELETE", "/faceclaim/delete/"+testBucket+"/"+testCharID+"/all", nil)
+	assert.Equal(t, 200, w.Code)
+
+	w = postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 409, w.Code)
+	assert.Contains(t, w.Body.String(), "deletion_in_progress")
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Empty(t, store.keys(testBucket))
+
+	// Other characters aren't affected
+	request := createFaceclaimRequest(testBucket)
+	request.CharID = renamedCharID
+	uploadTestImage(t, r, request)
+}
+
+func TestUploadWaitsForGroupDelete(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useDeleteLocks(t, time.Minute, 5*time.Second)
+	r := setupRouter(false)
+	deletionLocks.acquire(testBucket, testCharID)
+
+	done := make(chan int)
+	go func() {
+		done <- postTestImage(r, createFaceclaimRequest(testBucket)).Code
+	}()
+	select {
+	case <-done:
+		t.Fatal("The upload should wait for the deletion")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The deletion finishing, as the push handler would see it, lets it in
+	_, err := applyMessage(context.Background(), DeleteGroup{Bucket: testBucket, CharID: testCharID})
+	assert.NoError(t, err)
+	select {
+	case code := <-done:
+		assert.Equal(t, 201, code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The upload should go ahead once the deletion finishes")
+	}
+	assert.Len(t, store.keys(testBucket), 1, "The new faceclaim should survive")
+}
+
+func TestDeletionLockExpires(t *testing.T) {
+	useFakeBackends(t)
+	useDeleteLocks(t, 100*time.Millisecond, time.Second)
+	r := setupRouter(false)
+	deletionLocks.acquire(testBucket, testCharID)
+
+	start := time.Now()
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	_, _, held := deletionLocks.check(testBucket, testCharID)
+	assert.False(t, held)
+}
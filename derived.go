@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A derivedObject is stored alongside a faceclaim's WebP: its kept original,
+// or one of its size variants.
+type derivedObject struct {
+	label string // "original", or the variant's size
+	name  string
+	data  []byte
+	opts  UploadOptions
+}
+
+// How long after a derived object fails to upload it's retried.
+var derivedRetryDelay = 30 * time.Second
+
+// derivedRetries tracks the retries still pending, so tests can wait them out.
+var derivedRetries sync.WaitGroup
+
+// Uploads a faceclaim's WebP and its derived objects concurrently, with the
+// upload pool limiting how many writes actually run at once. A derived object
+// failing doesn't fail the faceclaim; the ones that did are returned. If the
+// WebP fails, the other uploads are cancelled and any derived objects already
+// written are deleted, so nothing is left unreferenced, unless the WebP
+// already exists: then they're its own, as for a repeated idempotent upload.
+func uploadFaceclaimObjects(ctx context.Context, bucket, objectName string, data []byte, opts UploadOptions, derived []derivedObject) ([]derivedObject, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	errs := make([]error, len(derived))
+
+	g.Go(func() error {
+		return uploadObject(gctx, bytes.NewBuffer(data), bucket, objectName, opts)
+	})
+	for i, d := range derived {
+		i, d := i, d
+		g.Go(func() error {
+			errs[i] = uploadObject(gctx, bytes.NewBuffer(d.data), bucket, d.name, d.opts)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		var conflict *ConflictError
+		if errors.As(err, &conflict) && conflict.Key == objectName {
+			return nil, err
+		}
+		for i, d := range derived {
+			if errs[i] != nil {
+				continue
+			}
+			if err := deleteObject(context.Background(), bucket, d.name); err != nil {
+				log.Println("Unable to clean up", d.name, err)
+			}
+		}
+		return nil, err
+	}
+
+	var failed []derivedObject
+	for i, d := range derived {
+		if errs[i] != nil {
+			log.Printf("Unable to upload %v: %v\n", d.name, errs[i])
+			failed = append(failed, d)
+		}
+	}
+	return failed, nil
+}
+
+// Retries derived objects that failed to upload, once, after
+// derivedRetryDelay. Their data is copied, since the caller's buffers are
+// returned to the pool.
+func retryDerivedUploads(bucket string, failed []derivedObject) {
+	retries := make([]derivedObject, len(failed))
+	for i, d := range failed {
+		d.data = append([]byte(nil), d.data...)
+		retries[i] = d
+	}
+
+	derivedRetries.Add(1)
+	go func() {
+		defer derivedRetries.Done()
+		time.Sleep(derivedRetryDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), UploadTimeout)
+		defer cancel()
+		for _, d := range retries {
+			err := uploadObject(ctx, bytes.NewBuffer(d.data), bucket, d.name, d.opts)
+			switch {
+			case err == nil:
+				log.Println("Retried upload of", d.name)
+			case errors.Is(err, ErrPreconditionFailed):
+				// The failed attempt landed after all
+				log.Println(d.name, "already exists")
+			default:
+				log.Printf("Retry of %v failed: %v\n", d.name, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+
+	"golang.org/x/image/webp"
+)
+
+// Reads MIN_DIMENSION, the smallest width or height a converted faceclaim
+// may have. 0, the default, allows any size.
+func loadDimensions(cfg *Config) error {
+	if value, ok := os.LookupEnv("MIN_DIMENSION"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("MIN_DIMENSION must be a non-negative integer")
+		}
+		cfg.MinDimension = n
+	}
+	return nil
+}
+
+// Reads MAX_IMAGE_BYTES and MAX_PIXELS, which cap the source images uploads
+// may fetch and decode: 25 MiB and 40 megapixels by default. 0 allows any
+// size.
+func loadImageSize(cfg *Config) error {
+	caps := map[string]*int64{
+		"MAX_IMAGE_BYTES": &cfg.MaxImageBytes,
+		"MAX_PIXELS":      &cfg.MaxPixels,
+	}
+	for name, limit := range caps {
+		if value, ok := os.LookupEnv(name); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%v must be a non-negative integer", name)
+			}
+			*limit = n
+		}
+	}
+	return nil
+}
+
+// An ImageTooLargeError means a source image is over MAX_IMAGE_BYTES or
+// MAX_PIXELS. Bytes is -1 if the download was cut off at the cap, and its
+// full size isn't known.
+type ImageTooLargeError struct {
+	Bytes, MaxBytes   int64
+	Pixels, MaxPixels int64
+}
+
+func (e *ImageTooLargeError) Error() string {
+	if e.MaxPixels > 0 && e.Pixels > e.MaxPixels {
+		return fmt.Sprintf("the source image is too large: %v pixels, but at most %v are allowed", e.Pixels, e.MaxPixels)
+	}
+	if e.Bytes < 0 {
+		return fmt.Sprintf("the source image is too large: over %v bytes", e.MaxBytes)
+	}
+	return fmt.Sprintf("the source image is too large: %v bytes, but at most %v are allowed", e.Bytes, e.MaxBytes)
+}
+
+// Checks a source image against MAX_IMAGE_BYTES and, from its header, against
+// MAX_PIXELS, before it's decoded in full.
+func checkImageSize(data []byte) error {
+	cfg := currentConfig()
+	if cfg.MaxImageBytes > 0 && int64(len(data)) > cfg.MaxImageBytes {
+		return &ImageTooLargeError{Bytes: int64(len(data)), MaxBytes: cfg.MaxImageBytes, MaxPixels: cfg.MaxPixels}
+	}
+	if cfg.MaxPixels == 0 {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// Left for decoding to report
+		return nil
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > cfg.MaxPixels {
+		return &ImageTooLargeError{Bytes: int64(len(data)), MaxBytes: cfg.MaxImageBytes, Pixels: pixels, MaxPixels: cfg.MaxPixels}
+	}
+	return nil
+}
+
+// An InvalidWebPError means the converter's output isn't a WebP we can read,
+// so it isn't stored.
+type InvalidWebPError struct {
+	Reason string
+}
+
+func (e *InvalidWebPError) Error() string {
+	return "the converter produced an invalid WebP: " + e.Reason
+}
+
+// A TooSmallError means a faceclaim is smaller than MIN_DIMENSION on one side,
+// which would look bad wherever it's shown.
+type TooSmallError struct {
+	Width, Height int
+	Min           int
+}
+
+func (e *TooSmallError) Error() string {
+	return fmt.Sprintf("the source image is too small: %vx%v, but faceclaims must be at least %vx%v", e.Width, e.Height, e.Min, e.Min)
+}
+
+// Reads a converted faceclaim's dimensions from its WebP header, checking
+// that it's valid and at least MIN_DIMENSION on each side.
+func checkConverted(data []byte) (width, height int, err error) {
+	config, err := webp.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, &InvalidWebPError{Reason: err.Error()}
+	}
+	min := currentConfig().MinDimension
+	if config.Width < min || config.Height < min {
+		return config.Width, config.Height, &TooSmallError{Width: config.Width, Height: config.Height, Min: min}
+	}
+	return config.Width, config.Height, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Require faceclaims to be at least min pixels on each side for the duration
+// of a test
+func useMinDimension(t *testing.T, min int) {
+	useConfig(t, func(cfg *Config) { cfg.MinDimension = min })
+}
+
+func TestUploadReportsDimensions(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 32, response.Width)
+	assert.Equal(t, 24, response.Height)
+
+	var source bytes.Buffer
+	png.Encode(&source, gradientImage())
+	assert.Equal(t, int64(source.Len()), response.InputBytes)
+	attrs, err := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Nil(t, err)
+	assert.Equal(t, attrs.Size, response.OutputBytes)
+}
+
+func TestUploadRejectsSmallImages(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useMinDimension(t, 64)
+	r := setupRouter(false)
+
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var body struct {
+		Code         string `json:"code"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		MinDimension int    `json:"min_dimension"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, "image_too_small", body.Code)
+	assert.Equal(t, 32, body.Width)
+	assert.Equal(t, 24, body.Height)
+	assert.Equal(t, 64, body.MinDimension)
+	assert.Empty(t, store.keys(testBucket))
+
+	// Images at the minimum are fine
+	useMinDimension(t, 24)
+	assert.Equal(t, http.StatusCreated, postTestImage(r, createFaceclaimRequest(testBucket)).Code)
+}
+
+func TestUploadRejectsInvalidWebP(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	ImageConverter = copyConverter{}
+	r := setupRouter(false)
+
+	// The PNG passes through unconverted
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"conversion_failed"`)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestUploadRejectsLargeImages(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	var body struct {
+		Code      string `json:"code"`
+		MaxBytes  int64  `json:"max_bytes"`
+		MaxPixels int64  `json:"max_pixels"`
+	}
+
+	// The 32x24 gradient has 768 pixels
+	useConfig(t, func(cfg *Config) { cfg.MaxPixels = 700 })
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, "image_too_large", body.Code)
+	assert.Equal(t, int64(700), body.MaxPixels)
+
+	useConfig(t, func(cfg *Config) { cfg.MaxPixels, cfg.MaxImageBytes = 0, 100 })
+	w = postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, "image_too_large", body.Code)
+	assert.Equal(t, int64(100), body.MaxBytes)
+	assert.Empty(t, store.keys(testBucket))
+
+	// 0 allows any size
+	useConfig(t, func(cfg *Config) { cfg.MaxPixels, cfg.MaxImageBytes = 0, 0 })
+	assert.Equal(t, http.StatusCreated, postTestImage(r, createFaceclaimRequest(testBucket)).Code)
+}
+
+func TestFetchStopsAtMaxImageBytes(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.MaxImageBytes = 1024 })
+	// No Content-Length, so the body is only cut off once it's over the cap
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := []byte(strings.Repeat("x", 512))
+		for i := 0; i < 64; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	_, _, err := httpFetcher{}.get(context.Background(), server.URL, Validators{})
+	var largeErr *ImageTooLargeError
+	assert.ErrorAs(t, err, &largeErr)
+	assert.Equal(t, int64(-1), largeErr.Bytes)
+	assert.Equal(t, int64(1024), largeErr.MaxBytes)
+}
+
+func TestLoadImageSize(t *testing.T) {
+	defer os.Unsetenv("MAX_IMAGE_BYTES")
+	defer os.Unsetenv("MAX_PIXELS")
+
+	cfg := newConfig()
+	assert.Nil(t, loadImageSize(cfg))
+	assert.Equal(t, int64(25<<20), cfg.MaxImageBytes)
+	assert.Equal(t, int64(40_000_000), cfg.MaxPixels)
+
+	os.Setenv("MAX_IMAGE_BYTES", "1000")
+	os.Setenv("MAX_PIXELS", "0")
+	assert.Nil(t, loadImageSize(cfg))
+	assert.Equal(t, int64(1000), cfg.MaxImageBytes)
+	assert.Equal(t, int64(0), cfg.MaxPixels)
+
+	os.Setenv("MAX_PIXELS", "-1")
+	assert.NotNil(t, loadImageSize(newConfig()))
+	os.Setenv("MAX_PIXELS", "lots")
+	assert.NotNil(t, loadImageSize(newConfig()))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A Discord attachment signature expiring at the given time
+func discordSignature(expires time.Time) string {
+	return fmt.Sprintf("ex=%v&is=%v&hm=abc123", strconv.FormatInt(expires.Unix(), 16), strconv.FormatInt(expires.Add(-24*time.Hour).Unix(), 16))
+}
+
+func TestNormalizeDiscordURL(t *testing.T) {
+	now := time.Now()
+	signature := discordSignature(now.Add(time.Hour))
+	media := "https://media.discordapp.net/attachments/1/2/face.png?" + signature + "&format=webp&width=400&height=300"
+
+	normalized, err := normalizeImageURL(media, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://cdn.discordapp.com/attachments/1/2/face.png?"+signature, normalized)
+
+	// Already normal URLs, and other hosts, are left alone
+	normalized, err = normalizeImageURL(normalized, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://cdn.discordapp.com/attachments/1/2/face.png?"+signature, normalized)
+	other := "https://example.com/face.png?width=400"
+	normalized, err = normalizeImageURL(other, now)
+	assert.Nil(t, err)
+	assert.Equal(t, other, normalized)
+
+	// The media proxy's other paths aren't on the CDN
+	external := "https://media.discordapp.net/external/abc/face.png?width=400"
+	normalized, err = normalizeImageURL(external, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://media.discordapp.net/external/abc/face.png", normalized)
+}
+
+func TestNormalizeExpiredDiscordURL(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(-time.Minute).Truncate(time.Second)
+	expired := "https://cdn.discordapp.com/attachments/1/2/face.png?" + discordSignature(expires)
+
+	_, err := normalizeImageURL(expired, now)
+	var expiredErr *ExpiredURLError
+	if assert.ErrorAs(t, err, &expiredErr) {
+		assert.True(t, expires.Equal(expiredErr.Expired))
+		assert.Contains(t, err.Error(), "expired Discord URL")
+	}
+}
+
+// recordingFetcher serves a PNG for any URL, remembering which it was asked for
+type recordingFetcher struct {
+	sync.Mutex
+	urls []string
+}
+
+func (f *recordingFetcher) Fetch(ctx context.Context, url string) (*FetchedImage, error) {
+	f.Lock()
+	f.urls = append(f.urls, url)
+	f.Unlock()
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	return &FetchedImage{Data: buf.Bytes(), URL: url}, nil
+}
+
+// Use the fetcher for the duration of a test
+func useRecordingFetcher(t *testing.T) *recordingFetcher {
+	fetcher := &recordingFetcher{}
+	ImageFetcher = fetcher
+	t.Cleanup(func() { ImageFetcher = httpFetcher{} })
+	return fetcher
+}
+
+func TestUploadNormalizesDiscordURL(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	fetcher := useRecordingFetcher(t)
+	r := setupRouter(false)
+
+	signature := discordSignature(time.Now().Add(time.Hour))
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = "https://media.discordapp.net/attachments/1/2/face.png?" + signature + "&width=400&height=300"
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	normalized := "https://cdn.discordapp.com/attachments/1/2/face.png?" + signature
+	assert.Equal(t, []string{normalized}, fetcher.urls)
+
+	response := getFaceclaimResponse(w.Body)
+	attrs, err := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Nil(t, err)
+	assert.Equal(t, normalized, attrs.Metadata["original"])
+	assert.Equal(t, request.ImageURL, attrs.Metadata["submitted_url"])
+}
+
+func TestUploadRejectsExpiredDiscordURL(t *testing.T) {
+	useFakeBackends(t)
+	fetcher := useRecordingFetcher(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = "https://cdn.discordapp.com/attachments/1/2/face.png?" + discordSignature(time.Now().Add(-time.Hour))
+	request.Async = true
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+
+	// Refused up front, even for async uploads, without a fetch
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"expired_url"`)
+	assert.Empty(t, fetcher.urls)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// An ErrorEvent describes a failed request.
+type ErrorEvent struct {
+	Err       error
+	Chain     []string // Err's message, followed by each error it wraps
+	RequestID string
+	Method    string
+	Route     string
+	Status    int
+	Tags      map[string]string // Request context, such as the charid and bucket
+	Stack     string            // Set for panics
+}
+
+// A Reporter sends errors to an error tracking service.
+type Reporter interface {
+	Report(ctx context.Context, event ErrorEvent)
+}
+
+// ErrorReporter receives every 5xx response and recovered panic. It's nil when
+// error reporting is disabled.
+var ErrorReporter Reporter
+
+// ErrorSampleRate is the fraction of errors reported, so an outage doesn't
+// flood the service.
+var ErrorSampleRate = 1.0
+
+// Reads SENTRY_DSN and ERROR_SAMPLE_RATE. Without a DSN, errors are reported
+// to Google Error Reporting when running on Cloud Run.
+func prepareErrorReporting() error {
+	ErrorReporter = nil
+	ErrorSampleRate = 1.0
+	if value, ok := os.LookupEnv("ERROR_SAMPLE_RATE"); ok {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return errors.New("ERROR_SAMPLE_RATE must be between 0 and 1")
+		}
+		ErrorSampleRate = rate
+	}
+
+	if dsn, ok := os.LookupEnv("SENTRY_DSN"); ok {
+		if err := sentry.Init(sentry.ClientOptions{Dsn: dsn}); err != nil {
+			return fmt.Errorf("SENTRY_DSN: %v", err)
+		}
+		ErrorReporter = sentryReporter{}
+	} else if service, ok := os.LookupEnv("K_SERVICE"); ok {
+		ErrorReporter = &stackdriverReporter{w: os.Stderr, service: service}
+	}
+	return nil
+}
+
+// Tags the request with context for error reports.
+func tagRequest(c *gin.Context, key, value string) {
+	tags := c.GetStringMapString("error_tags")
+	if tags == nil {
+		tags = make(map[string]string)
+		c.Set("error_tags", tags)
+	}
+	tags[key] = value
+}
+
+// ReportErrors sends 5xx responses and recovered panics to the ErrorReporter.
+// Handlers attach the underlying error with c.Error. Panics are answered with
+// a 500 rather than crashing the process.
+func ReportErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				abortWith(c, http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+				reportError(c, fmt.Errorf("panic: %v", r), string(debug.Stack()))
+			}
+		}()
+
+		c.Next()
+
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			err := c.Errors.Last()
+			if err == nil {
+				reportError(c, fmt.Errorf("%v %v", c.Writer.Status(), http.StatusText(c.Writer.Status())), "")
+			} else {
+				reportError(c, err.Err, "")
+			}
+		}
+	}
+}
+
+// Sends an error about the current request, subject to sampling.
+func reportError(c *gin.Context, err error, stack string) {
+	if ErrorReporter == nil || rand.Float64() >= ErrorSampleRate {
+		return
+	}
+
+	var chain []string
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		chain = append(chain, redact(e.Error()))
+	}
+	// Errors can quote the signed URLs they failed on
+	if message := redact(err.Error()); message != err.Error() {
+		err = errors.New(message)
+	}
+	tags := c.GetStringMapString("error_tags")
+	for _, param := range []string{"bucket", "charid"} {
+		if value := c.Param(param); value != "" {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[param] = value
+		}
+	}
+
+	ErrorReporter.Report(c.Request.Context(), ErrorEvent{
+		Err:       err,
+		Chain:     chain,
+		RequestID: requestID(c.Request.Context()),
+		Method:    c.Request.Method,
+		Route:     c.FullPath(),
+		Status:    c.Writer.Status(),
+		Tags:      tags,
+		Stack:     stack,
+	})
+}
+
+// sentryReporter sends events to Sentry.
+type sentryReporter struct{}
+
+func (sentryReporter) Report(ctx context.Context, event ErrorEvent) {
+	sentry.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("request_id", event.RequestID)
+		scope.SetTag("route", event.Route)
+		scope.SetTag("status", strconv.Itoa(event.Status))
+		scope.SetTags(event.Tags)
+		scope.SetExtra("error_chain", event.Chain)
+		if event.Stack != "" {
+			scope.SetExtra("stack", event.Stack)
+		}
+		sentry.CaptureException(event.Err)
+	})
+}
+
+// stackdriverReporter writes events as structured log entries in the format
+// Google Error Reporting picks up from Cloud Run logs.
+type stackdriverReporter struct {
+	w       io.Writer
+	service string
+}
+
+func (r *stackdriverReporter) Report(ctx context.Context, event ErrorEvent) {
+	message := event.Err.Error()
+	if event.Stack != "" {
+		message += "\n" + event.Stack
+	}
+	entry := map[string]interface{}{
+		"@type":     "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent",
+		"severity":  "ERROR",
+		"eventTime": time.Now().Format(time.RFC3339Nano),
+		"message":   message,
+		"serviceContext": map[string]string{
+			"service": r.service,
+		},
+		"context": map[string]interface{}{
+			"httpRequest": map[string]interface{}{
+				"method":             event.Method,
+				"url":                event.Route,
+				"responseStatusCode": event.Status,
+			},
+		},
+		"request_id":  event.RequestID,
+		"tags":        event.Tags,
+		"error_chain": event.Chain,
+	}
+	json.NewEncoder(r.w).Encode(entry)
+}
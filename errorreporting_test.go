@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeReporter records the events it's sent.
+type fakeReporter struct {
+	sync.Mutex
+	events []ErrorEvent
+}
+
+func (r *fakeReporter) Report(ctx context.Context, event ErrorEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Install a fakeReporter for the duration of a test
+func useReporter(t *testing.T) *fakeReporter {
+	reporter := &fakeReporter{}
+	ErrorReporter = reporter
+	t.Cleanup(func() {
+		ErrorReporter = nil
+		ErrorSampleRate = 1.0
+	})
+	return reporter
+}
+
+func TestStorageFailureReported(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	reporter := useReporter(t)
+	r := setupRouter(false)
+
+	store.err = fmt.Errorf("memStorage: %w", errors.New("connection reset"))
+	w := performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp", nil)
+	assert.Equal(t, 500, w.Code)
+
+	if assert.Len(t, reporter.events, 1) {
+		event := reporter.events[0]
+		assert.Equal(t, "/faceclaim/metadata/:bucket/:charid/:key", event.Route)
+		assert.Equal(t, 500, event.Status)
+		assert.Equal(t, w.Header().Get("X-Request-ID"), event.RequestID)
+		assert.Equal(t, map[string]string{"bucket": testBucket, "charid": "__test"}, event.Tags)
+		assert.Equal(t, []string{"memStorage: connection reset", "connection reset"}, event.Chain)
+	}
+}
+
+func TestClientErrorsNotReported(t *testing.T) {
+	useFakeBackends(t)
+	reporter := useReporter(t)
+	r := setupRouter(false)
+
+	w := performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/deadbeef.webp", nil)
+	assert.Equal(t, 404, w.Code)
+	w = performRequest(r, "POST", "/faceclaim/upload", bytes.NewBufferString("not json"))
+	assert.Equal(t, 400, w.Code)
+
+	assert.Empty(t, reporter.events)
+}
+
+func TestPanicReported(t *testing.T) {
+	reporter := useReporter(t)
+	r := setupRouter(false)
+	r.GET("/panic", func(c *gin.Context) { panic("oh no") })
+
+	w := performRequest(r, "GET", "/panic", nil)
+	assert.Equal(t, 500, w.Code)
+	if assert.Len(t, reporter.events, 1) {
+		assert.Equal(t, "panic: oh no", reporter.events[0].Err.Error())
+		assert.NotEmpty(t, reporter.events[0].Stack)
+	}
+}
+
+func TestErrorSampling(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	reporter := useReporter(t)
+	ErrorSampleRate = 0
+	r := setupRouter(false)
+
+	store.err = errors.New("connection reset")
+	performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp", nil)
+	assert.Empty(t, reporter.events)
+}
+
+func TestStackdriverReporter(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := &stackdriverReporter{w: &buf, service: "inconnu-api"}
+	reporter.Report(context.Background(), ErrorEvent{
+		Err:    errors.New("boom"),
+		Route:  "/faceclaim/upload",
+		Status: 500,
+	})
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent", entry["@type"])
+	assert.Equal(t, "boom", entry["message"])
+}
+
+func TestReportedErrorsRedacted(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	reporter := useReporter(t)
+	r := setupRouter(false)
+
+	store.err = fmt.Errorf("memStorage: %w", errors.New("Get "+signedURL+": connection reset"))
+	performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp", nil)
+
+	if assert.Len(t, reporter.events, 1) {
+		event := reporter.events[0]
+		assert.NotContains(t, event.Err.Error(), "deadbeef")
+		for _, message := range event.Chain {
+			assert.Contains(t, message, "X-Goog-Signature=[redacted]")
+			assert.NotContains(t, message, "deadbeef")
+		}
+	}
+}
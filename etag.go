@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Computes a strong ETag for a listing from its objects' names and
+// generations, so it changes whenever one is added, removed, or overwritten,
+// and from their metagenerations, which change when their metadata does. The
+// response format is mixed in, since JSON and msgpack listings differ.
+func listingETag(c *gin.Context, objects []*storage.ObjectAttrs) string {
+	entries := make([]string, len(objects))
+	for i, attrs := range objects {
+		entries[i] = fmt.Sprintf("%v %d %d", attrs.Name, attrs.Generation, attrs.Metageneration)
+	}
+	sort.Strings(entries)
+
+	hash := sha256.New()
+	fmt.Fprintln(hash, c.NegotiateFormat(responseFormats...))
+	for _, entry := range entries {
+		fmt.Fprintln(hash, entry)
+	}
+	return fmt.Sprintf("%q", base64.RawURLEncoding.EncodeToString(hash.Sum(nil)[:18]))
+}
+
+// Sets a listing's ETag and, if the client's If-None-Match already has it,
+// responds with a 304. Returns whether it did, in which case the handler has
+// nothing left to do.
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	c.Writer.Header().Add("Vary", "Accept")
+	if !etagMatches(c.GetHeader("If-None-Match"), etag) {
+		return false
+	}
+	c.AbortWithStatus(http.StatusNotModified)
+	return true
+}
+
+// Reports whether an If-None-Match header lists an ETag. As RFC 9110 asks,
+// weak validators match their strong equivalents.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
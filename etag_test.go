@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// GET a path with extra headers
+func getWithHeaders(r http.Handler, path string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestListingETag(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	path := "/faceclaim/list/" + testBucket + "/" + testCharID
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	first := performRequest(r, "GET", path, nil)
+	etag := first.Header().Get("ETag")
+	assert.Equal(t, 200, first.Code)
+	assert.NotEmpty(t, etag)
+	assert.False(t, strings.HasPrefix(etag, "W/"), "The ETag should be strong")
+
+	// Unchanged, so there's nothing to send, with or without compression
+	for _, encoding := range []string{"", "gzip"} {
+		w := getWithHeaders(r, path, map[string]string{"If-None-Match": etag, "Accept-Encoding": encoding})
+		assert.Equal(t, 304, w.Code)
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+	}
+	w := getWithHeaders(r, path, map[string]string{"If-None-Match": `"other", W/` + etag})
+	assert.Equal(t, 304, w.Code, "Weak and listed ETags should match")
+
+	// A new upload changes the ETag
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	w = getWithHeaders(r, path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	etag = w.Header().Get("ETag")
+
+	// As does overwriting an object
+	object := objectKey(testBucket, response.URL)
+	store.Upload(context.Background(), testBucket, object, strings.NewReader("rewritten"), UploadOptions{ContentType: "image/webp"})
+	w = getWithHeaders(r, path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	etag = w.Header().Get("ETag")
+
+	// And removing one
+	w = performRequest(r, "DELETE", "/faceclaim/delete/"+testBucket+"/"+object, nil)
+	assert.Less(t, w.Code, 300, w.Body.String())
+	w = getWithHeaders(r, path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestListingETagDependsOnFormat(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	path := "/faceclaim/list/" + testBucket + "/" + testCharID
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	json := performRequest(r, "GET", path, nil)
+	msgpack := getWithHeaders(r, path, map[string]string{"Accept": "application/msgpack"})
+	assert.NotEqual(t, json.Header().Get("ETag"), msgpack.Header().Get("ETag"))
+	assert.Contains(t, msgpack.Header().Values("Vary"), "Accept")
+
+	w := getWithHeaders(r, path, map[string]string{"Accept": "application/msgpack", "If-None-Match": json.Header().Get("ETag")})
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestLogListETag(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	store.Upload(context.Background(), logBucket, "first.log", strings.NewReader("log"), UploadOptions{ContentType: "text/plain"})
+
+	first := performRequest(r, "GET", "/log/list", nil)
+	assert.Equal(t, 200, first.Code)
+	etag := first.Header().Get("ETag")
+
+	w := getWithHeaders(r, "/log/list", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 304, w.Code)
+
+	store.Upload(context.Background(), logBucket, "second.log", strings.NewReader("log"), UploadOptions{ContentType: "text/plain"})
+	w = getWithHeaders(r, "/log/list", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestETagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`"x", "abc"`, `"abc"`))
+	assert.True(t, etagMatches(`W/"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`*`, `"abc"`))
+	assert.False(t, etagMatches(``, `"abc"`))
+	assert.False(t, etagMatches(`"abcd"`, `"abc"`))
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+)
+
+// memStorage is an in-memory Storage.
+type memStorage struct {
+	sync.Mutex
+	objects map[string]*memObject // Keyed by bucket/object
+	missing map[string]bool       // Buckets that fail CheckBucket
+	private map[string]bool       // Buckets that aren't publicly readable
+	err     error                 // If set, reads and writes fail
+
+	// If set, stored objects lose their last byte after the write's
+	// checksums pass, like corruption GCS didn't catch
+	corrupt bool
+
+	// If set, called before each upload or copy, e.g. to race it with another
+	// writer
+	beforeUpload func(bucket, object string)
+
+	// If set, called before each download or listing, e.g. to hold it up
+	beforeDownload func(bucket, object string)
+	beforeList     func(bucket string)
+
+	// If set, uploads it returns true for fail. It's called with the lock
+	// held, so it's safe to count calls in it.
+	rejectUpload func(bucket, object string) bool
+
+	generation int64 // The last generation assigned
+
+	publicChecks int // How many times IsPublic was called
+	lists        int // How many times List was called
+}
+
+type memObject struct {
+	data  []byte
+	attrs storage.ObjectAttrs
+}
+
+// Rejects metadata GCS would: values that aren't valid UTF-8, or that contain
+// control characters, and more than 8 KiB in all.
+func checkMemMetadata(metadata map[string]string) error {
+	size := 0
+	for k, v := range metadata {
+		if !utf8.ValidString(v) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return fmt.Errorf("memStorage: invalid metadata value for %v", k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > 8<<10 {
+		return errors.New("memStorage: metadata exceeds 8 KiB")
+	}
+	return nil
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string]*memObject)}
+}
+
+func (s *memStorage) Upload(ctx context.Context, bucket, object string, data io.Reader, opts UploadOptions) error {
+	if err := s.failure(); err != nil {
+		return err
+	}
+	if hook := s.beforeUpload; hook != nil {
+		s.beforeUpload = nil // So the hook's own uploads aren't intercepted
+		hook(bucket, object)
+		s.beforeUpload = hook
+	}
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	crc, md5sum := checksums(b)
+	if opts.CRC32C != 0 && opts.CRC32C != crc || opts.MD5 != nil && !bytes.Equal(opts.MD5, md5sum) {
+		return errors.New("memStorage: checksum mismatch")
+	}
+	if err := checkMemMetadata(opts.Metadata); err != nil {
+		return err
+	}
+	storageClass := opts.StorageClass
+	if storageClass == "" {
+		storageClass = "STANDARD" // The buckets' default
+	}
+	copied := make(map[string]string, len(opts.Metadata))
+	for k, v := range opts.Metadata {
+		copied[k] = v
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.rejectUpload != nil && s.rejectUpload(bucket, object) {
+		return errors.New("memStorage: upload rejected")
+	}
+	existing, exists := s.objects[bucket+"/"+object]
+	if opts.DoesNotExist && exists ||
+		opts.IfGenerationMatch != 0 && (!exists || existing.attrs.Generation != opts.IfGenerationMatch) {
+		return fmt.Errorf("memStorage: %w", ErrPreconditionFailed)
+	}
+	s.generation++
+	now := time.Now()
+	if s.corrupt && len(b) > 0 {
+		b = b[:len(b)-1]
+		crc, md5sum = checksums(b)
+	}
+	s.objects[bucket+"/"+object] = &memObject{
+		data: b,
+		attrs: storage.ObjectAttrs{
+			Bucket:       bucket,
+			Name:         object,
+			ContentType:  opts.ContentType,
+			Size:         int64(len(b)),
+			Metadata:     copied,
+			CRC32C:       crc,
+			MD5:          md5sum,
+			Generation:   s.generation,
+			StorageClass: storageClass,
+			CacheControl: opts.CacheControl,
+			Created:      now,
+			Updated:      now,
+		},
+	}
+	return nil
+}
+
+func (s *memStorage) Download(ctx context.Context, bucket, object string) ([]byte, error) {
+	if hook := s.beforeDownload; hook != nil {
+		hook(bucket, object)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	if o, ok := s.objects[bucket+"/"+object]; ok {
+		return o.data, nil
+	}
+	return nil, fmt.Errorf("memStorage: %w", storage.ErrObjectNotExist)
+}
+
+func (s *memStorage) Attrs(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	if o, ok := s.objects[bucket+"/"+object]; ok {
+		attrs := o.attrs
+		return &attrs, nil
+	}
+	return nil, fmt.Errorf("memStorage: %w", storage.ErrObjectNotExist)
+}
+
+func (s *memStorage) Delete(ctx context.Context, bucket, object string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	o, ok := s.objects[bucket+"/"+object]
+	if !ok {
+		return fmt.Errorf("memStorage: %w", storage.ErrObjectNotExist)
+	}
+	if o.attrs.TemporaryHold {
+		return errors.New("memStorage: the object is under a hold") // As GCS refuses
+	}
+	delete(s.objects, bucket+"/"+object)
+	return nil
+}
+
+func (s *memStorage) List(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error) {
+	if err := s.failure(); err != nil {
+		return nil, err
+	}
+	if hook := s.beforeList; hook != nil {
+		hook(bucket)
+	}
+	s.Lock()
+	s.lists++
+	s.Unlock()
+	var objects []*storage.ObjectAttrs
+	for _, key := range s.keys(bucket) {
+		if strings.HasPrefix(key, prefix) {
+			attrs, err := s.Attrs(ctx, bucket, key)
+			if err != nil {
+				continue // Deleted since listing the keys
+			}
+			objects = append(objects, attrs)
+		}
+	}
+	return objects, nil
+}
+
+func (s *memStorage) ListBefore(ctx context.Context, bucket, prefix, end string) ([]*storage.ObjectAttrs, error) {
+	objects, err := s.List(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var before []*storage.ObjectAttrs
+	for _, attrs := range objects {
+		if attrs.Name < end {
+			before = append(before, attrs)
+		}
+	}
+	return before, nil
+}
+
+// Pages are tokened by the name of the last object on the previous page.
+func (s *memStorage) ListPage(ctx context.Context, bucket, prefix, token string, size int) ([]*storage.ObjectAttrs, string, error) {
+	objects, err := s.List(ctx, bucket, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*storage.ObjectAttrs
+	for _, attrs := range objects {
+		if attrs.Name > token {
+			page = append(page, attrs)
+		}
+	}
+	if len(page) <= size {
+		return page, "", nil
+	}
+	return page[:size], page[size-1].Name, nil
+}
+
+func (s *memStorage) Copy(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string, cond Preconditions) (*storage.ObjectAttrs, error) {
+	if hook := s.beforeUpload; hook != nil {
+		s.beforeUpload = nil // So the hook's own uploads aren't intercepted
+		hook(dstBucket, dstObject)
+		s.beforeUpload = hook
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	src, ok := s.objects[srcBucket+"/"+srcObject]
+	if !ok {
+		return nil, fmt.Errorf("memStorage: %w", storage.ErrObjectNotExist)
+	}
+	if existing, exists := s.objects[dstBucket+"/"+dstObject]; cond.DoesNotExist && exists ||
+		cond.IfGenerationMatch != 0 && (!exists || existing.attrs.Generation != cond.IfGenerationMatch) {
+		return nil, fmt.Errorf("memStorage: %w", ErrPreconditionFailed)
+	}
+	dst := &memObject{data: append([]byte(nil), src.data...), attrs: src.attrs}
+	dst.attrs.Bucket, dst.attrs.Name = dstBucket, dstObject
+	s.generation++
+	dst.attrs.Generation, dst.attrs.Updated = s.generation, time.Now()
+	dst.attrs.Metadata = make(map[string]string, len(src.attrs.Metadata))
+	for k, v := range src.attrs.Metadata {
+		dst.attrs.Metadata[k] = v
+	}
+	s.objects[dstBucket+"/"+dstObject] = dst
+	attrs := dst.attrs
+	return &attrs, nil
+}
+
+func (s *memStorage) CheckBucket(ctx context.Context, bucket string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.missing[bucket] {
+		return fmt.Errorf("memStorage: bucket %v does not exist", bucket)
+	}
+	return nil
+}
+
+func (s *memStorage) IsPublic(ctx context.Context, bucket string) (bool, error) {
+	if err := s.failure(); err != nil {
+		return false, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.publicChecks++
+	return !s.private[bucket], nil
+}
+
+func (s *memStorage) SignURL(ctx context.Context, bucket, object string, expires time.Duration) (string, error) {
+	if err := s.failure(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://signed.example/%v/%v?expires=%v", bucket, object, int(expires.Seconds())), nil
+}
+
+func (s *memStorage) SetHold(ctx context.Context, bucket, object string, held bool) (*storage.ObjectAttrs, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	o, ok := s.objects[bucket+"/"+object]
+	if !ok {
+		return nil, fmt.Errorf("memStorage: %w", storage.ErrObjectNotExist)
+	}
+	o.attrs.TemporaryHold = held
+	o.attrs.Metageneration++
+	o.attrs.Updated = time.Now()
+	attrs := o.attrs
+	return &attrs, nil
+}
+
+func (s *memStorage) UpdateMetadata(ctx context.Context, bucket, object string, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	o, ok := s.objects[bucket+"/"+object]
+	if !ok {
+		return nil, fmt.Errorf("memStorage: %w", storage.ErrObjectNotExist)
+	}
+	if err := checkMemMetadata(metadata); err != nil {
+		return nil, err
+	}
+	merged := make(map[string]string, len(o.attrs.Metadata)+len(metadata))
+	for k, v := range o.attrs.Metadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	o.attrs.Metadata = merged
+	o.attrs.Metageneration++
+	o.attrs.Updated = time.Now()
+	attrs := o.attrs
+	return &attrs, nil
+}
+
+func (s *memStorage) SetContentType(ctx context.Context, bucket, object, contentType string) (*storage.ObjectAttrs, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	o, ok := s.objects[bucket+"/"+object]
+	if !ok {
+		return nil, fmt.Errorf("memStorage: %w", storage.ErrObjectNotExist)
+	}
+	o.attrs.ContentType = contentType
+	o.attrs.Metageneration++
+	o.attrs.Updated = time.Now()
+	attrs := o.attrs
+	return &attrs, nil
+}
+
+func (s *memStorage) failure() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+func (s *memStorage) exists(bucket, object string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.objects[bucket+"/"+object]
+	return ok
+}
+
+// Returns the sorted names of the objects in a bucket
+func (s *memStorage) keys(bucket string) []string {
+	s.Lock()
+	defer s.Unlock()
+	var keys []string
+	for k := range s.objects {
+		if object := strings.TrimPrefix(k, bucket+"/"); object != k {
+			keys = append(keys, object)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fakePublisher records published messages. Given a store, it also performs
+// deletions the way the Cloud Functions subscribed to the topics would.
+type fakePublisher struct {
+	sync.Mutex
+	messages []publishedMessage
+	store    *memStorage
+	err      error // If set, publishing fails
+
+	// If set, messages it returns true for fail to publish
+	reject func(msg map[string]string) bool
+}
+
+type publishedMessage struct {
+	Topic      string
+	Data       map[string]string
+	Attributes map[string]string
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) error {
+	// Recorded as the payload's fields, with numbers as strings
+	message, err := decodeMessage(data)
+	if err != nil {
+		return err
+	}
+	var envelope MessageEnvelope
+	var fields map[string]interface{}
+	json.Unmarshal(data, &envelope)
+	decoder := json.NewDecoder(bytes.NewReader(envelope.Payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	msg := make(map[string]string, len(fields))
+	for key, value := range fields {
+		msg[key] = fmt.Sprint(value)
+	}
+
+	p.Lock()
+	if p.err != nil {
+		defer p.Unlock()
+		return p.err
+	}
+	if p.reject != nil && p.reject(msg) {
+		p.Unlock()
+		return errors.New("fakePublisher: rejected")
+	}
+	p.messages = append(p.messages, publishedMessage{topic, msg, attributes})
+	p.Unlock()
+
+	if p.store == nil {
+		return nil
+	}
+	switch m := message.(type) {
+	case DeleteSingle:
+		p.store.Delete(ctx, m.Bucket, m.Key)
+	case DeleteGroup:
+		for _, key := range p.store.keys(m.Bucket) {
+			if strings.HasPrefix(key, m.CharID+"/") {
+				p.store.Delete(ctx, m.Bucket, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *fakePublisher) CheckTopic(ctx context.Context, topic string) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
+func (p *fakePublisher) published() []publishedMessage {
+	p.Lock()
+	defer p.Unlock()
+	return append([]publishedMessage(nil), p.messages...)
+}
+
+// fakeConverter re-encodes images as lossless WebP, so tests can inspect the
+// output without needing cwebp.
+type fakeConverter struct{}
+
+func (fakeConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(encodeLosslessWebP(img))
+	return err
+}
+
+func (fakeConverter) Version(ctx context.Context) (string, error) {
+	return "fake 1.0", nil
+}
+
+// Encodes an image as the simplest valid lossless WebP: no transforms, and
+// fixed 8-bit codes for every channel, so it's large but exact.
+func encodeLosslessWebP(img image.Image) []byte {
+	bounds := img.Bounds()
+	var w webpBitWriter
+	w.bits(0x2f, 8) // VP8L signature
+	w.bits(uint32(bounds.Dx()-1), 14)
+	w.bits(uint32(bounds.Dy()-1), 14)
+	w.bits(1, 1) // Alpha may be used
+	w.bits(0, 3) // Version
+	w.bits(0, 1) // No transforms
+	w.bits(0, 1) // No color cache
+	w.bits(0, 1) // No meta prefix codes
+
+	// Green (with the unused backward reference lengths), red, blue, and
+	// alpha get a code giving each literal 8 bits. The code lengths
+	// themselves are coded with 1 bit: 0 for unused, 1 for 8.
+	for _, alphabet := range []int{280, 256, 256, 256} {
+		w.bits(0, 1) // Normal code
+		w.bits(12-4, 4)
+		// In the spec's order: 17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8
+		for _, length := range []uint32{0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1} {
+			w.bits(length, 3)
+		}
+		w.bits(0, 1) // Every symbol's length follows
+		for symbol := 0; symbol < alphabet; symbol++ {
+			if symbol < 256 {
+				w.bits(1, 1)
+			} else {
+				w.bits(0, 1)
+			}
+		}
+	}
+	// Distances are never used, so a single symbol does
+	w.bits(1, 1) // Simple code
+	w.bits(0, 1) // One symbol
+	w.bits(0, 1) // 1-bit symbol
+	w.bits(0, 1)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			for _, v := range []uint8{c.G, c.R, c.B, c.A} {
+				w.code(uint32(v), 8)
+			}
+		}
+	}
+	vp8l := w.flush()
+
+	var out bytes.Buffer
+	chunkSize := len(vp8l)
+	padded := chunkSize + chunkSize%2
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(4+8+padded))
+	out.WriteString("WEBPVP8L")
+	binary.Write(&out, binary.LittleEndian, uint32(chunkSize))
+	out.Write(vp8l)
+	if padded != chunkSize {
+		out.WriteByte(0)
+	}
+	return out.Bytes()
+}
+
+// webpBitWriter packs bits least significant first, as VP8L reads them.
+type webpBitWriter struct {
+	out  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (w *webpBitWriter) bits(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nacc
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+// Writes a prefix code, which is read most significant bit first.
+func (w *webpBitWriter) code(v uint32, n uint) {
+	for i := n; i > 0; i-- {
+		w.bits(v>>(i-1)&1, 1)
+	}
+}
+
+func (w *webpBitWriter) flush() []byte {
+	if w.nacc > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.nacc = 0, 0
+	}
+	return w.out
+}
+
+// fakeRecords is an in-memory CharacterRecords, holding each character's
+// faceclaim URLs.
+type fakeRecords struct {
+	sync.Mutex
+	characters map[string][]string
+	err        error // If set, reads and updates fail
+}
+
+func (r *fakeRecords) Images(ctx context.Context, charid string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	images, ok := r.characters[charid]
+	if !ok {
+		return nil, ErrCharacterNotFound
+	}
+	return append([]string(nil), images...), nil
+}
+
+func (r *fakeRecords) RemoveImage(ctx context.Context, charid, url string) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return false, r.err
+	}
+	images := r.characters[charid]
+	for i, image := range images {
+		if image == url {
+			r.characters[charid] = append(images[:i:i], images[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Install in-memory character records for the duration of a test.
+func useFakeRecords(t testing.TB, characters map[string][]string) *fakeRecords {
+	records := &fakeRecords{characters: characters}
+	Records = records
+	t.Cleanup(func() { Records = nil })
+	return records
+}
+
+// Name faceclaims from a sequence starting at seed for the duration of a test.
+// Their keys are <charid>/<seed, seed+1, ... as 24 hex digits>.webp.
+func useDeterministicIDs(t testing.TB, seed uint64) {
+	old := newObjectID
+	newObjectID = sequentialIDs(seed)
+	t.Cleanup(func() { newObjectID = old })
+}
+
+// Install in-memory backends for the duration of a test. The publisher acts
+// on the store like the real delete workers. Deletions queued, usage tallied,
+// attributes cached, and guilds labeled by earlier tests are forgotten.
+func useFakeBackends(t testing.TB) (*memStorage, *fakePublisher) {
+	store := newMemStorage()
+	publisher := &fakePublisher{store: store}
+
+	oldStore, oldPublisher, oldConverter := Store, MessagePublisher, ImageConverter
+	Store, MessagePublisher, ImageConverter = store, publisher, fakeConverter{}
+	recentDeletes = newRecentSet(deleteDedupeWindow)
+	deletionLocks = newDeletionLockSet()
+	recentPushes = newRecentSet(pushDedupeWindow)
+	guildUsage = newUsageTally()
+	attrCache = newAttrLRU(AttrCacheSize, AttrCacheTTL)
+	guildLabels = newGuildLabeler(maxGuildLabels, guildPromotionThreshold)
+	publicAccess = newAccessCache()
+	listCache = newListingCache(ListCacheTTL)
+	tokenUsage.reset()
+	t.Cleanup(func() {
+		Store, MessagePublisher, ImageConverter = oldStore, oldPublisher, oldConverter
+	})
+
+	return store, publisher
+}
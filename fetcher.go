@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A Fetcher downloads source images.
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) (*FetchedImage, error)
+}
+
+// A ConditionalFetcher can skip downloading an image that hasn't changed since
+// it was last fetched.
+type ConditionalFetcher interface {
+	FetchIfChanged(ctx context.Context, url string, v Validators) (*FetchedImage, error)
+}
+
+// Validators identify the version of an image that was last fetched, as the
+// host's ETag and Last-Modified headers gave it. Either may be empty.
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Reports whether there's anything to make a fetch conditional on.
+func (v Validators) empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// A FetchedImage is a downloaded image and where it really came from.
+type FetchedImage struct {
+	Data []byte
+
+	// The URL the image was finally served from, after any redirects
+	URL       string
+	Redirects int
+
+	// The host of each URL fetched, starting with the one we were given, if
+	// there were redirects
+	Hosts []string
+
+	// The upstream's headers, if it sent them
+	ContentType  string
+	LastModified string
+	ETag         string
+
+	// Set if the host said the image hasn't changed since its validators were
+	// given, in which case there's no Data
+	NotModified bool
+}
+
+// ImageFetcher is the Fetcher used by the faceclaim pipeline.
+var ImageFetcher Fetcher = httpFetcher{}
+
+// The longest an upstream Retry-After is waited out before retrying. Longer
+// waits are left to the caller.
+var maxRetryWait = 5 * time.Second
+
+// The wait when a 429 doesn't say how long to back off.
+const defaultRetryWait = time.Second
+
+// FetchMaxRedirects is the most redirects followed to reach an image. Read
+// from MAX_FETCH_REDIRECTS.
+var FetchMaxRedirects = 5
+
+// FetchAllowedHosts, if not empty, are the only hosts images are fetched
+// from, along with their subdomains. Read from FETCH_ALLOWED_HOSTS.
+var FetchAllowedHosts []string
+
+// Hosts that are never fetched from, whatever the allowlist says: the cloud
+// metadata server hands out credentials.
+var blockedFetchHosts = []string{"metadata.google.internal", "metadata"}
+
+// Internal networks that images may be fetched from anyway. It's empty in
+// production; the tests set it so their image servers on the loopback
+// network can be reached.
+var fetchAllowedNetworks []*net.IPNet
+
+// How hostnames are resolved to check where they point.
+var fetchResolver = net.DefaultResolver
+
+// The carrier-grade NAT range, which net.IP doesn't count as private but
+// cloud providers use internally.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Reads FETCH_ALLOWED_HOSTS, a comma-separated list, and MAX_FETCH_REDIRECTS,
+// which defaults to 5.
+func prepareFetcher() error {
+	FetchMaxRedirects = 5
+	if value, ok := os.LookupEnv("MAX_FETCH_REDIRECTS"); ok {
+		redirects, err := strconv.Atoi(value)
+		if err != nil || redirects < 0 {
+			return fmt.Errorf("MAX_FETCH_REDIRECTS must be a non-negative integer, not %q", value)
+		}
+		FetchMaxRedirects = redirects
+	}
+
+	FetchAllowedHosts = nil
+	for _, host := range strings.Split(os.Getenv("FETCH_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host == "" {
+			continue
+		}
+		if strings.ContainsAny(host, "/:@") {
+			return fmt.Errorf("FETCH_ALLOWED_HOSTS: %q isn't a hostname", host)
+		}
+		FetchAllowedHosts = append(FetchAllowedHosts, host)
+	}
+	return nil
+}
+
+// A BlockedURLError means an image URL, or a URL it redirected to, points
+// somewhere images can't be fetched from.
+type BlockedURLError struct {
+	URL    string
+	Reason string
+}
+
+func (e *BlockedURLError) Error() string {
+	return fmt.Sprintf("can't fetch %v: %v", e.URL, e.Reason)
+}
+
+// Checks that an image may be fetched from a URL: it must be HTTP(S), be on an
+// allowed host if FETCH_ALLOWED_HOSTS is set, and not point at the metadata
+// server or an internal address. Hostnames are resolved to check the
+// addresses they point at; those that can't be are left for the fetch to
+// fail on.
+func validateFetchURL(ctx context.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &BlockedURLError{URL: u.String(), Reason: fmt.Sprintf("unsupported scheme %q", u.Scheme)}
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return &BlockedURLError{URL: u.String(), Reason: "no host"}
+	}
+	for _, blocked := range blockedFetchHosts {
+		if host == blocked {
+			return &BlockedURLError{URL: u.String(), Reason: "the metadata server is off limits"}
+		}
+	}
+	if !allowedFetchHost(host) {
+		return &BlockedURLError{URL: u.String(), Reason: fmt.Sprintf("%v isn't an allowed host", host)}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if reason := blockedFetchAddr(ip); reason != "" {
+			return &BlockedURLError{URL: u.String(), Reason: reason}
+		}
+		return nil
+	}
+	addrs, _ := fetchResolver.LookupIPAddr(ctx, host)
+	for _, addr := range addrs {
+		if reason := blockedFetchAddr(addr.IP); reason != "" {
+			return &BlockedURLError{URL: u.String(), Reason: fmt.Sprintf("%v resolves to %v; %v", host, addr.IP, reason)}
+		}
+	}
+	return nil
+}
+
+// Reports whether FETCH_ALLOWED_HOSTS, if set, includes a host or one of its
+// parent domains.
+func allowedFetchHost(host string) bool {
+	if len(FetchAllowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range FetchAllowedHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns why images can't be fetched from an address, or "" if they can.
+// Loopback, private, shared, link-local, and unspecified addresses reach this
+// server's own network, such as the admin port, rather than the internet.
+func blockedFetchAddr(ip net.IP) string {
+	for _, network := range fetchAllowedNetworks {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+	switch {
+	case ip.IsLoopback():
+		return "loopback addresses are off limits"
+	case ip.IsPrivate():
+		return "private addresses are off limits"
+	case sharedAddressSpace.Contains(ip):
+		return "shared addresses are off limits"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "link-local addresses are off limits"
+	case ip.IsUnspecified():
+		return "unspecified addresses are off limits"
+	}
+	return ""
+}
+
+// Checks each address images are about to be fetched from, as it's dialed.
+// validateFetchURL's lookup can't be trusted alone: by the time the fetch
+// resolves the host, it may point somewhere else.
+func checkFetchDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("checkFetchDial: %v", err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &BlockedURLError{URL: address, Reason: "not an IP address"}
+	}
+	if reason := blockedFetchAddr(ip); reason != "" {
+		return &BlockedURLError{URL: address, Reason: reason}
+	}
+	return nil
+}
+
+// Parses and validates an image URL.
+func checkFetchURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return &BlockedURLError{URL: raw, Reason: err.Error()}
+	}
+	return validateFetchURL(ctx, u)
+}
+
+// A RedirectError means an image URL redirected more times than
+// FetchMaxRedirects allows, or back to a URL it had already been through.
+type RedirectError struct {
+	URL       string
+	Redirects int
+	Loop      string // The URL revisited, for a loop
+}
+
+func (e *RedirectError) Error() string {
+	if e.Loop != "" {
+		return fmt.Sprintf("unable to fetch %v: redirected in a loop back to %v", e.URL, e.Loop)
+	}
+	return fmt.Sprintf("unable to fetch %v: stopped after %v redirects", e.URL, e.Redirects)
+}
+
+// Follows at most FetchMaxRedirects redirects, and none that loop, validating
+// each that moves to another host as if it were the URL we were given.
+func checkFetchRedirect(req *http.Request, via []*http.Request) error {
+	for _, previous := range via {
+		if previous.URL.String() == req.URL.String() {
+			return &RedirectError{URL: via[0].URL.String(), Redirects: len(via), Loop: req.URL.String()}
+		}
+	}
+	if len(via) > FetchMaxRedirects {
+		return &RedirectError{URL: via[0].URL.String(), Redirects: FetchMaxRedirects}
+	}
+	if !strings.EqualFold(req.URL.Host, via[len(via)-1].URL.Host) {
+		return validateFetchURL(req.Context(), req.URL)
+	}
+	return nil
+}
+
+// The client images are fetched with. Its dialer refuses internal addresses.
+var fetchClient = &http.Client{
+	CheckRedirect: checkFetchRedirect,
+	Transport:     newFetchTransport(),
+}
+
+// Returns the default transport, dialing through checkFetchDial. It never
+// goes through a proxy, which checkFetchDial would check in place of the
+// image host.
+func newFetchTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkFetchDial,
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// A RateLimitError means the image host is still rate-limiting us after a
+// retry, or asked for a longer wait than we're willing to make.
+type RateLimitError struct {
+	URL        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v is rate-limited; retry after %v", e.URL, e.RetryAfter)
+}
+
+// A FetchError means the image couldn't be downloaded intact, e.g. because
+// the connection dropped partway through.
+type FetchError struct {
+	URL    string
+	Reason string
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("unable to fetch %v: %v", e.URL, e.Reason)
+}
+
+// httpFetcher downloads images over HTTP.
+type httpFetcher struct{}
+
+// Fetch retries once if the host responds with a 429 whose Retry-After is
+// short enough to wait out within maxRetryWait and the context's deadline.
+func (f httpFetcher) Fetch(ctx context.Context, url string) (*FetchedImage, error) {
+	return f.FetchIfChanged(ctx, url, Validators{})
+}
+
+// FetchIfChanged sends the validators as If-None-Match and If-Modified-Since,
+// and retries like Fetch.
+func (f httpFetcher) FetchIfChanged(ctx context.Context, url string, v Validators) (*FetchedImage, error) {
+	if err := checkFetchURL(ctx, url); err != nil {
+		return nil, err
+	}
+	fetched, wait, err := f.get(ctx, url, v)
+	if err != nil || wait < 0 {
+		return fetched, err
+	}
+	if !canWait(ctx, wait) {
+		recordRateLimit("rejected")
+		return nil, &RateLimitError{URL: url, RetryAfter: wait}
+	}
+	recordRateLimit("retried")
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("httpFetcher.Fetch: %w", ctx.Err())
+	case <-timer.C:
+	}
+
+	fetched, wait, err = f.get(ctx, url, v)
+	if err != nil || wait < 0 {
+		return fetched, err
+	}
+	recordRateLimit("rejected")
+	return nil, &RateLimitError{URL: url, RetryAfter: wait}
+}
+
+// Downloads the URL once, unless it's unchanged since the validators. If the
+// host rate-limits us, the requested wait is returned instead of an image;
+// otherwise, the wait is negative.
+func (httpFetcher) get(ctx context.Context, url string, v Validators) (*FetchedImage, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, -1, fmt.Errorf("http.NewRequest: %v", err)
+	}
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, -1, fmt.Errorf("http.Get: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, retryAfter(resp.Header.Get("Retry-After")), nil
+	}
+	if resp.StatusCode == http.StatusNotModified && !v.empty() {
+		return &FetchedImage{URL: resp.Request.URL.String(), NotModified: true}, -1, nil
+	}
+
+	// Images over MAX_IMAGE_BYTES are refused without reading them in full
+	maxBytes := currentConfig().MaxImageBytes
+	body := io.Reader(resp.Body)
+	if maxBytes > 0 {
+		if resp.ContentLength > maxBytes {
+			return nil, -1, &ImageTooLargeError{Bytes: resp.ContentLength, MaxBytes: maxBytes}
+		}
+		body = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(body); err != nil {
+		return nil, -1, &FetchError{URL: url, Reason: err.Error()}
+	}
+	if maxBytes > 0 && int64(buf.Len()) > maxBytes {
+		return nil, -1, &ImageTooLargeError{Bytes: -1, MaxBytes: maxBytes}
+	}
+	// The caller keeps the image, so it gets its own copy
+	data := append([]byte(nil), buf.Bytes()...)
+	if err := checkComplete(data, resp.ContentLength); err != nil {
+		return nil, -1, &FetchError{URL: url, Reason: err.Error()}
+	}
+	// Each redirected request remembers the response that sent it
+	redirects := 0
+	hosts := []string{resp.Request.URL.Hostname()}
+	for r := resp.Request; r.Response != nil; r = r.Response.Request {
+		redirects++
+		hosts = append([]string{r.Response.Request.URL.Hostname()}, hosts...)
+	}
+	if redirects == 0 {
+		hosts = nil
+	}
+	return &FetchedImage{
+		Data:         data,
+		URL:          resp.Request.URL.String(),
+		Redirects:    redirects,
+		Hosts:        hosts,
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ETag:         resp.Header.Get("ETag"),
+	}, -1, nil
+}
+
+// Fetches an image with ImageFetcher, unless it hasn't changed since the
+// validators. Fetchers that can't make conditional requests always download it.
+func fetchIfChanged(ctx context.Context, url string, v Validators) (*FetchedImage, error) {
+	if f, ok := ImageFetcher.(ConditionalFetcher); ok && !v.empty() {
+		return f.FetchIfChanged(ctx, url, v)
+	}
+	return ImageFetcher.Fetch(ctx, url)
+}
+
+// Checks that a download wasn't truncated. If the host gave a Content-Length,
+// the data must be that long; otherwise, an image in a supported format must
+// decode in full. Unsupported formats are left for checkImageType to reject.
+func checkComplete(data []byte, contentLength int64) error {
+	if contentLength >= 0 {
+		if int64(len(data)) != contentLength {
+			return fmt.Errorf("received %v of %v bytes", len(data), contentLength)
+		}
+		return nil
+	}
+	if _, err := checkImageType(data); err != nil {
+		return nil
+	}
+	if _, err := decodeImage(data); err != nil {
+		return fmt.Errorf("incomplete image: %v", err)
+	}
+	return nil
+}
+
+// Parses a Retry-After header, which is either a number of seconds or an
+// HTTP date.
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryWait
+}
+
+// Reports whether a wait is short enough to make before retrying.
+func canWait(ctx context.Context, wait time.Duration) bool {
+	if wait > maxRetryWait {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+		return false
+	}
+	return true
+}
+
+// Records where an image was fetched from in its faceclaim's metadata.
+// Headers the upstream didn't send are left out.
+func (f *FetchedImage) stamp(metadata map[string]string) {
+	for key, value := range map[string]string{
+		"upstream_content_type":  f.ContentType,
+		"upstream_last_modified": f.LastModified,
+		"upstream_etag":          f.ETag,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if f.Redirects > 0 {
+		metadata["redirects"] = strconv.Itoa(f.Redirects)
+		metadata["redirect_hosts"] = strings.Join(f.Hosts, ",")
+	}
+}
+
+// Returns a warning about the redirects followed to fetch an image, or
+// nothing if there weren't any.
+func (f *FetchedImage) redirectWarning() string {
+	if f.Redirects == 0 {
+		return ""
+	}
+	host := f.URL
+	if u, err := url.Parse(f.URL); err == nil {
+		host = u.Hostname()
+	}
+	plural := "s"
+	if f.Redirects == 1 {
+		plural = ""
+	}
+	return fmt.Sprintf("The image URL redirected %v time%v; it was fetched from %v", f.Redirects, plural, host)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Serve the test PNG, rate-limiting the first `limited` requests with the
+// given Retry-After. The request count is returned alongside the server.
+func serveRateLimited(limited int32, retryAfter string) (*httptest.Server, *int32) {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) <= limited {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	return server, &count
+}
+
+// Upload from a URL without replacing it with the usual fixture server
+func postImageURL(r http.Handler, url string) *httptest.ResponseRecorder {
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = url
+	body, _ := json.Marshal(request)
+	return performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+}
+
+func TestUpstreamRateLimitRetried(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	server, count := serveRateLimited(1, "0")
+	defer server.Close()
+	retried := testutil.ToFloat64(upstreamRateLimitsTotal.WithLabelValues("retried"))
+
+	w := postImageURL(r, server.URL)
+
+	assert.Equal(t, 201, w.Code)
+	assert.Equal(t, int32(2), atomic.LoadInt32(count))
+	assert.Len(t, store.keys(testBucket), 1)
+	assert.Equal(t, retried+1, testutil.ToFloat64(upstreamRateLimitsTotal.WithLabelValues("retried")))
+}
+
+func TestUpstreamRateLimitPersists(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	server, count := serveRateLimited(2, "1")
+	defer server.Close()
+	rejected := testutil.ToFloat64(upstreamRateLimitsTotal.WithLabelValues("rejected"))
+
+	w := postImageURL(r, server.URL)
+
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "upstream_rate_limited")
+	assert.Equal(t, int32(2), atomic.LoadInt32(count), "The fetch should be retried only once")
+	assert.Empty(t, store.keys(testBucket))
+	assert.Equal(t, rejected+1, testutil.ToFloat64(upstreamRateLimitsTotal.WithLabelValues("rejected")))
+}
+
+func TestUpstreamRateLimitTooLong(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	server, count := serveRateLimited(1, "120")
+	defer server.Close()
+
+	start := time.Now()
+	w := postImageURL(r, server.URL)
+
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "120", w.Header().Get("Retry-After"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(count), "Waits beyond maxRetryWait are left to the caller")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 3*time.Second, retryAfter("3"))
+	assert.Equal(t, defaultRetryWait, retryAfter(""))
+	assert.Equal(t, defaultRetryWait, retryAfter("soon"))
+	assert.Equal(t, time.Duration(0), retryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+
+	wait := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, time.Minute.Seconds(), wait.Seconds(), 2)
+}
+
+// Serve half of the test PNG. With a Content-Length, the connection is
+// dropped partway through; without one, the truncated image is sent in full.
+func serveTruncated(withLength bool) *httptest.Server {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	data := buf.Bytes()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !withLength {
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			return
+		}
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: %v\r\n\r\n", len(data))
+		rw.Write(data[:len(data)/2])
+		rw.Flush()
+	}))
+}
+
+func TestTruncatedDownloadRejected(t *testing.T) {
+	for _, withLength := range []bool{true, false} {
+		store, _ := useFakeBackends(t)
+		r := setupRouter(false)
+		server := serveTruncated(withLength)
+
+		w := postImageURL(r, server.URL)
+		server.Close()
+
+		assert.Equal(t, 502, w.Code, "Content-Length: %v", withLength)
+		assert.Contains(t, w.Body.String(), "upstream_fetch_failed")
+		assert.Empty(t, store.keys(testBucket))
+	}
+}
+
+func TestCheckComplete(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	data := buf.Bytes()
+
+	assert.NoError(t, checkComplete(data, int64(len(data))))
+	assert.NoError(t, checkComplete(data, -1))
+	assert.Error(t, checkComplete(data[:10], int64(len(data))))
+	assert.Error(t, checkComplete(data[:len(data)/2], -1))
+	assert.NoError(t, checkComplete([]byte(svgFixture), -1), "Unsupported formats are rejected elsewhere")
+}
+
+// Serve the test PNG at /image.png, with Last-Modified and an ETag, after
+// redirecting through /hop/{n} n times
+func serveRedirectChain() *httptest.Server {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hops := strings.TrimPrefix(r.URL.Path, "/hop/"); hops != r.URL.Path {
+			n, _ := strconv.Atoi(hops)
+			next := "/image.png"
+			if n > 1 {
+				next = fmt.Sprintf("/hop/%v", n-1)
+			}
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		w.Header().Set("ETag", `"abc123"`)
+		w.Write(buf.Bytes())
+	}))
+}
+
+// Only fetch from the given hosts for the duration of a test
+func useFetchAllowedHosts(t *testing.T, hosts ...string) {
+	FetchAllowedHosts = hosts
+	t.Cleanup(func() { FetchAllowedHosts = nil })
+}
+
+func TestRedirectsRecorded(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	server := serveRedirectChain()
+	defer server.Close()
+
+	w := postImageURL(r, server.URL+"/hop/3")
+
+	assert.Equal(t, 201, w.Code, w.Body.String())
+	var response FaceclaimResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, server.URL+"/image.png", response.ResolvedURL)
+
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Equal(t, server.URL+"/hop/3", attrs.Metadata["submitted_url"])
+	assert.Equal(t, server.URL+"/image.png", attrs.Metadata["resolved_url"])
+	assert.Equal(t, "3", attrs.Metadata["redirects"])
+	assert.Equal(t, "image/png", attrs.Metadata["upstream_content_type"])
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", attrs.Metadata["upstream_last_modified"])
+	assert.Equal(t, `"abc123"`, attrs.Metadata["upstream_etag"])
+}
+
+func TestTooManyRedirects(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	server := serveRedirectChain()
+	defer server.Close()
+
+	w := postImageURL(r, server.URL+fmt.Sprintf("/hop/%v", FetchMaxRedirects))
+	assert.Equal(t, 201, w.Code)
+
+	w = postImageURL(r, server.URL+fmt.Sprintf("/hop/%v", FetchMaxRedirects+1))
+	assert.Equal(t, 502, w.Code)
+	assert.Contains(t, w.Body.String(), "too_many_redirects")
+	assert.Len(t, store.keys(testBucket), 1)
+
+	// The cap is configurable
+	t.Setenv("MAX_FETCH_REDIRECTS", "1")
+	if err := prepareFetcher(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { FetchMaxRedirects = 5 })
+	w = postImageURL(r, server.URL+"/hop/2")
+	assert.Equal(t, 502, w.Code)
+
+	t.Setenv("MAX_FETCH_REDIRECTS", "-1")
+	assert.Error(t, prepareFetcher())
+}
+
+func TestRedirectHops(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	target := serveRedirectChain()
+	defer target.Close()
+
+	// A shortener on one host redirects to the image on another
+	final := strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/hop/1"
+	shortener := httptest.NewServer(http.RedirectHandler(final, http.StatusFound))
+	defer shortener.Close()
+
+	w := postImageURL(r, shortener.URL)
+	assert.Equal(t, 201, w.Code, w.Body.String())
+	var response FaceclaimResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if assert.Len(t, response.Warnings, 1) {
+		assert.Equal(t, "redirected", response.Warnings[0].Code)
+		assert.Contains(t, response.Warnings[0].Message, "redirected 2 times")
+		assert.Contains(t, response.Warnings[0].Message, "fetched from localhost")
+	}
+
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Equal(t, "2", attrs.Metadata["redirects"])
+	assert.Equal(t, "127.0.0.1,localhost,localhost", attrs.Metadata["redirect_hosts"])
+
+	// Unredirected images get no warning, but the list is still there
+	w = postImageURL(r, target.URL+"/image.png")
+	assert.Equal(t, 201, w.Code)
+	assert.Contains(t, w.Body.String(), `"warnings":[]`)
+}
+
+func TestRedirectLoop(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a" {
+			http.Redirect(w, r, "/b", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/a", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	w := postImageURL(r, server.URL+"/a")
+	assert.Equal(t, 502, w.Code)
+	assert.Contains(t, w.Body.String(), "too_many_redirects")
+	assert.Contains(t, w.Body.String(), "loop")
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestRedirectToBlockedHost(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	target := serveRedirectChain()
+	defer target.Close()
+	useFetchAllowedHosts(t, "127.0.0.1")
+
+	// The target is on an allowed host, but isn't reached by that name
+	elsewhere := strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/image.png"
+	for name, location := range map[string]string{
+		"disallowed": elsewhere,
+		"metadata":   "http://169.254.169.254/computeMetadata/v1/",
+	} {
+		redirector := httptest.NewServer(http.RedirectHandler(location, http.StatusFound))
+
+		w := postImageURL(r, redirector.URL)
+		redirector.Close()
+
+		assert.Equal(t, 400, w.Code, name)
+		assert.Contains(t, w.Body.String(), "blocked_url", name)
+	}
+	assert.Empty(t, store.keys(testBucket))
+
+	// Without the allowlist, the redirect is followed
+	FetchAllowedHosts = nil
+	redirector := httptest.NewServer(http.RedirectHandler(elsewhere, http.StatusFound))
+	defer redirector.Close()
+	w := postImageURL(r, redirector.URL)
+	assert.Equal(t, 201, w.Code)
+}
+
+func TestValidateFetchURL(t *testing.T) {
+	useFetchAllowedHosts(t, "discordapp.com")
+
+	ctx := context.Background()
+	assert.NoError(t, checkFetchURL(ctx, "https://cdn.discordapp.com/attachments/1/2/a.png"))
+	assert.NoError(t, checkFetchURL(ctx, "https://discordapp.com/a.png"))
+	for _, url := range []string{
+		"https://notdiscordapp.com/a.png",
+		"ftp://cdn.discordapp.com/a.png",
+		"http://metadata.google.internal/computeMetadata/v1/",
+		"http://169.254.169.254/",
+		"not a url\x7f",
+	} {
+		var blockedErr *BlockedURLError
+		assert.ErrorAs(t, checkFetchURL(ctx, url), &blockedErr, url)
+	}
+}
+
+// Allow fetches from only the given networks for the duration of a test
+func useFetchAllowedNetworks(t *testing.T, cidrs ...string) {
+	old := fetchAllowedNetworks
+	fetchAllowedNetworks = nil
+	for _, cidr := range cidrs {
+		_, network, _ := net.ParseCIDR(cidr)
+		fetchAllowedNetworks = append(fetchAllowedNetworks, network)
+	}
+	t.Cleanup(func() { fetchAllowedNetworks = old })
+}
+
+func TestValidateFetchAddresses(t *testing.T) {
+	useFetchAllowedNetworks(t)
+	ctx := context.Background()
+
+	assert.NoError(t, checkFetchURL(ctx, "https://93.184.216.34/a.png"))
+	for _, url := range []string{
+		"http://127.0.0.1:8080/debug/pprof/",
+		"http://localhost/a.png",
+		"http://10.0.0.5/a.png",
+		"http://172.16.0.1/a.png",
+		"http://192.168.1.1/a.png",
+		"http://100.64.0.1/a.png",
+		"http://[::1]/a.png",
+		"http://[fd00::1]/a.png",
+		"http://[fe80::1]/a.png",
+		"http://0.0.0.0/a.png",
+	} {
+		var blockedErr *BlockedURLError
+		assert.ErrorAs(t, checkFetchURL(ctx, url), &blockedErr, url)
+	}
+
+	// Addresses are checked again as they're dialed, whatever the lookup said
+	var blockedErr *BlockedURLError
+	assert.ErrorAs(t, checkFetchDial("tcp", "10.1.2.3:443", nil), &blockedErr)
+	assert.NoError(t, checkFetchDial("tcp", "93.184.216.34:443", nil))
+	_, _, err := httpFetcher{}.get(ctx, "http://127.0.0.1:1/a.png", Validators{})
+	assert.ErrorAs(t, err, &blockedErr, "The dial itself is refused")
+}
+
+func TestFetchIgnoresProxy(t *testing.T) {
+	// Through a proxy, the dial check would see the proxy's address rather
+	// than the image host's
+	assert.Nil(t, newFetchTransport().Proxy)
+	assert.Nil(t, fetchClient.Transport.(*http.Transport).Proxy)
+}
+
+func TestRedirectToInternalBlocked(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	// Only the redirector itself is reachable
+	useFetchAllowedNetworks(t, "127.0.0.1/32")
+	r := setupRouter(false)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	target := serveImage(buf.Bytes())
+	defer target.Close()
+	port := target.URL[strings.LastIndex(target.URL, ":"):]
+
+	for _, location := range []string{
+		"http://127.0.0.2" + port + "/a.png",
+		"http://10.0.0.5/a.png",
+		"http://192.168.1.1/a.png",
+		"http://100.64.0.1/a.png",
+	} {
+		redirector := httptest.NewServer(http.RedirectHandler(location, http.StatusFound))
+		w := postImageURL(r, redirector.URL)
+		redirector.Close()
+
+		assert.Equal(t, 400, w.Code, location)
+		assert.Contains(t, w.Body.String(), "blocked_url", location)
+	}
+	assert.Empty(t, store.keys(testBucket))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+)
+
+// The source formats the pipeline accepts, by MIME type, with the extension
+// kept originals are stored under. Everything else, notably SVG (which can
+// carry scripts and external references), ICO, and TIFF, is rejected.
+var supportedImageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+	"image/bmp":  "bmp",
+}
+
+// Returns the supported MIME types, sorted.
+func supportedTypeNames() []string {
+	var names []string
+	for name := range supportedImageTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// An UnsupportedTypeError is returned for source images in a format the
+// pipeline doesn't accept.
+type UnsupportedTypeError struct {
+	Type string
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("unsupported image type %v", e.Type)
+}
+
+// Detects an image's MIME type from its contents. Beyond what
+// http.DetectContentType knows, SVG and TIFF are recognized so they can be
+// named when rejected.
+func sniffImageType(data []byte) string {
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+	if bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+		return "image/svg+xml"
+	}
+
+	contentType := http.DetectContentType(data)
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return contentType
+}
+
+// Returns the image's MIME type, or an UnsupportedTypeError if the pipeline
+// doesn't accept it.
+func checkImageType(data []byte) (string, error) {
+	contentType := sniffImageType(data)
+	if _, ok := supportedImageTypes[contentType]; !ok {
+		return "", &UnsupportedTypeError{Type: contentType}
+	}
+	return contentType, nil
+}
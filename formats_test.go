@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const svgFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10">
+  <script>alert(1)</script>
+  <rect width="10" height="10"/>
+</svg>`
+
+// A minimal little-endian TIFF header
+var tiffFixture = []byte("II*\x00\x08\x00\x00\x00\x00\x00")
+
+// Post a source image with the given bytes, returning the response
+func postSourceBytes(t *testing.T, data []byte) (int, map[string]interface{}) {
+	server := serveImage(data)
+	defer server.Close()
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	body, _ := json.Marshal(request)
+	w := performRequest(setupRouter(false), "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestUploadRejectsSVG(t *testing.T) {
+	store, _ := useFakeBackends(t)
+
+	code, response := postSourceBytes(t, []byte(svgFixture))
+
+	assert.Equal(t, 415, code)
+	assert.Equal(t, "image/svg+xml", response["detected"])
+	assert.Contains(t, response["supported"], "image/png")
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestUploadRejectsTIFF(t *testing.T) {
+	store, _ := useFakeBackends(t)
+
+	code, response := postSourceBytes(t, tiffFixture)
+
+	assert.Equal(t, 415, code)
+	assert.Equal(t, "image/tiff", response["detected"])
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestSniffImageType(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+
+	assert.Equal(t, "image/png", sniffImageType(buf.Bytes()))
+	assert.Equal(t, "image/svg+xml", sniffImageType([]byte(svgFixture)))
+	assert.Equal(t, "image/svg+xml", sniffImageType([]byte("  <SVG></SVG>")))
+	assert.Equal(t, "image/tiff", sniffImageType(tiffFixture))
+	assert.Equal(t, "image/tiff", sniffImageType([]byte("MM\x00*\x00\x00\x00\x08")))
+	assert.Equal(t, "image/x-icon", sniffImageType([]byte("\x00\x00\x01\x00\x01\x00")))
+	assert.Equal(t, "text/plain", sniffImageType([]byte("not an image")))
+
+	_, err := checkImageType([]byte("\x00\x00\x01\x00\x01\x00"))
+	var typeErr *UnsupportedTypeError
+	assert.ErrorAs(t, err, &typeErr)
+	contentType, err := checkImageType(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+}
+
+func TestOriginalExtension(t *testing.T) {
+	for contentType, extension := range supportedImageTypes {
+		assert.Equal(t, extension, originalExtension(contentType))
+	}
+	assert.Equal(t, "bin", originalExtension("image/tiff"))
+}
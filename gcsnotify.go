@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// GCSNotifyToken is the token the GCS notification subscription appends to
+// its push endpoint, as ?token=. Until GCS_NOTIFY_TOKEN sets it, deliveries
+// are refused so they stay queued.
+var GCSNotifyToken string
+
+// Reads GCS_NOTIFY_TOKEN.
+func prepareGCSNotify() error {
+	GCSNotifyToken = os.Getenv("GCS_NOTIFY_TOKEN")
+	return nil
+}
+
+// Handles a GCS object notification pushed from Pub/Sub. Objects changed
+// behind the API's back, e.g. deleted in the console, are dropped from the
+// caches, and if the bot's records are configured, they're checked against
+// the change: deleted faceclaims are removed from their character, and new
+// ones are checked for. Discrepancies are logged and counted.
+func handleGCSNotification(c *gin.Context) {
+	if GCSNotifyToken == "" {
+		abortWith(c, http.StatusServiceUnavailable, gin.H{"error": "GCS notifications aren't configured"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(GCSNotifyToken)) != 1 {
+		abortWith(c, http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var envelope PushEnvelope
+	if err := c.ShouldBindJSON(&envelope); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	attributes := envelope.Message.Attributes
+	event, bucket, object := attributes["eventType"], attributes["bucketId"], attributes["objectId"]
+	result := gin.H{"message_id": envelope.Message.MessageID, "event": event, "object": object}
+
+	// The data is the object's resource, with its custom metadata
+	var resource struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	if len(envelope.Message.Data) > 0 {
+		if err := json.Unmarshal(envelope.Message.Data, &resource); err != nil {
+			log.Printf("Unable to decode notification %v: %v\n", envelope.Message.MessageID, err)
+		}
+	}
+	attrs := &storage.ObjectAttrs{Bucket: bucket, Name: object, Metadata: resource.Metadata}
+
+	status, err := syncNotification(c, event, attrs, attributes)
+	if err != nil {
+		// Let a redelivery try again
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result["status"] = status
+	respond(c, http.StatusOK, result)
+}
+
+// Brings the caches and the bot's records in line with a notification,
+// returning what was found: ignored, unchecked (the records aren't
+// configured), in_sync, or the discrepancy, which is removed (a deleted
+// faceclaim was still recorded), orphaned (a new faceclaim's character
+// doesn't exist), or unrecorded (a new faceclaim isn't listed).
+func syncNotification(c *gin.Context, event string, attrs *storage.ObjectAttrs, attributes map[string]string) (string, error) {
+	ctx := c.Request.Context()
+	bucket, object := attrs.Bucket, attrs.Name
+	if bucket == "" || object == "" || bucket == logBucket {
+		return "ignored", nil
+	}
+	tagRequest(c, "bucket", bucket)
+
+	switch event {
+	case "OBJECT_FINALIZE", "OBJECT_DELETE":
+	default:
+		return "ignored", nil
+	}
+	if event == "OBJECT_DELETE" && attributes["overwrittenByGeneration"] != "" {
+		// The object was replaced, not removed
+		return "ignored", nil
+	}
+	attrCache.invalidate(bucket, object)
+	listCache.invalidate(bucket, object)
+	guildUsage.invalidate(bucket)
+
+	// Only faceclaims are recorded, not their kept originals or variants
+	charid, key, _ := strings.Cut(object, "/")
+	if validateCharID(charid) != nil || validateKey(key) != nil || !isFaceclaim(attrs) {
+		return "ignored", nil
+	}
+	tagRequest(c, "charid", charid)
+	if Records == nil {
+		return "unchecked", nil
+	}
+	url := objectURL(bucket, object)
+
+	if event == "OBJECT_DELETE" {
+		removed, err := Records.RemoveImage(ctx, charid, url)
+		if err != nil {
+			return "", fmt.Errorf("syncNotification: %v", err)
+		}
+		if !removed {
+			return "in_sync", nil
+		}
+		log.Printf("%v was deleted from GCS but still recorded; removed it from %v\n", url, charid)
+		recordDiscrepancy("removed")
+		return "removed", nil
+	}
+
+	// The bot records a faceclaim once its upload responds, so a notification
+	// that beats it here is reported as unrecorded
+	images, err := Records.Images(ctx, charid)
+	if errors.Is(err, ErrCharacterNotFound) {
+		log.Printf("%v was uploaded, but character %v doesn't exist\n", url, charid)
+		recordDiscrepancy("orphaned")
+		return "orphaned", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("syncNotification: %v", err)
+	}
+	if contains(images, url) {
+		return "in_sync", nil
+	}
+	log.Printf("%v was uploaded, but %v doesn't list it\n", url, charid)
+	recordDiscrepancy("unrecorded")
+	return "unrecorded", nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testNotifyToken = "notify-token"
+	notifyCharID    = "63b4c3e1a1b2c3d4e5f60718"
+)
+
+// Accept notifications with the test token for the duration of a test
+func useGCSNotify(t *testing.T) {
+	GCSNotifyToken = testNotifyToken
+	t.Cleanup(func() { GCSNotifyToken = "" })
+}
+
+// Push a notification shaped like the ones GCS publishes. A "variant" in
+// extra goes in the object's metadata; the rest are message attributes.
+func notify(r http.Handler, token, event, bucket, object string, extra map[string]string) *httptest.ResponseRecorder {
+	var envelope PushEnvelope
+	envelope.Message.MessageID = "123"
+	resource := map[string]interface{}{"bucket": bucket, "name": object, "kind": "storage#object"}
+	if size := extra["variant"]; size != "" {
+		resource["metadata"] = map[string]string{"variant": size}
+	}
+	envelope.Message.Data, _ = json.Marshal(resource)
+	envelope.Message.Attributes = map[string]string{
+		"eventType":          event,
+		"bucketId":           bucket,
+		"objectId":           object,
+		"payloadFormat":      "JSON_API_V1",
+		"notificationConfig": "projects/_/buckets/" + bucket + "/notificationConfigs/1",
+	}
+	for k, v := range extra {
+		if k != "variant" {
+			envelope.Message.Attributes[k] = v
+		}
+	}
+	envelope.Subscription = "projects/inconnu/subscriptions/gcs-notify"
+	body, _ := json.Marshal(envelope)
+
+	req, _ := http.NewRequest("POST", "/internal/gcs/notify?token="+token, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func notifyStatus(t *testing.T, w *httptest.ResponseRecorder) string {
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body["status"]
+}
+
+func faceclaimURL(object string) string {
+	return fmt.Sprintf("https://%v/%v", testBucket, object)
+}
+
+func TestNotifyDeleteRemovesRecord(t *testing.T) {
+	useFakeBackends(t)
+	useGCSNotify(t)
+	object := notifyCharID + "/63b4c3e1a1b2c3d4e5f60719.webp"
+	records := useFakeRecords(t, map[string][]string{
+		notifyCharID: {faceclaimURL(object), faceclaimURL(notifyCharID + "/other.webp")},
+	})
+	router := setupRouter(false)
+
+	w := notify(router, testNotifyToken, "OBJECT_DELETE", testBucket, object, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "removed", notifyStatus(t, w))
+	assert.Equal(t, []string{faceclaimURL(notifyCharID + "/other.webp")}, records.characters[notifyCharID])
+
+	// A redelivery finds nothing left to do
+	w = notify(router, testNotifyToken, "OBJECT_DELETE", testBucket, object, nil)
+	assert.Equal(t, "in_sync", notifyStatus(t, w))
+}
+
+func TestNotifyOverwriteKeepsRecord(t *testing.T) {
+	useFakeBackends(t)
+	useGCSNotify(t)
+	object := notifyCharID + "/63b4c3e1a1b2c3d4e5f60719.webp"
+	records := useFakeRecords(t, map[string][]string{notifyCharID: {faceclaimURL(object)}})
+	router := setupRouter(false)
+
+	w := notify(router, testNotifyToken, "OBJECT_DELETE", testBucket, object, map[string]string{"overwrittenByGeneration": "2"})
+	assert.Equal(t, "ignored", notifyStatus(t, w))
+	assert.Equal(t, []string{faceclaimURL(object)}, records.characters[notifyCharID])
+}
+
+func TestNotifyFinalizeChecksRecord(t *testing.T) {
+	useFakeBackends(t)
+	useGCSNotify(t)
+	recorded := notifyCharID + "/63b4c3e1a1b2c3d4e5f60719.webp"
+	records := useFakeRecords(t, map[string][]string{notifyCharID: {faceclaimURL(recorded)}})
+	router := setupRouter(false)
+
+	for _, tc := range []struct {
+		object  string
+		variant string
+		status  string
+	}{
+		{recorded, "", "in_sync"},
+		{notifyCharID + "/63b4c3e1a1b2c3d4e5f6071a.webp", "", "unrecorded"},
+		{"63b4c3e1a1b2c3d4e5f6071b/63b4c3e1a1b2c3d4e5f6071c.webp", "", "orphaned"},
+		{notifyCharID + "/63b4c3e1a1b2c3d4e5f60719_256.webp", "256", "ignored"},
+		{notifyCharID + "/63b4c3e1a1b2c3d4e5f60719.orig.png", "", "ignored"},
+	} {
+		w := notify(router, testNotifyToken, "OBJECT_FINALIZE", testBucket, tc.object, map[string]string{"variant": tc.variant})
+		assert.Equal(t, http.StatusOK, w.Code, tc.object)
+		assert.Equal(t, tc.status, notifyStatus(t, w), tc.object)
+	}
+	assert.Equal(t, []string{faceclaimURL(recorded)}, records.characters[notifyCharID])
+}
+
+func TestNotifyIgnoresLogs(t *testing.T) {
+	useFakeBackends(t)
+	useGCSNotify(t)
+	records := useFakeRecords(t, map[string][]string{})
+	records.err = errors.New("records shouldn't be consulted")
+	router := setupRouter(false)
+
+	w := notify(router, testNotifyToken, "OBJECT_DELETE", logBucket, "logs/bot.log", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ignored", notifyStatus(t, w))
+}
+
+func TestNotifyWithoutRecords(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useGCSNotify(t)
+	router := setupRouter(false)
+	object := notifyCharID + "/63b4c3e1a1b2c3d4e5f60719.webp"
+
+	// The cached attributes are dropped even without records to check
+	store.Upload(context.Background(), testBucket, object, strings.NewReader("x"), UploadOptions{})
+	cachedObjectAttrs(context.Background(), testBucket, object)
+	assert.Equal(t, 1, attrCache.len())
+
+	w := notify(router, testNotifyToken, "OBJECT_DELETE", testBucket, object, nil)
+	assert.Equal(t, "unchecked", notifyStatus(t, w))
+	assert.Equal(t, 0, attrCache.len())
+}
+
+func TestNotifyRecordsFailure(t *testing.T) {
+	useFakeBackends(t)
+	useGCSNotify(t)
+	records := useFakeRecords(t, map[string][]string{})
+	records.err = errors.New("mongo is down")
+	router := setupRouter(false)
+
+	w := notify(router, testNotifyToken, "OBJECT_DELETE", testBucket, notifyCharID+"/63b4c3e1a1b2c3d4e5f60719.webp", nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestNotifyRejectsBadToken(t *testing.T) {
+	useFakeBackends(t)
+	router := setupRouter(false)
+	object := notifyCharID + "/63b4c3e1a1b2c3d4e5f60719.webp"
+
+	w := notify(router, testNotifyToken, "OBJECT_DELETE", testBucket, object, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	useGCSNotify(t)
+	for _, token := range []string{"", "wrong"} {
+		w := notify(router, token, "OBJECT_DELETE", testBucket, object, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, token)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Reports whether an object is under a hold, so GCS won't delete it.
+func isHeld(attrs *storage.ObjectAttrs) bool {
+	return attrs.TemporaryHold || attrs.EventBasedHold
+}
+
+// Places a temporary hold on a faceclaim, its kept original, and its size
+// variants, so no delete route can remove them until the hold is released.
+func holdFaceclaim(c *gin.Context) {
+	setFaceclaimHold(c, true)
+}
+
+// Releases a faceclaim's hold.
+func releaseFaceclaim(c *gin.Context) {
+	setFaceclaimHold(c, false)
+}
+
+func setFaceclaimHold(c *gin.Context, held bool) {
+	ctx := c.Request.Context()
+	bucket := c.Param("bucket")
+	object := fmt.Sprintf("%v/%v", c.Param("charid"), c.Param("key"))
+
+	attrs, err := getObjectAttrs(ctx, bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", object)})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	objects := faceclaimObjects(object, attrs.Metadata)
+	for _, name := range objects {
+		_, err := Store.SetHold(ctx, bucket, name, held)
+		attrCache.invalidate(bucket, name)
+		listCache.invalidate(bucket, name)
+		if err != nil && !(name != object && errors.Is(err, storage.ErrObjectNotExist)) {
+			c.Error(err)
+			abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if held {
+		log.Println("Placed a hold on", object)
+	} else {
+		log.Println("Released the hold on", object)
+	}
+	respond(c, http.StatusOK, gin.H{"key": object, "held": held, "objects": objects})
+}
+
+// Returns the held objects under a character's prefix, and the rest. If the
+// character can't be listed, ok is false.
+func partitionHeld(ctx context.Context, bucket, charid string) (held, unheld []string, ok bool) {
+	objects, err := listCharacter(ctx, bucket, charid)
+	if err != nil {
+		log.Println("Unable to check", charid, "for held faceclaims:", err)
+		return nil, nil, false
+	}
+	for _, attrs := range objects {
+		if isHeld(attrs) {
+			held = append(held, attrs.Name)
+		} else {
+			unheld = append(unheld, attrs.Name)
+		}
+	}
+	return held, unheld, true
+}
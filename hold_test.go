@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Place ("POST") or release ("DELETE") a faceclaim's hold through the route
+func setTestHold(t *testing.T, r http.Handler, method, object string) {
+	w := performRequest(r, method, "/faceclaim/hold/"+testBucket+"/"+object, nil)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+}
+
+func TestHoldSurvivesGroupDelete(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	request.Variants = []string{"16"}
+	canon := uploadTestImage(t, r, request)
+	others := []FaceclaimResponse{
+		uploadTestImage(t, r, createFaceclaimRequest(testBucket)),
+		uploadTestImage(t, r, createFaceclaimRequest(testBucket)),
+	}
+	canonObjects := []string{
+		objectKey(testBucket, canon.URL),
+		objectKey(testBucket, canon.OriginalURL),
+		objectKey(testBucket, canon.Variants["16"]),
+	}
+	setTestHold(t, r, "POST", canonObjects[0])
+
+	faceclaims := listTestFaceclaims(t, r)
+	if assert.Len(t, faceclaims, 3) {
+		assert.True(t, faceclaims[0].Held)
+		assert.False(t, faceclaims[1].Held)
+		assert.False(t, faceclaims[2].Held)
+	}
+
+	w := performRequest(r, "DELETE", "/faceclaim/delete/"+testBucket+"/"+testCharID+"/all", nil)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	var result DeleteResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.ElementsMatch(t, canonObjects, result.Skipped)
+
+	for _, object := range canonObjects {
+		assert.True(t, store.exists(testBucket, object), "%v is held", object)
+	}
+	for _, response := range others {
+		assert.False(t, store.exists(testBucket, objectKey(testBucket, response.URL)))
+	}
+	for _, msg := range publisher.published() {
+		assert.NotEqual(t, "delete-faceclaim-group", msg.Topic, "A group message would take the held faceclaim too")
+	}
+
+	// Released, it goes like any other
+	setTestHold(t, r, "DELETE", canonObjects[0])
+	recentDeletes = newRecentSet(deleteDedupeWindow)
+	w = performRequest(r, "DELETE", "/faceclaim/delete/"+testBucket+"/"+testCharID+"/all", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestHoldSkipsSingleDelete(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	r := setupRouter(false)
+	object := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	setTestHold(t, r, "POST", object)
+
+	w := performRequest(r, "DELETE", "/faceclaim/delete/"+testBucket+"/"+object, nil)
+	assert.Equal(t, 200, w.Code)
+	var result DeleteResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, []string{object}, result.Skipped)
+	assert.Contains(t, result.Message, "held")
+	assert.Empty(t, publisher.published())
+	assert.True(t, store.exists(testBucket, object))
+
+	w = performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/"+object, nil)
+	assert.Contains(t, w.Body.String(), `"held":true`)
+}
+
+func TestHoldMissingFaceclaim(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := performRequest(r, "POST", "/faceclaim/hold/"+testBucket+"/"+testObjectKey(1), nil)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestDeletePushSkipsHeld(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	held := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	other := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	setTestHold(t, r, "POST", held)
+
+	deleted, err := applyMessage(context.Background(), DeleteGroup{Bucket: testBucket, CharID: testCharID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.True(t, store.exists(testBucket, held))
+	assert.False(t, store.exists(testBucket, other))
+
+	deleted, err = applyMessage(context.Background(), DeleteSingle{Bucket: testBucket, Key: held})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+	assert.True(t, store.exists(testBucket, held))
+}
+
+func TestEvictionSkipsHeld(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useCharLimit(t, 2)
+	r := setupRouter(false)
+	first := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	second := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	setTestHold(t, r, "POST", first)
+
+	evictions, err := planCharacterSlot(testBucket, testCharID, true)
+	assert.NoError(t, err)
+	evicted, err := evictFaceclaims(testBucket, evictions)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{second}, evicted, "The oldest unheld faceclaim should go")
+	assert.True(t, store.exists(testBucket, first))
+
+	// With everything held, there's nothing to evict
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	for _, attrs := range faceclaimsOf(t, store) {
+		setTestHold(t, r, "POST", attrs)
+	}
+	_, err = planCharacterSlot(testBucket, testCharID, true)
+	var limitErr *CharLimitError
+	assert.ErrorAs(t, err, &limitErr)
+}
+
+// The names of the test character's faceclaims
+func faceclaimsOf(t *testing.T, store *memStorage) []string {
+	objects, err := store.List(context.Background(), testBucket, testCharID+"/")
+	assert.NoError(t, err)
+	var names []string
+	for _, attrs := range faceclaimsIn(objects) {
+		names = append(names, attrs.Name)
+	}
+	return names
+}
+
+func TestReconcileSkipsHeldOrphans(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	url := seedReconcile(t, r, store)
+	store.SetHold(context.Background(), testBucket, "__test/aaaa.webp", true)
+
+	w, result := postReconcile(r, "?dry_run=false", ReconcileRequest{KnownKeys: []string{url}})
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, result.Queued)
+	assert.Contains(t, result.Results, BatchItem{Key: "__test/aaaa.webp", Status: "held"})
+	assert.True(t, store.exists(testBucket, "__test/aaaa.webp"))
+	assert.False(t, store.exists(testBucket, "__gone/bbbb.webp"))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/singleflight"
+)
+
+// The longest idempotency key accepted.
+const maxIdempotencyKeyLength = 200
+
+// Idempotent uploads in progress, by their object, so identical ones arriving
+// at once share a run.
+var uploadFlights singleflight.Group
+
+// Checks that an idempotency key is printable and not too long.
+func validateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("idempotency_key can't be longer than %v bytes", maxIdempotencyKeyLength)
+	}
+	if strings.IndexFunc(key, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return errors.New("idempotency_key must be printable")
+	}
+	return nil
+}
+
+// Returns the ID an idempotent upload's objects are named with: 24 hex
+// digits, like an ObjectId, derived from the bucket, character, and key.
+func idempotentObjectID(bucket, charid, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "\x00" + charid + "\x00" + key))
+	return hex.EncodeToString(sum[:12])
+}
+
+// detachedContext keeps a context's values, such as its credential, but not
+// its deadline or cancellation, like context.WithoutCancel in Go 1.21.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Runs an idempotent upload. Within this process, identical uploads share one
+// run and its response. If the faceclaim has already been stored, by an
+// earlier attempt or another instance, it's returned instead.
+//
+// The shared run isn't tied to any one caller's request, so a caller that
+// disconnects or runs out of time gives up alone; the run carries on, under
+// UploadTimeout, for the others.
+func processIdempotentImage(ctx context.Context, request FaceclaimRequest) (FaceclaimResponse, error) {
+	bucket := request.Bucket
+	if bucket == "" {
+		bucket = currentConfig().FaceclaimBucket
+	}
+	objectName := fmt.Sprintf("%v/%v.webp", request.CharID, idempotentObjectID(bucket, request.CharID, request.IdempotencyKey))
+
+	flight := uploadFlights.DoChan(bucket+"/"+objectName, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, UploadTimeout)
+		defer cancel()
+		if _, err := Store.Attrs(ctx, bucket, objectName); err == nil {
+			return storedFaceclaim(ctx, bucket, objectName)
+		} else if !errors.Is(err, storage.ErrObjectNotExist) {
+			return FaceclaimResponse{}, fmt.Errorf("processIdempotentImage: %w", err)
+		}
+		return convertAndStore(ctx, request)
+	})
+	select {
+	case <-ctx.Done():
+		return FaceclaimResponse{}, ctx.Err()
+	case result := <-flight:
+		response, _ := result.Val.(FaceclaimResponse)
+		if result.Shared {
+			// Each caller may add to its own warnings
+			response.Warnings = append([]Warning(nil), response.Warnings...)
+		}
+		return response, result.Err
+	}
+}
+
+// Describes a faceclaim that was already stored under an idempotent upload's
+// name, as its upload did. Its dimensions are read from the WebP.
+func storedFaceclaim(ctx context.Context, bucket, objectName string) (FaceclaimResponse, error) {
+	attrs, err := Store.Attrs(ctx, bucket, objectName)
+	if err != nil {
+		return FaceclaimResponse{}, fmt.Errorf("storedFaceclaim: %w", err)
+	}
+	data, err := Store.Download(ctx, bucket, objectName)
+	if err != nil {
+		return FaceclaimResponse{}, fmt.Errorf("storedFaceclaim: %w", err)
+	}
+	width, height, err := checkConverted(data)
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+
+	metadata := attrs.Metadata
+	quality, _ := strconv.Atoi(metadata["quality"])
+	response := FaceclaimResponse{
+		URL:           objectURL(bucket, objectName),
+		BlurHash:      metadata["blurhash"],
+		DominantColor: metadata["dominant_color"],
+		CRC32C:        encodeCRC32C(attrs.CRC32C),
+		Width:         width,
+		Height:        height,
+		Quality:       quality,
+		TargetMissed:  metadata["target_missed"] == "true",
+		OutputBytes:   attrs.Size,
+		ResolvedURL:   metadata["resolved_url"],
+		Warnings:      []Warning{{Code: "already_uploaded", Message: "Already uploaded with this idempotency key"}},
+	}
+	if name := metadata["original_object"]; name != "" {
+		response.OriginalURL = objectURL(bucket, name)
+	}
+	if sizes := metadata["variants"]; sizes != "" {
+		response.Variants = make(map[string]string)
+		for _, size := range strings.Split(sizes, ",") {
+			response.Variants[size] = objectURL(bucket, variantObjectName(objectName, size))
+		}
+	}
+	return response, nil
+}
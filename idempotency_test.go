@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedConverter counts conversions, holding the first until release is
+// closed, or its context is done, and signalling started once it's begun.
+type gatedConverter struct {
+	calls   *int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func newGatedConverter() gatedConverter {
+	return gatedConverter{new(int32), make(chan struct{}), make(chan struct{})}
+}
+
+func (c gatedConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	if atomic.AddInt32(c.calls, 1) == 1 {
+		close(c.started)
+		select {
+		case <-c.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fakeConverter{}.Convert(ctx, src, dst, quality)
+}
+
+// Serve the gradient fixture until the test ends, returning a request for it
+func idempotentRequest(t *testing.T, key string) *FaceclaimRequest {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	t.Cleanup(server.Close)
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	request.IdempotencyKey = key
+	return request
+}
+
+// Post an upload request as is
+func postUpload(r http.Handler, request *FaceclaimRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(request)
+	return performRequest(r, "POST", "/faceclaim/upload", bytes.NewReader(body))
+}
+
+func TestIdempotentUploadsConcurrent(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	converter := newGatedConverter()
+	ImageConverter = converter
+	r := setupRouter(false)
+	request := idempotentRequest(t, "discord-interaction-1")
+
+	responses := make([]*httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		responses[0] = postUpload(r, request)
+	}()
+	<-converter.started
+	go func() {
+		defer wg.Done()
+		responses[1] = postUpload(r, request)
+	}()
+	close(converter.release)
+	wg.Wait()
+
+	var urls []string
+	for _, w := range responses {
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		urls = append(urls, getFaceclaimResponse(w.Body).URL)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(converter.calls), "Only one conversion runs")
+	assert.NotEmpty(t, urls[0])
+	assert.Equal(t, urls[0], urls[1])
+	assert.True(t, store.exists(testBucket, objectKey(testBucket, urls[0])))
+}
+
+func TestIdempotentUploadFirstCallerGone(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	converter := newGatedConverter()
+	ImageConverter = converter
+	r := setupRouter(false)
+	request := idempotentRequest(t, "discord-interaction-5")
+
+	// The first caller starts the upload, then disconnects...
+	ctx, cancel := context.WithCancel(context.Background())
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest("POST", "/faceclaim/upload", bytes.NewReader(body)).WithContext(ctx)
+	gone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		gone <- w
+	}()
+	<-converter.started
+	cancel()
+	assert.NotEqual(t, http.StatusCreated, (<-gone).Code)
+
+	// ...while a duplicate joins the run, which carries on for it
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postUpload(r, request) }()
+	close(converter.release)
+	w := <-done
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	url := getFaceclaimResponse(w.Body).URL
+	assert.NotEmpty(t, url)
+	assert.True(t, store.exists(testBucket, objectKey(testBucket, url)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(converter.calls), "The first caller's run wasn't canceled")
+}
+
+func TestIdempotentUploadConflict(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	converter := newGatedConverter()
+	ImageConverter = converter
+	r := setupRouter(false)
+	request := idempotentRequest(t, "discord-interaction-2")
+
+	// This instance's upload is held mid-conversion...
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postUpload(r, request) }()
+	<-converter.started
+
+	// ...while another instance, which shares the bucket but not the
+	// in-process coordination, stores the same faceclaim
+	winner, err := convertAndStore(context.Background(), *request)
+	if !assert.NoError(t, err) {
+		close(converter.release)
+		<-done
+		return
+	}
+	stored := len(store.keys(testBucket))
+	close(converter.release)
+
+	// The loser's precondition fails, and it returns the winner's faceclaim
+	w := <-done
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	response := getFaceclaimResponse(w.Body)
+	assert.Equal(t, winner.URL, response.URL)
+	assert.Equal(t, winner.CRC32C, response.CRC32C)
+	assert.Equal(t, winner.Width, response.Width)
+	assert.Equal(t, winner.OriginalURL, response.OriginalURL)
+	assert.Contains(t, warningCodes(response), "already_uploaded")
+	assert.Len(t, store.keys(testBucket), stored, "The loser leaves nothing behind")
+}
+
+func TestIdempotentUploadRetry(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	request := idempotentRequest(t, "discord-interaction-3")
+
+	first := postUpload(r, request)
+	assert.Equal(t, http.StatusCreated, first.Code, first.Body.String())
+	stored := len(store.keys(testBucket))
+
+	// A retry, here with the key in the header, gets the same faceclaim
+	request.IdempotencyKey = ""
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest("POST", "/faceclaim/upload", bytes.NewReader(body))
+	req.Header.Set("Idempotency-Key", "discord-interaction-3")
+	retry := httptest.NewRecorder()
+	r.ServeHTTP(retry, req)
+	assert.Equal(t, http.StatusCreated, retry.Code, retry.Body.String())
+	assert.Equal(t, getFaceclaimResponse(first.Body).URL, getFaceclaimResponse(retry.Body).URL)
+	assert.Len(t, store.keys(testBucket), stored)
+
+	// Another key is another faceclaim
+	request.IdempotencyKey = "discord-interaction-4"
+	w := postUpload(r, request)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NotEqual(t, getFaceclaimResponse(first.Body).URL, getFaceclaimResponse(w.Body).URL)
+
+	request.IdempotencyKey = strings.Repeat("x", maxIdempotencyKeyLength+1)
+	assert.Equal(t, http.StatusBadRequest, postUpload(r, request).Code)
+	request.IdempotencyKey = "bad\nkey"
+	assert.Equal(t, http.StatusBadRequest, postUpload(r, request).Code)
+}
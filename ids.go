@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newObjectID names new faceclaims. Tests, and TEST_DETERMINISTIC_IDS, swap
+// it for a predictable sequence.
+var newObjectID = primitive.NewObjectID
+
+// DeterministicIDs is whether TEST_DETERMINISTIC_IDS is in effect.
+var DeterministicIDs bool
+
+// Reads TEST_DETERMINISTIC_IDS. When it's set to a number, faceclaims are
+// named from a sequence starting there instead of from random ObjectIDs, so
+// test environments can predict their keys. Never set it in production: the
+// sequence restarts with the process, overwriting earlier faceclaims.
+func prepareIDs() error {
+	newObjectID, DeterministicIDs = primitive.NewObjectID, false
+	value, ok := os.LookupEnv("TEST_DETERMINISTIC_IDS")
+	if !ok {
+		return nil
+	}
+	seed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return errors.New("TEST_DETERMINISTIC_IDS must be a non-negative integer")
+	}
+	log.Printf("WARNING: Naming faceclaims deterministically, starting from %v; don't use this in production\n", seed)
+	newObjectID, DeterministicIDs = sequentialIDs(seed), true
+	return nil
+}
+
+// Returns a generator of ObjectIDs counting up from seed. Each ID's hex is
+// the count, zero-padded to 24 digits.
+func sequentialIDs(seed uint64) func() primitive.ObjectID {
+	var mu sync.Mutex
+	next := seed
+	return func() primitive.ObjectID {
+		mu.Lock()
+		n := next
+		next++
+		mu.Unlock()
+
+		var id primitive.ObjectID
+		binary.BigEndian.PutUint64(id[4:], n)
+		return id
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequentialIDs(t *testing.T) {
+	next := sequentialIDs(255)
+	assert.Equal(t, "0000000000000000000000ff", next().Hex())
+	assert.Equal(t, "000000000000000000000100", next().Hex())
+}
+
+func TestPrepareIDs(t *testing.T) {
+	t.Cleanup(func() {
+		os.Unsetenv("TEST_DETERMINISTIC_IDS")
+		prepareIDs()
+	})
+
+	assert.Nil(t, prepareIDs())
+	assert.False(t, DeterministicIDs)
+	assert.NotEqual(t, newObjectID(), newObjectID())
+
+	for _, bad := range []string{"", "-1", "seven"} {
+		os.Setenv("TEST_DETERMINISTIC_IDS", bad)
+		assert.NotNil(t, prepareIDs(), bad)
+	}
+
+	os.Setenv("TEST_DETERMINISTIC_IDS", "7")
+	assert.Nil(t, prepareIDs())
+	assert.True(t, DeterministicIDs)
+	assert.Equal(t, "000000000000000000000007", newObjectID().Hex())
+}
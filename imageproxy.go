@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// ProxyImages streams faceclaims through the API instead of redirecting to
+// signed URLs.
+var ProxyImages bool
+
+// How long the signed URLs that images redirect to are good for. The redirect
+// itself is cached for less, so nobody's handed an expired URL.
+const (
+	signedURLTTL     = 15 * time.Minute
+	redirectCacheAge = 10 * time.Minute
+)
+
+// How long proxied images may be cached.
+const proxyCacheAge = 24 * time.Hour
+
+// Reads PROXY_IMAGES.
+func prepareImageProxy() error {
+	ProxyImages = false
+	if value, ok := os.LookupEnv("PROXY_IMAGES"); ok {
+		proxy, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("PROXY_IMAGES: %v", err)
+		}
+		ProxyImages = proxy
+	}
+	return nil
+}
+
+// Serves a faceclaim at a stable URL, for buckets that aren't public. By
+// default, this redirects to a freshly signed URL; with PROXY_IMAGES, the
+// image is streamed, with support for conditional and Range requests.
+func getFaceclaimImage(c *gin.Context) {
+	bucket := c.Param("bucket")
+	object := fmt.Sprintf("%v/%v", c.Param("charid"), c.Param("key"))
+	ctx := c.Request.Context()
+
+	attrs, err := cachedObjectAttrs(ctx, bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", object)})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !ProxyImages {
+		url, err := Store.SignURL(ctx, bucket, object, signedURLTTL)
+		if err != nil {
+			c.Error(err)
+			abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%v", int(redirectCacheAge.Seconds())))
+		c.Redirect(http.StatusFound, url)
+		return
+	}
+
+	data, err := Store.Download(ctx, bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", object)})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// ServeContent handles Range, If-None-Match, and If-Modified-Since
+	c.Header("Content-Type", attrs.ContentType)
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%v", int(proxyCacheAge.Seconds())))
+	c.Header("ETag", fmt.Sprintf("%q", encodeCRC32C(attrs.CRC32C)))
+	http.ServeContent(c.Writer, c.Request, object, attrs.Created, bytes.NewReader(data))
+}
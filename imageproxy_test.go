@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Store a faceclaim to fetch through the image route, returning its path
+func seedImage(store *memStorage, data string) string {
+	object := "__test/abc123.webp"
+	store.Upload(context.Background(), testBucket, object, strings.NewReader(data), UploadOptions{ContentType: "image/webp"})
+	return fmt.Sprintf("/faceclaim/image/%v/%v", testBucket, object)
+}
+
+// Enable proxying for the duration of a test
+func useProxyImages(t *testing.T) {
+	ProxyImages = true
+	t.Cleanup(func() { ProxyImages = false })
+}
+
+func TestImageRedirect(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	path := seedImage(store, "webp bytes")
+
+	w := performRequest(r, "GET", path, nil)
+
+	assert.Equal(t, 302, w.Code)
+	assert.Equal(t, fmt.Sprintf("https://signed.example/%v/__test/abc123.webp?expires=900", testBucket), w.Header().Get("Location"))
+	assert.Equal(t, "private, max-age=600", w.Header().Get("Cache-Control"))
+}
+
+func TestImageProxy(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useProxyImages(t)
+	r := setupRouter(false)
+	path := seedImage(store, "webp bytes")
+
+	w := performRequest(r, "GET", path, nil)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "webp bytes", w.Body.String())
+	assert.Equal(t, "image/webp", w.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=86400", w.Header().Get("Cache-Control"))
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// Discord's proxy revalidates with the ETag
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 304, w.Code)
+}
+
+func TestImageProxyRange(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useProxyImages(t)
+	r := setupRouter(false)
+	path := seedImage(store, "webp bytes")
+
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("Range", "bytes=0-3")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "webp", w.Body.String())
+	assert.Equal(t, "bytes 0-3/10", w.Header().Get("Content-Range"))
+}
+
+func TestImageMissing(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	path := fmt.Sprintf("/faceclaim/image/%v/__test/deadbeef.webp", testBucket)
+
+	assert.Equal(t, 404, performRequest(r, "GET", path, nil).Code)
+	useProxyImages(t)
+	assert.Equal(t, 404, performRequest(r, "GET", path, nil).Code)
+}
+
+func TestPrepareImageProxy(t *testing.T) {
+	t.Cleanup(func() {
+		os.Unsetenv("PROXY_IMAGES")
+		prepareImageProxy()
+	})
+
+	os.Setenv("PROXY_IMAGES", "true")
+	assert.NoError(t, prepareImageProxy())
+	assert.True(t, ProxyImages)
+
+	os.Setenv("PROXY_IMAGES", "sometimes")
+	assert.Error(t, prepareImageProxy())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Image analysis only needs the broad strokes, so working on a full-size image
+// is wasted effort.
+const analysisSampleSize = 32
+
+// Decodes the image data and computes its BlurHash and dominant color. Neither
+// is essential, so any failure is logged and leaves the values empty.
+func analyzeImage(data []byte) (blurHash, dominantColor string) {
+	img, err := decodeImage(data)
+	if err != nil {
+		log.Println("Unable to analyze image:", err)
+		return "", ""
+	}
+	sample := downsample(img, analysisSampleSize)
+
+	return computeBlurHash(sample), computeDominantColor(sample)
+}
+
+// Decodes an image in any of the formats the faceclaim pipeline accepts.
+func decodeImage(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image.Decode: %v", err)
+	}
+	return img, nil
+}
+
+// Downsamples an image so that its longest side is no larger than maxSize.
+// Images already within bounds are copied to RGBA without resizing, so the
+// result can always be read with RGBAAt().
+func downsample(img image.Image, maxSize int) *image.RGBA {
+	return scaleToFit(img, maxSize, draw.BiLinear)
+}
+
+// Scales an image with the given interpolator so that its longest side is no
+// larger than maxSize. Images already within bounds are copied as-is.
+func scaleToFit(img image.Image, maxSize int, scaler draw.Scaler) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width <= maxSize && height <= maxSize {
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Copy(dst, image.Point{}, img, bounds, draw.Src, nil)
+		return dst
+	}
+
+	if width >= height {
+		height = height * maxSize / width
+		width = maxSize
+	} else {
+		width = width * maxSize / height
+		height = maxSize
+	}
+	// Extremely narrow images can otherwise scale down to nothing
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	scaler.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The largest request body /faceclaim/inspect accepts, which is mostly
+// image_data, base64-encoded in JSON.
+const maxInspectBody = 32 << 20
+
+// An InspectRequest is the POST body for /faceclaim/inspect: an upload
+// request, whose image is fetched from image_url or given inline as
+// image_data. The fields that only matter once the faceclaim is stored, such
+// as charid, are ignored.
+type InspectRequest struct {
+	FaceclaimRequest
+	ImageData []byte `json:"image_data"`
+}
+
+// An InspectResponse is the response body for /faceclaim/inspect: what was
+// detected in the source image, and what an upload of it would produce.
+type InspectResponse struct {
+	ContentType  string `json:"content_type"`
+	Format       string `json:"format"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Animated     bool   `json:"animated"`
+	Frames       int    `json:"frames"`
+	Orientation  int    `json:"orientation"`
+	ColorProfile bool   `json:"color_profile"`
+	InputBytes   int64  `json:"input_bytes"`
+	ResolvedURL  string `json:"resolved_url,omitempty"`
+
+	// The WebP an upload would store
+	OutputWidth    int   `json:"output_width"`
+	OutputHeight   int   `json:"output_height"`
+	EstimatedBytes int64 `json:"estimated_bytes"`
+	Quality        int   `json:"quality"`
+	TargetMissed   bool  `json:"target_missed,omitempty"`
+
+	// The notes an upload would come back with
+	Notes []string `json:"notes,omitempty"`
+}
+
+// Reports what an upload would detect in an image, and what it would make of
+// it, without storing anything: the image is fetched or read, checked, and
+// encoded as an upload would be. Images an upload would reject fail the same
+// way. The image isn't moderated.
+func inspectFaceclaim(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxInspectBody)
+	var request InspectRequest
+	if err := bindBody(c, &request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (request.ImageURL == "") == (len(request.ImageData) == 0) {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "give either image_url or image_data"})
+		return
+	}
+	if request.Bucket != "" {
+		var prefixed bool
+		if request.Bucket, prefixed = normalizeBucket(request.Bucket); prefixed {
+			warnDeprecatedBucket(c)
+		}
+		if err := validateBucket(request.Bucket); err != nil {
+			abortWith(c, bucketErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := request.validateImageOptions(); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.ImageURL != "" {
+		if err := checkFetchURL(c.Request.Context(), request.ImageURL); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error(), "code": "blocked_url"})
+			return
+		}
+	}
+
+	response, err := inspectImage(c.Request.Context(), request)
+	if abortIfTimedOut(c) || abortWithUploadError(c, err) {
+		return
+	}
+	for _, warning := range requestWarnings(c) {
+		response.Notes = append(response.Notes, warning.Message)
+	}
+	respond(c, http.StatusOK, response)
+}
+
+// Runs an upload's checks and encode on an image, keeping nothing.
+func inspectImage(ctx context.Context, request InspectRequest) (InspectResponse, error) {
+	cfg := currentConfig()
+	var response InspectResponse
+
+	original := request.ImageData
+	if request.ImageURL != "" {
+		imageURL, err := normalizeImageURL(request.ImageURL, time.Now())
+		if err != nil {
+			return InspectResponse{}, err
+		}
+		fetched, err := ImageFetcher.Fetch(ctx, imageURL)
+		if err != nil {
+			return InspectResponse{}, err
+		}
+		original, response.ResolvedURL = fetched.Data, fetched.URL
+	}
+	response.InputBytes = int64(len(original))
+
+	contentType, err := checkImageType(original)
+	if err != nil {
+		return InspectResponse{}, err
+	}
+	if err := checkColorSpace(original); err != nil {
+		return InspectResponse{}, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return InspectResponse{}, fmt.Errorf("image.DecodeConfig: %v", err)
+	}
+	response.ContentType, response.Format = contentType, supportedImageTypes[contentType]
+	response.Width, response.Height = config.Width, config.Height
+	response.Frames = countFrames(original)
+	response.Animated = response.Frames > 1
+	response.ColorProfile = embeddedProfile(original) != nil
+
+	prepared, err := prepareSource(original, request.FaceclaimRequest)
+	if err != nil {
+		return InspectResponse{}, err
+	}
+	response.Orientation = prepared.orientation
+
+	bucket := request.Bucket
+	if bucket == "" {
+		bucket = cfg.FaceclaimBucket
+	}
+	profile := cfg.bucketProfile(bucket)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	response.Quality = profile.Quality
+	if request.TargetBytes > 0 {
+		response.Quality, response.TargetMissed, err = encodeToTarget(ctx, prepared.source, buf, request.TargetBytes, profile.Quality)
+	} else {
+		err = ImageConverter.Convert(ctx, bytes.NewReader(prepared.source), buf, response.Quality)
+	}
+	if err != nil {
+		return InspectResponse{}, err
+	}
+	response.EstimatedBytes = int64(buf.Len())
+	if response.OutputWidth, response.OutputHeight, err = checkConverted(buf.Bytes()); err != nil {
+		return InspectResponse{}, err
+	}
+
+	if len(request.Variants) > 0 {
+		img, err := decodeImage(prepared.source)
+		if err != nil {
+			return InspectResponse{}, fmt.Errorf("variants: %v", err)
+		}
+		_, response.Notes = planVariants(request.Variants, img)
+	}
+	if !request.SignedURL && !profile.SignedURLs {
+		public, err := checkPublicBucket(ctx, bucket)
+		if err != nil {
+			return InspectResponse{}, err
+		}
+		if !public {
+			response.Notes = append(response.Notes, privateBucketNote(bucket))
+		}
+	}
+	return response, nil
+}
+
+// Counts an image's frames: those of a GIF, an animated WebP, or an APNG.
+// Everything else has one.
+func countFrames(data []byte) int {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		if g, err := gif.DecodeAll(bytes.NewReader(data)); err == nil && len(g.Image) > 0 {
+			return len(g.Image)
+		}
+	case isAnimatedWebP(data):
+		// Each frame is an ANMF chunk
+		frames := 0
+		for offset := 12; offset+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+			if string(data[offset:offset+4]) == "ANMF" {
+				frames++
+			}
+			offset += 8 + size + size%2
+		}
+		if frames > 0 {
+			return frames
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		// APNGs declare their frames in an acTL chunk, before the image data
+		for offset := 8; offset+12 <= len(data); {
+			size := int(binary.BigEndian.Uint32(data[offset:]))
+			kind := string(data[offset+4 : offset+8])
+			if kind == "acTL" && size >= 8 {
+				if frames := int(binary.BigEndian.Uint32(data[offset+8:])); frames > 0 {
+					return frames
+				}
+			}
+			if kind == "IDAT" {
+				break
+			}
+			offset += 12 + size
+		}
+	}
+	return 1
+}
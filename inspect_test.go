@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postInspect(t *testing.T, request InspectRequest) (*httptest.ResponseRecorder, InspectResponse) {
+	r := setupRouter(false)
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/inspect", bytes.NewReader(body))
+	var response InspectResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+// An animated GIF with the given number of frames
+func animatedGIF(frames int) []byte {
+	var anim gif.GIF
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 30), palette.Plan9)
+		for y := 0; y < 30; y++ {
+			for x := 0; x < 40; x++ {
+				frame.Set(x, y, color.RGBA{uint8(x * 6), uint8(y * 8), uint8(i * 80), 255})
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, &anim)
+	return buf.Bytes()
+}
+
+func TestInspectGIF(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	data := animatedGIF(3)
+	server := serveImage(data)
+	defer server.Close()
+
+	request := InspectRequest{FaceclaimRequest: FaceclaimRequest{ImageURL: server.URL, Variants: []string{"16", "256"}}}
+	w, response := postInspect(t, request)
+
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, "image/gif", response.ContentType)
+	assert.Equal(t, "gif", response.Format)
+	assert.Equal(t, 40, response.Width)
+	assert.Equal(t, 30, response.Height)
+	assert.True(t, response.Animated)
+	assert.Equal(t, 3, response.Frames)
+	assert.Equal(t, int64(len(data)), response.InputBytes)
+	assert.Equal(t, server.URL, response.ResolvedURL)
+	assert.Equal(t, 40, response.OutputWidth)
+	assert.Positive(t, response.EstimatedBytes)
+	assert.Equal(t, currentConfig().WebPQuality, response.Quality)
+	assert.Equal(t, []string{"Skipped variant 256: the image is only 40x30"}, response.Notes,
+		"The notes are the ones an upload would give")
+	assert.Empty(t, store.keys(testBucket), "Nothing is stored")
+}
+
+func TestInspectPNG(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+
+	request := InspectRequest{
+		FaceclaimRequest: FaceclaimRequest{Bucket: "gs://" + testBucket, Fit: fitSquare},
+		ImageData:        buf.Bytes(),
+	}
+	w, response := postInspect(t, request)
+
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, "image/png", response.ContentType)
+	assert.Equal(t, "png", response.Format)
+	assert.Equal(t, 32, response.Width)
+	assert.Equal(t, 24, response.Height)
+	assert.False(t, response.Animated)
+	assert.Equal(t, 1, response.Frames)
+	assert.Equal(t, 1, response.Orientation)
+	assert.False(t, response.ColorProfile)
+	assert.Empty(t, response.ResolvedURL)
+	assert.Equal(t, 24, response.OutputWidth, "The output is squared, as it would be")
+	assert.Equal(t, 24, response.OutputHeight)
+	assert.Contains(t, response.Notes, gsPrefixDeprecation)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestInspectRejects(t *testing.T) {
+	useFakeBackends(t)
+
+	for name, request := range map[string]InspectRequest{
+		"no image":   {},
+		"both":       {FaceclaimRequest: FaceclaimRequest{ImageURL: "https://example.com/a.png"}, ImageData: []byte("x")},
+		"bad fit":    {FaceclaimRequest: FaceclaimRequest{Fit: "stretch"}, ImageData: []byte("x")},
+		"blocked":    {FaceclaimRequest: FaceclaimRequest{ImageURL: "http://169.254.169.254/"}},
+		"not images": {ImageData: []byte("plain text, not an image")},
+	} {
+		w, _ := postInspect(t, request)
+		expected := 400
+		if name == "not images" {
+			expected = 415
+		}
+		assert.Equal(t, expected, w.Code, name)
+	}
+}
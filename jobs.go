@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A JobStatus is the stage an asynchronous job has reached.
+type JobStatus string
+
+const (
+	JobPending    JobStatus = "pending"
+	JobProcessing JobStatus = "processing"
+	JobSucceeded  JobStatus = "succeeded"
+	JobFailed     JobStatus = "failed"
+)
+
+// A Job tracks an operation running in the background.
+type Job struct {
+	ID       string      `json:"id"`
+	Status   JobStatus   `json:"status"`
+	Progress interface{} `json:"progress,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Created  time.Time   `json:"created"`
+	Updated  time.Time   `json:"updated"`
+}
+
+const (
+	// Finished or not, jobs are forgotten after this long.
+	jobTTL = time.Hour
+
+	// The number of jobs allowed to run at once. The rest wait as pending.
+	maxConcurrentJobs = 4
+)
+
+// Jobs is the in-process job store.
+var Jobs = newJobStore("")
+
+var jobSlots = make(chan struct{}, maxConcurrentJobs)
+
+type jobStore struct {
+	sync.Mutex
+	jobs map[string]*Job
+
+	// If set, jobs are persisted here so their status survives a restart
+	bucket string
+}
+
+func newJobStore(bucket string) *jobStore {
+	return &jobStore{jobs: make(map[string]*Job), bucket: bucket}
+}
+
+// Creates the job store, persisting to JOBS_BUCKET if it's set.
+func prepareJobs() {
+	Jobs = newJobStore(os.Getenv("JOBS_BUCKET"))
+}
+
+// Starts running fn in the background, returning the job that tracks it.
+func startJob(fn func() (interface{}, error)) Job {
+	return startTrackedJob(func(progress func(interface{})) (interface{}, error) {
+		return fn()
+	})
+}
+
+// Like startJob, but fn can report its progress, which is shown with the job.
+func startTrackedJob(fn func(progress func(interface{})) (interface{}, error)) Job {
+	now := time.Now()
+	job := Job{
+		ID:      primitive.NewObjectID().Hex(),
+		Status:  JobPending,
+		Created: now,
+		Updated: now,
+	}
+	store := Jobs
+	store.put(&job)
+
+	go func() {
+		jobSlots <- struct{}{}
+		defer func() { <-jobSlots }()
+
+		store.update(job.ID, func(j *Job) { j.Status = JobProcessing })
+		result, err := fn(func(progress interface{}) {
+			store.update(job.ID, func(j *Job) { j.Progress = progress })
+		})
+		store.update(job.ID, func(j *Job) {
+			if err != nil {
+				j.Status = JobFailed
+				j.Error = err.Error()
+			} else {
+				j.Status = JobSucceeded
+				j.Result = result
+			}
+		})
+	}()
+
+	return job
+}
+
+// Adds a job to the store, sweeping out expired jobs while it's at it.
+func (s *jobStore) put(job *Job) {
+	s.Lock()
+	for id, j := range s.jobs {
+		if time.Since(j.Created) > jobTTL {
+			delete(s.jobs, id)
+		}
+	}
+	snapshot := *job
+	s.jobs[job.ID] = &snapshot
+	s.Unlock()
+
+	s.persist(snapshot)
+}
+
+// Applies a change to a job and persists it.
+func (s *jobStore) update(id string, change func(*Job)) {
+	s.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		s.Unlock()
+		return
+	}
+	change(job)
+	job.Updated = time.Now()
+	snapshot := *job
+	s.Unlock()
+
+	s.persist(snapshot)
+}
+
+// Returns a copy of a job. Jobs not in memory, such as those started before a
+// restart, are looked up in the store's bucket.
+func (s *jobStore) get(id string) (Job, bool) {
+	s.Lock()
+	job, ok := s.jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	s.Unlock()
+
+	if !ok {
+		var err error
+		if snapshot, err = s.load(id); err != nil {
+			if !errors.Is(err, storage.ErrObjectNotExist) {
+				log.Println("Unable to load job:", err)
+			}
+			return Job{}, false
+		}
+	}
+	if time.Since(snapshot.Created) > jobTTL {
+		return Job{}, false
+	}
+	return snapshot, true
+}
+
+// Returns the number of jobs in memory at each status.
+func (s *jobStore) counts() map[JobStatus]int {
+	s.Lock()
+	defer s.Unlock()
+
+	counts := make(map[JobStatus]int)
+	for _, job := range s.jobs {
+		counts[job.Status]++
+	}
+	return counts
+}
+
+// Returns the object name of a persisted job.
+func jobObjectName(id string) string {
+	return fmt.Sprintf("jobs/%v.json", id)
+}
+
+// Writes a job to the store's bucket, if configured. Failures are logged, as
+// the in-memory copy is still good for the life of the process.
+func (s *jobStore) persist(job Job) {
+	if s.bucket == "" {
+		return
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		log.Println("Unable to persist job:", err)
+		return
+	}
+	if err := uploadObject(context.Background(), bytes.NewReader(data), s.bucket, jobObjectName(job.ID), UploadOptions{ContentType: "application/json"}); err != nil {
+		log.Println("Unable to persist job:", err)
+	}
+}
+
+// Reads a job from the store's bucket.
+func (s *jobStore) load(id string) (Job, error) {
+	if s.bucket == "" {
+		return Job{}, fmt.Errorf("jobStore.load: %w", storage.ErrObjectNotExist)
+	}
+	data, err := downloadObject(context.Background(), s.bucket, jobObjectName(id))
+	if err != nil {
+		return Job{}, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Job{}, fmt.Errorf("json.Unmarshal: %v", err)
+	}
+	return job, nil
+}
+
+// Returns the status of an asynchronous job.
+func getJob(c *gin.Context) {
+	job, ok := Jobs.get(c.Param("id"))
+	if !ok {
+		abortWith(c, http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	respond(c, http.StatusOK, job)
+}
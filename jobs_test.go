@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowConverter blocks each conversion until released, so tests can observe
+// jobs mid-flight.
+type slowConverter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c slowConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	c.started <- struct{}{}
+	<-c.release
+	return fakeConverter{}.Convert(ctx, src, dst, quality)
+}
+
+// Submit an async upload of the gradient fixture, returning the job. The image
+// server is closed when the test ends, since the job outlives the request.
+func startAsyncUpload(t *testing.T, r *gin.Engine) Job {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	t.Cleanup(server.Close)
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	request.Async = true
+	body, _ := json.Marshal(request)
+
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+	assert.Equal(t, 202, w.Code)
+
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	assert.NotEmpty(t, job.ID)
+	return job
+}
+
+// Fetch a job through the status route
+func fetchJob(r *gin.Engine, id string) (int, map[string]interface{}) {
+	w := performRequest(r, "GET", "/faceclaim/job/"+id, nil)
+	var job map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &job)
+	return w.Code, job
+}
+
+// Poll a job until it finishes or the deadline passes
+func waitForJob(t *testing.T, r *gin.Engine, id string) map[string]interface{} {
+	for i := 0; i < 100; i++ {
+		_, job := fetchJob(r, id)
+		if job["status"] == string(JobSucceeded) || job["status"] == string(JobFailed) {
+			return job
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Job %v didn't finish in time", id)
+	return nil
+}
+
+func TestAsyncUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	converter := slowConverter{make(chan struct{}), make(chan struct{})}
+	ImageConverter = converter
+	r := setupRouter(false)
+
+	job := startAsyncUpload(t, r)
+	assert.Equal(t, JobPending, job.Status)
+
+	// Hold the conversion so the job is observably in progress
+	<-converter.started
+	code, status := fetchJob(r, job.ID)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, string(JobProcessing), status["status"])
+	close(converter.release)
+
+	status = waitForJob(t, r, job.ID)
+	assert.Equal(t, string(JobSucceeded), status["status"])
+	result := status["result"].(map[string]interface{})
+	assert.True(t, store.exists(testBucket, objectKey(testBucket, result["url"].(string))))
+}
+
+func TestAsyncUploadFailure(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	server := serveImage([]byte("not an image"))
+	defer server.Close()
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	request.Async = true
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+	assert.Equal(t, 202, w.Code)
+
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	status := waitForJob(t, r, job.ID)
+	assert.Equal(t, string(JobFailed), status["status"])
+	assert.NotEmpty(t, status["error"])
+}
+
+func TestJobNotFound(t *testing.T) {
+	r := setupRouter(false)
+	code, _ := fetchJob(r, "000000000000000000000000")
+	assert.Equal(t, 404, code)
+}
+
+func TestJobExpiry(t *testing.T) {
+	r := setupRouter(false)
+	Jobs.put(&Job{ID: "expired", Status: JobSucceeded, Created: time.Now().Add(-2 * jobTTL)})
+
+	code, _ := fetchJob(r, "expired")
+	assert.Equal(t, 404, code)
+}
+
+func TestJobPersistence(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	Jobs = newJobStore("jobs.test")
+	defer func() { Jobs = newJobStore("") }()
+	r := setupRouter(false)
+
+	job := startAsyncUpload(t, r)
+	waitForJob(t, r, job.ID)
+	assert.True(t, store.exists("jobs.test", fmt.Sprintf("jobs/%v.json", job.ID)))
+
+	// Simulate a restart by discarding the in-memory jobs
+	Jobs = newJobStore("jobs.test")
+	code, status := fetchJob(r, job.ID)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, string(JobSucceeded), status["status"])
+}
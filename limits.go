@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits are the caps and features clients need to know about to make
+// requests the server will accept. For caps, 0 means unlimited.
+type Limits struct {
+	Images   ImageLimits   `json:"images"`
+	Variants VariantLimits `json:"variants"`
+	Buckets  BucketLimits  `json:"buckets"`
+	Batches  BatchLimits   `json:"batches"`
+	Uploads  UploadLimits  `json:"uploads"`
+	Features FeatureFlags  `json:"features"`
+}
+
+// ImageLimits are the limits on source images and the faceclaims made from
+// them.
+type ImageLimits struct {
+	MaxBytes      int64      `json:"max_bytes"`
+	MaxPixels     int64      `json:"max_pixels"`
+	MinDimension  int        `json:"min_dimension"`
+	Formats       []string   `json:"formats"`
+	MaxRedirects  int        `json:"max_redirects"`
+	AllowedHosts  []string   `json:"allowed_hosts"`
+	CharMaxImages int        `json:"char_max_images"`
+	GuildQuota    GuildQuota `json:"guild_quota"`
+	Quality       int        `json:"quality"`
+	QualityFloor  int        `json:"quality_floor"`
+}
+
+// VariantLimits bound the size variants an upload may ask for.
+type VariantLimits struct {
+	MaxCount int `json:"max_count"`
+	MaxSize  int `json:"max_size"`
+}
+
+// BucketLimits say which buckets are accepted. If Allowed is empty, any
+// validly named bucket is.
+type BucketLimits struct {
+	Default string   `json:"default"`
+	Allowed []string `json:"allowed"`
+}
+
+// BatchLimits cap how many items one request may act on.
+type BatchLimits struct {
+	MaxDeletes       int   `json:"max_deletes"`
+	MaxBundleEntries int   `json:"max_bundle_entries"`
+	MaxRawLogBytes   int64 `json:"max_raw_log_bytes"`
+}
+
+// UploadLimits are how much upload work runs at once, which is what limits a
+// client's rate: uploads beyond the queue are turned away with a 503.
+type UploadLimits struct {
+	Concurrency    int     `json:"concurrency"`
+	QueueSize      int     `json:"queue_size"`
+	QueueWait      float64 `json:"queue_wait_seconds"`
+	TimeoutSeconds float64 `json:"timeout_seconds"`
+}
+
+// FeatureFlags say which optional behaviors are on.
+type FeatureFlags struct {
+	Async         bool `json:"async"`
+	Variants      bool `json:"variants"`
+	KeepOriginals bool `json:"keep_originals"`
+	Moderation    bool `json:"moderation"`
+	ProxyImages   bool `json:"proxy_images"`
+	UploadEvents  bool `json:"upload_events"`
+	ReadOnly      bool `json:"read_only"`
+}
+
+// Returns the limits in effect, read afresh from the live config and settings.
+func currentLimits() Limits {
+	cfg := currentConfig()
+	hosts := FetchAllowedHosts
+	if hosts == nil {
+		hosts = []string{}
+	}
+	return Limits{
+		Images: ImageLimits{
+			MaxBytes:      cfg.MaxImageBytes,
+			MaxPixels:     cfg.MaxPixels,
+			MinDimension:  cfg.MinDimension,
+			Formats:       supportedTypeNames(),
+			MaxRedirects:  FetchMaxRedirects,
+			AllowedHosts:  hosts,
+			CharMaxImages: cfg.CharMaxImages,
+			GuildQuota:    cfg.DefaultQuota,
+			Quality:       cfg.WebPQuality,
+			QualityFloor:  cfg.WebPQualityFloor,
+		},
+		Variants: VariantLimits{MaxCount: maxVariants, MaxSize: maxVariantSize},
+		Buckets:  BucketLimits{Default: cfg.FaceclaimBucket, Allowed: cfg.acceptedBuckets()},
+		Batches: BatchLimits{
+			MaxDeletes:       maxDeleteBatch,
+			MaxBundleEntries: maxBundleEntries,
+			MaxRawLogBytes:   MaxRawLogBytes,
+		},
+		Uploads: UploadLimits{
+			Concurrency:    UploadConcurrency,
+			QueueSize:      UploadQueueSize,
+			QueueWait:      UploadQueueWait.Seconds(),
+			TimeoutSeconds: UploadTimeout.Seconds(),
+		},
+		Features: FeatureFlags{
+			Async:         true,
+			Variants:      true,
+			KeepOriginals: cfg.KeepOriginals,
+			Moderation:    ImageModerator != nil,
+			ProxyImages:   ProxyImages,
+			UploadEvents:  PublishUploadEvents,
+			ReadOnly:      readOnlyMode.Load(),
+		},
+	}
+}
+
+// Returns every bucket that's accepted, sorted, or none if any bucket is.
+func (cfg *Config) acceptedBuckets() []string {
+	if len(cfg.AllowedBuckets) == 0 && len(cfg.Buckets) == 0 {
+		return []string{}
+	}
+	seen := map[string]bool{cfg.FaceclaimBucket: true}
+	for _, bucket := range cfg.AllowedBuckets {
+		seen[bucket] = true
+	}
+	for bucket := range cfg.Buckets {
+		seen[bucket] = true
+	}
+	buckets := make([]string, 0, len(seen))
+	for bucket := range seen {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// Reports the limits clients should respect, so they needn't hardcode them.
+func getLimits(c *gin.Context) {
+	respond(c, http.StatusOK, currentLimits())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimits(t *testing.T) {
+	useFakeBackends(t)
+	useConfig(t, func(cfg *Config) {
+		cfg.MinDimension = 64
+		cfg.MaxImageBytes, cfg.MaxPixels = 8<<20, 16_000_000
+		cfg.CharMaxImages = 10
+		cfg.DefaultQuota = GuildQuota{MaxImages: 500, MaxBytes: 1 << 20}
+		cfg.AllowedBuckets = []string{"pcs.botch.lol"}
+		cfg.Buckets = map[string]BucketProfile{"cdn.inconnu.app": {}}
+		cfg.WebPQuality, cfg.WebPQualityFloor = 90, 40
+		cfg.KeepOriginals = true
+	})
+	oldHosts, oldRedirects := FetchAllowedHosts, FetchMaxRedirects
+	FetchAllowedHosts, FetchMaxRedirects = []string{"cdn.discordapp.com"}, 3
+	t.Cleanup(func() { FetchAllowedHosts, FetchMaxRedirects = oldHosts, oldRedirects })
+	t.Setenv("UPLOAD_CONCURRENCY", "2")
+	t.Setenv("UPLOAD_QUEUE_WAIT", "5s")
+	t.Setenv("UPLOAD_TIMEOUT", "90s")
+	t.Cleanup(func() { prepareUploadPool(); prepareTimeouts() })
+	assert.NoError(t, prepareUploadPool())
+	assert.NoError(t, prepareTimeouts())
+	r := setupRouter(false)
+
+	w := performRequest(r, "GET", "/limits", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"images": {
+			"max_bytes": 8388608,
+			"max_pixels": 16000000,
+			"min_dimension": 64,
+			"formats": ["image/bmp", "image/gif", "image/jpeg", "image/png", "image/webp"],
+			"max_redirects": 3,
+			"allowed_hosts": ["cdn.discordapp.com"],
+			"char_max_images": 10,
+			"guild_quota": {"max_images": 500, "max_bytes": 1048576},
+			"quality": 90,
+			"quality_floor": 40
+		},
+		"variants": {"max_count": 4, "max_size": 4096},
+		"buckets": {"default": "`+testBucket+`", "allowed": ["cdn.inconnu.app", "pcs.botch.lol", "`+testBucket+`"]},
+		"batches": {"max_deletes": 50, "max_bundle_entries": 1000, "max_raw_log_bytes": 1073741824},
+		"uploads": {"concurrency": 2, "queue_size": 16, "queue_wait_seconds": 5, "timeout_seconds": 90},
+		"features": {
+			"async": true,
+			"variants": true,
+			"keep_originals": true,
+			"moderation": false,
+			"proxy_images": false,
+			"upload_events": false,
+			"read_only": false
+		}
+	}`, w.Body.String())
+
+	// Changes to the config show up at once
+	useConfig(t, func(cfg *Config) {
+		cfg.AllowedBuckets, cfg.Buckets = nil, nil
+	})
+	readOnlyMode.Store(true)
+	t.Cleanup(func() { readOnlyMode.Store(false) })
+	limits := currentLimits()
+	assert.Empty(t, limits.Buckets.Allowed)
+	assert.True(t, limits.Features.ReadOnly)
+	assert.Equal(t, 90*time.Second, time.Duration(limits.Uploads.TimeoutSeconds)*time.Second)
+}
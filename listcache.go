@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Character listings are cached for ListCacheTTL, so galleries of popular
+// characters don't each cost a full prefix listing. 0 disables the cache.
+var ListCacheTTL = 15 * time.Second
+
+// At most this many characters' listings are cached at once.
+const maxListCacheEntries = 1000
+
+// listCache holds recent character listings.
+var listCache = newListingCache(ListCacheTTL)
+
+// Reads LIST_CACHE_TTL.
+func prepareListCache() error {
+	ListCacheTTL = 15 * time.Second
+	if value, ok := os.LookupEnv("LIST_CACHE_TTL"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return errors.New("LIST_CACHE_TTL must be a non-negative duration, e.g. \"15s\"")
+		}
+		ListCacheTTL = d
+	}
+	listCache = newListingCache(ListCacheTTL)
+	return nil
+}
+
+// A listingCache maps a bucket and character prefix to the objects listed
+// under it. Local writes and deletes drop the listings they touch; changes
+// made elsewhere are caught by checking the newest object before a listing is
+// served, or by GCS notifications.
+type listingCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]listing
+	now     func() time.Time
+}
+
+type listing struct {
+	objects []*storage.ObjectAttrs
+	expires time.Time
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	return &listingCache{ttl: ttl, entries: make(map[string]listing), now: time.Now}
+}
+
+// Returns a prefix's cached listing, if it hasn't expired.
+func (c *listingCache) get(bucket, prefix string) ([]*storage.ObjectAttrs, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[attrKey(bucket, prefix)]
+	if !ok || c.now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.objects, true
+}
+
+// Caches a prefix's listing. When the cache is full, expired listings are
+// swept out, and if none have expired, the listing isn't cached.
+func (c *listingCache) add(bucket, prefix string, objects []*storage.ObjectAttrs) {
+	if c.ttl == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if len(c.entries) >= maxListCacheEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= maxListCacheEntries {
+			return
+		}
+	}
+	c.entries[attrKey(bucket, prefix)] = listing{objects: objects, expires: now.Add(c.ttl)}
+}
+
+// Drops the listing of the character an object belongs to.
+func (c *listingCache) invalidate(bucket, object string) {
+	charid, _, ok := strings.Cut(object, "/")
+	if !ok {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, attrKey(bucket, charid+"/"))
+}
+
+// Lists the objects under a character's prefix, from the cache if it was
+// listed recently and its newest object hasn't changed since.
+func listCharacter(ctx context.Context, bucket, charid string) ([]*storage.ObjectAttrs, error) {
+	prefix := charid + "/"
+	if objects, ok := listCache.get(bucket, prefix); ok {
+		if listingCurrent(ctx, bucket, objects) {
+			recordListCacheLookup("hit")
+			return objects, nil
+		}
+		recordListCacheLookup("stale")
+	} else {
+		recordListCacheLookup("miss")
+	}
+
+	objects, err := Store.List(ctx, bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listCharacter: %v", err)
+	}
+	listCache.add(bucket, prefix, objects)
+	return objects, nil
+}
+
+// Checks a cached listing against GCS by looking up its most recently updated
+// object, which is much cheaper than listing again. If it's gone or has been
+// rewritten, the listing is stale. Empty listings have nothing to check.
+func listingCurrent(ctx context.Context, bucket string, objects []*storage.ObjectAttrs) bool {
+	var newest *storage.ObjectAttrs
+	for _, attrs := range objects {
+		if newest == nil || attrs.Updated.After(newest.Updated) {
+			newest = attrs
+		}
+	}
+	if newest == nil {
+		return true
+	}
+	attrs, err := getObjectAttrs(ctx, bucket, newest.Name)
+	if err != nil {
+		return false
+	}
+	return attrs.Generation == newest.Generation && attrs.Updated.Equal(newest.Updated)
+}
+
+// Returns the faceclaims among a character's objects, oldest first. Kept
+// originals and size variants aren't included.
+func faceclaimsIn(objects []*storage.ObjectAttrs) []*storage.ObjectAttrs {
+	var faceclaims []*storage.ObjectAttrs
+	for _, attrs := range objects {
+		if isFaceclaim(attrs) {
+			faceclaims = append(faceclaims, attrs)
+		}
+	}
+	sort.Slice(faceclaims, func(i, j int) bool {
+		if faceclaims[i].Created.Equal(faceclaims[j].Created) {
+			return faceclaims[i].Name < faceclaims[j].Name
+		}
+		return faceclaims[i].Created.Before(faceclaims[j].Created)
+	})
+	return faceclaims
+}
+
+// Lists a character's faceclaims, oldest first, for the bot's gallery.
+func listFaceclaims(c *gin.Context) {
+	bucket, charid := c.Param("bucket"), c.Param("charid")
+	objects, err := listCharacter(c.Request.Context(), bucket, charid)
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if notModified(c, listingETag(c, objects)) {
+		return
+	}
+
+	faceclaims := []FaceclaimMetadata{}
+	for _, attrs := range faceclaimsIn(objects) {
+		faceclaims = append(faceclaims, faceclaimMetadata(bucket, attrs))
+	}
+	respond(c, http.StatusOK, gin.H{"charid": charid, "faceclaims": faceclaims})
+}
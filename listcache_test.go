@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// List a character's faceclaims through the route
+func listTestFaceclaims(t *testing.T, r http.Handler) []FaceclaimMetadata {
+	w := performRequest(r, "GET", "/faceclaim/list/"+testBucket+"/"+testCharID, nil)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	var response struct {
+		Faceclaims []FaceclaimMetadata `json:"faceclaims"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Faceclaims
+}
+
+func TestListFaceclaims(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	assert.Empty(t, listTestFaceclaims(t, r))
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	request.Variants = []string{"16"}
+	first := uploadTestImage(t, r, request)
+	second := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	faceclaims := listTestFaceclaims(t, r)
+	if assert.Len(t, faceclaims, 2, "Originals and variants aren't listed") {
+		assert.Equal(t, first.URL, faceclaims[0].URL)
+		assert.Equal(t, first.BlurHash, faceclaims[0].BlurHash)
+		assert.Equal(t, second.URL, faceclaims[1].URL)
+	}
+}
+
+func TestListCachedUntilUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	assert.Len(t, listTestFaceclaims(t, r), 1)
+	lists := store.lists
+	assert.Len(t, listTestFaceclaims(t, r), 1)
+	assert.Equal(t, lists, store.lists, "The second listing should come from the cache")
+
+	// The upload drops the cached listing, though it hasn't expired
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	faceclaims := listTestFaceclaims(t, r)
+	if assert.Len(t, faceclaims, 2) {
+		assert.Equal(t, response.URL, faceclaims[1].URL)
+	}
+}
+
+func TestListStaleWhenNewestChanges(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	newest := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.Len(t, listTestFaceclaims(t, r), 2)
+
+	// Deleted by another instance, so nothing here drops the listing
+	store.Delete(context.Background(), testBucket, objectKey(testBucket, newest.URL))
+	lists := store.lists
+	assert.Len(t, listTestFaceclaims(t, r), 1)
+	assert.Equal(t, lists+1, store.lists)
+}
+
+func TestListCacheExpires(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	now := time.Now()
+	listCache.now = func() time.Time { return now }
+
+	listTestFaceclaims(t, r)
+	listTestFaceclaims(t, r)
+	assert.Equal(t, 1, store.lists)
+
+	now = now.Add(ListCacheTTL + time.Second)
+	listTestFaceclaims(t, r)
+	assert.Equal(t, 2, store.lists)
+}
+
+func TestListCacheDisabled(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	listCache = newListingCache(0)
+	r := setupRouter(false)
+
+	listTestFaceclaims(t, r)
+	listTestFaceclaims(t, r)
+	assert.Equal(t, 2, store.lists)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Limits on expanding a log bundle, so a small upload can't decompress into
+// something enormous. Every entry counts toward maxBundleEntries, even those,
+// like directories, that aren't uploaded.
+var (
+	maxBundleEntries          = 1000
+	maxBundleMemberSize int64 = 16 << 20
+	maxBundleSize       int64 = 64 << 20
+)
+
+// A BundleError means a log bundle couldn't be expanded. TooLarge is set if it
+// exceeded one of the limits.
+type BundleError struct {
+	Reason   string
+	TooLarge bool
+}
+
+func (e *BundleError) Error() string {
+	return "unable to expand bundle: " + e.Reason
+}
+
+// A bundleMember is a log extracted from a bundle.
+type bundleMember struct {
+	name string // The object name, under the bundle's prefix
+	data []byte
+}
+
+// Returns whether data is gzipped.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// Returns whether data is a gzipped tarball, judging by its first header.
+func isTarball(data []byte) bool {
+	if !isGzip(data) {
+		return false
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(gz, header); err != nil {
+		return false
+	}
+	return bytes.HasPrefix(header[257:], []byte("ustar"))
+}
+
+// Returns the prefix a bundle's members are stored under: its name without
+// the .tar.gz, e.g. shard-3/ for shard-3.tar.gz, or under the dated layout,
+// the dated name of the bundle.
+func bundlePrefix(filename, shard string, now time.Time) string {
+	if LogLayout == logLayoutDated {
+		return datedLogName(datedLogBase(filename, shard), now) + "/"
+	}
+	base := filename
+	for _, ext := range []string{".tar.gz", ".tgz", ".gz"} {
+		if trimmed := strings.TrimSuffix(filename, ext); trimmed != filename && trimmed != "" {
+			base = trimmed
+			break
+		}
+	}
+	return base + "/"
+}
+
+// Returns the object name for a bundle member, or an error if its path isn't
+// safe to use, e.g. because it's absolute or climbs out with "..".
+func bundleMemberName(prefix, name string) (string, error) {
+	if strings.HasPrefix(name, "/") {
+		return "", &BundleError{Reason: fmt.Sprintf("%q is an absolute path", name)}
+	}
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." {
+			continue
+		}
+		if err := checkSegment("member name", segment); err != nil {
+			return "", &BundleError{Reason: fmt.Sprintf("%q: %v", name, err)}
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", &BundleError{Reason: fmt.Sprintf("%q is not a file name", name)}
+	}
+	return prefix + path.Join(segments...), nil
+}
+
+// Extracts the regular files from a gzipped tarball, enforcing the bundle
+// limits on what's actually decompressed rather than trusting the headers.
+func readLogBundle(data []byte, prefix string) ([]bundleMember, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, &BundleError{Reason: err.Error()}
+	}
+	archive := tar.NewReader(gz)
+
+	var members []bundleMember
+	var total int64
+	for entries := 1; ; entries++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &BundleError{Reason: err.Error()}
+		}
+		if entries > maxBundleEntries {
+			return nil, &BundleError{Reason: fmt.Sprintf("more than %v entries", maxBundleEntries), TooLarge: true}
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue // Directories, links, and devices aren't logs
+		}
+		name, err := bundleMemberName(prefix, header.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		contents, err := io.ReadAll(io.LimitReader(archive, maxBundleMemberSize+1))
+		if err != nil {
+			return nil, &BundleError{Reason: err.Error()}
+		}
+		if int64(len(contents)) > maxBundleMemberSize {
+			return nil, &BundleError{Reason: fmt.Sprintf("%q is larger than %v bytes", header.Name, maxBundleMemberSize), TooLarge: true}
+		}
+		if total += int64(len(contents)); total > maxBundleSize {
+			return nil, &BundleError{Reason: fmt.Sprintf("more than %v bytes in total", maxBundleSize), TooLarge: true}
+		}
+		members = append(members, bundleMember{name: name, data: contents})
+	}
+	if len(members) == 0 {
+		return nil, &BundleError{Reason: "no files"}
+	}
+	return members, nil
+}
+
+// A BundleResult is the response body for an expanded log bundle.
+type BundleResult struct {
+	Bundle string `json:"bundle"`
+	BatchResult
+}
+
+// Extracts a bundle and stores each of its files as its own log under prefix,
+// with its sniffed Content-Type. The whole bundle is checked before anything
+// is stored, so a file that isn't a log, unless force is set, is a
+// LogTypeError. Once it has been, a file that fails to store doesn't stop the
+// rest.
+func expandLogBundle(ctx context.Context, data []byte, prefix string, opts UploadOptions, force bool) (BundleResult, error) {
+	members, err := readLogBundle(data, prefix)
+	if err != nil {
+		return BundleResult{}, err
+	}
+	contentTypes := make([]string, len(members))
+	for i, member := range members {
+		if contentTypes[i], err = sniffLogType(member.name, member.data, force); err != nil {
+			return BundleResult{}, err
+		}
+	}
+	result := BundleResult{Bundle: prefix}
+	for i, member := range members {
+		opts.ContentType = contentTypes[i]
+		if err := storeLog(ctx, bytes.NewReader(member.data), member.name, opts); err != nil {
+			result.fail(member.name, "failed", err)
+			continue
+		}
+		result.succeed(member.name, "stored")
+	}
+	return result, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A tarEntry is a file, or with a typeflag, some other entry, for makeTarball.
+type tarEntry struct {
+	name     string
+	contents string
+	typeflag byte
+}
+
+// Build a gzipped tarball of the entries
+func makeTarball(t *testing.T, entries ...tarEntry) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	archive := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: entry.typeflag, Size: int64(len(entry.contents))}
+		switch entry.typeflag {
+		case 0:
+			header.Typeflag = tar.TypeReg
+		case tar.TypeSymlink:
+			header.Linkname, header.Size = entry.contents, 0
+		default:
+			header.Size = 0
+		}
+		assert.NoError(t, archive.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			archive.Write([]byte(entry.contents))
+		}
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, gz.Close())
+	return b.Bytes()
+}
+
+// Post a log file, expanding it if it's a bundle
+func postBundle(r http.Handler, name string, data []byte) *httptest.ResponseRecorder {
+	var b bytes.Buffer
+	m := multipart.NewWriter(&b)
+	fw, _ := m.CreateFormFile("log_file", name)
+	fw.Write(data)
+	m.Close()
+
+	req := httptest.NewRequest("POST", "/log/upload?expand=true", &b)
+	req.Header.Set("Content-Type", m.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// Set a bundle limit for the duration of a test
+func useBundleLimits(t *testing.T, entries int, memberSize, size int64) {
+	oldEntries, oldMemberSize, oldSize := maxBundleEntries, maxBundleMemberSize, maxBundleSize
+	maxBundleEntries, maxBundleMemberSize, maxBundleSize = entries, memberSize, size
+	t.Cleanup(func() {
+		maxBundleEntries, maxBundleMemberSize, maxBundleSize = oldEntries, oldMemberSize, oldSize
+	})
+}
+
+func TestExpandLogBundle(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	bundle := makeTarball(t,
+		tarEntry{name: "nested/", typeflag: tar.TypeDir},
+		tarEntry{name: "app.log", contents: "app started"},
+		tarEntry{name: "./nested/worker.log", contents: "worker started"},
+		tarEntry{name: "latest.log", contents: "app.log", typeflag: tar.TypeSymlink},
+	)
+	w := postBundle(r, "shard-3.tar.gz", bundle)
+	assert.Equal(t, 201, w.Code, w.Body.String())
+	assert.Equal(t, "gs://"+logBucket+"/shard-3/", w.Header().Get("Location"))
+
+	var response BundleResult
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "shard-3/", response.Bundle)
+	assert.Equal(t, 2, response.Succeeded)
+	assert.Zero(t, response.Failed)
+	assert.Equal(t, []BatchItem{
+		{Key: "shard-3/app.log", Status: "stored"},
+		{Key: "shard-3/nested/worker.log", Status: "stored"},
+	}, response.Results)
+	assert.ElementsMatch(t, []string{"shard-3/app.log", "shard-3/nested/worker.log"}, store.keys(logBucket))
+
+	data, err := store.Download(context.Background(), logBucket, "shard-3/nested/worker.log")
+	assert.NoError(t, err)
+	assert.Equal(t, "worker started", string(data))
+}
+
+func TestExpandLogBundlePartialFailure(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.rejectUpload = func(bucket, object string) bool { return object == "shard-3/b.log" }
+	r := setupRouter(false)
+
+	bundle := makeTarball(t,
+		tarEntry{name: "a.log", contents: "a"},
+		tarEntry{name: "b.log", contents: "b"},
+		tarEntry{name: "c.log", contents: "c"},
+	)
+	w := postBundle(r, "shard-3.tar.gz", bundle)
+	assert.Equal(t, 207, w.Code, w.Body.String())
+
+	var response BundleResult
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Succeeded)
+	assert.Equal(t, 1, response.Failed)
+	if assert.Len(t, response.Results, 3) {
+		assert.Equal(t, "stored", response.Results[0].Status)
+		assert.Equal(t, BatchItem{Key: "shard-3/b.log", Status: "failed", Code: "internal", Message: response.Results[1].Message}, response.Results[1])
+		assert.NotEmpty(t, response.Results[1].Message)
+		assert.Equal(t, "stored", response.Results[2].Status)
+	}
+	assert.ElementsMatch(t, []string{"shard-3/a.log", "shard-3/c.log"}, store.keys(logBucket))
+
+	// When every file fails, nothing was stored
+	store.rejectUpload = func(bucket, object string) bool { return true }
+	w = postBundle(r, "shard-4.tar.gz", bundle)
+	assert.Equal(t, 500, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+}
+
+func TestLogBundleStoredAsIs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	bundle := makeTarball(t, tarEntry{name: "app.log", contents: "app started"})
+
+	// Without ?expand=true
+	assert.Equal(t, 201, postLog(r, "shard-3.tar.gz", string(bundle)).Code)
+	attrs, err := store.Attrs(context.Background(), logBucket, "shard-3.tar.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "application/gzip", attrs.ContentType)
+
+	// Not a tarball
+	assert.Equal(t, 201, postBundle(r, "plain.log", []byte("just a log")).Code)
+	assert.ElementsMatch(t, []string{"shard-3.tar.gz", "plain.log"}, store.keys(logBucket))
+}
+
+func TestLogBundleLimits(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	useBundleLimits(t, 3, 1024, 2048)
+
+	for name, bundle := range map[string][]byte{
+		"entries": makeTarball(t,
+			tarEntry{name: "a/", typeflag: tar.TypeDir},
+			tarEntry{name: "a/1.log", contents: "1"},
+			tarEntry{name: "a/2.log", contents: "2"},
+			tarEntry{name: "a/3.log", contents: "3"},
+		),
+		// Compresses to a fraction of the limit
+		"member": makeTarball(t, tarEntry{name: "bomb.log", contents: strings.Repeat("0", 1<<20)}),
+		"total": makeTarball(t,
+			tarEntry{name: "1.log", contents: strings.Repeat("1", 1000)},
+			tarEntry{name: "2.log", contents: strings.Repeat("2", 1000)},
+			tarEntry{name: "3.log", contents: strings.Repeat("3", 1000)},
+		),
+	} {
+		w := postBundle(r, name+".tar.gz", bundle)
+		assert.Equal(t, 413, w.Code, name)
+	}
+	assert.Empty(t, store.keys(logBucket))
+}
+
+func TestLogBundleUnsafeNames(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	for _, name := range []string{"../escape.log", "logs/../../escape.log", "/etc/passwd", "bad\x07name.log"} {
+		bundle := makeTarball(t,
+			tarEntry{name: "ok.log", contents: "fine"},
+			tarEntry{name: name, contents: "nope"},
+		)
+		w := postBundle(r, "shard.tar.gz", bundle)
+		assert.Equal(t, 400, w.Code, name)
+	}
+	assert.Empty(t, store.keys(logBucket))
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// The ways logs can be laid out in the log bucket. Flat logs keep the name
+// they were uploaded with; dated logs are stored as
+// logs/YYYY/MM/DD/<shard or name>-<timestamp>.log, by upload time in UTC.
+const (
+	logLayoutFlat  = "flat"
+	logLayoutDated = "dated"
+)
+
+// LogLayout is how uploaded logs are named.
+var LogLayout = logLayoutFlat
+
+// MaxRawLogBytes bounds the logs streamed to /log/raw.
+var MaxRawLogBytes int64 = 1 << 30
+
+// Reads LOG_LAYOUT and LOG_MAX_BYTES.
+func prepareLogs() error {
+	switch layout := os.Getenv("LOG_LAYOUT"); layout {
+	case "", logLayoutFlat:
+		LogLayout = logLayoutFlat
+	case logLayoutDated:
+		LogLayout = logLayoutDated
+	default:
+		return fmt.Errorf("LOG_LAYOUT must be %v or %v, not %q", logLayoutFlat, logLayoutDated, layout)
+	}
+	MaxRawLogBytes = 1 << 30
+	if value, ok := os.LookupEnv("LOG_MAX_BYTES"); ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return errors.New("LOG_MAX_BYTES must be a positive integer")
+		}
+		MaxRawLogBytes = n
+	}
+	return nil
+}
+
+// Returns the prefix of the dated logs uploaded on t's day.
+func datedLogPrefix(t time.Time) string {
+	return "logs/" + t.UTC().Format("2006/01/02") + "/"
+}
+
+// Returns the name, without an extension, of a dated log uploaded at t.
+func datedLogName(base string, t time.Time) string {
+	return datedLogPrefix(t) + base + "-" + t.UTC().Format("20060102T150405.000Z")
+}
+
+// Returns the base name of a dated log: the shard, if given, or else the
+// uploaded file's name up to its first dot.
+func datedLogBase(filename, shard string) string {
+	if shard != "" {
+		return shard
+	}
+	if base := strings.SplitN(filename, ".", 2)[0]; base != "" {
+		return base
+	}
+	return filename
+}
+
+// Returns the object name for an uploaded log under LogLayout.
+func logKey(filename, shard string, gzipped bool, now time.Time) string {
+	if LogLayout != logLayoutDated {
+		return filename
+	}
+	ext := ".log"
+	if gzipped {
+		ext = ".log.gz"
+	}
+	return datedLogName(datedLogBase(filename, shard), now) + ext
+}
+
+// Limits on ?name_regex=. Go's regexps run in linear time, so bounding the
+// pattern's size bounds the cost of matching it against each name.
+const (
+	maxNameRegexLength = 256
+	maxNameRegexInsts  = 2000
+)
+
+// A LogFilter selects the archived logs /log/list returns.
+type LogFilter struct {
+	Prefix      string
+	NameRegex   *regexp.Regexp
+	ContentType string
+	MinSize     int64
+	MaxSize     int64 // -1 for no limit
+	Descending  bool
+}
+
+// A LogEntry describes an archived log.
+type LogEntry struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Created     time.Time `json:"created"`
+}
+
+// Lists the archived logs, oldest first. Query parameters filter them by
+// ?date=YYYY-MM-DD (for dated logs), ?prefix=, ?name_regex=, ?content_type=,
+// and ?min_size=/?max_size= (bytes), and ?order=desc lists the newest first.
+func listLogs(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	objects, err := Store.List(c.Request.Context(), logBucket, filter.Prefix)
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var matched []*storage.ObjectAttrs
+	for _, attrs := range objects {
+		if filter.matches(attrs) {
+			matched = append(matched, attrs)
+		}
+	}
+	if notModified(c, listingETag(c, matched)) {
+		return
+	}
+
+	logs := []LogEntry{}
+	for _, attrs := range matched {
+		logs = append(logs, LogEntry{
+			Name:        attrs.Name,
+			Size:        attrs.Size,
+			ContentType: attrs.ContentType,
+			Created:     attrs.Created,
+		})
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		a, b := logs[i], logs[j]
+		if filter.Descending {
+			a, b = b, a
+		}
+		if !a.Created.Equal(b.Created) {
+			return a.Created.Before(b.Created)
+		}
+		return a.Name < b.Name
+	})
+	respond(c, http.StatusOK, gin.H{"bucket": logBucket, "logs": logs})
+}
+
+// Reads a LogFilter from the query string.
+func parseLogFilter(c *gin.Context) (LogFilter, error) {
+	filter := LogFilter{
+		Prefix:      c.Query("prefix"),
+		ContentType: strings.ToLower(c.Query("content_type")),
+		MaxSize:     -1,
+	}
+	if date := c.Query("date"); date != "" {
+		day, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return filter, fmt.Errorf("date must be YYYY-MM-DD, not %q", date)
+		}
+		filter.Prefix = datedLogPrefix(day) + filter.Prefix
+	}
+	if pattern := c.Query("name_regex"); pattern != "" {
+		re, err := compileNameRegex(pattern)
+		if err != nil {
+			return filter, err
+		}
+		filter.NameRegex = re
+	}
+	sizes := map[string]*int64{"min_size": &filter.MinSize, "max_size": &filter.MaxSize}
+	for name, size := range sizes {
+		if value, ok := c.GetQuery(name); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("%v must be a non-negative integer", name)
+			}
+			*size = n
+		}
+	}
+	if filter.MaxSize >= 0 && filter.MinSize > filter.MaxSize {
+		return filter, errors.New("min_size can't be more than max_size")
+	}
+	switch order := c.DefaultQuery("order", "asc"); order {
+	case "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, fmt.Errorf("order must be asc or desc, not %q", order)
+	}
+	return filter, nil
+}
+
+// Compiles a ?name_regex=, rejecting patterns that are invalid or too large.
+func compileNameRegex(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxNameRegexLength {
+		return nil, fmt.Errorf("name_regex can't be longer than %v characters", maxNameRegexLength)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("name_regex: %v", err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("name_regex: %v", err)
+	}
+	if len(prog.Inst) > maxNameRegexInsts {
+		return nil, errors.New("name_regex is too complex")
+	}
+	return regexp.Compile(pattern)
+}
+
+// Returns whether a log passes the filter.
+func (f LogFilter) matches(attrs *storage.ObjectAttrs) bool {
+	if f.NameRegex != nil && !f.NameRegex.MatchString(attrs.Name) {
+		return false
+	}
+	if f.ContentType != "" {
+		// Match the media type alone, e.g. text/plain for text/plain; charset=utf-8
+		mediaType, _, err := mime.ParseMediaType(attrs.ContentType)
+		if err != nil || mediaType != f.ContentType {
+			return false
+		}
+	}
+	if attrs.Size < f.MinSize || f.MaxSize >= 0 && attrs.Size > f.MaxSize {
+		return false
+	}
+	return true
+}
+
+// Deletes an archived log. With ?dry_run=true, only checks that it exists.
+func deleteLog(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+		return
+	}
+
+	_, err = getObjectAttrs(c.Request.Context(), logBucket, name)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", name)})
+		return
+	}
+	if err == nil && !dryRun {
+		err = deleteObject(c.Request.Context(), logBucket, name)
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"name": name, "deleted": !dryRun, "dry_run": dryRun})
+}
+
+// errLogTooLarge means a streamed log exceeded MaxRawLogBytes.
+var errLogTooLarge = errors.New("the log is too large")
+
+// limitedBody fails once more than limit bytes have been read through it, so
+// an oversized log is caught while it streams rather than after. It may be
+// read by the compressor's goroutine.
+type limitedBody struct {
+	r        io.Reader
+	limit    int64
+	n        atomic.Int64
+	exceeded atomic.Bool
+}
+
+func (b *limitedBody) Read(data []byte) (int, error) {
+	n, err := b.r.Read(data)
+	if b.n.Add(int64(n)) > b.limit {
+		b.exceeded.Store(true)
+		return n, errLogTooLarge
+	}
+	return n, err
+}
+
+// Returns a reader of r's contents, gzipped as they're read. Closing it
+// stops the compression.
+func gzipStream(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := copyBuffered(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Streams a log from the request body straight into the log bucket, without
+// buffering it, for logs too large for /log/upload. With ?gzip=true, it's
+// compressed on the way, and .gz is added to its name.
+func uploadRawLog(c *gin.Context) {
+	compress, err := strconv.ParseBool(c.DefaultQuery("gzip", "false"))
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "gzip must be true or false"})
+		return
+	}
+	tooLarge := gin.H{"error": fmt.Sprintf("Logs may be at most %v bytes", MaxRawLogBytes)}
+	if c.Request.ContentLength > MaxRawLogBytes {
+		abortWith(c, http.StatusRequestEntityTooLarge, tooLarge)
+		return
+	}
+
+	body := &limitedBody{r: c.Request.Body, limit: MaxRawLogBytes}
+	var data io.Reader = body
+	name := c.Param("name")
+	opts := UploadOptions{ContentType: "text/plain", StorageClass: LogStorageClass}
+	if compress {
+		compressed := gzipStream(body)
+		defer compressed.Close()
+		data = compressed
+		opts.ContentType = "application/gzip"
+		if !strings.HasSuffix(name, ".gz") {
+			name += ".gz"
+		}
+	}
+	key := logKey(name, "", compress, time.Now())
+
+	ctx := c.Request.Context()
+	if err := conditionLogUpload(ctx, key, &opts); err != nil {
+		abortLogUpload(c, err)
+		return
+	}
+	stored, err := streamObject(ctx, data, logBucket, key, opts)
+	if body.exceeded.Load() {
+		abortWith(c, http.StatusRequestEntityTooLarge, tooLarge)
+		return
+	}
+	if err != nil {
+		abortLogUpload(c, err)
+		return
+	}
+	path := fmt.Sprintf("gs://%v/%v", logBucket, key)
+	c.Header("Location", path)
+	respond(c, http.StatusCreated, gin.H{"key": key, "path": path, "bytes": body.n.Load(), "stored_bytes": stored})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Upload a handful of logs, a minute apart, in the order given
+func seedLogs(t *testing.T, store *memStorage, r http.Handler) {
+	logs := []struct{ name, contents string }{
+		{"bot-2024-01-01.log", "short"},
+		{"bot-2024-01-02.log", strings.Repeat("x", 100)},
+		{"web-2024-01-01.log", strings.Repeat("x", 1000)},
+		{"crash.txt", "panic"},
+	}
+	start := time.Now().Add(-time.Hour)
+	for i, log := range logs {
+		assert.Equal(t, 201, postLog(r, log.name, log.contents).Code)
+		store.objects[logBucket+"/"+log.name].attrs.Created = start.Add(time.Duration(i) * time.Minute)
+	}
+	err := store.Upload(context.Background(), logBucket, "trace.json", strings.NewReader("{}"),
+		UploadOptions{ContentType: "application/json; charset=utf-8"})
+	assert.NoError(t, err)
+}
+
+// List the logs with the given query, returning their names
+func listLogNames(t *testing.T, r http.Handler, query url.Values) []string {
+	w := performRequest(r, "GET", "/log/list?"+query.Encode(), nil)
+	if !assert.Equal(t, 200, w.Code, w.Body.String()) {
+		return nil
+	}
+	var response struct {
+		Logs []LogEntry `json:"logs"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	names := []string{}
+	for _, log := range response.Logs {
+		names = append(names, log.Name)
+	}
+	return names
+}
+
+func TestListLogs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedLogs(t, store, r)
+
+	all := []string{"bot-2024-01-01.log", "bot-2024-01-02.log", "web-2024-01-01.log", "crash.txt", "trace.json"}
+	assert.Equal(t, all, listLogNames(t, r, url.Values{}))
+	assert.Equal(t,
+		[]string{"trace.json", "crash.txt", "web-2024-01-01.log", "bot-2024-01-02.log", "bot-2024-01-01.log"},
+		listLogNames(t, r, url.Values{"order": {"desc"}}))
+	assert.Equal(t,
+		[]string{"bot-2024-01-01.log", "bot-2024-01-02.log"},
+		listLogNames(t, r, url.Values{"prefix": {"bot-"}}))
+	assert.Equal(t,
+		[]string{"bot-2024-01-01.log", "web-2024-01-01.log"},
+		listLogNames(t, r, url.Values{"name_regex": {`-01-01\.log$`}}))
+	assert.Equal(t,
+		[]string{"trace.json"},
+		listLogNames(t, r, url.Values{"content_type": {"application/json"}}))
+	assert.Equal(t,
+		[]string{"bot-2024-01-02.log", "web-2024-01-01.log"},
+		listLogNames(t, r, url.Values{"min_size": {"100"}}))
+	assert.Equal(t,
+		[]string{"bot-2024-01-01.log", "crash.txt", "trace.json"},
+		listLogNames(t, r, url.Values{"max_size": {"99"}}))
+	assert.Equal(t,
+		[]string{"bot-2024-01-02.log"},
+		listLogNames(t, r, url.Values{"prefix": {"bot-"}, "min_size": {"6"}, "content_type": {"text/plain"}}))
+	assert.Equal(t, []string{}, listLogNames(t, r, url.Values{"prefix": {"nope"}}))
+}
+
+func TestListLogsRejectsBadFilters(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	for _, query := range []url.Values{
+		{"name_regex": {"bot-("}},
+		{"name_regex": {strings.Repeat("a", maxNameRegexLength+1)}},
+		{"name_regex": {"(a{1,100}){1,100}"}},
+		{"min_size": {"-1"}},
+		{"max_size": {"big"}},
+		{"min_size": {"10"}, "max_size": {"5"}},
+		{"order": {"newest"}},
+	} {
+		w := performRequest(r, "GET", "/log/list?"+query.Encode(), nil)
+		assert.Equal(t, 400, w.Code, query.Encode())
+	}
+}
+
+func TestDeleteLog(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	assert.Equal(t, 201, postLog(r, "bot.log", "log line").Code)
+
+	w := performRequest(r, "DELETE", "/log/bot.log?dry_run=true", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"name": "bot.log", "deleted": false, "dry_run": true}`, w.Body.String())
+	assert.Equal(t, []string{"bot.log"}, store.keys(logBucket))
+
+	w = performRequest(r, "DELETE", "/log/bot.log", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"name": "bot.log", "deleted": true, "dry_run": false}`, w.Body.String())
+	_, err := store.Download(context.Background(), logBucket, "bot.log")
+	assert.ErrorIs(t, err, storage.ErrObjectNotExist)
+
+	w = performRequest(r, "DELETE", "/log/bot.log", nil)
+	assert.Equal(t, 404, w.Code)
+	w = performRequest(r, "DELETE", "/log/bot.log?dry_run=true", nil)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestDeleteLogRejectsBadNames(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	assert.Equal(t, 201, postLog(r, "bot.log", "log line").Code)
+
+	for _, path := range []string{"/log/..", "/log/%2e%2e", "/log/bot.log%00", "/log/bot.log?dry_run=maybe"} {
+		w := performRequest(r, "DELETE", path, nil)
+		assert.Equal(t, 400, w.Code, path)
+	}
+	assert.Equal(t, []string{"bot.log"}, store.keys(logBucket))
+}
+
+func TestDeleteLogScope(t *testing.T) {
+	useFakeBackends(t)
+	useJWTAuth(t, map[string]string{})
+	r := setupRouter(false)
+
+	w := requestWithAuth(r, "DELETE", "/log/bot.log", "Bearer "+signHS256(validClaims(scopeLogRead, scopeLogWrite)))
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), scopeLogDelete)
+
+	w = requestWithAuth(r, "DELETE", "/log/bot.log", "Bearer "+signHS256(validClaims(scopeLogDelete)))
+	assert.Equal(t, 404, w.Code)
+}
+
+// Use a log layout for the duration of a test
+func useLogLayout(t *testing.T, layout string) {
+	LogLayout = layout
+	t.Cleanup(func() { LogLayout = logLayoutFlat })
+}
+
+func TestPrepareLogs(t *testing.T) {
+	defer os.Unsetenv("LOG_LAYOUT")
+	defer os.Unsetenv("LOG_MAX_BYTES")
+	defer prepareLogs()
+
+	assert.NoError(t, prepareLogs())
+	assert.Equal(t, logLayoutFlat, LogLayout)
+	assert.Equal(t, int64(1<<30), MaxRawLogBytes)
+	os.Setenv("LOG_LAYOUT", "dated")
+	os.Setenv("LOG_MAX_BYTES", "1048576")
+	assert.NoError(t, prepareLogs())
+	assert.Equal(t, logLayoutDated, LogLayout)
+	assert.Equal(t, int64(1<<20), MaxRawLogBytes)
+	os.Setenv("LOG_MAX_BYTES", "0")
+	assert.Error(t, prepareLogs())
+	os.Setenv("LOG_LAYOUT", "weekly")
+	assert.Error(t, prepareLogs())
+}
+
+func TestDatedLogUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useLogLayout(t, logLayoutDated)
+	r := setupRouter(false)
+
+	w := postLog(r, "bot.log", "log line")
+	assert.Equal(t, 201, w.Code)
+	var response struct{ Key string }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	today := time.Now().UTC()
+	assert.Regexp(t, `^logs/\d{4}/\d{2}/\d{2}/bot-\d{8}T\d{6}\.\d{3}Z\.log$`, response.Key)
+	assert.True(t, strings.HasPrefix(response.Key, datedLogPrefix(today)))
+	assert.Equal(t, "gs://"+logBucket+"/"+response.Key, w.Header().Get("Location"))
+	assert.Equal(t, []string{response.Key}, store.keys(logBucket))
+
+	// Listed under today's date only
+	assert.Equal(t, []string{response.Key}, listLogNames(t, r, url.Values{"date": {today.Format("2006-01-02")}}))
+	assert.Equal(t, []string{}, listLogNames(t, r, url.Values{"date": {"2020-01-01"}}))
+	w = performRequest(r, "GET", "/log/list?date=01/02/2024", nil)
+	assert.Equal(t, 400, w.Code)
+
+	// And deletable by its key
+	w = performRequest(r, "DELETE", "/log/"+response.Key, nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, store.keys(logBucket))
+}
+
+func TestDatedLogKey(t *testing.T) {
+	useLogLayout(t, logLayoutDated)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC)
+
+	assert.Equal(t, "logs/2024/01/02/bot-20240102T030405.006Z.log", logKey("bot.log", "", false, now))
+	assert.Equal(t, "logs/2024/01/02/shard-3-20240102T030405.006Z.log", logKey("bot.log", "shard-3", false, now))
+	assert.Equal(t, "logs/2024/01/02/bot-20240102T030405.006Z.log.gz", logKey("bot.log.gz", "", true, now))
+	assert.Equal(t, "logs/2024/01/02/shard-3-20240102T030405.006Z/", bundlePrefix("shard-3.tar.gz", "", now))
+}
+
+func TestPurgeDatedLogs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useLogLayout(t, logLayoutDated)
+	ctx := context.Background()
+
+	now := time.Now()
+	old := now.Add(-72 * time.Hour)
+	for name, created := range map[string]time.Time{
+		datedLogName("old", old) + ".log": old,
+		datedLogName("new", now) + ".log": now,
+		"legacy.log":                      old,
+	} {
+		store.Upload(ctx, logBucket, name, strings.NewReader("log"), UploadOptions{ContentType: "text/plain"})
+		store.objects[logBucket+"/"+name].attrs.Created = created
+	}
+
+	result, err := purgeLogs(24 * time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []BatchItem{{Key: datedLogName("old", old) + ".log", Status: "deleted"}}, result.Results)
+	// Flat logs are left to LOG_LAYOUT=flat
+	assert.ElementsMatch(t, []string{datedLogName("new", now) + ".log", "legacy.log"}, store.keys(logBucket))
+}
+
+// logStream produces size bytes of log lines without holding them in memory,
+// counting how many have been read.
+type logStream struct {
+	size int64
+	read atomic.Int64
+}
+
+func (s *logStream) Read(data []byte) (int, error) {
+	remaining := s.size - s.read.Load()
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(data)) > remaining {
+		data = data[:remaining]
+	}
+	for i := range data {
+		data[i] = "log line\n"[(s.read.Load()+int64(i))%9]
+	}
+	s.read.Add(int64(len(data)))
+	return len(data), nil
+}
+
+func TestRawLogUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	// The body has no length, so it arrives chunked
+	body := &logStream{size: 8 << 20}
+	var readBeforeUpload int64 = -1
+	store.beforeUpload = func(bucket, object string) {
+		readBeforeUpload = body.read.Load()
+	}
+	w := performRequest(r, "PUT", "/log/raw/shard-3.log", body)
+	assert.Equal(t, 201, w.Code, w.Body.String())
+
+	// Nothing was buffered before the write to storage began
+	assert.Equal(t, int64(0), readBeforeUpload)
+	assert.JSONEq(t, `{
+		"key": "shard-3.log",
+		"path": "gs://inconnu-logs/shard-3.log",
+		"bytes": 8388608,
+		"stored_bytes": 8388608
+	}`, w.Body.String())
+	data, err := store.Download(context.Background(), logBucket, "shard-3.log")
+	assert.NoError(t, err)
+	assert.Len(t, data, 8<<20)
+	assert.True(t, strings.HasPrefix(string(data), "log line\nlog line\n"))
+}
+
+func TestRawLogUploadGzip(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := performRequest(r, "PUT", "/log/raw/shard-3.log?gzip=true", &logStream{size: 1 << 20})
+	assert.Equal(t, 201, w.Code, w.Body.String())
+	attrs, err := store.Attrs(context.Background(), logBucket, "shard-3.log.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "application/gzip", attrs.ContentType)
+	assert.Less(t, attrs.Size, int64(1<<20))
+
+	data, _ := store.Download(context.Background(), logBucket, "shard-3.log.gz")
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	unzipped, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Len(t, unzipped, 1<<20)
+}
+
+func TestRawLogUploadLimit(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	MaxRawLogBytes = 64 << 10
+	defer func() { MaxRawLogBytes = 1 << 30 }()
+
+	// Caught partway through the stream
+	body := &logStream{size: 1 << 20}
+	w := performRequest(r, "PUT", "/log/raw/big.log", body)
+	assert.Equal(t, 413, w.Code)
+	assert.Less(t, body.read.Load(), int64(1<<20))
+	w = performRequest(r, "PUT", "/log/raw/big.log?gzip=true", &logStream{size: 1 << 20})
+	assert.Equal(t, 413, w.Code)
+
+	// Or up front, given a length
+	w = performRequest(r, "PUT", "/log/raw/big.log", bytes.NewReader(make([]byte, 128<<10)))
+	assert.Equal(t, 413, w.Code)
+	assert.Empty(t, store.keys(logBucket))
+
+	w = performRequest(r, "PUT", "/log/raw/..", &logStream{size: 10})
+	assert.Equal(t, 400, w.Code)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// A LogTypeError means an uploaded log isn't text, JSON, NDJSON, or a gzip
+// of them.
+type LogTypeError struct {
+	Name string
+	Type string // What it was sniffed as
+}
+
+func (e *LogTypeError) Error() string {
+	return fmt.Sprintf("%v is %v; logs must be text, JSON, or NDJSON, optionally gzipped", e.Name, e.Type)
+}
+
+// Returns the Content-Type of a log, sniffed from its contents: text/plain,
+// application/json, application/x-ndjson, or application/gzip for a gzip of
+// any of those or of a tarball of them. Anything else is a LogTypeError,
+// unless force is set, in which case its sniffed type is returned.
+func sniffLogType(name string, data []byte, force bool) (string, error) {
+	if isGzip(data) {
+		if isTarball(data) {
+			// Bundles' files are checked as they're expanded
+			return "application/gzip", nil
+		}
+		contentType := "application/octet-stream"
+		if gz, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+			head, _ := io.ReadAll(io.LimitReader(gz, 512))
+			contentType = http.DetectContentType(head)
+		}
+		if !force && !isTextType(contentType) {
+			return "", &LogTypeError{Name: name, Type: "gzipped " + mediaType(contentType)}
+		}
+		return "application/gzip", nil
+	}
+
+	contentType := http.DetectContentType(data)
+	if !isTextType(contentType) {
+		if force {
+			return mediaType(contentType), nil
+		}
+		return "", &LogTypeError{Name: name, Type: mediaType(contentType)}
+	}
+	switch {
+	case json.Valid(data):
+		return "application/json", nil
+	case isNDJSON(data):
+		return "application/x-ndjson", nil
+	}
+	return "text/plain", nil
+}
+
+// Reports whether a sniffed Content-Type is text. Empty files count.
+func isTextType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/")
+}
+
+// Returns a Content-Type without its parameters.
+func mediaType(contentType string) string {
+	return strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+}
+
+// Reports whether every non-blank line of data is a JSON value.
+func isNDJSON(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	lines := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return false
+		}
+		lines++
+	}
+	return lines > 0 && scanner.Err() == nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Post a log file through the log route with a query and credentials
+func postLogAs(r http.Handler, query, auth, name string, contents []byte) *httptest.ResponseRecorder {
+	var b bytes.Buffer
+	m := multipart.NewWriter(&b)
+	fw, _ := m.CreateFormFile("log_file", name)
+	fw.Write(contents)
+	m.Close()
+
+	req := httptest.NewRequest("POST", "/log/upload"+query, &b)
+	req.Header.Set("Content-Type", m.FormDataContentType())
+	req.Header.Set("Authorization", auth)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func pngBytes() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	return buf.Bytes()
+}
+
+func TestLogUploadRejectsBinary(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := postLogAs(r, "", "", "bot.log", pngBytes())
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Contains(t, w.Body.String(), "unsupported_log_type")
+	assert.Contains(t, w.Body.String(), "image/png")
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(pngBytes())
+	gz.Close()
+	w = postLogAs(r, "", "", "bot.log.gz", gzipped.Bytes())
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "Gzips are sniffed inside")
+	assert.Empty(t, store.keys(logBucket))
+}
+
+func TestLogUploadContentTypes(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("log line\n"))
+	gz.Close()
+
+	tests := []struct {
+		name     string
+		contents []byte
+		want     string
+	}{
+		{"bot.log", []byte("log line\n"), "text/plain"},
+		{"trace.json", []byte(`{"events": [1, 2]}`), "application/json"},
+		{"events.log", []byte("{\"a\": 1}\n{\"b\": 2}\n"), "application/x-ndjson"},
+		{"bot.log.gz", gzipped.Bytes(), "application/gzip"},
+	}
+	for _, test := range tests {
+		w := postLogAs(r, "", "", test.name, test.contents)
+		if assert.Equal(t, http.StatusCreated, w.Code, test.name) {
+			attrs, _ := store.Attrs(context.Background(), logBucket, test.name)
+			assert.Equal(t, test.want, attrs.ContentType, test.name)
+		}
+	}
+}
+
+func TestLogUploadForce(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useJWTAuth(t, map[string]string{})
+	r := setupRouter(false)
+
+	writer := "Bearer " + signHS256(validClaims(scopeLogWrite))
+	w := postLogAs(r, "?force=true", writer, "core.bin", pngBytes())
+	assert.Equal(t, http.StatusForbidden, w.Code, "Only admins may force an upload")
+
+	admin := "Bearer " + signHS256(validClaims(scopeLogWrite, scopeAdmin))
+	w = postLogAs(r, "?force=true", admin, "core.bin", pngBytes())
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	attrs, _ := store.Attrs(context.Background(), logBucket, "core.bin")
+	assert.Equal(t, "image/png", attrs.ContentType)
+}
+
+func TestLogBundleRejectsBinary(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	bundle := makeTarball(t,
+		tarEntry{name: "app.log", contents: "app started"},
+		tarEntry{name: "trace.json", contents: `{"spans": []}`},
+	)
+	assert.Equal(t, http.StatusCreated, postBundle(r, "shard-3.tar.gz", bundle).Code)
+	attrs, _ := store.Attrs(context.Background(), logBucket, "shard-3/trace.json")
+	assert.Equal(t, "application/json", attrs.ContentType)
+
+	bundle = makeTarball(t,
+		tarEntry{name: "app.log", contents: "app started"},
+		tarEntry{name: "screenshot.png", contents: string(pngBytes())},
+	)
+	w := postBundle(r, "shard-4.tar.gz", bundle)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+	assert.NotContains(t, store.keys(logBucket), "shard-4/app.log", "Nothing in the bundle is stored")
+}
@@ -4,121 +4,618 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
 	"github.com/gin-gonic/gin"
-	"github.com/nickalie/go-webpbin"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const ProjectID = "inconnu-357402"
-var ApiToken string
-var Port string
-var FaceclaimBucket string
 
-// JSON represents generic k:v pairings used by publishMessage().
+// ImageModerator screens faceclaims before upload. It's nil when moderation is
+// disabled.
+var ImageModerator Moderator
+var ModerationThreshold Likelihood
+
+// JSON represents generic k:v pairings, as in message envelopes.
 type JSON map[string]interface{}
 
 // A FaceclaimRequest represents the necessary POST body data for /faceclaim/upload.
 type FaceclaimRequest struct {
-	Guild    int    `json:"guild"`
-	User     int    `json:"user"`
-	CharID   string `json:"charid"`
-	ImageURL string `json:"image_url"`
-	Bucket 	 string	`json:"bucket"`
+	Guild     int    `json:"guild"`
+	User      int    `json:"user"`
+	CharID    string `json:"charid"`
+	ImageURL  string `json:"image_url"`
+	Bucket    string `json:"bucket"`
+	Watermark string `json:"watermark"`
+
+	// Whether to store the untouched source image. Defaults to KEEP_ORIGINALS.
+	KeepOriginal *bool `json:"keep_original"`
+
+	// Sizes, in pixels along the longest side, of additional renditions to
+	// generate, e.g. ["256", "512"]
+	Variants []string `json:"variants"`
+
+	// The region of the image to keep, e.g. to trim a screenshot's borders
+	Crop *Crop `json:"crop"`
+
+	// How to fit the image: "contain" (the default) keeps its aspect ratio,
+	// and "square" center-crops it for use as an avatar
+	Fit string `json:"fit"`
+
+	// If set, the WebP is encoded at the highest quality that keeps it within
+	// this many bytes, down to WEBP_QUALITY_FLOOR
+	TargetBytes int64 `json:"target_bytes"`
+
+	// Whether to process the upload in the background, returning a job ID
+	// immediately instead of waiting for the result
+	Async bool `json:"async"`
+
+	// Whether to delete the character's oldest faceclaim when they're at
+	// CHAR_MAX_IMAGES, rather than rejecting the upload
+	EvictOldest bool `json:"evict_oldest"`
+
+	// If set, the character is trimmed to this many of their newest
+	// faceclaims once the upload is stored, as by /faceclaim/trim
+	TrimTo int `json:"trim_to"`
+
+	// The GCS storage class to store the images with. Defaults to
+	// FACECLAIM_STORAGE_CLASS, or the bucket's default.
+	StorageClass string `json:"storage_class"`
+
+	// Whether to return a signed URL as well, for buckets that aren't public.
+	// The bucket's access isn't checked when it's set.
+	SignedURL bool `json:"signed_url"`
+
+	// Whether to check and convert the image without storing anything, as
+	// with ?dry_run=true
+	DryRun bool `json:"dry_run"`
+
+	// Names the upload, so retries and duplicates of it store one faceclaim
+	// rather than several. Also read from the Idempotency-Key header.
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
-func main() {
-	log.SetFlags(log.Ltime | log.Lmicroseconds)
-	if err := prepareEnvVars(); err != nil {
-		log.Fatalln(err.Error())
+// Whether the untouched source image should be stored alongside the WebP.
+func (r FaceclaimRequest) keepOriginal() bool {
+	if r.KeepOriginal != nil {
+		return *r.KeepOriginal
 	}
-
-	r := setupRouter(true)
-	r.Run(":" + Port)
+	return currentConfig().KeepOriginals
 }
 
-// Gets the ApiToken and FaceclaimBucket vars from the environment.
-func prepareEnvVars() error {
-	port, ok := os.LookupEnv("PORT")
-	if ok {
-		Port = port
-	} else {
-		// $PORT doesn't need to explicitly be set
-		Port = "8080"
+// The storage class the images should be stored with.
+func (r FaceclaimRequest) storageClass() (string, error) {
+	if r.StorageClass != "" {
+		return parseStorageClass(r.StorageClass)
 	}
+	return FaceclaimStorageClass, nil
+}
 
-	if token, ok := os.LookupEnv("API_TOKEN"); ok {
-		ApiToken = token
-	} else {
-		return errors.New("API_TOKEN is not set!")
+// Checks the options that say how the image is processed: the watermark,
+// variants, crop, fit, target size, and storage class.
+func (r FaceclaimRequest) validateImageOptions() error {
+	if _, ok := Watermarks[r.Watermark]; r.Watermark != "" && !ok {
+		return fmt.Errorf("Unknown watermark: %v", r.Watermark)
 	}
-	if bucket, ok := os.LookupEnv("FACECLAIM_BUCKET"); ok {
-		FaceclaimBucket = bucket
-	} else {
-		return errors.New("FACECLAIM_BUCKET is not set!")
+	if err := validateVariants(r.Variants); err != nil {
+		return err
+	}
+	if r.Crop != nil {
+		if err := r.Crop.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateFit(r.Fit); err != nil {
+		return err
+	}
+	if r.TargetBytes < 0 {
+		return errors.New("target_bytes can't be negative")
+	}
+	if r.TrimTo < 0 {
+		return errors.New("trim_to can't be negative")
+	}
+	if _, err := r.storageClass(); err != nil {
+		return err
+	}
+	if r.IdempotencyKey != "" {
+		if err := validateIdempotencyKey(r.IdempotencyKey); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// A FaceclaimResponse is the response body for a successful /faceclaim/upload.
+type FaceclaimResponse struct {
+	URL           string            `json:"url,omitempty"`
+	BlurHash      string            `json:"blurhash"`
+	DominantColor string            `json:"dominant_color"`
+	CRC32C        string            `json:"crc32c"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Quality       int               `json:"quality"`
+	TargetMissed  bool              `json:"target_missed,omitempty"`
+	InputBytes    int64             `json:"input_bytes"`
+	OutputBytes   int64             `json:"output_bytes"`
+	OriginalURL   string            `json:"original_url,omitempty"`
+	ResolvedURL   string            `json:"resolved_url,omitempty"`
+	Variants      map[string]string `json:"variants,omitempty"`
+	Evicted       []string          `json:"evicted,omitempty"`
+	Trimmed       []string          `json:"trimmed,omitempty"`
+
+	// Things that went wrong, or that the caller may not expect, without
+	// failing the upload, such as the image URL redirecting elsewhere. It's
+	// always present, even if empty.
+	Warnings []Warning `json:"warnings"`
+
+	// A URL good for 15 minutes, if signed_url was requested
+	SignedURL string `json:"signed_url,omitempty"`
+
+	// False if the bucket isn't publicly readable, in which case URL won't
+	// load for anyone; absent otherwise
+	Public *bool `json:"public,omitempty"`
+
+	// Derived objects that couldn't be uploaded: "original", or a variant's
+	// size. Each is retried once in the background.
+	Failed []string `json:"failed,omitempty"`
+
+	// For a dry run, which has no URLs: the bytes the upload would store,
+	// counting the kept original and variants
+	DryRun         bool  `json:"dry_run,omitempty"`
+	PredictedBytes int64 `json:"predicted_bytes,omitempty"`
+}
+
+// A Warning is something non-fatal the caller should know about an upload.
+// Codes are stable; messages are for people.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Adds a warning to the response.
+func (r *FaceclaimResponse) warn(code, message string) {
+	r.Warnings = append(r.Warnings, Warning{Code: code, Message: message})
+}
+
+// FaceclaimMetadata is the response body for /faceclaim/metadata.
+type FaceclaimMetadata struct {
+	URL          string            `json:"url"`
+	ContentType  string            `json:"content_type"`
+	Size         int64             `json:"size"`
+	Created      time.Time         `json:"created"`
+	StorageClass string            `json:"storage_class"`
+	BlurHash     string            `json:"blurhash"`
+	Encoder      *EncoderSettings  `json:"encoder,omitempty"`
+	Held         bool              `json:"held"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+func main() {
+	log.SetFlags(log.Ltime | log.Lmicroseconds)
+	log.SetOutput(redactingWriter{os.Stderr})
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Reads the configuration from the environment.
+func prepareEnvVars() error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	setConfig(cfg)
+	prepareJobs()
+	if err := prepareStorageClasses(); err != nil {
+		return err
+	}
+	if err := prepareLogs(); err != nil {
+		return err
+	}
+	if err := prepareUploadPool(); err != nil {
+		return err
+	}
+	if err := prepareAttrCache(); err != nil {
+		return err
+	}
+	if err := prepareListCache(); err != nil {
+		return err
+	}
+	if err := prepareProxies(); err != nil {
+		return err
+	}
+	if err := prepareFetcher(); err != nil {
+		return err
+	}
+	if err := preparePubSubPush(); err != nil {
+		return err
+	}
+	if err := prepareGCSNotify(); err != nil {
+		return err
+	}
+	if err := prepareRecords(); err != nil {
+		return err
+	}
+	if err := prepareDeleteJournal(); err != nil {
+		return err
+	}
+	if err := prepareDeleteLocks(); err != nil {
+		return err
+	}
+	if err := prepareQueueStatus(); err != nil {
+		return err
+	}
+	if err := prepareMessages(); err != nil {
+		return err
+	}
+	if err := prepareReencode(); err != nil {
+		return err
+	}
+	if err := prepareManifests(); err != nil {
+		return err
+	}
+	if err := prepareUsage(); err != nil {
+		return err
+	}
+	if err := prepareBucketStats(); err != nil {
+		return err
+	}
+	if err := prepareMetadata(); err != nil {
+		return err
+	}
+	if err := prepareIDs(); err != nil {
+		return err
+	}
+	if err := prepareTimeouts(); err != nil {
+		return err
+	}
+	if err := prepareMaintenance(); err != nil {
+		return err
+	}
+	if err := prepareReadOnly(); err != nil {
+		return err
+	}
+	if err := prepareTracing(); err != nil {
+		return err
+	}
+	if err := prepareErrorReporting(); err != nil {
+		return err
+	}
+	if err := prepareDebugDump(); err != nil {
+		return err
+	}
+	prepareAdmin()
+	if err := prepareModeration(); err != nil {
+		return err
+	}
+	if err := prepareValidation(); err != nil {
+		return err
+	}
+	if err := prepareImageProxy(); err != nil {
+		return err
+	}
+	if err := preparePublicCheck(); err != nil {
+		return err
+	}
+	if err := prepareSelfTest(); err != nil {
+		return err
+	}
+	if err := prepareAuth(); err != nil {
+		return err
+	}
+	if err := prepareAPIToken(); err != nil {
+		return err
+	}
+	if err := prepareAuthBans(); err != nil {
+		return err
+	}
+	return prepareWatermarks()
+}
+
 // Sets up the router. Disable Gin logging by setting showLogs to false.
 func setupRouter(showLogs bool) *gin.Engine {
 	var r *gin.Engine
 	if showLogs {
-		r = gin.Default()
+		// AccessLog replaces gin's logger
+		r = gin.New()
+		r.Use(gin.Recovery())
 	} else {
-		// For testing purposes. No logger, no recovery, no default routes
+		// For testing purposes. No recovery, no default routes
 		r = gin.New()
 	}
 
-	r.SetTrustedProxies(nil)
+	configureProxies(r)
+
+	// Health checks come from the platform, which doesn't have the token
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+
+	r.Use(RequestContext())
+	r.Use(AccessLog())
+	r.Use(ReportErrors())
 	r.Use(VerifyAuth())
+	r.Use(TrackUsage())
+	r.Use(Timeout())
+	r.Use(Maintenance())
+	r.Use(ReadOnly())
+	r.Use(ValidateParams())
+	r.Use(DebugDump())
 
 	r.POST("/faceclaim/upload", processFaceclaim)
+	r.POST("/faceclaim/inspect", inspectFaceclaim)
 	r.DELETE("/faceclaim/delete/:bucket/:charid/all", deleteCharacterFaceclaims)
 	r.DELETE("/faceclaim/delete/:bucket/:charid/:key", deleteSingleFaceclaim)
+	r.POST("/faceclaim/delete-batch", deleteFaceclaimBatch)
+	r.GET("/faceclaim/list/:bucket/:charid", Compress(), listFaceclaims)
+	r.POST("/faceclaim/trim/:bucket/:charid", trimFaceclaims)
+	r.POST("/faceclaim/hold/:bucket/:charid/:key", holdFaceclaim)
+	r.DELETE("/faceclaim/hold/:bucket/:charid/:key", releaseFaceclaim)
+	r.GET("/faceclaim/metadata/:bucket/:charid/:key", getFaceclaimMetadata)
+	r.PATCH("/faceclaim/:bucket/:charid/:key", patchFaceclaimMetadata)
+	r.GET("/faceclaim/image/:bucket/:charid/:key", getFaceclaimImage)
+	r.POST("/faceclaim/refresh/:bucket/:charid/:key", refreshFaceclaim)
+	r.GET("/faceclaim/job/:id", getJob)
+	r.GET("/version", getVersion)
+	r.GET("/limits", getLimits)
+	r.GET("/faceclaim/usage/:bucket/:guild", Compress(), getGuildUsage)
+	r.POST("/faceclaim/reconcile", reconcileFaceclaims)
+	r.POST("/faceclaim/rename", renameCharacter)
+	r.POST("/faceclaim/audit", Compress(), auditFaceclaims)
+	r.POST("/faceclaim/manifest/:bucket", createManifest)
+	r.GET("/faceclaim/manifest/:bucket/latest", Compress(), getLatestManifest)
 	r.POST("/log/upload", uploadLog)
+	r.PUT("/log/raw/:name", uploadRawLog)
+	r.GET("/log/list", Compress(), listLogs)
+	r.DELETE("/log/*name", deleteLog)
+	r.POST("/admin/maintenance", setMaintenance)
+	r.POST("/admin/read-only", setReadOnly)
+	r.POST("/admin/debug-dump", setDebugDump)
+	r.POST("/admin/reload", reloadSettings)
+	r.GET("/admin/queue-status", getQueueStatus)
+	r.GET("/admin/usage", Compress(), getUsage)
+	r.GET("/admin/buckets", getBucketStats)
+	r.POST("/admin/migrate", migrateBucket)
+	r.POST("/admin/reencode", reencodeBucket)
+	r.POST("/admin/fix-content-type", fixContentTypes)
+	r.POST("/internal/pubsub/push", handleDeletePush)
+	r.POST("/internal/gcs/notify", handleGCSNotification)
 
 	return r
 }
 
-// VerifyAuth ensures that the Authorization token matches the API_KEY ENV var.
-func VerifyAuth() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		token := c.Request.Header.Get("Authorization")
-		if token != os.Getenv("API_TOKEN") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
-		}
-		c.Next()
-	}
-}
-
 // ROUTES
 
 // Downloads a given image, then converts it to WebP and uploads it to GCS.
 func processFaceclaim(c *gin.Context) {
 	var request FaceclaimRequest
-	if err := c.BindJSON(&request); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := bindBody(c, &request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	objectURL, err := processImage(request)
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+		return
+	}
+	request.DryRun = request.DryRun || dryRun
+	if request.IdempotencyKey == "" {
+		request.IdempotencyKey = c.GetHeader("Idempotency-Key")
+	}
+	if request.DryRun && request.Async {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "dry_run can't be combined with async"})
 		return
 	}
-	c.JSON(http.StatusCreated, objectURL)
+	tagRequest(c, "charid", request.CharID)
+	tagRequest(c, "bucket", request.Bucket)
+	if request.Bucket != "" {
+		var prefixed bool
+		if request.Bucket, prefixed = normalizeBucket(request.Bucket); prefixed {
+			warnDeprecatedBucket(c)
+		}
+		if err := validateBucket(request.Bucket); err != nil {
+			abortWith(c, bucketErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := validateCharID(request.CharID); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := request.validateImageOptions(); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Expired URLs are caught before anything is queued
+	var expiredErr *ExpiredURLError
+	if _, err := normalizeImageURL(request.ImageURL, time.Now()); errors.As(err, &expiredErr) {
+		abortWith(c, http.StatusBadRequest, gin.H{
+			"error":      err.Error(),
+			"code":       "expired_url",
+			"expired_at": expiredErr.Expired,
+		})
+		return
+	}
+	if err := checkFetchURL(c.Request.Context(), request.ImageURL); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error(), "code": "blocked_url"})
+		return
+	}
+
+	if request.Async {
+		credential := requestCredential(c)
+		job := startJob(func() (interface{}, error) {
+			// The job outlives the request, so it gets a deadline of its own
+			ctx := withCredential(context.Background(), credential)
+			ctx, cancel := context.WithTimeout(ctx, UploadTimeout)
+			defer cancel()
+			return processImage(ctx, request)
+		})
+		respond(c, http.StatusAccepted, job)
+		return
+	}
+
+	response, err := processImage(c.Request.Context(), request)
+	if abortIfTimedOut(c) {
+		return
+	}
+	if abortWithUploadError(c, err) {
+		return
+	}
+	response.Warnings = append(response.Warnings, requestWarnings(c)...)
+	if request.DryRun {
+		respond(c, http.StatusOK, response)
+		return
+	}
+	c.Header("Location", response.URL)
+	respond(c, http.StatusCreated, response)
+}
+
+// Responds to an upload's error with its status and details, returning
+// whether there was one. Errors without a status of their own are 400s.
+func abortWithUploadError(c *gin.Context, err error) bool {
+	var moderationErr *ModerationError
+	if errors.As(err, &moderationErr) {
+		abortWith(c, http.StatusUnprocessableEntity, gin.H{
+			"error":    err.Error(),
+			"category": moderationErr.Category,
+		})
+		return true
+	}
+	var limitErr *CharLimitError
+	if errors.As(err, &limitErr) {
+		abortWith(c, http.StatusConflict, gin.H{
+			"error": err.Error(),
+			"count": limitErr.Count,
+			"limit": limitErr.Limit,
+		})
+		return true
+	}
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		abortWith(c, http.StatusTooManyRequests, gin.H{
+			"error": err.Error(),
+			"usage": quotaErr.Usage,
+			"limit": quotaErr.Limit,
+		})
+		return true
+	}
+	var largeErr *ImageTooLargeError
+	if errors.As(err, &largeErr) {
+		abortWith(c, http.StatusRequestEntityTooLarge, gin.H{
+			"error":      err.Error(),
+			"code":       "image_too_large",
+			"max_bytes":  largeErr.MaxBytes,
+			"max_pixels": largeErr.MaxPixels,
+		})
+		return true
+	}
+	var smallErr *TooSmallError
+	if errors.As(err, &smallErr) {
+		abortWith(c, http.StatusUnprocessableEntity, gin.H{
+			"error":         err.Error(),
+			"code":          "image_too_small",
+			"width":         smallErr.Width,
+			"height":        smallErr.Height,
+			"min_dimension": smallErr.Min,
+		})
+		return true
+	}
+	var privateErr *PrivateBucketError
+	if errors.As(err, &privateErr) {
+		abortWith(c, http.StatusUnprocessableEntity, gin.H{
+			"error":  err.Error(),
+			"code":   "bucket_not_public",
+			"bucket": privateErr.Bucket,
+		})
+		return true
+	}
+	var cropErr *CropError
+	if errors.As(err, &cropErr) {
+		abortWith(c, http.StatusBadRequest, gin.H{
+			"error":  err.Error(),
+			"code":   "crop_out_of_bounds",
+			"width":  cropErr.Width,
+			"height": cropErr.Height,
+		})
+		return true
+	}
+	var fitErr *FitError
+	if errors.As(err, &fitErr) {
+		abortWith(c, http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": "unsupported_fit", "fit": fitErr.Fit})
+		return true
+	}
+	var webpErr *InvalidWebPError
+	if errors.As(err, &webpErr) {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error(), "code": "conversion_failed"})
+		return true
+	}
+	var colorErr *ColorSpaceError
+	if errors.As(err, &colorErr) {
+		abortWith(c, http.StatusUnsupportedMediaType, gin.H{
+			"error":       err.Error(),
+			"code":        "unsupported_color_space",
+			"color_space": colorErr.Space,
+		})
+		return true
+	}
+	var typeErr *UnsupportedTypeError
+	if errors.As(err, &typeErr) {
+		abortWith(c, http.StatusUnsupportedMediaType, gin.H{
+			"error":     err.Error(),
+			"detected":  typeErr.Type,
+			"supported": supportedTypeNames(),
+		})
+		return true
+	}
+	var blockedErr *BlockedURLError
+	if errors.As(err, &blockedErr) {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error(), "code": "blocked_url"})
+		return true
+	}
+	var redirectErr *RedirectError
+	if errors.As(err, &redirectErr) {
+		abortWith(c, http.StatusBadGateway, gin.H{"error": redirectErr.Error(), "code": "too_many_redirects"})
+		return true
+	}
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		c.Error(err)
+		abortWith(c, http.StatusBadGateway, gin.H{"error": err.Error(), "code": "upstream_fetch_failed"})
+		return true
+	}
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		// Rounded up, so the caller never retries early
+		seconds := int((rateLimitErr.RetryAfter + time.Second - 1) / time.Second)
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		abortWith(c, http.StatusTooManyRequests, gin.H{
+			"error":       err.Error(),
+			"code":        "upstream_rate_limited",
+			"retry_after": seconds,
+		})
+		return true
+	}
+	var integrityErr *IntegrityError
+	if errors.As(err, &integrityErr) {
+		c.Error(err)
+		abortWith(c, http.StatusBadGateway, gin.H{"error": err.Error(), "code": "storage_error"})
+		return true
+	}
+	if abortIfUploadsBusy(c, err) || abortIfConflict(c, err) || abortIfDeleting(c, err) {
+		return true
+	}
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return true
+	}
+	return false
 }
 
 // Publishes a delete-faceclaim-group message to Pub/Sub to delete all of a
@@ -126,13 +623,17 @@ func processFaceclaim(c *gin.Context) {
 // response of this function, as the user doesn't need to see the deletions
 // happen in real time.
 func deleteCharacterFaceclaims(c *gin.Context) {
-	bucket := c.Param("bucket")
-	charid := c.Param("charid")
-	if err := publishMessage("delete-faceclaim-group", JSON{"bucket": bucket, "charid": charid}); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	result, err := queueCharacterDeletion(c.Request.Context(), c.Param("bucket"), c.Param("charid"))
+	recordDelete(c.Param("bucket"), "group", err)
+	if abortIfJournalFull(c, err) {
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, fmt.Sprintf("Deleted %v's faceclaim images", charid))
+	respond(c, http.StatusOK, result)
 }
 
 // Publishes a delete-single-faceclaim message to Pub/Sub to delete a given GCS
@@ -141,147 +642,903 @@ func deleteCharacterFaceclaims(c *gin.Context) {
 // of a character's faceclaim images using the same mechanism, which is much
 // more responsive for the user.
 func deleteSingleFaceclaim(c *gin.Context) {
-	bucket := c.Param("bucket")
-	charid := c.Param("charid")
-	key := c.Param("key")
+	result, err := queueFaceclaimDeletion(c.Request.Context(), c.Param("bucket"), c.Param("charid"), c.Param("key"))
+	recordDelete(c.Param("bucket"), "single", err)
+	if abortIfJournalFull(c, err) {
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, result)
+}
+
+// A DeleteResult is the response body for the delete routes. Held objects
+// aren't deleted, and are listed as skipped.
+type DeleteResult struct {
+	Message       string   `json:"message"`
+	AlreadyQueued bool     `json:"already_queued"`
+	Skipped       []string `json:"skipped,omitempty"`
+}
+
+// Queues the deletion of all of a character's faceclaim images.
+func queueCharacterDeletion(ctx context.Context, bucket, charid string) (DeleteResult, error) {
+	result := DeleteResult{Message: fmt.Sprintf("Deleted %v's faceclaim images", charid)}
+
+	// Duplicate requests within the dedupe window are acknowledged without
+	// queueing another deletion
+	dedupeKey := fmt.Sprintf("%v/%v/", bucket, charid)
+	if !recentDeletes.add(dedupeKey) {
+		result.AlreadyQueued = true
+		return result, nil
+	}
+
+	// Uploads to the character are held off until the deletion is seen to
+	// finish, or the mark expires
+	deletionLocks.acquire(bucket, charid)
+
+	// A group message deletes everything under the prefix, so if any of the
+	// character's faceclaims are held, the rest are deleted one by one
+	if held, unheld, ok := partitionHeld(ctx, bucket, charid); ok && len(held) > 0 {
+		for _, name := range unheld {
+			attributes := map[string]string{"dedupe_key": fmt.Sprintf("%v/%v", bucket, name)}
+			if err := publishMessage(ctx, DeleteSingle{Bucket: bucket, Key: name}, attributes); err != nil {
+				recentDeletes.remove(dedupeKey)
+				deletionLocks.release(bucket, charid)
+				return DeleteResult{}, err
+			}
+		}
+		result.Message = fmt.Sprintf("Deleted %v's faceclaim images, except %v held objects", charid, len(held))
+		result.Skipped = held
+	} else {
+		message := DeleteGroup{Bucket: bucket, CharID: charid}
+		if err := publishMessage(ctx, message, map[string]string{"dedupe_key": dedupeKey}); err != nil {
+			recentDeletes.remove(dedupeKey)
+			deletionLocks.release(bucket, charid)
+			return DeleteResult{}, err
+		}
+	}
+	guildUsage.invalidate(bucket)
+	attrCache.invalidatePrefix(bucket, charid+"/")
+	listCache.invalidate(bucket, charid+"/")
+	return result, nil
+}
+
+// Queues the deletion of a single faceclaim image, along with its kept
+// original and size variants.
+func queueFaceclaimDeletion(ctx context.Context, bucket, charid, key string) (DeleteResult, error) {
 	object := fmt.Sprintf("%v/%v", charid, key)
+	result := DeleteResult{Message: fmt.Sprintf("Deleted %v", object)}
+
+	// Duplicate requests within the dedupe window are acknowledged without
+	// queueing another deletion
+	dedupeKey := fmt.Sprintf("%v/%v", bucket, object)
+	if !recentDeletes.add(dedupeKey) {
+		result.AlreadyQueued = true
+		return result, nil
+	}
+
+	// A kept original and any size variants are deleted along with their
+	// WebP. If the lookup fails, the WebP deletion still proceeds; the
+	// siblings can be cleaned up by a later group deletion.
+	objects := []string{object}
+	if attrs, err := cachedObjectAttrs(ctx, bucket, object); err == nil {
+		objects = faceclaimObjects(object, attrs.Metadata)
+		if isHeld(attrs) {
+			recentDeletes.remove(dedupeKey)
+			result.Message = fmt.Sprintf("%v is held, so it wasn't deleted", object)
+			result.Skipped = objects
+			return result, nil
+		}
+	} else if !errors.Is(err, storage.ErrObjectNotExist) {
+		log.Println("Unable to look up original for", object, err)
+	}
+
+	for _, o := range objects {
+		attributes := map[string]string{"dedupe_key": fmt.Sprintf("%v/%v", bucket, o)}
+		if err := publishMessage(ctx, DeleteSingle{Bucket: bucket, Key: o}, attributes); err != nil {
+			recentDeletes.remove(dedupeKey)
+			return DeleteResult{}, err
+		}
+		attrCache.invalidate(bucket, o)
+		listCache.invalidate(bucket, o)
+	}
+	guildUsage.invalidate(bucket)
+	return result, nil
+}
 
-	if err := publishMessage("delete-single-faceclaim", JSON{"key": object, "bucket": bucket}); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+// Returns a faceclaim image's attributes and metadata, including the BlurHash
+// computed when it was uploaded.
+func getFaceclaimMetadata(c *gin.Context) {
+	bucket := c.Param("bucket")
+	object := fmt.Sprintf("%v/%v", c.Param("charid"), c.Param("key"))
+
+	attrs, err := cachedObjectAttrs(c.Request.Context(), bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", object)})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, fmt.Sprintf("Deleted %v", object))
+	respond(c, http.StatusOK, faceclaimMetadata(bucket, attrs))
+}
+
+// Describes a faceclaim for the metadata route.
+func faceclaimMetadata(bucket string, attrs *storage.ObjectAttrs) FaceclaimMetadata {
+	return FaceclaimMetadata{
+		URL:          objectURL(bucket, attrs.Name),
+		ContentType:  attrs.ContentType,
+		Size:         attrs.Size,
+		Created:      attrs.Created,
+		StorageClass: attrs.StorageClass,
+		BlurHash:     attrs.Metadata["blurhash"],
+		Encoder:      stampedSettings(attrs.Metadata),
+		Held:         isHeld(attrs),
+		Metadata:     attrs.Metadata,
+	}
 }
 
-// Upload a log file to the "inconnu-logs" bucket in GCS. This route will
-// overwrite any object by the same name!
+// Upload a log file to the "inconnu-logs" bucket in GCS, named according to
+// LogLayout. This route will overwrite any object by the same name! With
+// ?expand=true, a gzipped tarball is instead unpacked into one log per file.
+// Logs must be text, JSON, or NDJSON, or gzips of them, unless an admin
+// passes ?force=true.
 func uploadLog(c *gin.Context) {
+	expand, err := strconv.ParseBool(c.DefaultQuery("expand", "false"))
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "expand must be true or false"})
+		return
+	}
+	force, err := strconv.ParseBool(c.DefaultQuery("force", "false"))
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "force must be true or false"})
+		return
+	}
+	if force && !hasScope(c, scopeAdmin) {
+		abortWith(c, http.StatusForbidden, gin.H{"error": fmt.Sprintf("Missing scope %v", scopeAdmin)})
+		return
+	}
 	formFile, err := c.FormFile("log_file")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		abortWith(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	shard := c.PostForm("shard")
+	if shard != "" {
+		if err := checkSegment("shard", shard); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	storageClass := LogStorageClass
+	if class := c.PostForm("storage_class"); class != "" {
+		if storageClass, err = parseStorageClass(class); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 	fileData, err := formFile.Open()
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		abortWith(c, http.StatusBadRequest, err.Error())
 		return
 	}
 	defer fileData.Close()
+	data, err := io.ReadAll(fileData)
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	uploadObject(fileData, "inconnu-logs", formFile.Filename, "text/plain")
-	c.JSON(http.StatusCreated, fmt.Sprintf("Uploaded %v", formFile.Filename))
+	contentType, err := sniffLogType(formFile.Filename, data, force)
+	if err != nil {
+		abortLogUpload(c, err)
+		return
+	}
+
+	now := time.Now()
+	opts := UploadOptions{ContentType: contentType, StorageClass: storageClass}
+	if expand && isTarball(data) {
+		prefix := bundlePrefix(formFile.Filename, shard, now)
+		result, err := expandLogBundle(c.Request.Context(), data, prefix, opts, force)
+		if err != nil {
+			abortLogUpload(c, err)
+			return
+		}
+		if result.Succeeded > 0 {
+			c.Header("Location", fmt.Sprintf("gs://%v/%v", logBucket, prefix))
+		}
+		respond(c, result.httpStatus(http.StatusCreated), result)
+		return
+	}
+	key := logKey(formFile.Filename, shard, isGzip(data), now)
+	if err := storeLog(c.Request.Context(), bytes.NewReader(data), key, opts); err != nil {
+		abortLogUpload(c, err)
+		return
+	}
+	// Logs aren't served over HTTP, so they're located by their GCS path
+	c.Header("Location", fmt.Sprintf("gs://%v/%v", logBucket, key))
+	if LogLayout == logLayoutDated {
+		respond(c, http.StatusCreated, gin.H{"message": fmt.Sprintf("Uploaded %v", key), "key": key})
+		return
+	}
+	respond(c, http.StatusCreated, fmt.Sprintf("Uploaded %v", key))
 }
 
-// GCP HELPERS
+// Stores a log in the log bucket.
+func storeLog(ctx context.Context, data io.Reader, name string, opts UploadOptions) error {
+	if err := conditionLogUpload(ctx, name, &opts); err != nil {
+		return err
+	}
+	return uploadObject(ctx, data, logBucket, name, opts)
+}
 
-func publishMessage(topicName string, data JSON) error {
-	ctx := context.Background()
+// Conditions a log upload on the generation seen beforehand, so a log
+// rewritten in the meantime isn't clobbered.
+func conditionLogUpload(ctx context.Context, name string, opts *UploadOptions) error {
+	attrs, err := getObjectAttrs(ctx, logBucket, name)
+	switch {
+	case err == nil:
+		opts.IfGenerationMatch = attrs.Generation
+	case errors.Is(err, storage.ErrObjectNotExist):
+		opts.DoesNotExist = true
+	default:
+		return err
+	}
+	return nil
+}
 
-	// Get the client
-	pubsubClient, err := pubsub.NewClient(ctx, ProjectID)
-	if err != nil {
-		return fmt.Errorf("pubsub.NewClient: %v", err)
+// Responds to a failed log upload.
+func abortLogUpload(c *gin.Context, err error) {
+	var bundleErr *BundleError
+	if errors.As(err, &bundleErr) {
+		status := http.StatusBadRequest
+		if bundleErr.TooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		abortWith(c, status, gin.H{"error": err.Error()})
+		return
+	}
+	var typeErr *LogTypeError
+	if errors.As(err, &typeErr) {
+		abortWith(c, http.StatusUnsupportedMediaType, gin.H{"error": err.Error(), "code": "unsupported_log_type"})
+		return
+	}
+	if abortIfUploadsBusy(c, err) {
+		return
+	}
+	if abortIfConflict(c, err) {
+		return
+	}
+	var integrityErr *IntegrityError
+	if errors.As(err, &integrityErr) {
+		c.Error(err)
+		abortWith(c, http.StatusBadGateway, gin.H{"error": err.Error(), "code": "storage_error"})
+		return
 	}
+	c.Error(err)
+	abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// GCP HELPERS
 
-	// Get the topic
-	pubsubTopic := pubsubClient.Topic(topicName)
-	log.Println("pubsubTopic:", pubsubTopic)
+// Publishes a message, in its envelope, to its action's topic. Attributes,
+// such as the "dedupe_key" consumers use to skip duplicate deletions, are
+// optional. The request ID and trace context are added from ctx.
+func publishMessage(ctx context.Context, data Message, attributes map[string]string) error {
+	attributes = messageAttributes(ctx, attributes)
+	topicName, ok := actionTopics[data.Action()]
+	if !ok {
+		return fmt.Errorf("publishMessage: no topic for %v", data.Action())
+	}
 
-	// The client is valid; now format the message
-	msg, err := json.Marshal(data)
+	// Format the message
+	msg, err := encodeMessage(ctx, data)
 	if err != nil {
-		return fmt.Errorf("json.Marshal: %v", err)
+		return err
 	}
 	log.Println("Message JSON:", string(msg))
 
-	res := pubsubTopic.Publish(ctx, &pubsub.Message{Data: msg})
-	if _, err := res.Get(ctx); err != nil {
-		return fmt.Errorf("Publish.Get: %v", err)
+	if err := MessagePublisher.Publish(ctx, topicName, msg, attributes); err != nil {
+		if deleteJournal == nil || !isDeletion(data) {
+			return &PublishError{Topic: topicName, Err: err}
+		}
+		// Journaled deletions are retried in the background
+		log.Println("Unable to publish; journaling the deletion:", err)
+		entry := journalEntry{Topic: topicName, Data: msg, Attributes: attributes, Queued: time.Now()}
+		if err := deleteJournal.add(entry); err != nil {
+			return err
+		}
+		log.Println("Journaled deletion of", data)
+		recordQueuedDeletion(ctx, data)
+		return nil
 	}
-	log.Println("Queued deletion of", data)
+	log.Printf("Published %v: %v\n", data.Action(), data)
+	recordQueuedDeletion(ctx, data)
 
 	return nil
 }
 
-func processImage(request FaceclaimRequest) (string, error) {
-	resp, err := http.Get(request.ImageURL)
+// Publishes an upload's event. The upload has already succeeded, so a failure
+// is only logged and counted.
+func publishUploadEvent(ctx context.Context, event FaceclaimUploaded) {
+	err := publishMessage(ctx, event, nil)
 	if err != nil {
-		return "", fmt.Errorf("http.Get: %v", err)
+		log.Println("Unable to publish the upload event for", event.Key, err)
 	}
-	defer resp.Body.Close()
+	recordUploadEvent(err)
+}
 
-	log.Println("File downloaded; converting to WebP")
+// A PublishError means a message couldn't be published to Pub/Sub.
+type PublishError struct {
+	Topic string
+	Err   error
+}
+
+func (e *PublishError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// The note given when a faceclaim's bucket isn't public.
+func privateBucketNote(bucket string) string {
+	return fmt.Sprintf("Bucket %v isn't publicly readable, so the URL won't load; request signed_url or use the image route", bucket)
+}
 
-	var buf bytes.Buffer
-	err = webpbin.NewCWebP().
-		Quality(99).
-		Input(resp.Body).
-		Output(&buf).
-		Run()
+// A preparedSource is a source image made ready for encoding.
+type preparedSource struct {
+	upright        []byte // Oriented, in sRGB, and cropped
+	source         []byte // upright, watermarked if asked
+	orientation    int
+	colorConverted bool
+}
+
+// Turns a fetched image upright, converts it to sRGB, and crops, squares, and
+// watermarks it as the request asks, ready to be encoded.
+func prepareSource(original []byte, request FaceclaimRequest) (preparedSource, error) {
+	if err := checkImageSize(original); err != nil {
+		return preparedSource{}, err
+	}
+	// Sideways phone photos are turned upright, since their EXIF orientation
+	// doesn't survive conversion
+	upright, orientation, err := correctOrientation(original)
+	if err != nil {
+		return preparedSource{}, fmt.Errorf("correctOrientation: %v", err)
+	}
+	if orientation != 1 {
+		log.Println("Corrected EXIF orientation", orientation)
+	}
+	// The profile is read from the original, since correcting the orientation
+	// doesn't keep it
+	upright, colorConverted, err := convertToSRGB(upright, embeddedProfile(original))
+	if err != nil {
+		return preparedSource{}, fmt.Errorf("convertToSRGB: %v", err)
+	}
+	if colorConverted {
+		log.Println("Converted the color profile to sRGB")
+	}
+	if request.Crop != nil {
+		if upright, err = cropImage(upright, *request.Crop); err != nil {
+			return preparedSource{}, err
+		}
+	}
+	// Squared after cropping, so the square comes from the region kept
+	if request.Fit == fitSquare {
+		if upright, err = squareImage(upright); err != nil {
+			return preparedSource{}, err
+		}
+	}
+
+	// The watermark is applied to the source image, so the converter sees
+	// the composited result
+	source := upright
+	if request.Watermark != "" {
+		if source, err = applyWatermark(upright, request.Watermark); err != nil {
+			return preparedSource{}, fmt.Errorf("applyWatermark: %v", err)
+		}
+		log.Println("Applied watermark", request.Watermark)
+	}
+	return preparedSource{upright: upright, source: source, orientation: orientation, colorConverted: colorConverted}, nil
+}
+
+// Downloads, converts, and uploads a faceclaim image, then trims the
+// character if asked to. Cancelling the context abandons the work, killing
+// the converter if it's running. Identical idempotent uploads running at once
+// share one run.
+func processImage(ctx context.Context, request FaceclaimRequest) (response FaceclaimResponse, err error) {
+	if request.IdempotencyKey == "" || request.DryRun {
+		response, err = convertAndStore(ctx, request)
+	} else {
+		response, err = processIdempotentImage(ctx, request)
+	}
 	if err != nil {
-		return "", fmt.Errorf("webpbin: %v", err)
+		return response, err
+	}
+	if request.TrimTo > 0 && !request.DryRun {
+		trimAfterUpload(ctx, request, &response)
 	}
-	log.Println("File converted!")
+	// Clients count on the warnings being there
+	if response.Warnings == nil {
+		response.Warnings = []Warning{}
+	}
+	return response, nil
+}
+
+// Does the work of processImage.
+func convertAndStore(ctx context.Context, request FaceclaimRequest) (response FaceclaimResponse, err error) {
+	// The settings stay the same for the whole upload, even if they're
+	// reloaded meanwhile
+	cfg := currentConfig()
 
 	// Determine the bucket to upload to
 	bucketName := request.Bucket
 	if bucketName == "" {
-		log.Println("Bucket not specified; using", FaceclaimBucket)
-		bucketName = FaceclaimBucket
+		bucketName = cfg.FaceclaimBucket
+		log.Println("Bucket not specified; using", bucketName)
 	} else {
 		log.Println("Using specified bucket", bucketName)
 	}
 
-	// The objectName is <charid>/<ObjectId()>.webp
-	o := primitive.NewObjectID()
-	objectName := fmt.Sprintf("%v/%v.webp", request.CharID, o.Hex())
+	var size int64
+	defer func() {
+		if !request.DryRun {
+			recordUpload(bucketName, request.Guild, err, size)
+		}
+	}()
 
-	// Upload the file
-	metadata := map[string]string{
-		"guild":    fmt.Sprint(request.Guild),
-		"user":     fmt.Sprint(request.User),
-		"original": request.ImageURL,
-		"charid":   request.CharID,
+	// The bucket's own policies take the place of the defaults
+	profile := cfg.bucketProfile(bucketName)
+	storageClass, err := request.storageClass()
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+	if request.StorageClass == "" {
+		storageClass = profile.StorageClass
+	}
+	if profile.SignedURLs {
+		request.SignedURL = true
+	}
+	// Catch a private bucket before doing any work, in case it's rejected
+	public := true
+	if !request.SignedURL {
+		if public, err = checkPublicBucket(ctx, bucketName); err != nil {
+			return FaceclaimResponse{}, err
+		}
+	}
+
+	// Discord URLs are rewritten to fetch the full-size attachment
+	imageURL, err := normalizeImageURL(request.ImageURL, time.Now())
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+
+	// Keep the downloaded bytes around so the image can be analyzed without
+	// fetching it a second time
+	fetched, err := ImageFetcher.Fetch(ctx, imageURL)
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+	original := fetched.Data
+	if fetched.Redirects > 0 {
+		log.Printf("Followed %v redirects to %v\n", fetched.Redirects, fetched.URL)
+	}
+	// Nothing else gets to see formats we don't accept
+	contentType, err := checkImageType(original)
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+	if err := checkColorSpace(original); err != nil {
+		return FaceclaimResponse{}, err
+	}
+
+	moderation, err := moderateImage(ctx, original)
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+
+	prepared, err := prepareSource(original, request)
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+	upright, source := prepared.upright, prepared.source
+	orientation, colorConverted := prepared.orientation, prepared.colorConverted
+
+	log.Println("File downloaded; converting to WebP")
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	quality, targetMissed := profile.Quality, false
+	if request.TargetBytes > 0 {
+		quality, targetMissed, err = encodeToTarget(ctx, source, buf, request.TargetBytes, profile.Quality)
+	} else {
+		err = ImageConverter.Convert(ctx, bytes.NewReader(source), buf, quality)
 	}
-	if err = uploadObject(&buf, bucketName, objectName, "image/webp", metadata); err != nil {
-		return "", fmt.Errorf("processImage: %v", err)
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+	log.Println("File converted at quality", quality)
+	width, height, err := checkConverted(buf.Bytes())
+	if err != nil {
+		return FaceclaimResponse{}, err
 	}
 
+	blurHash, dominantColor := analyzeImage(upright)
+
+	// Kept originals count against the guild's quota, too
+	guild := fmt.Sprint(request.Guild)
+	size = int64(buf.Len())
+	if request.keepOriginal() {
+		size += int64(len(original))
+	}
+	if err := checkQuota(bucketName, guild, size); err != nil {
+		return FaceclaimResponse{}, err
+	}
+
+	if !request.DryRun {
+		// Uploads to the same character are serialized so they can't both
+		// slip in under the cap
+		defer characterLocks.lock(bucketName + "/" + request.CharID)()
+		// A group deletion under way would take the new faceclaim with it
+		if err := deletionLocks.wait(ctx, bucketName, request.CharID); err != nil {
+			return FaceclaimResponse{}, err
+		}
+	}
+	// Faceclaims are only evicted once the new one is stored and counted, so
+	// a failed upload leaves the character as it was. A dry run only reports
+	// what would be evicted.
+	evictions, err := planCharacterSlot(bucketName, request.CharID, request.EvictOldest)
+	if err != nil {
+		return FaceclaimResponse{}, err
+	}
+
+	// The objectName is <charid>/<ObjectId()>.webp, or for an idempotent
+	// upload, a name of the same form derived from its key
+	id := newObjectID().Hex()
+	if request.IdempotencyKey != "" {
+		id = idempotentObjectID(bucketName, request.CharID, request.IdempotencyKey)
+	}
+	objectName := fmt.Sprintf("%v/%v.webp", request.CharID, id)
+
 	// The object's URL is derived from the bucket name and key name
-	return fmt.Sprintf("https://%v/%v", bucketName, objectName), nil
-}
+	crc, _ := checksums(buf.Bytes())
+	response = FaceclaimResponse{
+		URL:           objectURL(bucketName, objectName),
+		BlurHash:      blurHash,
+		DominantColor: dominantColor,
+		CRC32C:        encodeCRC32C(crc),
+		Width:         width,
+		Height:        height,
+		Quality:       quality,
+		TargetMissed:  targetMissed,
+		InputBytes:    int64(len(original)),
+		OutputBytes:   int64(buf.Len()),
+		ResolvedURL:   fetched.URL,
+	}
+	if warning := fetched.redirectWarning(); warning != "" {
+		response.warn("redirected", warning)
+	}
+	if targetMissed {
+		response.warn("target_missed", fmt.Sprintf("The WebP is over target_bytes even at quality %v", quality))
+	}
 
-// Adapted from https://cloud.google.com/storage/docs/uploading-objects-from-memory
-func uploadObject(data io.Reader, bucket, object, contentType string, metadata ...map[string]string) error {
-	// bucket := "bucket-name"
-	// object := "object-name"
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	metadata := map[string]string{
+		"guild":          guild,
+		"user":           fmt.Sprint(request.User),
+		"original":       imageURL,
+		"submitted_url":  request.ImageURL,
+		"resolved_url":   fetched.URL,
+		"charid":         request.CharID,
+		"blurhash":       blurHash,
+		"dominant_color": dominantColor,
+	}
+	encoderSettings(quality, "none").stamp(metadata)
+	fetched.stamp(metadata)
+	if targetMissed {
+		metadata["target_missed"] = "true"
+	}
+	if moderation != "" {
+		metadata["moderation"] = moderation
+	}
+	if request.Watermark != "" {
+		metadata["watermark"] = request.Watermark
+	}
+	if orientation != 1 {
+		metadata["orientation_corrected"] = strconv.Itoa(orientation)
+	}
+	if colorConverted {
+		metadata["color_converted"] = "true"
+	}
+	if request.Crop != nil {
+		metadata["crop"] = request.Crop.String()
+	}
+	if request.Fit == fitSquare {
+		metadata["fit"] = fitSquare
+	}
+
+	// The untouched original, if kept, lives next to the WebP as
+	// <charid>/<ObjectId()>.orig.<ext>
+	var derived []derivedObject
+	var originalName string
+	if request.keepOriginal() {
+		originalName = fmt.Sprintf("%v/%v.orig.%v", request.CharID, id, originalExtension(contentType))
+		// Tagged with the owner so it's counted in the guild's usage
+		derived = append(derived, derivedObject{
+			label: "original",
+			name:  originalName,
+			data:  original,
+			opts: UploadOptions{
+				ContentType: contentType,
+				Metadata: map[string]string{
+					"guild":  guild,
+					"user":   metadata["user"],
+					"charid": request.CharID,
+				},
+				StorageClass:  storageClass,
+				CacheControl:  profile.CacheControl,
+				Preconditions: Preconditions{DoesNotExist: true},
+			},
+		})
+		response.OriginalURL = objectURL(bucketName, originalName)
+	}
+
+	// Size variants live next to the WebP as <charid>/<ObjectId()>_<size>.webp
+	if len(request.Variants) > 0 {
+		img, err := decodeImage(source)
+		if err != nil {
+			return FaceclaimResponse{}, fmt.Errorf("variants: %v", err)
+		}
+		sizes, skipped := planVariants(request.Variants, img)
+		for _, note := range skipped {
+			response.warn("variant_skipped", note)
+		}
+
+		rendered, err := renderVariants(ctx, img, sizes, profile.Quality)
+		if err != nil {
+			return FaceclaimResponse{}, fmt.Errorf("processImage: %w", err)
+		}
+		defer func() {
+			for _, buf := range rendered {
+				putBuffer(buf)
+			}
+		}()
+		response.Variants = make(map[string]string, len(sizes))
+		for i, size := range sizes {
+			variantMetadata := map[string]string{"variant": size}
+			for k, v := range metadata {
+				variantMetadata[k] = v
+			}
+			encoderSettings(profile.Quality, "fit:"+size).stamp(variantMetadata)
+			name := variantObjectName(objectName, size)
+			derived = append(derived, derivedObject{
+				label: size,
+				name:  name,
+				data:  rendered[i].Bytes(),
+				opts: UploadOptions{
+					ContentType:   "image/webp",
+					Metadata:      variantMetadata,
+					StorageClass:  storageClass,
+					CacheControl:  profile.CacheControl,
+					Preconditions: Preconditions{DoesNotExist: true},
+				},
+			})
+			response.Variants[size] = objectURL(bucketName, name)
+		}
+		if len(sizes) > 0 {
+			metadata["variants"] = strings.Join(sizes, ",")
+		}
+	}
+	if originalName != "" {
+		metadata["original_object"] = originalName
+	}
+
+	// A dry run stops short of storing anything. Its objects' names are never
+	// used, so it has no URLs to give.
+	if request.DryRun {
+		response.DryRun = true
+		for _, attrs := range evictions {
+			response.Evicted = append(response.Evicted, objectURL(bucketName, attrs.Name))
+		}
+		response.PredictedBytes = int64(buf.Len())
+		for _, d := range derived {
+			response.PredictedBytes += int64(len(d.data))
+		}
+		response.URL, response.OriginalURL, response.Variants = "", "", nil
+		if !public {
+			response.Public = &public
+			response.warn("private_bucket", privateBucketNote(bucketName))
+		}
+		return response, nil
+	}
+
+	// The WebP and its derived objects are uploaded together. The WebP lists
+	// all of them in its metadata, even ones that fail, which are retried in
+	// the background; deleting it deletes whichever exist.
+	failed, err := uploadFaceclaimObjects(ctx, bucketName, objectName, buf.Bytes(), UploadOptions{
+		ContentType:   "image/webp",
+		Metadata:      metadata,
+		StorageClass:  storageClass,
+		CacheControl:  profile.CacheControl,
+		Preconditions: Preconditions{DoesNotExist: true},
+	}, derived)
+	var conflict *ConflictError
+	if request.IdempotencyKey != "" && errors.As(err, &conflict) && conflict.Key == objectName {
+		// Another instance stored it first
+		return storedFaceclaim(ctx, bucketName, objectName)
+	}
 	if err != nil {
-		return fmt.Errorf("storage.NewClient: %v", err)
+		return FaceclaimResponse{}, fmt.Errorf("processImage: %w", err)
 	}
-	defer client.Close()
+	for _, d := range failed {
+		response.Failed = append(response.Failed, d.label)
+		response.warn("derived_upload_failed", fmt.Sprintf("Unable to store %v; it will be retried in the background", d.label))
+		if d.label == "original" {
+			response.OriginalURL = ""
+		} else {
+			delete(response.Variants, d.label)
+		}
+	}
+
+	// Another instance may have uploaded to the character at the same time
+	if err := confirmCharacterLimit(bucketName, request.CharID, evictions); err != nil {
+		for _, name := range faceclaimObjects(objectName, metadata) {
+			if err := deleteObject(context.Background(), bucketName, name); err != nil {
+				log.Println("Unable to clean up", name, err)
+			}
+		}
+		return FaceclaimResponse{}, err
+	}
+
+	// The new faceclaim stands even if eviction fails, leaving the character
+	// over its cap until one is deleted
+	evicted, evictErr := evictFaceclaims(bucketName, evictions)
+	for _, name := range evicted {
+		response.Evicted = append(response.Evicted, objectURL(bucketName, name))
+	}
+	if evictErr != nil {
+		log.Println("Unable to evict from", request.CharID, evictErr)
+		response.warn("eviction_failed", evictErr.Error())
+	}
+	if len(failed) > 0 {
+		retryDerivedUploads(bucketName, failed)
+	}
+
+	if request.SignedURL {
+		if response.SignedURL, err = Store.SignURL(ctx, bucketName, objectName, signedURLTTL); err != nil {
+			log.Println("Unable to sign", objectName, err)
+			response.warn("signing_failed", "Unable to sign the URL; use the image route instead")
+			err = nil
+		}
+	}
+	if !public {
+		response.Public = &public
+		response.warn("private_bucket", privateBucketNote(bucketName))
+	}
+
+	// Variants aren't counted until the bucket's usage is next recomputed
+	guildUsage.add(bucketName, guild, GuildUsage{Images: 1, Bytes: size})
+
+	if PublishUploadEvents {
+		publishUploadEvent(ctx, FaceclaimUploaded{
+			Bucket: bucketName,
+			Key:    objectName,
+			CharID: request.CharID,
+			Guild:  guild,
+			User:   fmt.Sprint(request.User),
+			Bytes:  response.OutputBytes,
+			Width:  width,
+			Height: height,
+		})
+	}
+
+	return response, nil
+}
 
+// Returns the file extension for a sniffed image content type.
+func originalExtension(contentType string) string {
+	if extension, ok := supportedImageTypes[contentType]; ok {
+		return extension
+	}
+	return "bin"
+}
+
+// Uploads an object, then reads back its checksums to make sure it arrived
+// intact. Objects that fail the check are deleted, and an IntegrityError is
+// returned. If the upload's precondition fails, a ConflictError gives the
+// object's current generation.
+func uploadObject(ctx context.Context, data io.Reader, bucket, object string, opts UploadOptions) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second * 50)
 	defer cancel()
 
-	// Upload an object with storage.Writer
-	wc := client.Bucket(bucket).Object(object).NewWriter(ctx)
-	wc.ContentType = contentType
-	wc.ChunkSize = 0
-
-	if len(metadata) > 0 {
-		wc.Metadata = metadata[0]
+	// Buffers are uploaded in place; anything else is read into a pooled one
+	var contents []byte
+	if buf, ok := data.(*bytes.Buffer); ok {
+		contents = buf.Bytes()
+	} else {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if _, err := buf.ReadFrom(data); err != nil {
+			return fmt.Errorf("Buffer.ReadFrom: %v", err)
+		}
+		contents = buf.Bytes()
 	}
+	crc, md5sum := checksums(contents)
+	opts.CRC32C, opts.MD5 = crc, md5sum
+	opts.Metadata = sanitizeMetadata(opts.Metadata)
+	release, err := uploads.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = Store.Upload(ctx, bucket, object, bytes.NewReader(contents), opts)
+	if err = finishUpload(ctx, bucket, object, err, crc, md5sum); err != nil {
+		return err
+	}
+	recordBytesUploaded(ctx, int64(len(contents)))
+	return nil
+}
 
-	if _, err = io.Copy(wc, data); err != nil {
-		return fmt.Errorf("io.Copy: %v", err)
+// Checks the outcome of an upload: turns a failed precondition into a
+// ConflictError, and verifies the checksums of what was stored, deleting
+// it if they don't match.
+func finishUpload(ctx context.Context, bucket, object string, err error, crc uint32, md5sum []byte) error {
+	attrCache.invalidate(bucket, object)
+	listCache.invalidate(bucket, object)
+	if err != nil {
+		return conflictError(ctx, err, bucket, object)
 	}
-	if err := wc.Close(); err != nil {
-		return fmt.Errorf("Writer.Close: %v", err)
+
+	if err := verifyUpload(ctx, bucket, object, crc, md5sum); err != nil {
+		var integrityErr *IntegrityError
+		if errors.As(err, &integrityErr) {
+			log.Println("Deleting corrupt upload:", err)
+			if err := deleteObject(context.Background(), bucket, object); err != nil {
+				log.Println("Unable to delete corrupt upload", object, err)
+			}
+		}
+		return err
 	}
 
 	log.Printf("%v uploaded to %v\n", object, bucket)
 
 	return nil
 }
+
+// Fetches an object's attributes, including its custom metadata.
+func getObjectAttrs(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second * 10)
+	defer cancel()
+
+	return Store.Attrs(ctx, bucket, object)
+}
+
+// Downloads an object's contents into memory.
+func downloadObject(ctx context.Context, bucket, object string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second * 50)
+	defer cancel()
+
+	return Store.Download(ctx, bucket, object)
+}
+
+// Deletes an object. Missing objects aren't considered an error, so repeated
+// deletions of the same object all succeed.
+func deleteObject(ctx context.Context, bucket, object string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second * 10)
+	defer cancel()
+
+	attrCache.invalidate(bucket, object)
+	listCache.invalidate(bucket, object)
+	if err := Store.Delete(ctx, bucket, object); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+	log.Printf("%v deleted from %v\n", object, bucket)
+	recordDeletion(ctx, 1, 0)
+
+	return nil
+}
@@ -2,19 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"regexp"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -22,6 +23,9 @@ import (
 
 var buckets = [2]string{"pcs.inconnu.app","pcs.botch.lol"}
 
+// The default bucket the tests run with
+const testBucket = "pcs.inconnu.app"
+
 // Create a faceclaim upload request for a given bucket
 func createFaceclaimRequest(bucket string) *FaceclaimRequest {
 	return &FaceclaimRequest{
@@ -36,7 +40,19 @@ func createFaceclaimRequest(bucket string) *FaceclaimRequest {
 // Quiet logs and set the faceclaim bucket name
 func TestMain(m *testing.M) {
 	log.SetOutput(ioutil.Discard)
-	FaceclaimBucket = "pcs.inconnu.app"
+	AccessLogEnabled = false
+	cfg := newConfig()
+	cfg.FaceclaimBucket = testBucket
+	setConfig(cfg)
+	AllowTestCharID = true
+	// The tests' image servers listen on the loopback network
+	for _, cidr := range []string{"127.0.0.0/8", "::1/128"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		fetchAllowedNetworks = append(fetchAllowedNetworks, network)
+	}
+	// Tests fail authentication on purpose, all from the same address
+	os.Setenv("AUTH_BAN_THRESHOLD", "0")
+	prepareAuthBans()
 	gin.SetMode(gin.TestMode)
 
 	os.Exit(m.Run())
@@ -52,7 +68,7 @@ func TestEnvVars(t *testing.T) {
 
 	// Only second env var set
 	os.Unsetenv("API_TOKEN")
-	os.Setenv("FACECLAIM_BUCKET", FaceclaimBucket) // Don't overwrite the current value
+	os.Setenv("FACECLAIM_BUCKET", testBucket) // Don't overwrite the current value
 	assert.NotNil(t, prepareEnvVars(), "prepareEnvVars() should have returned an error")
 
 	// Both env vars set
@@ -83,103 +99,177 @@ func TestFaceclaimEmptyUpload(t *testing.T) {
 }
 
 func TestFaceclaimCorrectUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useDeterministicIDs(t, 1)
 	r := setupRouter(false)
 
-	for _, bucket := range buckets {
-		request, _ := json.Marshal(createFaceclaimRequest(bucket))
-		w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(request))
-
-		assert.Equal(t, 201, w.Code)
+	for i, bucket := range buckets {
+		response := uploadTestImage(t, r, createFaceclaimRequest(bucket))
 
 		// Check that the image exists at the URL
-		imgUrl := getStringBody(w.Body)
-		assert.True(t, urlExists(imgUrl), fmt.Sprintf("%v does not exist", imgUrl))
-		assert.True(t, strings.HasPrefix(imgUrl, fmt.Sprintf("https://%v", bucket)))
+		key := testObjectKey(uint64(i + 1))
+		assert.Equal(t, fmt.Sprintf("https://%v/%v", bucket, key), response.URL)
+		assert.True(t, store.exists(bucket, key), fmt.Sprintf("%v does not exist", response.URL))
+		assert.NotEmpty(t, response.BlurHash)
 	}
 }
 
 func TestSingleDelete(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useDeterministicIDs(t, 1)
 	r := setupRouter(false)
 
-	for _, bucket := range buckets {
+	for i, bucket := range buckets {
 		// Process a new faceclaim
-		request, _ := json.Marshal(createFaceclaimRequest(bucket))
-		w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(request))
-
-		assert.Equal(t, 201, w.Code)
+		uploadTestImage(t, r, createFaceclaimRequest(bucket))
 
 		// Make sure the image was, in fact, created
-		imgUrl := getStringBody(w.Body)
-		assert.True(t, urlExists(imgUrl), fmt.Sprintf("%v does not exist", imgUrl))
-		assert.True(t, strings.HasPrefix(imgUrl, fmt.Sprintf("https://%v", bucket)))
+		key := testObjectKey(uint64(i + 1))
+		assert.True(t, store.exists(bucket, key), fmt.Sprintf("%v does not exist", key))
 
 		// Now delete the faceclaim
-		path := fmt.Sprintf("/faceclaim/delete/%v/%v", bucket, getObjectFromUrl(imgUrl))
-		w = performRequest(r, "DELETE", path, nil)
+		path := fmt.Sprintf("/faceclaim/delete/%v/%v", bucket, key)
+		w := performRequest(r, "DELETE", path, nil)
 		assert.Equal(t, 200, w.Code)
-
-		successful := false
-		for i := 0; i < 60; i++ {
-			if urlExists(imgUrl) {
-				successful = true
-				break
-			}
-			time.Sleep(1 * time.Second)
-		}
-		assert.True(t, successful, "Image was not deleted after 60 seconds")
+		assert.False(t, store.exists(bucket, key), "Image was not deleted")
 	}
 }
 
 func TestMultiDelete(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useDeterministicIDs(t, 1)
 	r := setupRouter(false)
 
-	for _, bucket := range buckets {
-		// Shared request will result in different ObjectIds from being created
+	for i, bucket := range buckets {
 		faceclaimRequest := createFaceclaimRequest(bucket)
-		request, _ := json.Marshal(faceclaimRequest)
 
 		// Upload three images
-		imgUrls := make([]string, 3)
-		for i := 0; i < 3; i++ {
-			w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(request))
-
-			// Make sure the images were created successfully
-			assert.Equal(t, 201, w.Code)
-			url := getStringBody(w.Body)
-			assert.True(t, urlExists(url), "The image was not uploaded")
-			assert.True(t, strings.HasPrefix(url, fmt.Sprintf("https://%v", bucket)))
-			imgUrls[i] = url
+		keys := make([]string, 3)
+		for n := range keys {
+			uploadTestImage(t, r, faceclaimRequest)
+			keys[n] = testObjectKey(uint64(3*i + n + 1))
 		}
+		assert.Equal(t, keys, store.keys(bucket))
 
 		// Delete the entire Faceclaim group
 		path := fmt.Sprintf("/faceclaim/delete/%v/%v/all", bucket, faceclaimRequest.CharID)
 		w := performRequest(r, "DELETE", path, nil)
 		assert.Equal(t, 200, w.Code)
-
-		// Ensure the URLs were all deleted
-		numDeleted := 0
-		successful := false
-		for n := 0; n < 60; n++ {
-			numDeleted = 0
-			for _, u := range imgUrls {
-				if !urlExists(u) {
-					numDeleted += 1
-				} else {
-					// No point in checking the other URLs if one still exists
-					break
-				}
-			}
-			if numDeleted == len(imgUrls) {
-				successful = true
-				break
-			}
-			time.Sleep(1 * time.Second)
-		}
-		assert.True(t, successful, "The faceclaim images were not deleted after 60s")
+		assert.Empty(t, store.keys(bucket), "The faceclaim images were not deleted")
 	}
 }
 
+// The key of the test faceclaim named n by useDeterministicIDs
+func testObjectKey(n uint64) string {
+	return fmt.Sprintf("%v/%024x.webp", testCharID, n)
+}
+
+// Upload a PNG fixture through the faceclaim route using the fake backends
+func uploadTestImage(t *testing.T, r http.Handler, request *FaceclaimRequest) FaceclaimResponse {
+	w := postTestImage(r, request)
+	assert.Equal(t, 201, w.Code)
+
+	return getFaceclaimResponse(w.Body)
+}
+
+// Post a PNG fixture to the faceclaim route, whatever the outcome
+func postTestImage(r http.Handler, request *FaceclaimRequest) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	defer server.Close()
+
+	request.ImageURL = server.URL
+	body, _ := json.Marshal(request)
+	return performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+}
+
+// Strip the scheme and bucket from an object URL
+func objectKey(bucket, url string) string {
+	return strings.TrimPrefix(url, fmt.Sprintf("https://%v/", bucket))
+}
+
+func TestKeepOriginal(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	response := uploadTestImage(t, r, request)
+
+	webpKey := objectKey(testBucket, response.URL)
+	originalKey := objectKey(testBucket, response.OriginalURL)
+	assert.Equal(t, strings.TrimSuffix(webpKey, ".webp")+".orig.png", originalKey)
+
+	// The WebP links to the original, which is stored untouched
+	attrs, err := store.Attrs(context.Background(), testBucket, webpKey)
+	assert.Nil(t, err)
+	assert.Equal(t, originalKey, attrs.Metadata["original_object"])
+
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	original, err := store.Download(context.Background(), testBucket, originalKey)
+	assert.Nil(t, err)
+	assert.Equal(t, buf.Bytes(), original)
+	attrs, _ = store.Attrs(context.Background(), testBucket, originalKey)
+	assert.Equal(t, "image/png", attrs.ContentType)
+
+	// Deleting the WebP also deletes its original
+	w := performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v", testBucket, webpKey), nil)
+	assert.Equal(t, 200, w.Code)
+	assert.False(t, store.exists(testBucket, webpKey))
+	assert.False(t, store.exists(testBucket, originalKey))
+}
+
+func TestUploadLocation(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 201, w.Code)
+
+	response := getFaceclaimResponse(w.Body)
+	assert.NotEmpty(t, response.URL)
+	assert.Equal(t, response.URL, w.Header().Get("Location"))
+}
+
+func TestKeepOriginalsDefault(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	useConfig(t, func(cfg *Config) { cfg.KeepOriginals = true })
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.NotEmpty(t, response.OriginalURL)
+
+	// The request can opt out of the default
+	keep := false
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	response = uploadTestImage(t, r, request)
+	assert.Empty(t, response.OriginalURL)
+
+	assert.Len(t, store.keys(testBucket), 3)
+}
+
+func TestGroupDeleteRemovesOriginals(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	uploadTestImage(t, r, request)
+	assert.Len(t, store.keys(testBucket), 2)
+
+	w := performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v/all", testBucket, request.CharID), nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, store.keys(testBucket))
+}
+
 func TestLogUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
 	fileName := "main.go"
 	var b bytes.Buffer
 	m := multipart.NewWriter(&b)
@@ -196,17 +286,133 @@ func TestLogUpload(t *testing.T) {
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	keys := store.keys(logBucket)
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, "gs://"+logBucket+"/"+keys[0], w.Header().Get("Location"))
+	}
+}
+
+// Count the objects a test writes to the fake storage
+func countWrites(store *memStorage) *int {
+	writes := 0
+	store.beforeUpload = func(bucket, object string) { writes++ }
+	return &writes
+}
+
+func TestUploadDryRun(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	writes := countWrites(store)
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	request.Variants = []string{"16"}
+	request.DryRun = true
+	w := postTestImage(r, request)
+	response := getFaceclaimResponse(w.Body)
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.True(t, response.DryRun)
+	assert.Empty(t, response.URL)
+	assert.Empty(t, response.OriginalURL)
+	assert.Empty(t, response.Variants)
+	assert.Positive(t, response.OutputBytes)
+	assert.Greater(t, response.PredictedBytes, response.OutputBytes+response.InputBytes,
+		"The prediction counts the original and variants")
+	assert.NotEmpty(t, response.BlurHash)
+
+	assert.Zero(t, *writes)
+	assert.Empty(t, store.keys(testBucket))
+	assert.Empty(t, publisher.messages)
+}
+
+func TestUploadDryRunQuery(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	writes := countWrites(store)
+	r := setupRouter(false)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	defer server.Close()
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	body, _ := json.Marshal(request)
+
+	w := performRequest(r, "POST", "/faceclaim/upload?dry_run=true", bytes.NewReader(body))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Zero(t, *writes)
+
+	w = performRequest(r, "POST", "/faceclaim/upload?dry_run=maybe", bytes.NewReader(body))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	request.Async = true
+	body, _ = json.Marshal(request)
+	w = performRequest(r, "POST", "/faceclaim/upload?dry_run=true", bytes.NewReader(body))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "A dry run can't be a background job")
+}
+
+func TestUploadDryRunErrors(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	writes := countWrites(store)
+	r := setupRouter(false)
+
+	server := serveImage([]byte("not an image"))
+	defer server.Close()
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	request.DryRun = true
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewReader(body))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+
+	// The character's limit is checked, but nothing is evicted
+	useConfig(t, func(cfg *Config) { cfg.CharMaxImages = 1 })
+	existing := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	*writes = 0
+
+	request = createFaceclaimRequest(testBucket)
+	request.DryRun = true
+	w = postTestImage(r, request)
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	request.EvictOldest = true
+	w = postTestImage(r, request)
+	response := getFaceclaimResponse(w.Body)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{existing.URL}, response.Evicted)
+	assert.Equal(t, []string{objectKey(testBucket, existing.URL)}, store.keys(testBucket))
+	assert.Zero(t, *writes)
 }
 
 // HELPERS
 
-func getStringBody(r io.Reader) string {
+func getFaceclaimResponse(r io.Reader) FaceclaimResponse {
 	bodyBytes, _ := io.ReadAll(r)
-	var body string
-	json.Unmarshal(bodyBytes, &body)
+	var response FaceclaimResponse
+	json.Unmarshal(bodyBytes, &response)
 
-	return body
+	return response
+}
+
+// The codes of a response's warnings, in order
+func warningCodes(response FaceclaimResponse) []string {
+	var codes []string
+	for _, warning := range response.Warnings {
+		codes = append(codes, warning.Code)
+	}
+	return codes
+}
+
+// Serve the given bytes as an image, returning the server. The caller must
+// close it.
+func serveImage(data []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
 }
 
 func performRequest(r http.Handler, method, path string, body io.Reader) *httptest.ResponseRecorder {
@@ -217,20 +423,19 @@ func performRequest(r http.Handler, method, path string, body io.Reader) *httpte
 	return w
 }
 
-func getObjectFromUrl(url string) string {
-	// In actual use, CharID is an ObjectId, just like the WebP file's name.
-	// Thus, this regex should NOT be considered valid for standard use.
-	// During testing, however, we use a hardcoded "__test" CharID for easy
-	// identification in the GCP console.
-	r := regexp.MustCompile("([A-Za-z0-9_]+\\/[A-Fa-f0-9]+\\.webp)$")
-	match := r.FindStringSubmatch(url)
-	return match[0]
-}
+func TestUploadWarnings(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.private = map[string]bool{testBucket: true}
+	r := setupRouter(false)
 
-func urlExists(url string) bool {
-	r, err := http.Head(url)
-	if err != nil {
-		return false
+	// The gradient fixture is 32x24, too small for a 64px variant
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16", "64"}
+	w := postTestImage(r, request)
+	assert.Equal(t, 201, w.Code, w.Body.String())
+	response := getFaceclaimResponse(w.Body)
+	assert.Equal(t, []string{"variant_skipped", "private_bucket"}, warningCodes(response))
+	for _, warning := range response.Warnings {
+		assert.NotEmpty(t, warning.Message, warning.Code)
 	}
-	return r.StatusCode == 200
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// While in maintenance mode, requests that would modify storage are refused so
+// buckets can be migrated without taking the service down.
+var maintenanceMode atomic.Bool
+
+// How long, in seconds, clients are told to wait before retrying.
+const maintenanceRetryAfter = 300
+
+// Reads MAINTENANCE, which starts the service in maintenance mode.
+func prepareMaintenance() error {
+	enabled := false
+	if value, ok := os.LookupEnv("MAINTENANCE"); ok {
+		var err error
+		if enabled, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("MAINTENANCE: %v", err)
+		}
+	}
+	maintenanceMode.Store(enabled)
+	return nil
+}
+
+// Maintenance refuses POST, PUT, PATCH, and DELETE requests with a 503 while
+// maintenance mode is on. Read-only routes, and the route that turns it off,
+// still work.
+func Maintenance() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if !maintenanceMode.Load() || c.FullPath() == "/admin/maintenance" {
+			c.Next()
+			return
+		}
+		if method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete {
+			c.Header("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+			abortWith(c, http.StatusServiceUnavailable, gin.H{
+				"error": "The service is undergoing maintenance. Please try again in a few minutes.",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// A MaintenanceRequest is the POST body for /admin/maintenance.
+type MaintenanceRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// Turns maintenance mode on or off.
+func setMaintenance(c *gin.Context) {
+	var request MaintenanceRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	maintenanceMode.Store(*request.Enabled)
+	respond(c, http.StatusOK, gin.H{"maintenance": *request.Enabled})
+}
+
+// Reports that the service is up, and whether it's in maintenance or read-only
+// mode.
+func healthz(c *gin.Context) {
+	respond(c, http.StatusOK, gin.H{
+		"status":      "ok",
+		"maintenance": maintenanceMode.Load(),
+		"read_only":   readOnlyMode.Load(),
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Flip maintenance mode through the admin route
+func setMaintenanceMode(t *testing.T, r http.Handler, enabled bool) {
+	body := bytes.NewBufferString(fmt.Sprintf(`{"enabled": %v}`, enabled))
+	w := performRequest(r, "POST", "/admin/maintenance", body)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	t.Cleanup(func() { maintenanceMode.Store(false) })
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	key := objectKey(testBucket, response.URL)
+
+	setMaintenanceMode(t, r, true)
+
+	w := performRequest(r, "GET", "/healthz", nil)
+	assert.JSONEq(t, `{"status": "ok", "maintenance": true, "read_only": false}`, w.Body.String())
+
+	// Writes are refused
+	w = postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "300", w.Header().Get("Retry-After"))
+
+	w = performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v", testBucket, key), nil)
+	assert.Equal(t, 503, w.Code)
+	assert.True(t, store.exists(testBucket, key))
+
+	w = performRequest(r, "PATCH", fmt.Sprintf("/faceclaim/%v/%v", testBucket, key), bytes.NewBufferString(`{"user": "42"}`))
+	assert.Equal(t, 503, w.Code)
+	attrs, _ := store.Attrs(context.Background(), testBucket, key)
+	assert.NotEqual(t, "42", attrs.Metadata["user"])
+
+	// Reads still work
+	w = performRequest(r, "GET", fmt.Sprintf("/faceclaim/metadata/%v/%v", testBucket, key), nil)
+	assert.Equal(t, 200, w.Code)
+
+	setMaintenanceMode(t, r, false)
+
+	w = performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v", testBucket, key), nil)
+	assert.Equal(t, 200, w.Code)
+	assert.False(t, store.exists(testBucket, key))
+}
+
+func TestMaintenanceRequiresEnabled(t *testing.T) {
+	r := setupRouter(false)
+	w := performRequest(r, "POST", "/admin/maintenance", bytes.NewBufferString(`{}`))
+	assert.Equal(t, 400, w.Code)
+	assert.False(t, maintenanceMode.Load())
+}
+
+func TestPrepareMaintenance(t *testing.T) {
+	defer os.Unsetenv("MAINTENANCE")
+
+	assert.Nil(t, prepareMaintenance())
+	assert.False(t, maintenanceMode.Load())
+
+	os.Setenv("MAINTENANCE", "true")
+	assert.Nil(t, prepareMaintenance())
+	assert.True(t, maintenanceMode.Load())
+
+	os.Setenv("MAINTENANCE", "maybe")
+	assert.NotNil(t, prepareMaintenance())
+
+	maintenanceMode.Store(false)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Manifests with at most this many entries are also returned inline.
+const manifestInlineEntries = 1000
+
+// BackupBucket is where manifests are written. Empty means the bucket they
+// describe. Read from BACKUP_BUCKET.
+var BackupBucket string
+
+// BackupPrefix is the prefix manifests are written under, as
+// <prefix><bucket>/<time>.ndjson. Read from BACKUP_PREFIX.
+var BackupPrefix = "manifests/"
+
+// Reads BACKUP_BUCKET and BACKUP_PREFIX, which defaults to manifests/.
+func prepareManifests() error {
+	BackupBucket = os.Getenv("BACKUP_BUCKET")
+	if BackupBucket != "" {
+		if err := validateBucketName(BackupBucket); err != nil {
+			return fmt.Errorf("BACKUP_BUCKET: %v", err)
+		}
+	}
+	BackupPrefix = "manifests/"
+	if value, ok := os.LookupEnv("BACKUP_PREFIX"); ok {
+		if value == "" || strings.HasPrefix(value, "/") {
+			return errors.New("BACKUP_PREFIX must be a non-empty object prefix")
+		}
+		if !strings.HasSuffix(value, "/") {
+			value += "/"
+		}
+		BackupPrefix = value
+	}
+	return nil
+}
+
+// A ManifestRequest is the POST body for /faceclaim/manifest/:bucket. It may
+// be empty.
+type ManifestRequest struct {
+	// If given, only these characters' objects are listed
+	CharIDs []string `json:"charids"`
+
+	// Run in the background, returning a job ID, as for big buckets
+	Async bool `json:"async"`
+}
+
+// A ManifestEntry is one object in a manifest.
+type ManifestEntry struct {
+	Key      string            `json:"key"`
+	Size     int64             `json:"size"`
+	CRC32C   string            `json:"crc32c"`
+	Updated  time.Time         `json:"updated"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// A ManifestResult describes a written manifest. Small manifests' entries are
+// included.
+type ManifestResult struct {
+	Bucket         string          `json:"bucket"`
+	ManifestBucket string          `json:"manifest_bucket"`
+	Manifest       string          `json:"manifest"`
+	Objects        int             `json:"objects"`
+	Bytes          int64           `json:"bytes"`
+	Entries        []ManifestEntry `json:"entries,omitempty"`
+}
+
+// Writes a manifest of a bucket's objects, or some characters', as NDJSON
+// for backups.
+func createManifest(c *gin.Context) {
+	var request ManifestRequest
+	if c.Request.ContentLength != 0 {
+		if err := bindBody(c, &request); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	for _, charid := range request.CharIDs {
+		if err := validateCharID(charid); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	bucket := c.Param("bucket")
+
+	if request.Async {
+		job := startJob(func() (interface{}, error) {
+			// The job outlives the request and may take a long time, so it
+			// isn't given a deadline
+			return writeManifest(context.Background(), bucket, request.CharIDs, time.Now())
+		})
+		respond(c, http.StatusAccepted, job)
+		return
+	}
+
+	result, err := writeManifest(c.Request.Context(), bucket, request.CharIDs, time.Now())
+	if abortIfTimedOut(c) {
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusCreated, result)
+}
+
+// Returns where a bucket's manifests are kept.
+func manifestLocation(bucket string) (string, string) {
+	manifestBucket := BackupBucket
+	if manifestBucket == "" {
+		manifestBucket = bucket
+	}
+	return manifestBucket, BackupPrefix + bucket + "/"
+}
+
+// Lists a bucket's objects, or those of the given characters, leaving out
+// manifests kept in the bucket itself.
+func manifestEntries(ctx context.Context, bucket string, charids []string) ([]ManifestEntry, error) {
+	prefixes := []string{""}
+	if len(charids) > 0 {
+		prefixes = prefixes[:0]
+		for _, charid := range charids {
+			prefixes = append(prefixes, charid+"/")
+		}
+	}
+
+	var entries []ManifestEntry
+	for _, prefix := range prefixes {
+		objects, err := Store.List(ctx, bucket, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("manifestEntries: %v", err)
+		}
+		for _, attrs := range objects {
+			if BackupBucket == "" && strings.HasPrefix(attrs.Name, BackupPrefix) {
+				continue
+			}
+			entries = append(entries, ManifestEntry{
+				Key:      attrs.Name,
+				Size:     attrs.Size,
+				CRC32C:   encodeCRC32C(attrs.CRC32C),
+				Updated:  attrs.Updated,
+				Metadata: attrs.Metadata,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// Lists a bucket's objects and writes them as a manifest named for now.
+func writeManifest(ctx context.Context, bucket string, charids []string, now time.Time) (ManifestResult, error) {
+	entries, err := manifestEntries(ctx, bucket, charids)
+	if err != nil {
+		return ManifestResult{}, err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	result := ManifestResult{Bucket: bucket, Objects: len(entries)}
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return ManifestResult{}, fmt.Errorf("writeManifest: %v", err)
+		}
+		result.Bytes += entry.Size
+	}
+
+	// Names sort by time, so the latest is the last listed
+	manifestBucket, prefix := manifestLocation(bucket)
+	name := prefix + now.UTC().Format("20060102T150405.000000000Z") + ".ndjson"
+	metadata := map[string]string{"objects": fmt.Sprint(len(entries))}
+	if len(charids) > 0 {
+		metadata["charids"] = strings.Join(charids, ",")
+	}
+	err = uploadObject(ctx, &buf, manifestBucket, name, UploadOptions{
+		ContentType:   "application/x-ndjson",
+		Metadata:      metadata,
+		Preconditions: Preconditions{DoesNotExist: true},
+	})
+	if err != nil {
+		return ManifestResult{}, fmt.Errorf("writeManifest: %w", err)
+	}
+
+	result.ManifestBucket, result.Manifest = manifestBucket, name
+	if len(entries) <= manifestInlineEntries {
+		result.Entries = entries
+	}
+	return result, nil
+}
+
+// Serves a bucket's latest manifest, as NDJSON.
+func getLatestManifest(c *gin.Context) {
+	bucket := c.Param("bucket")
+	ctx := c.Request.Context()
+	manifestBucket, prefix := manifestLocation(bucket)
+
+	objects, err := Store.List(ctx, manifestBucket, prefix)
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var latest *storage.ObjectAttrs
+	for _, attrs := range objects {
+		if strings.HasSuffix(attrs.Name, ".ndjson") && (latest == nil || attrs.Name > latest.Name) {
+			latest = attrs
+		}
+	}
+	if latest == nil {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v has no manifest", bucket)})
+		return
+	}
+
+	data, err := Store.Download(ctx, manifestBucket, latest.Name)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", latest.Name)})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("X-Manifest", latest.Name)
+	c.Header("Last-Modified", latest.Updated.UTC().Format(http.TimeFormat))
+	c.Data(http.StatusOK, "application/x-ndjson", data)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A character besides the test one
+const otherCharID = "64b7f0c2a1b2c3d4e5f60718"
+
+// Seed the fake bucket with objects under two characters
+func seedManifestBucket(store *memStorage) {
+	ctx := context.Background()
+	store.Upload(ctx, testBucket, testCharID+"/a.webp", strings.NewReader("aaaa"), UploadOptions{
+		ContentType: "image/webp",
+		Metadata:    map[string]string{"guild": "1"},
+	})
+	store.Upload(ctx, testBucket, testCharID+"/a.orig.png", strings.NewReader("original"), UploadOptions{ContentType: "image/png"})
+	store.Upload(ctx, testBucket, otherCharID+"/b.webp", strings.NewReader("bb"), UploadOptions{ContentType: "image/webp"})
+}
+
+// Parse an NDJSON manifest
+func readManifest(t *testing.T, data []byte) []ManifestEntry {
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestManifest(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	seedManifestBucket(store)
+	r := setupRouter(false)
+
+	w := performRequest(r, "POST", "/faceclaim/manifest/"+testBucket, nil)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var result ManifestResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, testBucket, result.ManifestBucket)
+	assert.True(t, strings.HasPrefix(result.Manifest, "manifests/"+testBucket+"/"), result.Manifest)
+	assert.Equal(t, 3, result.Objects)
+	assert.Equal(t, int64(14), result.Bytes)
+	assert.Len(t, result.Entries, 3, "Small manifests are returned inline")
+
+	data, err := store.Download(context.Background(), testBucket, result.Manifest)
+	if !assert.NoError(t, err) {
+		return
+	}
+	entries := readManifest(t, data)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, otherCharID+"/b.webp", entries[0].Key)
+		assert.Equal(t, testCharID+"/a.orig.png", entries[1].Key)
+		assert.Equal(t, testCharID+"/a.webp", entries[2].Key)
+
+		attrs, _ := store.Attrs(context.Background(), testBucket, testCharID+"/a.webp")
+		assert.Equal(t, int64(4), entries[2].Size)
+		assert.Equal(t, encodeCRC32C(attrs.CRC32C), entries[2].CRC32C)
+		assert.Equal(t, "1", entries[2].Metadata["guild"])
+	}
+
+	// The latest manifest is served as written
+	w = performRequest(r, "GET", "/faceclaim/manifest/"+testBucket+"/latest", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Equal(t, result.Manifest, w.Header().Get("X-Manifest"))
+	assert.Equal(t, data, w.Body.Bytes())
+}
+
+func TestManifestCharIDs(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	seedManifestBucket(store)
+	r := setupRouter(false)
+
+	body := strings.NewReader(`{"charids": ["` + otherCharID + `"]}`)
+	w := performRequest(r, "POST", "/faceclaim/manifest/"+testBucket, body)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var result ManifestResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if assert.Len(t, result.Entries, 1) {
+		assert.Equal(t, otherCharID+"/b.webp", result.Entries[0].Key)
+	}
+
+	// Manifests kept in the bucket aren't listed in later ones
+	w = performRequest(r, "POST", "/faceclaim/manifest/"+testBucket, nil)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, 3, result.Objects)
+
+	w = performRequest(r, "POST", "/faceclaim/manifest/"+testBucket, strings.NewReader(`{"charids": ["../x"]}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestManifestBackupBucket(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	seedManifestBucket(store)
+	t.Setenv("BACKUP_BUCKET", "faceclaim-backups")
+	t.Setenv("BACKUP_PREFIX", "nightly")
+	if err := prepareManifests(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { BackupBucket, BackupPrefix = "", "manifests/" })
+	r := setupRouter(false)
+
+	w := performRequest(r, "GET", "/faceclaim/manifest/"+testBucket+"/latest", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(r, "POST", "/faceclaim/manifest/"+testBucket, strings.NewReader(`{"async": true}`))
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	status := waitForJob(t, r, job.ID)
+	assert.Equal(t, string(JobSucceeded), status["status"], status["error"])
+
+	keys := store.keys("faceclaim-backups")
+	if assert.Len(t, keys, 1) {
+		assert.True(t, strings.HasPrefix(keys[0], "nightly/"+testBucket+"/"), keys[0])
+	}
+	w = performRequest(r, "GET", "/faceclaim/manifest/"+testBucket+"/latest", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, readManifest(t, w.Body.Bytes()), 3)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+// The user-facing messages for error codes, one catalog per language. Each
+// maps a code to its message, in which {field} is replaced with that field
+// of the error response.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// The fallback language, used when the client accepts none of the others.
+var defaultLanguage = language.English
+
+// A messageCatalog holds the error messages in each language it supports.
+type messageCatalog struct {
+	languages []language.Tag // The default language first
+	messages  []map[string]string
+	matcher   language.Matcher
+}
+
+// The embedded catalog. It's checked by the tests, so a malformed locale file
+// fails them rather than the server.
+var errorMessages = mustLoadCatalog()
+
+func mustLoadCatalog() *messageCatalog {
+	catalog, err := loadCatalog()
+	if err != nil {
+		panic(err)
+	}
+	return catalog
+}
+
+// Reads the catalog from the embedded locale files, named by their language
+// tags.
+func loadCatalog() (*messageCatalog, error) {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		return nil, fmt.Errorf("localeFiles.ReadDir: %v", err)
+	}
+	catalog := &messageCatalog{}
+	for _, file := range files {
+		tag, err := language.Parse(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", file.Name(), err)
+		}
+		data, err := localeFiles.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("localeFiles.ReadFile: %v", err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("%v: %v", file.Name(), err)
+		}
+		catalog.languages = append(catalog.languages, tag)
+		catalog.messages = append(catalog.messages, messages)
+	}
+
+	// The matcher falls back to the first language it's given
+	fallback := -1
+	for i, tag := range catalog.languages {
+		if tag == defaultLanguage {
+			fallback = i
+		}
+	}
+	if fallback < 0 {
+		return nil, fmt.Errorf("there's no catalog for %v", defaultLanguage)
+	}
+	catalog.languages[0], catalog.languages[fallback] = catalog.languages[fallback], catalog.languages[0]
+	catalog.messages[0], catalog.messages[fallback] = catalog.messages[fallback], catalog.messages[0]
+	catalog.matcher = language.NewMatcher(catalog.languages)
+	return catalog, nil
+}
+
+// Returns the message for an error code in the best language for an
+// Accept-Language header, filled in from the error's fields, and the language
+// it's in. Messages missing from that language's catalog come from the
+// default one. ok is false if the code has no message.
+func (m *messageCatalog) message(acceptLanguage, code string, fields gin.H) (message string, tag language.Tag, ok bool) {
+	_, index := language.MatchStrings(m.matcher, acceptLanguage)
+	message, ok = m.messages[index][code]
+	tag = m.languages[index]
+	if !ok {
+		message, ok = m.messages[0][code]
+		tag = m.languages[0]
+	}
+	if !ok {
+		return "", language.Und, false
+	}
+	for field, value := range fields {
+		message = strings.ReplaceAll(message, "{"+field+"}", fmt.Sprint(value))
+	}
+	return message, tag, true
+}
+
+// Adds a display message to an error response with a code in the catalog,
+// in the language the client asked for. Clients should still branch on the
+// code; the message is only for showing to users.
+func localizeError(c *gin.Context, obj interface{}) {
+	body, ok := obj.(gin.H)
+	if !ok {
+		return
+	}
+	code, ok := body["code"].(string)
+	if !ok {
+		return
+	}
+	message, tag, ok := errorMessages.message(c.GetHeader("Accept-Language"), code, body)
+	if !ok {
+		return
+	}
+	body["message"] = message
+	c.Header("Content-Language", tag.String())
+	c.Writer.Header().Add("Vary", "Accept-Language")
+}
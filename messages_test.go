@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Upload from a blocked URL, asking for the given languages
+func postBlockedURL(r http.Handler, acceptLanguage string) *httptest.ResponseRecorder {
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = "http://169.254.169.254/computeMetadata/v1/"
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest("POST", "/faceclaim/upload", bytes.NewReader(body))
+	if acceptLanguage != "" {
+		req.Header.Set("Accept-Language", acceptLanguage)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLocalizedError(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	for acceptLanguage, expected := range map[string]string{
+		"es-MX,es;q=0.9,en;q=0.5": "es",
+		"es":                      "es",
+		"de-DE":                   "en",
+		"":                        "en",
+	} {
+		w := postBlockedURL(r, acceptLanguage)
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+
+		assert.Equal(t, 400, w.Code, acceptLanguage)
+		assert.Equal(t, "blocked_url", body["code"], "The code doesn't change with the language")
+		message, _, _ := errorMessages.message(expected, "blocked_url", nil)
+		assert.Equal(t, message, body["message"], acceptLanguage)
+		assert.Equal(t, expected, w.Header().Get("Content-Language"), acceptLanguage)
+		assert.Contains(t, body["error"], "169.254.169.254", "The error itself is left as it was")
+	}
+	w := postBlockedURL(r, "es")
+	assert.Contains(t, w.Body.String(), "Ese enlace de imagen no se puede usar")
+}
+
+func TestErrorMessageFields(t *testing.T) {
+	message, _, ok := errorMessages.message("es", "image_too_small", gin.H{"width": 80, "height": 120, "min_dimension": 100})
+	assert.True(t, ok)
+	assert.Equal(t, "La imagen mide 80×120, pero los faceclaims deben medir al menos 100 píxeles por lado.", message)
+
+	_, _, ok = errorMessages.message("es", "no_such_code", nil)
+	assert.False(t, ok, "Codes without a message are left alone")
+}
+
+func TestCatalogsMatch(t *testing.T) {
+	catalog, err := loadCatalog()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, defaultLanguage, catalog.languages[0])
+
+	// Each language has every message, with the same fields
+	placeholders := regexp.MustCompile(`\{[a-z_]+\}`)
+	for i, messages := range catalog.messages[1:] {
+		tag := catalog.languages[i+1]
+		assert.Len(t, messages, len(catalog.messages[0]), tag.String())
+		for code, english := range catalog.messages[0] {
+			if assert.Contains(t, messages, code, tag.String()) {
+				assert.ElementsMatch(t, placeholders.FindAllString(english, -1), placeholders.FindAllString(messages[code], -1), code)
+			}
+		}
+	}
+}
+
+func TestCatalogsCoverErrorCodes(t *testing.T) {
+	// Every code a handler responds with, found in the source
+	sources, err := filepath.Glob("*.go")
+	if !assert.NoError(t, err) {
+		return
+	}
+	pattern := regexp.MustCompile(`"code":\s*"([a-z_]+)"`)
+	codes := make(map[string]bool)
+	for _, source := range sources {
+		if strings.HasSuffix(source, "_test.go") {
+			continue
+		}
+		data, err := os.ReadFile(source)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, match := range pattern.FindAllSubmatch(data, -1) {
+			codes[string(match[1])] = true
+		}
+	}
+	assert.NotEmpty(t, codes)
+
+	for i, messages := range errorMessages.messages {
+		for code := range codes {
+			assert.Contains(t, messages, code, errorMessages.languages[i].String())
+		}
+	}
+}
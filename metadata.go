@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MetadataMaxBytes caps each metadata value written to an object; GCS allows
+// only 8 KiB of custom metadata in all. Read from METADATA_MAX_BYTES.
+var MetadataMaxBytes = 1024
+
+// URLs in metadata longer than this lose their query strings, which is where
+// tracking parameters pile up.
+const metadataURLMaxBytes = 512
+
+// Appended to values cut short by MetadataMaxBytes, within the cap.
+const truncatedSuffix = "…(truncated)"
+
+// The metadata keys holding URLs, whose query strings may be dropped.
+var urlMetadataKeys = map[string]bool{
+	"original":      true,
+	"submitted_url": true,
+	"resolved_url":  true,
+}
+
+// Reads METADATA_MAX_BYTES, which defaults to 1024.
+func prepareMetadata() error {
+	MetadataMaxBytes = 1024
+	if value, ok := os.LookupEnv("METADATA_MAX_BYTES"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 64 {
+			return errors.New("METADATA_MAX_BYTES must be an integer of at least 64")
+		}
+		MetadataMaxBytes = n
+	}
+	return nil
+}
+
+// Returns a copy of the metadata that GCS will accept: values are made valid
+// UTF-8, stripped of control characters, and truncated to MetadataMaxBytes.
+// Overlong URLs lose their query strings first.
+func sanitizeMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	clean := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		value = sanitizeMetadataValue(value)
+		if urlMetadataKeys[key] {
+			value = shortenMetadataURL(value)
+		}
+		clean[key] = truncateMetadataValue(value, MetadataMaxBytes)
+	}
+	return clean
+}
+
+// Drops invalid UTF-8 and control characters.
+func sanitizeMetadataValue(value string) string {
+	value = strings.ToValidUTF8(value, "")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// Drops the query string and fragment from a URL longer than
+// metadataURLMaxBytes.
+func shortenMetadataURL(value string) string {
+	if len(value) <= metadataURLMaxBytes {
+		return value
+	}
+	if u, err := url.Parse(value); err == nil {
+		u.RawQuery, u.ForceQuery, u.Fragment, u.RawFragment = "", false, "", ""
+		return u.String()
+	}
+	if i := strings.IndexAny(value, "?#"); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
+
+// Cuts a value down to max bytes, on a character boundary, marking it as
+// truncated.
+func truncateMetadataValue(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	cut := max - len(truncatedSuffix)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + truncatedSuffix
+}
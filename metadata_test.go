@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeMetadata(t *testing.T) {
+	long := strings.Repeat("é", 600) // 1200 bytes
+	clean := sanitizeMetadata(map[string]string{
+		"note":  "bad\xffbytes\x00 and\ttabs\n",
+		"long":  long,
+		"other": "https://example.com/?" + strings.Repeat("a", 600),
+		"short": "https://example.com/face.png?size=1",
+	})
+	assert.Equal(t, "badbytes andtabs", clean["note"])
+	assert.True(t, strings.HasSuffix(clean["long"], truncatedSuffix))
+	assert.LessOrEqual(t, len(clean["long"]), MetadataMaxBytes)
+	assert.True(t, utf8.ValidString(clean["long"]), "Truncation splits no characters")
+	assert.Len(t, clean["other"], 621, "Only URL keys lose their queries")
+	assert.Equal(t, "https://example.com/face.png?size=1", clean["short"])
+
+	assert.Nil(t, sanitizeMetadata(nil))
+}
+
+func TestUploadSanitizesMetadata(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "\"face\xff\xfe\"")
+		w.Header().Set("Last-Modified", strings.Repeat("\xe9", 2000))
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL + "/face.png?utm_source=\xff\xfe&tracking=" + strings.Repeat("x", 4000)
+	w := postUpload(r, request)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	response := getFaceclaimResponse(w.Body)
+
+	attrs, err := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/face.png", attrs.Metadata["original"])
+	assert.Equal(t, server.URL+"/face.png", attrs.Metadata["submitted_url"])
+	assert.Equal(t, "\"face\"", attrs.Metadata["upstream_etag"])
+	for key, value := range attrs.Metadata {
+		assert.True(t, utf8.ValidString(value), key)
+		assert.LessOrEqual(t, len(value), MetadataMaxBytes, key)
+	}
+}
+
+func TestPrepareMetadata(t *testing.T) {
+	t.Cleanup(func() { prepareMetadata() })
+
+	assert.NoError(t, prepareMetadata())
+	assert.Equal(t, 1024, MetadataMaxBytes)
+	t.Setenv("METADATA_MAX_BYTES", "256")
+	assert.NoError(t, prepareMetadata())
+	assert.Equal(t, 256, MetadataMaxBytes)
+	for _, value := range []string{"10", "lots"} {
+		t.Setenv("METADATA_MAX_BYTES", value)
+		assert.Error(t, prepareMetadata(), value)
+	}
+}
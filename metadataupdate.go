@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// The longest note a faceclaim can carry.
+const maxNoteLength = 1024
+
+// The metadata keys that can be changed after upload, and how each is
+// checked. The rest describe the image itself, or where it came from.
+var patchableMetadata = map[string]func(value string) error{
+	"user":  checkSnowflake,
+	"guild": checkSnowflake,
+	"note": func(value string) error {
+		if len(value) > maxNoteLength {
+			return fmt.Errorf("can be at most %v bytes", maxNoteLength)
+		}
+		return nil
+	},
+}
+
+// Checks that a value is a Discord ID, as user and guild are stored.
+func checkSnowflake(value string) error {
+	if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+		return errors.New("must be a Discord ID")
+	}
+	return nil
+}
+
+// Checks a metadata patch, returning an error naming the first bad key.
+func checkMetadataPatch(patch map[string]string) error {
+	if len(patch) == 0 {
+		return fmt.Errorf("the body must set at least one of %v", patchableKeys())
+	}
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		check, ok := patchableMetadata[key]
+		if !ok {
+			return fmt.Errorf("%v can't be changed; only %v can", key, patchableKeys())
+		}
+		if err := check(patch[key]); err != nil {
+			return fmt.Errorf("%v %v", key, err)
+		}
+	}
+	return nil
+}
+
+func patchableKeys() string {
+	keys := make([]string, 0, len(patchableMetadata))
+	for key := range patchableMetadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// Updates a faceclaim's user, guild, or note in place, as when a character
+// changes hands, and responds as the metadata route would. Other metadata is
+// left as it is. Kept originals and variants get the same changes, so they're
+// counted against the right guild.
+func patchFaceclaimMetadata(c *gin.Context) {
+	var patch map[string]string
+	if err := c.BindJSON(&patch); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkMetadataPatch(patch); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	patch = sanitizeMetadata(patch)
+
+	ctx := c.Request.Context()
+	bucket := c.Param("bucket")
+	object := fmt.Sprintf("%v/%v", c.Param("charid"), c.Param("key"))
+	attrs, err := getObjectAttrs(ctx, bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", object)})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var updated *storage.ObjectAttrs
+	for _, name := range faceclaimObjects(object, attrs.Metadata) {
+		result, err := Store.UpdateMetadata(ctx, bucket, name, patch)
+		attrCache.invalidate(bucket, name)
+		listCache.invalidate(bucket, name)
+		if name != object && errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			c.Error(err)
+			abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if name == object {
+			updated = result
+		}
+	}
+	if _, ok := patch["guild"]; ok {
+		guildUsage.invalidate(bucket)
+	}
+	log.Println("Updated the metadata of", object)
+	respond(c, http.StatusOK, faceclaimMetadata(bucket, updated))
+}
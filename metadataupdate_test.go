@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchFaceclaimMetadata(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	response := uploadTestImage(t, r, request)
+	object := objectKey(testBucket, response.URL)
+
+	w := performRequest(r, "PATCH", "/faceclaim/"+testBucket+"/"+object, strings.NewReader(`{"user": "42", "note": "Transferred"}`))
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	var patched FaceclaimMetadata
+	json.Unmarshal(w.Body.Bytes(), &patched)
+	assert.Equal(t, "42", patched.Metadata["user"])
+	assert.Equal(t, "Transferred", patched.Metadata["note"])
+	assert.Equal(t, testCharID, patched.Metadata["charid"], "Other metadata should be kept")
+
+	w = performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/"+object, nil)
+	var metadata FaceclaimMetadata
+	json.Unmarshal(w.Body.Bytes(), &metadata)
+	assert.Equal(t, "42", metadata.Metadata["user"])
+	assert.Equal(t, patched.Metadata, metadata.Metadata)
+	assert.NotEmpty(t, metadata.Metadata["blurhash"])
+
+	// The kept original follows its faceclaim
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.OriginalURL))
+	assert.Equal(t, "42", attrs.Metadata["user"])
+}
+
+func TestPatchFaceclaimMetadataRejected(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	object := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+
+	for _, body := range []string{
+		`{"charid": "5f0000000000000000000000"}`,
+		`{"original": "https://example.com/a.png"}`,
+		`{"user": "42", "blurhash": "x"}`,
+		`{"user": "someone"}`,
+		`{}`,
+		`[]`,
+	} {
+		w := performRequest(r, "PATCH", "/faceclaim/"+testBucket+"/"+object, strings.NewReader(body))
+		assert.Equal(t, 400, w.Code, body)
+	}
+
+	w := performRequest(r, "PATCH", "/faceclaim/"+testBucket+"/"+testObjectKey(1), strings.NewReader(`{"user": "42"}`))
+	assert.Equal(t, 404, w.Code)
+}
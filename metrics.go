@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics is the Prometheus registry served on the admin port at /metrics.
+var Metrics = prometheus.NewRegistry()
+
+var (
+	uploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_faceclaim_uploads_total",
+		Help: "Faceclaim uploads by bucket, guild, and outcome (success, rejected, or failure).",
+	}, []string{"bucket", "guild", "outcome"})
+
+	uploadBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_faceclaim_upload_bytes_total",
+		Help: "Bytes stored by successful faceclaim uploads, including kept originals.",
+	}, []string{"bucket", "guild"})
+
+	deletesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_faceclaim_deletes_total",
+		Help: "Faceclaim deletions queued by bucket, kind (single, group, batch, reconcile, or trim), and outcome.",
+	}, []string{"bucket", "kind", "outcome"})
+
+	authCredentialsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_auth_credentials_total",
+		Help: "Authenticated requests by credential (primary, secondary, jwt, or google-oidc).",
+	}, []string{"credential"})
+
+	authRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_auth_rejections_total",
+		Help: "Requests refused authentication by reason (invalid credentials, or a banned client).",
+	}, []string{"reason"})
+
+	authBansTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inconnu_auth_bans_total",
+		Help: "Clients temporarily banned for repeated authentication failures.",
+	})
+
+	upstreamRateLimitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_upstream_rate_limits_total",
+		Help: "429s from image hosts by outcome (retried, or rejected back to the caller).",
+	}, []string{"outcome"})
+
+	uploadQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "inconnu_upload_queue_depth",
+		Help: "Uploads to GCS waiting for a turn.",
+	})
+
+	uploadQueueWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "inconnu_upload_queue_wait_seconds",
+		Help:    "Time uploads to GCS spent waiting for a turn.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+	})
+
+	uploadPoolRejectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inconnu_upload_pool_rejections_total",
+		Help: "Uploads to GCS refused because the queue was full or the wait too long.",
+	})
+
+	attrCacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_attr_cache_lookups_total",
+		Help: "Object attribute lookups by result (hit, or miss, which goes to GCS).",
+	}, []string{"result"})
+
+	listCacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_list_cache_lookups_total",
+		Help: "Character listings by result (hit; miss or stale, which list GCS again).",
+	}, []string{"result"})
+
+	deleteJournalDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "inconnu_delete_journal_depth",
+		Help: "Deletions journaled because they couldn't be published, waiting to be retried.",
+	})
+
+	recordDiscrepanciesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_record_discrepancies_total",
+		Help: "Faceclaims found out of step with the bot's records by kind (removed, orphaned, or unrecorded).",
+	}, []string{"kind"})
+
+	selfTestPassed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "inconnu_self_test_passed",
+		Help: "Whether the startup self-test passed (1) or failed (0).",
+	})
+
+	selfTestFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_self_test_failures_total",
+		Help: "Self-test failures by stage (encode, upload, readback, or delete).",
+	}, []string{"stage"})
+
+	deleteBacklogMessages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inconnu_delete_backlog_messages",
+		Help: "Undelivered messages in each delete subscription, as Cloud Monitoring last reported.",
+	}, []string{"subscription"})
+
+	deleteBacklogOldestSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inconnu_delete_backlog_oldest_seconds",
+		Help: "The age of each delete subscription's oldest unacknowledged message.",
+	}, []string{"subscription"})
+
+	uploadEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inconnu_upload_events_total",
+		Help: "faceclaim-uploaded events by outcome (success, or failure to publish).",
+	}, []string{"outcome"})
+
+	bucketObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inconnu_bucket_objects",
+		Help: "Objects in each bucket, as of its last listing.",
+	}, []string{"bucket"})
+
+	bucketBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inconnu_bucket_bytes",
+		Help: "Total bytes stored in each bucket, as of its last listing.",
+	}, []string{"bucket"})
+
+	bucketLargestObjectBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inconnu_bucket_largest_object_bytes",
+		Help: "The size of the largest object in each bucket, as of its last listing.",
+	}, []string{"bucket"})
+
+	bucketLastModifiedSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inconnu_bucket_last_modified_timestamp_seconds",
+		Help: "When each bucket's most recently modified object was modified.",
+	}, []string{"bucket"})
+
+	bucketStatsRefreshedSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inconnu_bucket_stats_refreshed_timestamp_seconds",
+		Help: "When each bucket was last listed successfully.",
+	}, []string{"bucket"})
+)
+
+func init() {
+	Metrics.MustRegister(uploadsTotal, uploadBytesTotal, deletesTotal, authCredentialsTotal, authRejectionsTotal, authBansTotal, upstreamRateLimitsTotal,
+		uploadQueueDepth, uploadQueueWaitSeconds, uploadPoolRejectionsTotal, attrCacheLookupsTotal, listCacheLookupsTotal,
+		deleteJournalDepth, recordDiscrepanciesTotal, selfTestPassed, selfTestFailuresTotal, deleteBacklogMessages,
+		deleteBacklogOldestSeconds, uploadEventsTotal, bucketObjects, bucketBytes, bucketLargestObjectBytes,
+		bucketLastModifiedSeconds, bucketStatsRefreshedSeconds)
+}
+
+// Guild IDs are unbounded, and every label value is a separate series, so only
+// a few guilds get a label of their own. A guild is promoted once it has made
+// guildPromotionThreshold uploads, until maxGuildLabels guilds have been
+// promoted; the busiest guilds get there first. Promotions are permanent for
+// the life of the process, and all other guilds share the "other" label, so
+// there are never more than maxGuildLabels+1 guild values per bucket.
+const (
+	maxGuildLabels          = 10
+	guildPromotionThreshold = 10
+
+	// Bounds the memory spent counting guilds that haven't been promoted
+	maxGuildCandidates = 1000
+)
+
+var guildLabels = newGuildLabeler(maxGuildLabels, guildPromotionThreshold)
+
+type guildLabeler struct {
+	sync.Mutex
+	limit      int
+	threshold  int
+	promoted   map[string]bool
+	candidates map[string]int
+}
+
+func newGuildLabeler(limit, threshold int) *guildLabeler {
+	return &guildLabeler{
+		limit:      limit,
+		threshold:  threshold,
+		promoted:   make(map[string]bool),
+		candidates: make(map[string]int),
+	}
+}
+
+// Counts an upload from a guild and returns the guild's metrics label.
+func (l *guildLabeler) label(guild string) string {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.promoted[guild] {
+		return guild
+	}
+	if len(l.promoted) >= l.limit {
+		return "other"
+	}
+
+	if _, ok := l.candidates[guild]; !ok && len(l.candidates) >= maxGuildCandidates {
+		// Start counting afresh rather than grow without bound
+		l.candidates = make(map[string]int)
+	}
+	l.candidates[guild]++
+	if l.candidates[guild] >= l.threshold {
+		l.promoted[guild] = true
+		delete(l.candidates, guild)
+		if len(l.promoted) >= l.limit {
+			l.candidates = nil
+		}
+		return guild
+	}
+	return "other"
+}
+
+// Classifies an upload's outcome. Uploads turned away by moderation, a limit,
+// their format or color space, their size, their crop or fit, or a private
+// bucket are "rejected" rather than "failure", so failure rates reflect real
+// errors.
+func uploadOutcome(err error) string {
+	var moderationErr *ModerationError
+	var limitErr *CharLimitError
+	var quotaErr *QuotaError
+	var typeErr *UnsupportedTypeError
+	var smallErr *TooSmallError
+	var cropErr *CropError
+	var fitErr *FitError
+	var colorErr *ColorSpaceError
+	var privateErr *PrivateBucketError
+	switch {
+	case err == nil:
+		return "success"
+	case errors.As(err, &moderationErr), errors.As(err, &limitErr), errors.As(err, &quotaErr), errors.As(err, &typeErr),
+		errors.As(err, &smallErr), errors.As(err, &cropErr), errors.As(err, &fitErr), errors.As(err, &colorErr),
+		errors.As(err, &privateErr):
+		return "rejected"
+	default:
+		return "failure"
+	}
+}
+
+// Records a finished upload.
+func recordUpload(bucket string, guild int, err error, bytes int64) {
+	label := guildLabels.label(fmt.Sprint(guild))
+	uploadsTotal.WithLabelValues(bucket, label, uploadOutcome(err)).Inc()
+	if err == nil {
+		uploadBytesTotal.WithLabelValues(bucket, label).Add(float64(bytes))
+	}
+}
+
+// Records a published upload event.
+func recordUploadEvent(err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	uploadEventsTotal.WithLabelValues(outcome).Inc()
+}
+
+// Records a queued deletion.
+func recordDelete(bucket, kind string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	deletesTotal.WithLabelValues(bucket, kind, outcome).Inc()
+}
+
+// Records the credential a request authenticated with.
+func recordCredential(credential string) {
+	authCredentialsTotal.WithLabelValues(credential).Inc()
+}
+
+// Records a request refused authentication.
+func recordAuthRejection(reason string) {
+	authRejectionsTotal.WithLabelValues(reason).Inc()
+}
+
+// Records a client being banned.
+func recordAuthBan() {
+	authBansTotal.Inc()
+}
+
+// Records a 429 from an image host.
+func recordRateLimit(outcome string) {
+	upstreamRateLimitsTotal.WithLabelValues(outcome).Inc()
+}
+
+// Sets the number of uploads waiting for a turn.
+func setUploadQueueDepth(depth int) {
+	uploadQueueDepth.Set(float64(depth))
+}
+
+// Sets the number of journaled deletions waiting to be retried.
+func setJournalDepth(depth int) {
+	deleteJournalDepth.Set(float64(depth))
+}
+
+// Sets a delete subscription's backlog.
+func setDeleteBacklog(subscription string, undelivered, oldestSeconds int64) {
+	deleteBacklogMessages.WithLabelValues(subscription).Set(float64(undelivered))
+	deleteBacklogOldestSeconds.WithLabelValues(subscription).Set(float64(oldestSeconds))
+}
+
+// Sets a bucket's size from its latest listing.
+func setBucketStats(stats BucketStats) {
+	bucketObjects.WithLabelValues(stats.Bucket).Set(float64(stats.Objects))
+	bucketBytes.WithLabelValues(stats.Bucket).Set(float64(stats.Bytes))
+	bucketLargestObjectBytes.WithLabelValues(stats.Bucket).Set(float64(stats.LargestBytes))
+	if !stats.LastModified.IsZero() {
+		bucketLastModifiedSeconds.WithLabelValues(stats.Bucket).Set(float64(stats.LastModified.Unix()))
+	}
+	bucketStatsRefreshedSeconds.WithLabelValues(stats.Bucket).Set(float64(stats.Refreshed.Unix()))
+}
+
+// Records how long an upload waited for its turn.
+func recordUploadWait(wait time.Duration) {
+	uploadQueueWaitSeconds.Observe(wait.Seconds())
+}
+
+// Records an upload refused a turn.
+func recordUploadRejection() {
+	uploadPoolRejectionsTotal.Inc()
+}
+
+// Records an object attribute lookup as a cache hit or miss.
+func recordAttrCacheLookup(hit bool) {
+	if hit {
+		attrCacheLookupsTotal.WithLabelValues("hit").Inc()
+	} else {
+		attrCacheLookupsTotal.WithLabelValues("miss").Inc()
+	}
+}
+
+// Records a character listing: a "hit" served from the cache, a "miss", or a
+// "stale" listing whose newest object had changed.
+func recordListCacheLookup(result string) {
+	listCacheLookupsTotal.WithLabelValues(result).Inc()
+}
+
+// Records the self-test's result, and the stage that failed if it did.
+func recordSelfTest(stage string, passed bool) {
+	if passed {
+		selfTestPassed.Set(1)
+		return
+	}
+	selfTestPassed.Set(0)
+	selfTestFailuresTotal.WithLabelValues(stage).Inc()
+}
+
+// Records a faceclaim found out of step with the bot's records.
+func recordDiscrepancy(kind string) {
+	recordDiscrepanciesTotal.WithLabelValues(kind).Inc()
+}
+
+// Returns the handler for the Prometheus scrape endpoint.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(Metrics, promhttp.HandlerOpts{})
+}
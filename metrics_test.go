@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadMetricsByBucket(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	other := "pcs.botch.lol"
+	successes := testutil.ToFloat64(uploadsTotal.WithLabelValues(testBucket, "other", "success"))
+	otherSuccesses := testutil.ToFloat64(uploadsTotal.WithLabelValues(other, "other", "success"))
+	otherRejections := testutil.ToFloat64(uploadsTotal.WithLabelValues(other, "other", "rejected"))
+
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	uploadTestImage(t, r, createFaceclaimRequest(other))
+
+	useCharLimit(t, 1)
+	w := postTestImage(r, createFaceclaimRequest(other))
+	assert.Equal(t, 409, w.Code)
+
+	assert.Equal(t, successes+1, testutil.ToFloat64(uploadsTotal.WithLabelValues(testBucket, "other", "success")))
+	assert.Equal(t, otherSuccesses+1, testutil.ToFloat64(uploadsTotal.WithLabelValues(other, "other", "success")))
+	assert.Equal(t, otherRejections+1, testutil.ToFloat64(uploadsTotal.WithLabelValues(other, "other", "rejected")))
+	assert.Positive(t, testutil.ToFloat64(uploadBytesTotal.WithLabelValues(other, "other")))
+}
+
+func TestDeleteMetricsByBucket(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	r := setupRouter(false)
+
+	before := testutil.ToFloat64(deletesTotal.WithLabelValues("pcs.botch.lol", "group", "failure"))
+	publisher.err = fmt.Errorf("unavailable")
+	performRequest(r, "DELETE", "/faceclaim/delete/pcs.botch.lol/__test/all", nil)
+
+	assert.Equal(t, before+1, testutil.ToFloat64(deletesTotal.WithLabelValues("pcs.botch.lol", "group", "failure")))
+}
+
+func TestGuildLabelCardinality(t *testing.T) {
+	labeler := newGuildLabeler(2, 3)
+
+	// Guilds are promoted once they're busy enough
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "other", labeler.label("1"))
+	}
+	assert.Equal(t, "1", labeler.label("1"))
+	assert.Equal(t, "1", labeler.label("1"))
+
+	// One-off guilds stay in "other"
+	for i := 100; i < 200; i++ {
+		assert.Equal(t, "other", labeler.label(fmt.Sprint(i)))
+	}
+
+	for i := 0; i < 2; i++ {
+		labeler.label("2")
+	}
+	assert.Equal(t, "2", labeler.label("2"))
+
+	// Once the cap is reached, nobody else is promoted
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "other", labeler.label("3"))
+	}
+	assert.Len(t, labeler.promoted, 2)
+}
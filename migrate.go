@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// A MigrateRequest is the POST body for /admin/migrate.
+type MigrateRequest struct {
+	Source      string `json:"source" binding:"required"`
+	Destination string `json:"destination" binding:"required"`
+
+	// If given, only this character's objects are migrated
+	CharID string `json:"charid"`
+
+	// Report what would be copied without copying anything
+	DryRun bool `json:"dry_run"`
+
+	// Delete each source object once its copy is verified
+	DeleteSource bool `json:"delete_source"`
+
+	// Overwrite destination objects that differ from their sources, instead
+	// of reporting them as conflicts
+	Merge bool `json:"merge"`
+
+	// Run in the background, returning a job ID, instead of streaming progress
+	Async bool `json:"async"`
+}
+
+// A MigrateEntry is the outcome of migrating one object: "copied", "skipped"
+// (already in the destination), "pending" (in a dry run), "conflict" (a
+// different object is in the destination), or "failed".
+type MigrateEntry struct {
+	Object        string `json:"object"`
+	Status        string `json:"status"`
+	Bytes         int64  `json:"bytes"`
+	SourceDeleted bool   `json:"source_deleted,omitempty"`
+	Error         string `json:"error,omitempty"`
+	ErrorCode     string `json:"error_code,omitempty"`
+
+	// The generation of the object in the destination, for conflicts
+	Generation int64 `json:"generation,omitempty"`
+}
+
+// A MigrateResult summarizes a migration. Conflicts count as failures.
+type MigrateResult struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	DryRun      bool   `json:"dry_run"`
+	Total       int    `json:"total"`
+	Copied      int    `json:"copied"`
+	Skipped     int    `json:"skipped"`
+	Pending     int    `json:"pending"`
+	Conflicts   int    `json:"conflicts"`
+	Bytes       int64  `json:"bytes"`
+	BatchResult
+}
+
+// Copies a bucket's objects, or one character's, to another bucket. Progress
+// is streamed as NDJSON, one MigrateEntry per object followed by the
+// MigrateResult, unless the request is async, in which case a job is returned.
+// Objects already copied are skipped, so an interrupted migration can simply
+// be run again.
+func migrateBucket(c *gin.Context) {
+	var request MigrateRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Source == request.Destination {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "source and destination must differ"})
+		return
+	}
+	tagRequest(c, "bucket", request.Source)
+	tagRequest(c, "charid", request.CharID)
+	if request.CharID != "" {
+		if err := validateCharID(request.CharID); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if request.Async {
+		job := startTrackedJob(func(progress func(interface{})) (interface{}, error) {
+			// The job outlives the request and may take a long time, so it
+			// isn't given a deadline
+			return migrateObjects(context.Background(), request, func(_ MigrateEntry, result MigrateResult) {
+				progress(result)
+			})
+		})
+		respond(c, http.StatusAccepted, job)
+		return
+	}
+
+	// Nothing is streamed until the source has been listed, so listing
+	// failures get a proper status
+	ctx := c.Request.Context()
+	objects, err := migrationObjects(ctx, request)
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	result := migrateListed(ctx, request, objects, func(entry MigrateEntry, _ MigrateResult) {
+		encoder.Encode(entry)
+		c.Writer.Flush()
+	})
+	encoder.Encode(result)
+}
+
+// Returns the source objects a migration covers.
+func migrationObjects(ctx context.Context, request MigrateRequest) ([]*storage.ObjectAttrs, error) {
+	prefix := ""
+	if request.CharID != "" {
+		prefix = request.CharID + "/"
+	}
+	objects, err := Store.List(ctx, request.Source, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("migrationObjects: %v", err)
+	}
+	return objects, nil
+}
+
+// Lists and migrates the request's objects, calling emit after each one with
+// its outcome and the running totals.
+func migrateObjects(ctx context.Context, request MigrateRequest, emit func(MigrateEntry, MigrateResult)) (MigrateResult, error) {
+	objects, err := migrationObjects(ctx, request)
+	if err != nil {
+		return MigrateResult{}, err
+	}
+	return migrateListed(ctx, request, objects, emit), nil
+}
+
+// Migrates the listed objects one at a time. Failures are recorded and the
+// migration carries on.
+func migrateListed(ctx context.Context, request MigrateRequest, objects []*storage.ObjectAttrs, emit func(MigrateEntry, MigrateResult)) MigrateResult {
+	result := MigrateResult{
+		Source:      request.Source,
+		Destination: request.Destination,
+		DryRun:      request.DryRun,
+		Total:       len(objects),
+		BatchResult: BatchResult{Results: []BatchItem{}},
+	}
+	for _, attrs := range objects {
+		entry := migrateObject(ctx, request, attrs)
+		switch entry.Status {
+		case "copied":
+			result.Copied++
+			result.Bytes += entry.Bytes
+		case "skipped":
+			result.Skipped++
+		case "pending":
+			result.Pending++
+			result.Bytes += entry.Bytes
+		case "conflict":
+			result.Conflicts++
+		}
+		result.add(BatchItem{Key: entry.Object, Status: entry.Status, Code: entry.ErrorCode, Message: entry.Error})
+		emit(entry, result)
+	}
+	if !request.DryRun {
+		guildUsage.invalidate(request.Source)
+		guildUsage.invalidate(request.Destination)
+	}
+	log.Printf("Migrated %v to %v: %v copied, %v skipped, %v failed (%v conflicts)\n",
+		request.Source, request.Destination, result.Copied, result.Skipped, result.Failed, result.Conflicts)
+	return result
+}
+
+// Copies an object to the destination bucket under the same name and verifies
+// the copy's CRC32C. Objects whose copies already match are skipped. A
+// different object in the destination is a conflict, and left alone, unless
+// the request merges.
+func migrateObject(ctx context.Context, request MigrateRequest, src *storage.ObjectAttrs) MigrateEntry {
+	entry := MigrateEntry{Object: src.Name, Bytes: src.Size}
+	fail := func(err error) MigrateEntry {
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			entry.Status = "conflict"
+			entry.Generation = conflict.Generation
+		} else {
+			entry.Status = "failed"
+		}
+		entry.Error, entry.ErrorCode = err.Error(), batchErrorCode(err)
+		return entry
+	}
+
+	dst, err := getObjectAttrs(ctx, request.Destination, src.Name)
+	exists := err == nil
+	switch {
+	case exists && dst.CRC32C == src.CRC32C:
+		entry.Status = "skipped"
+	case err != nil && !errors.Is(err, storage.ErrObjectNotExist):
+		return fail(err)
+	case exists && !request.Merge:
+		return fail(&ConflictError{Bucket: request.Destination, Key: src.Name, Generation: dst.Generation})
+	case request.DryRun:
+		entry.Status = "pending"
+	default:
+		// The destination is only overwritten as it was seen, so a copy made
+		// in the meantime is reported rather than clobbered
+		cond := Preconditions{DoesNotExist: true}
+		if exists {
+			cond = Preconditions{IfGenerationMatch: dst.Generation}
+		}
+		dst, err = Store.Copy(ctx, request.Source, src.Name, request.Destination, src.Name, cond)
+		attrCache.invalidate(request.Destination, src.Name)
+		listCache.invalidate(request.Destination, src.Name)
+		if err != nil {
+			return fail(conflictError(ctx, err, request.Destination, src.Name))
+		}
+		if dst.CRC32C != src.CRC32C {
+			return fail(fmt.Errorf("CRC32C mismatch: source %08x, copy %08x", src.CRC32C, dst.CRC32C))
+		}
+		entry.Status = "copied"
+	}
+
+	if request.DeleteSource && !request.DryRun {
+		if err := deleteObject(ctx, request.Source, src.Name); err != nil {
+			return fail(fmt.Errorf("copied, but the source wasn't deleted: %v", err))
+		}
+		entry.SourceDeleted = true
+	}
+	return entry
+}
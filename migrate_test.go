@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	migrateSource      = "pcs.botch.lol"
+	migrateDestination = "pcs.inconnu.app"
+)
+
+// Seed the source bucket with two of a character's objects and one belonging
+// to another character
+func seedMigration(store *memStorage) {
+	ctx := context.Background()
+	metadata := map[string]string{"guild": "1", "charid": "__test"}
+	store.Upload(ctx, migrateSource, "__test/a.webp", strings.NewReader("aaaa"), UploadOptions{ContentType: "image/webp", Metadata: metadata})
+	store.Upload(ctx, migrateSource, "__test/b.webp", strings.NewReader("bbbbbbbb"), UploadOptions{ContentType: "image/webp", Metadata: metadata})
+	store.Upload(ctx, migrateSource, "__other/c.webp", strings.NewReader("cc"), UploadOptions{ContentType: "image/webp"})
+}
+
+// Post a migration and decode its NDJSON stream into the entries and summary
+func postMigration(t *testing.T, r http.Handler, request MigrateRequest) ([]MigrateEntry, MigrateResult) {
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/admin/migrate", bytes.NewReader(body))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	var lines []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if !assert.NotEmpty(t, lines) {
+		return nil, MigrateResult{}
+	}
+
+	var entries []MigrateEntry
+	for _, line := range lines[:len(lines)-1] {
+		var entry MigrateEntry
+		json.Unmarshal([]byte(line), &entry)
+		entries = append(entries, entry)
+	}
+	var result MigrateResult
+	json.Unmarshal([]byte(lines[len(lines)-1]), &result)
+	return entries, result
+}
+
+func TestMigratePrefix(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedMigration(store)
+
+	entries, result := postMigration(t, r, MigrateRequest{
+		Source:      migrateSource,
+		Destination: migrateDestination,
+		CharID:      "__test",
+	})
+
+	assert.Len(t, entries, 2)
+	assert.Equal(t, 2, result.Copied)
+	assert.Equal(t, int64(12), result.Bytes)
+	assert.Equal(t, []string{"__test/a.webp", "__test/b.webp"}, store.keys(migrateDestination))
+	for _, key := range store.keys(migrateDestination) {
+		src, _ := store.Download(context.Background(), migrateSource, key)
+		dst, _ := store.Download(context.Background(), migrateDestination, key)
+		assert.Equal(t, src, dst, "%v should be copied byte for byte", key)
+
+		attrs, _ := store.Attrs(context.Background(), migrateDestination, key)
+		assert.Equal(t, "__test", attrs.Metadata["charid"])
+	}
+	assert.Len(t, store.keys(migrateSource), 3, "Sources shouldn't be deleted by default")
+}
+
+func TestMigrateResumes(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedMigration(store)
+
+	// An earlier, interrupted run got as far as the first object
+	store.Copy(context.Background(), migrateSource, "__test/a.webp", migrateDestination, "__test/a.webp", Preconditions{})
+
+	_, result := postMigration(t, r, MigrateRequest{Source: migrateSource, Destination: migrateDestination})
+
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, 2, result.Copied)
+	assert.Len(t, store.keys(migrateDestination), 3)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedMigration(store)
+
+	entries, result := postMigration(t, r, MigrateRequest{
+		Source:       migrateSource,
+		Destination:  migrateDestination,
+		DryRun:       true,
+		DeleteSource: true,
+	})
+
+	assert.Len(t, entries, 3)
+	for _, entry := range entries {
+		assert.Equal(t, "pending", entry.Status)
+	}
+	assert.Equal(t, 3, result.Pending)
+	assert.Empty(t, store.keys(migrateDestination))
+	assert.Len(t, store.keys(migrateSource), 3)
+}
+
+func TestMigrateDeletesSources(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedMigration(store)
+
+	entries, _ := postMigration(t, r, MigrateRequest{
+		Source:       migrateSource,
+		Destination:  migrateDestination,
+		CharID:       "__test",
+		DeleteSource: true,
+	})
+
+	for _, entry := range entries {
+		assert.True(t, entry.SourceDeleted)
+	}
+	assert.Equal(t, []string{"__other/c.webp"}, store.keys(migrateSource))
+	assert.Len(t, store.keys(migrateDestination), 2)
+}
+
+func TestMigrateConflicts(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedMigration(store)
+	ctx := context.Background()
+	store.Upload(ctx, migrateDestination, "__test/a.webp", strings.NewReader("different"), UploadOptions{})
+	existing, _ := store.Attrs(ctx, migrateDestination, "__test/a.webp")
+
+	request := MigrateRequest{Source: migrateSource, Destination: migrateDestination, CharID: "__test", DeleteSource: true}
+	entries, result := postMigration(t, r, request)
+
+	assert.Equal(t, 1, result.Conflicts)
+	assert.Equal(t, 1, result.Copied)
+	assert.Equal(t, "conflict", entries[0].Status)
+	assert.Equal(t, existing.Generation, entries[0].Generation)
+	assert.False(t, entries[0].SourceDeleted)
+	assert.Equal(t, 1, result.Failed)
+	assert.Equal(t, BatchItem{Key: "__test/a.webp", Status: "conflict", Code: "conflict", Message: entries[0].Error}, result.Results[0])
+	data, _ := store.Download(ctx, migrateDestination, "__test/a.webp")
+	assert.Equal(t, "different", string(data), "The destination shouldn't be overwritten")
+	assert.True(t, store.exists(migrateSource, "__test/a.webp"))
+
+	// Merging overwrites it
+	request.Merge = true
+	_, result = postMigration(t, r, request)
+	assert.Equal(t, 1, result.Copied)
+	data, _ = store.Download(ctx, migrateDestination, "__test/a.webp")
+	assert.Equal(t, "aaaa", string(data))
+}
+
+func TestMigrateCopyRace(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedMigration(store)
+
+	// Another writer gets in between the destination lookup and the copy
+	store.beforeUpload = func(bucket, object string) {
+		store.Upload(context.Background(), bucket, object, strings.NewReader("theirs"), UploadOptions{})
+	}
+	entries, result := postMigration(t, r, MigrateRequest{Source: migrateSource, Destination: migrateDestination, CharID: "__test"})
+
+	assert.Equal(t, 2, result.Conflicts)
+	attrs, _ := store.Attrs(context.Background(), migrateDestination, "__test/a.webp")
+	assert.Equal(t, attrs.Generation, entries[0].Generation)
+	data, _ := store.Download(context.Background(), migrateDestination, "__test/a.webp")
+	assert.Equal(t, "theirs", string(data))
+}
+
+func TestMigrateAsync(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	seedMigration(store)
+
+	body, _ := json.Marshal(MigrateRequest{Source: migrateSource, Destination: migrateDestination, Async: true})
+	w := performRequest(r, "POST", "/admin/migrate", bytes.NewReader(body))
+	assert.Equal(t, 202, w.Code)
+
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	status := waitForJob(t, r, job.ID)
+	assert.Equal(t, string(JobSucceeded), status["status"])
+
+	result := status["result"].(map[string]interface{})
+	assert.Equal(t, float64(3), result["copied"])
+	progress := status["progress"].(map[string]interface{})
+	assert.Equal(t, float64(3), progress["copied"])
+	assert.Len(t, store.keys(migrateDestination), 3)
+}
+
+func TestMigrateRejectsSameBucket(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	body := fmt.Sprintf(`{"source": %q, "destination": %q}`, migrateSource, migrateSource)
+	w := performRequest(r, "POST", "/admin/migrate", strings.NewReader(body))
+
+	assert.Equal(t, 400, w.Code)
+}
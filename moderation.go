@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// A Likelihood is a SafeSearch rating, ordered from least to most likely.
+type Likelihood int
+
+const (
+	LikelihoodUnknown Likelihood = iota
+	LikelihoodVeryUnlikely
+	LikelihoodUnlikely
+	LikelihoodPossible
+	LikelihoodLikely
+	LikelihoodVeryLikely
+)
+
+var likelihoodNames = [...]string{"UNKNOWN", "VERY_UNLIKELY", "UNLIKELY", "POSSIBLE", "LIKELY", "VERY_LIKELY"}
+
+func (l Likelihood) String() string {
+	if l < 0 || int(l) >= len(likelihoodNames) {
+		return likelihoodNames[LikelihoodUnknown]
+	}
+	return likelihoodNames[l]
+}
+
+// Parses a Vision API likelihood name, such as "LIKELY".
+func parseLikelihood(name string) (Likelihood, error) {
+	for i, n := range likelihoodNames {
+		if strings.EqualFold(name, n) {
+			return Likelihood(i), nil
+		}
+	}
+	return LikelihoodUnknown, fmt.Errorf("unknown likelihood %q", name)
+}
+
+// UnmarshalJSON reads a likelihood from its Vision API name.
+func (l *Likelihood) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	// The Vision API may add ratings; treat anything unknown as UNKNOWN
+	*l, _ = parseLikelihood(name)
+	return nil
+}
+
+// A SafeSearchVerdict holds the SafeSearch ratings we moderate on.
+type SafeSearchVerdict struct {
+	Adult    Likelihood `json:"adult"`
+	Violence Likelihood `json:"violence"`
+}
+
+// Summarizes the verdict for storage in object metadata.
+func (v SafeSearchVerdict) String() string {
+	return fmt.Sprintf("adult=%v,violence=%v", v.Adult, v.Violence)
+}
+
+// A Moderator screens image data before it's uploaded.
+type Moderator interface {
+	SafeSearch(ctx context.Context, image []byte) (SafeSearchVerdict, error)
+}
+
+// A ModerationError is returned when an image fails content screening.
+type ModerationError struct {
+	Category   string
+	Likelihood Likelihood
+}
+
+func (e *ModerationError) Error() string {
+	return fmt.Sprintf("image rejected by moderation: %v content is %v", e.Category, e.Likelihood)
+}
+
+// Configures image moderation from the MODERATION and MODERATION_THRESHOLD
+// env vars. Moderation is disabled unless MODERATION is set.
+func prepareModeration() error {
+	switch mode := os.Getenv("MODERATION"); mode {
+	case "":
+		ImageModerator = nil
+	case "vision":
+		ImageModerator = &visionModerator{}
+	default:
+		return fmt.Errorf("unknown MODERATION mode %q", mode)
+	}
+
+	ModerationThreshold = LikelihoodPossible
+	if name, ok := os.LookupEnv("MODERATION_THRESHOLD"); ok {
+		threshold, err := parseLikelihood(name)
+		if err != nil {
+			return fmt.Errorf("MODERATION_THRESHOLD: %v", err)
+		}
+		ModerationThreshold = threshold
+	}
+	return nil
+}
+
+// Screens an image with the configured Moderator, returning a summary of the
+// verdict for the object's metadata. Images rated more likely than
+// ModerationThreshold in any category are rejected with a *ModerationError.
+// When moderation is disabled, this returns immediately with an empty summary.
+func moderateImage(ctx context.Context, data []byte) (string, error) {
+	if ImageModerator == nil {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	verdict, err := ImageModerator.SafeSearch(ctx, data)
+	if err != nil {
+		return "", fmt.Errorf("moderateImage: %v", err)
+	}
+	if verdict.Adult > ModerationThreshold {
+		return "", &ModerationError{Category: "adult", Likelihood: verdict.Adult}
+	}
+	if verdict.Violence > ModerationThreshold {
+		return "", &ModerationError{Category: "violence", Likelihood: verdict.Violence}
+	}
+	return verdict.String(), nil
+}
+
+// visionModerator checks images with the Cloud Vision SafeSearch API. The HTTP
+// client is created on first use, so a deployment without moderation never
+// needs Vision credentials.
+type visionModerator struct {
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+const visionAnnotateURL = "https://vision.googleapis.com/v1/images:annotate"
+
+func (m *visionModerator) SafeSearch(ctx context.Context, image []byte) (SafeSearchVerdict, error) {
+	m.once.Do(func() {
+		m.client, m.err = google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/cloud-vision")
+	})
+	if m.err != nil {
+		return SafeSearchVerdict{}, fmt.Errorf("google.DefaultClient: %v", m.err)
+	}
+
+	body, err := json.Marshal(JSON{
+		"requests": []JSON{{
+			"image":    JSON{"content": base64.StdEncoding.EncodeToString(image)},
+			"features": []JSON{{"type": "SAFE_SEARCH_DETECTION"}},
+		}},
+	})
+	if err != nil {
+		return SafeSearchVerdict{}, fmt.Errorf("json.Marshal: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, visionAnnotateURL, bytes.NewReader(body))
+	if err != nil {
+		return SafeSearchVerdict{}, fmt.Errorf("http.NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return SafeSearchVerdict{}, fmt.Errorf("vision: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return SafeSearchVerdict{}, fmt.Errorf("vision: unexpected status %v", resp.Status)
+	}
+
+	var result struct {
+		Responses []struct {
+			SafeSearchAnnotation SafeSearchVerdict `json:"safeSearchAnnotation"`
+			Error                *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"responses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return SafeSearchVerdict{}, fmt.Errorf("json.Decode: %v", err)
+	}
+	if len(result.Responses) == 0 {
+		return SafeSearchVerdict{}, fmt.Errorf("vision: empty response")
+	}
+	if e := result.Responses[0].Error; e != nil {
+		return SafeSearchVerdict{}, fmt.Errorf("vision: %v", e.Message)
+	}
+	return result.Responses[0].SafeSearchAnnotation, nil
+}
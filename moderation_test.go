@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeModerator returns a canned verdict and counts how often it's consulted.
+type fakeModerator struct {
+	verdict SafeSearchVerdict
+	err     error
+	calls   int
+}
+
+func (m *fakeModerator) SafeSearch(ctx context.Context, image []byte) (SafeSearchVerdict, error) {
+	m.calls++
+	return m.verdict, m.err
+}
+
+// Install a fake moderator for the duration of a test
+func useModerator(t *testing.T, m Moderator) {
+	ImageModerator = m
+	ModerationThreshold = LikelihoodPossible
+	t.Cleanup(func() { ImageModerator = nil })
+}
+
+func TestModerateImageDisabled(t *testing.T) {
+	ImageModerator = nil
+	summary, err := moderateImage(context.Background(), []byte("image"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", summary)
+}
+
+func TestModerateImagePasses(t *testing.T) {
+	useModerator(t, &fakeModerator{verdict: SafeSearchVerdict{Adult: LikelihoodVeryUnlikely, Violence: LikelihoodPossible}})
+
+	summary, err := moderateImage(context.Background(), []byte("image"))
+	assert.Nil(t, err)
+	assert.Equal(t, "adult=VERY_UNLIKELY,violence=POSSIBLE", summary)
+}
+
+func TestModerateImageFailsClosed(t *testing.T) {
+	useModerator(t, &fakeModerator{err: errors.New("vision is down")})
+
+	_, err := moderateImage(context.Background(), []byte("image"))
+	assert.NotNil(t, err, "moderateImage() should fail when the moderator does")
+}
+
+func TestModerationRejectsUpload(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(color.RGBA{255, 0, 0, 255}))
+	server := serveImage(buf.Bytes())
+	defer server.Close()
+
+	moderator := &fakeModerator{verdict: SafeSearchVerdict{Adult: LikelihoodVeryUnlikely, Violence: LikelihoodVeryLikely}}
+	useModerator(t, moderator)
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	body, _ := json.Marshal(request)
+
+	r := setupRouter(false)
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+
+	assert.Equal(t, 422, w.Code)
+	assert.Equal(t, 1, moderator.calls)
+
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, "violence", response["category"])
+}
+
+func TestPrepareModeration(t *testing.T) {
+	defer os.Unsetenv("MODERATION")
+	defer os.Unsetenv("MODERATION_THRESHOLD")
+
+	assert.Nil(t, prepareModeration())
+	assert.Nil(t, ImageModerator, "Moderation should be disabled by default")
+
+	os.Setenv("MODERATION", "vision")
+	os.Setenv("MODERATION_THRESHOLD", "likely")
+	assert.Nil(t, prepareModeration())
+	assert.IsType(t, &visionModerator{}, ImageModerator)
+	assert.Equal(t, LikelihoodLikely, ModerationThreshold)
+
+	os.Setenv("MODERATION_THRESHOLD", "sorta")
+	assert.NotNil(t, prepareModeration(), "prepareModeration() should reject unknown thresholds")
+
+	os.Setenv("MODERATION", "rekognition")
+	assert.NotNil(t, prepareModeration(), "prepareModeration() should reject unknown modes")
+
+	ImageModerator = nil
+}
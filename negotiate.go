@@ -0,0 +1,43 @@
+package main
+
+import (
+	"mime"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
+)
+
+// The response formats clients can ask for with Accept. JSON comes first, so
+// it's what clients that don't ask get.
+var responseFormats = []string{binding.MIMEJSON, binding.MIMEMSGPACK2, binding.MIMEMSGPACK}
+
+// Writes a response in the format the client accepts: msgpack if it asked
+// for it, JSON otherwise.
+func respond(c *gin.Context, code int, obj interface{}) {
+	switch c.NegotiateFormat(responseFormats...) {
+	case binding.MIMEMSGPACK, binding.MIMEMSGPACK2:
+		c.Render(code, render.MsgPack{Data: obj})
+	default:
+		c.JSON(code, obj)
+	}
+}
+
+// Stops the handler chain and writes a response, usually an error, in the
+// format the client accepts. Errors with a code get a message in the
+// client's language.
+func abortWith(c *gin.Context, code int, obj interface{}) {
+	c.Abort()
+	localizeError(c, obj)
+	respond(c, code, obj)
+}
+
+// Decodes a request body as msgpack if its Content-Type says it is, or as
+// JSON otherwise.
+func bindBody(c *gin.Context, obj interface{}) error {
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if contentType == binding.MIMEMSGPACK || contentType == binding.MIMEMSGPACK2 {
+		return c.ShouldBindWith(obj, binding.MsgPack)
+	}
+	return c.ShouldBindWith(obj, binding.JSON)
+}
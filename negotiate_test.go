@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+// Encode a value as msgpack
+func encodeMsgpack(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	var handle codec.MsgpackHandle
+	if err := codec.NewEncoder(&buf, &handle).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Decode a msgpack response body
+func decodeMsgpack(t *testing.T, data []byte, v interface{}) {
+	var handle codec.MsgpackHandle
+	handle.RawToString = true
+	if err := codec.NewDecoderBytes(data, &handle).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Make a request with the given body and Content-Type, accepting msgpack
+func requestMsgpack(r http.Handler, method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/msgpack")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMsgpackUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	defer server.Close()
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	request.Variants = []string{"16"}
+	w := requestMsgpack(r, "POST", "/faceclaim/upload", "application/msgpack", encodeMsgpack(t, request))
+
+	assert.Equal(t, 201, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/msgpack")
+	var response FaceclaimResponse
+	decodeMsgpack(t, w.Body.Bytes(), &response)
+	assert.Equal(t, w.Header().Get("Location"), response.URL)
+	assert.NotEmpty(t, response.BlurHash)
+	assert.NotEmpty(t, response.CRC32C)
+	assert.Contains(t, response.Variants, "16")
+	assert.True(t, store.exists(testBucket, objectKey(testBucket, response.URL)))
+}
+
+func TestMsgpackErrors(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest("Not_A_Bucket")
+	w := requestMsgpack(r, "POST", "/faceclaim/upload", "application/x-msgpack", encodeMsgpack(t, request))
+
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/msgpack")
+	var body map[string]interface{}
+	decodeMsgpack(t, w.Body.Bytes(), &body)
+	assert.Contains(t, body["error"], "lowercase")
+
+	// Errors from middleware are negotiated too
+	w = requestMsgpack(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/..%2Fx.webp", "", nil)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/msgpack")
+}
+
+func TestJSONByDefault(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	for _, accept := range []string{"", "*/*", "application/json", "text/html"} {
+		req, _ := http.NewRequest("GET", "/faceclaim/job/000000000000000000000000", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 404, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "application/json", accept)
+		assert.True(t, json.Valid(w.Body.Bytes()), accept)
+	}
+}
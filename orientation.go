@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// The EXIF tag saying how a photo's pixels must be turned to display upright
+const exifOrientationTag = 0x0112
+
+// Reads the EXIF Orientation of a JPEG: 1 (upright) through 8. Phones often
+// store photos sideways and set this instead of rotating the pixels. Images
+// that aren't JPEGs, or have no valid tag, are taken to be upright.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	// Walk the segments up to the image data, looking for the EXIF one
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		segment := data[i+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// Reads the Orientation tag from IFD0 of EXIF's TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// A SHORT, stored in the first half of the value field
+		if order.Uint16(tiff[entry+2:]) != 3 {
+			return 1
+		}
+		if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+			return value
+		}
+		return 1
+	}
+	return 1
+}
+
+// Turns an image upright according to its EXIF orientation. Orientations 5
+// through 8 swap the width and height.
+func orientImage(img image.Image, orientation int) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Copy(src, image.Point{}, img, bounds, draw.Src, nil)
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Flip horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotate 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Flip vertically
+				dx, dy = x, h-1-y
+			case 5: // Flip across the main diagonal
+				dx, dy = y, x
+			case 6: // Rotate 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // Flip across the anti-diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotate 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// Rotates and flips a JPEG's pixels to match its EXIF orientation, since the
+// tag is lost when the image is converted. Returns the upright image as a PNG
+// and the orientation that was corrected, or the data untouched and 1 if it
+// was already upright.
+func correctOrientation(data []byte) ([]byte, int, error) {
+	orientation := jpegOrientation(data)
+	if orientation == 1 {
+		return data, 1, nil
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, orientImage(img, orientation)); err != nil {
+		return nil, 0, fmt.Errorf("png.Encode: %v", err)
+	}
+	return buf.Bytes(), orientation, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Encode an image as a JPEG carrying an EXIF Orientation tag, in the given
+// byte order
+func exifJPEG(img image.Image, orientation int, order binary.ByteOrder) []byte {
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, img, nil)
+
+	// TIFF header, then IFD0 with the one entry
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2]) // SOI
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := gradientImage()
+	assert.Equal(t, 6, jpegOrientation(exifJPEG(img, 6, binary.BigEndian)))
+	assert.Equal(t, 8, jpegOrientation(exifJPEG(img, 8, binary.LittleEndian)))
+	assert.Equal(t, 1, jpegOrientation(exifJPEG(img, 9, binary.BigEndian)), "Invalid values are ignored")
+
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, img, nil)
+	assert.Equal(t, 1, jpegOrientation(plain.Bytes()))
+	assert.Equal(t, 1, jpegOrientation([]byte("not an image")))
+}
+
+func TestOrientImage(t *testing.T) {
+	// A 2x1 image: red, then blue
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.SetRGBA(0, 0, red)
+	img.SetRGBA(1, 0, blue)
+
+	tests := map[int][]color.RGBA{
+		1: {red, blue},
+		2: {blue, red},
+		3: {blue, red},
+		6: {red, blue}, // Top to bottom
+		8: {blue, red},
+	}
+	for orientation, want := range tests {
+		oriented := orientImage(img, orientation)
+		bounds := oriented.Bounds()
+		var got []color.RGBA
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				got = append(got, oriented.RGBAAt(x, y))
+			}
+		}
+		assert.Equal(t, want, got, orientation)
+		if orientation >= 5 {
+			assert.Equal(t, image.Rect(0, 0, 1, 2), bounds, orientation)
+		}
+	}
+}
+
+func TestUploadCorrectsOrientation(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := postImageBytes(r, createFaceclaimRequest(testBucket), exifJPEG(gradientImage(), 6, binary.BigEndian))
+
+	assert.Equal(t, 201, w.Code)
+	response := getFaceclaimResponse(w.Body)
+	assert.Equal(t, 24, response.Width, "The width and height should be swapped")
+	assert.Equal(t, 32, response.Height)
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Equal(t, "6", attrs.Metadata["orientation_corrected"])
+
+	// Upright images are left alone
+	response = uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 32, response.Width)
+	attrs, _ = store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.NotContains(t, attrs.Metadata, "orientation_corrected")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrustedProxies lists the addresses, as IPs or CIDRs, whose X-Forwarded-For
+// and X-Real-IP headers are believed. When it's empty, no proxy is trusted,
+// and the client is whoever opened the connection.
+var TrustedProxies []string
+
+// TrustedPlatform names a header set by the platform in front of the service
+// with the client's address, which is then believed outright. It's empty
+// unless TRUSTED_PLATFORM is set.
+var TrustedPlatform string
+
+// The platforms TRUSTED_PLATFORM accepts by name. Any other value is taken as
+// the name of the header itself.
+var trustedPlatforms = map[string]string{
+	"appengine":  gin.PlatformGoogleAppEngine,
+	"cloudflare": gin.PlatformCloudflare,
+}
+
+// Reads TRUSTED_PROXIES, a comma-separated list of IPs and CIDRs, and
+// TRUSTED_PLATFORM.
+func prepareProxies() error {
+	TrustedProxies, TrustedPlatform = nil, ""
+
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("TRUSTED_PROXIES: %q is neither an IP nor a CIDR", proxy)
+		}
+		TrustedProxies = append(TrustedProxies, proxy)
+	}
+
+	if platform := strings.TrimSpace(os.Getenv("TRUSTED_PLATFORM")); platform != "" {
+		if header, ok := trustedPlatforms[strings.ToLower(platform)]; ok {
+			TrustedPlatform = header
+		} else if strings.ContainsAny(platform, " :\t") {
+			return fmt.Errorf("TRUSTED_PLATFORM: %q is neither a known platform nor a header name", platform)
+		} else {
+			TrustedPlatform = http.CanonicalHeaderKey(platform)
+		}
+	}
+	return nil
+}
+
+// Tells the router which proxies and platform to believe about clients'
+// addresses. If the proxies can't be set, none are trusted, rather than
+// gin's default of trusting everyone.
+func configureProxies(r *gin.Engine) {
+	if err := r.SetTrustedProxies(TrustedProxies); err != nil {
+		log.Println("Unable to set trusted proxies; trusting none:", err)
+		r.SetTrustedProxies(nil)
+	}
+	r.TrustedPlatform = TrustedPlatform
+}
+
+// Returns the address of the client behind a request: the TrustedPlatform
+// header if there is one, or else the address a trusted proxy forwarded the
+// request for, or else the address of the connection itself. Banning and the
+// access log both go by it, so they agree on who a client is.
+func clientIP(c *gin.Context) string {
+	return c.ClientIP()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Send a request from remoteAddr with a header naming the client, returning
+// the client address the access log recorded
+func loggedClientIP(t *testing.T, remoteAddr, header, client string) string {
+	output := captureAccessLog(t)
+	r := setupRouter(false)
+
+	req, _ := http.NewRequest("GET", "/faceclaim/job/000000000000000000000000", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set(header, client)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	var record AccessRecord
+	json.Unmarshal([]byte(strings.TrimSpace(output.String())), &record)
+	return record.ClientIP
+}
+
+// Set the proxy config for the duration of a test
+func useProxies(t *testing.T, proxies, platform string) {
+	os.Setenv("TRUSTED_PROXIES", proxies)
+	os.Setenv("TRUSTED_PLATFORM", platform)
+	t.Cleanup(func() {
+		os.Unsetenv("TRUSTED_PROXIES")
+		os.Unsetenv("TRUSTED_PLATFORM")
+		prepareProxies()
+	})
+	assert.Nil(t, prepareProxies())
+}
+
+func TestForwardedForIgnoredByDefault(t *testing.T) {
+	useProxies(t, "", "")
+	assert.Equal(t, "10.0.0.5", loggedClientIP(t, "10.0.0.5:1234", "X-Forwarded-For", "203.0.113.7"))
+}
+
+func TestForwardedForFromTrustedProxy(t *testing.T) {
+	useProxies(t, "10.0.0.0/8, 192.0.2.1", "")
+	assert.Equal(t, "203.0.113.7", loggedClientIP(t, "10.0.0.5:1234", "X-Forwarded-For", "203.0.113.7"))
+	assert.Equal(t, "203.0.113.7", loggedClientIP(t, "192.0.2.1:1234", "X-Forwarded-For", "203.0.113.7"))
+}
+
+func TestForwardedForFromUntrustedSource(t *testing.T) {
+	useProxies(t, "10.0.0.0/8", "")
+	assert.Equal(t, "198.51.100.9", loggedClientIP(t, "198.51.100.9:1234", "X-Forwarded-For", "203.0.113.7"))
+}
+
+func TestForwardedForSpoofedBehindProxy(t *testing.T) {
+	useProxies(t, "10.0.0.0/8", "")
+
+	// The client claims an address, then the proxy appends the real one
+	assert.Equal(t, "203.0.113.7", loggedClientIP(t, "10.0.0.5:1234", "X-Forwarded-For", "1.2.3.4, 203.0.113.7"))
+}
+
+func TestTrustedPlatform(t *testing.T) {
+	useProxies(t, "", "cloudflare")
+	assert.Equal(t, "203.0.113.7", loggedClientIP(t, "10.0.0.5:1234", "CF-Connecting-IP", "203.0.113.7"))
+
+	// Without the platform, its header means nothing
+	useProxies(t, "", "")
+	assert.Equal(t, "10.0.0.5", loggedClientIP(t, "10.0.0.5:1234", "CF-Connecting-IP", "203.0.113.7"))
+}
+
+func TestBansFollowForwardedClient(t *testing.T) {
+	os.Setenv("API_TOKEN", "hunter2")
+	defer os.Unsetenv("API_TOKEN")
+	useProxies(t, "10.0.0.0/8", "")
+	useBanList(t, 1, time.Minute, time.Hour, 100)
+	r := setupRouter(false)
+
+	req, _ := http.NewRequest("GET", "/faceclaim/job/000000000000000000000000", nil)
+	req.RemoteAddr = "10.0.0.5:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("Authorization", "wrong")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The client is banned, not the proxy
+	_, banned := authBans.banned("203.0.113.7")
+	assert.True(t, banned)
+	_, banned = authBans.banned("10.0.0.5")
+	assert.False(t, banned)
+}
+
+func TestInvalidTrustedProxies(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,not-an-ip")
+	t.Cleanup(func() {
+		os.Unsetenv("TRUSTED_PROXIES")
+		prepareProxies()
+	})
+	assert.ErrorContains(t, prepareProxies(), "not-an-ip")
+}
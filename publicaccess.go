@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StrictPublicCheck rejects uploads to buckets that aren't publicly readable,
+// rather than warning about them, read from STRICT_PUBLIC_CHECK.
+var StrictPublicCheck bool
+
+// PublicCheckInterval is how long a bucket's access is trusted before it's
+// checked again.
+var PublicCheckInterval = 10 * time.Minute
+
+// Reads STRICT_PUBLIC_CHECK and PUBLIC_CHECK_INTERVAL.
+func preparePublicCheck() error {
+	StrictPublicCheck, PublicCheckInterval = false, 10*time.Minute
+	if value, ok := os.LookupEnv("STRICT_PUBLIC_CHECK"); ok {
+		strict, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("STRICT_PUBLIC_CHECK: %v", err)
+		}
+		StrictPublicCheck = strict
+	}
+	if value, ok := os.LookupEnv("PUBLIC_CHECK_INTERVAL"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.New("PUBLIC_CHECK_INTERVAL must be a positive duration, e.g. \"10m\"")
+		}
+		PublicCheckInterval = d
+	}
+	publicAccess = newAccessCache()
+	return nil
+}
+
+// A PrivateBucketError means an upload targeted a bucket whose objects
+// aren't publicly readable, so its URLs would be useless to Discord.
+type PrivateBucketError struct {
+	Bucket string
+}
+
+func (e *PrivateBucketError) Error() string {
+	return fmt.Sprintf("bucket %v isn't publicly readable, so its faceclaims' URLs wouldn't load; request signed_url or use the image route", e.Bucket)
+}
+
+// accessCache remembers which buckets are publicly readable. Failed checks
+// aren't cached, so they're retried on the next upload.
+type accessCache struct {
+	sync.Mutex
+	checked map[string]accessEntry
+}
+
+type accessEntry struct {
+	public bool
+	at     time.Time
+}
+
+func newAccessCache() *accessCache {
+	return &accessCache{checked: make(map[string]accessEntry)}
+}
+
+// The cache of bucket access consulted by uploads.
+var publicAccess = newAccessCache()
+
+// Reports whether a bucket is publicly readable, checking it if it hasn't
+// been within PublicCheckInterval.
+func (a *accessCache) isPublic(ctx context.Context, bucket string) (bool, error) {
+	a.Lock()
+	entry, ok := a.checked[bucket]
+	a.Unlock()
+	if ok && time.Since(entry.at) < PublicCheckInterval {
+		return entry.public, nil
+	}
+	return a.refresh(ctx, bucket)
+}
+
+// Checks a bucket's access and caches the result.
+func (a *accessCache) refresh(ctx context.Context, bucket string) (bool, error) {
+	public, err := Store.IsPublic(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+	a.Lock()
+	a.checked[bucket] = accessEntry{public: public, at: time.Now()}
+	a.Unlock()
+	return public, nil
+}
+
+// The buckets uploads may target, and so whose access is checked at startup.
+func uploadBuckets() []string {
+	cfg := currentConfig()
+	buckets := []string{cfg.FaceclaimBucket}
+	for _, bucket := range cfg.AllowedBuckets {
+		if bucket != cfg.FaceclaimBucket {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// Checks the upload buckets' access now and every PublicCheckInterval until
+// the context is cancelled, logging a warning for each that isn't public.
+func watchBucketAccess(ctx context.Context) {
+	ticker := time.NewTicker(PublicCheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, bucket := range uploadBuckets() {
+			public, err := publicAccess.refresh(ctx, bucket)
+			if err != nil {
+				log.Printf("Unable to check whether %v is public: %v\n", bucket, err)
+			} else if !public {
+				log.Printf("WARNING: %v isn't publicly readable; its faceclaims' URLs won't load\n", bucket)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks that an upload's bucket is publicly readable. Returns whether it is,
+// or a PrivateBucketError if it isn't and StrictPublicCheck is set. Buckets
+// whose access can't be determined are given the benefit of the doubt.
+func checkPublicBucket(ctx context.Context, bucket string) (bool, error) {
+	public, err := publicAccess.isPublic(ctx, bucket)
+	if err != nil {
+		log.Printf("Unable to check whether %v is public: %v\n", bucket, err)
+		return true, nil
+	}
+	if !public && StrictPublicCheck {
+		return false, &PrivateBucketError{Bucket: bucket}
+	}
+	return public, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadToPublicBucket(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	first := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	second := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	assert.Nil(t, first.Public)
+	assert.Nil(t, second.Public)
+	assert.Equal(t, 1, store.publicChecks, "The bucket's access should be cached")
+}
+
+func TestUploadToPrivateBucketWarns(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.private = map[string]bool{testBucket: true}
+	r := setupRouter(false)
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	if assert.NotNil(t, response.Public) {
+		assert.False(t, *response.Public)
+	}
+	assert.Equal(t, []string{"private_bucket"}, warningCodes(response))
+	assert.True(t, store.exists(testBucket, objectKey(testBucket, response.URL)))
+}
+
+func TestUploadToPrivateBucketStrict(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.private = map[string]bool{testBucket: true}
+	StrictPublicCheck = true
+	t.Cleanup(func() { StrictPublicCheck = false })
+	r := setupRouter(false)
+
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+
+	assert.Equal(t, 422, w.Code)
+	assert.Contains(t, w.Body.String(), "bucket_not_public")
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestUploadSignedURLSkipsPublicCheck(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.private = map[string]bool{testBucket: true}
+	StrictPublicCheck = true
+	t.Cleanup(func() { StrictPublicCheck = false })
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.SignedURL = true
+	response := uploadTestImage(t, r, request)
+
+	assert.Nil(t, response.Public)
+	assert.Contains(t, response.SignedURL, "https://signed.example/"+testBucket+"/")
+	assert.Zero(t, store.publicChecks)
+}
+
+func TestBucketAccessRefreshed(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	ctx := context.Background()
+
+	public, err := checkPublicBucket(ctx, testBucket)
+	assert.Nil(t, err)
+	assert.True(t, public)
+
+	// A bucket made private isn't noticed until the check expires
+	store.private = map[string]bool{testBucket: true}
+	public, _ = checkPublicBucket(ctx, testBucket)
+	assert.True(t, public)
+
+	PublicCheckInterval = time.Nanosecond
+	t.Cleanup(func() { PublicCheckInterval = 10 * time.Minute })
+	public, _ = checkPublicBucket(ctx, testBucket)
+	assert.False(t, public)
+	assert.Equal(t, 2, store.publicChecks)
+}
+
+func TestBucketAccessUnknown(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.err = assert.AnError
+	StrictPublicCheck = true
+	t.Cleanup(func() { StrictPublicCheck = false })
+
+	// Failures are given the benefit of the doubt, and not cached
+	public, err := checkPublicBucket(context.Background(), testBucket)
+	assert.Nil(t, err)
+	assert.True(t, public)
+	assert.Empty(t, publicAccess.checked)
+}
+
+func TestPreparePublicCheck(t *testing.T) {
+	t.Setenv("STRICT_PUBLIC_CHECK", "true")
+	t.Setenv("PUBLIC_CHECK_INTERVAL", "1m")
+	t.Cleanup(func() {
+		StrictPublicCheck, PublicCheckInterval = false, 10*time.Minute
+	})
+	assert.Nil(t, preparePublicCheck())
+	assert.True(t, StrictPublicCheck)
+	assert.Equal(t, time.Minute, PublicCheckInterval)
+
+	t.Setenv("PUBLIC_CHECK_INTERVAL", "0s")
+	assert.NotNil(t, preparePublicCheck())
+}
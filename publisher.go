@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// A Publisher sends messages to the background workers.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) error
+
+	// Returns an error if the topic doesn't exist or can't be accessed
+	CheckTopic(ctx context.Context, topic string) error
+}
+
+// MessagePublisher is the Publisher used by the handlers.
+var MessagePublisher Publisher = pubsubPublisher{}
+
+// pubsubPublisher publishes messages to Google Cloud Pub/Sub.
+type pubsubPublisher struct{}
+
+func (pubsubPublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) error {
+	client, err := pubsub.NewClient(ctx, ProjectID)
+	if err != nil {
+		return fmt.Errorf("pubsub.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	res := client.Topic(topic).Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes})
+	if _, err := res.Get(ctx); err != nil {
+		return fmt.Errorf("Publish.Get: %v", err)
+	}
+	return nil
+}
+
+func (pubsubPublisher) CheckTopic(ctx context.Context, topic string) error {
+	client, err := pubsub.NewClient(ctx, ProjectID)
+	if err != nil {
+		return fmt.Errorf("pubsub.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	exists, err := client.Topic(topic).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("Topic.Exists: %v", err)
+	}
+	if !exists {
+		return fmt.Errorf("topic %v does not exist", topic)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PushAuth verifies the identity tokens Pub/Sub attaches to push deliveries.
+// It's nil unless PUBSUB_PUSH_AUDIENCE is set, and until it is, deliveries
+// are refused so they stay queued.
+var PushAuth *oidcVerifier
+
+// Deliveries of a message already handled within this window are
+// acknowledged without deleting anything again.
+const pushDedupeWindow = 10 * time.Minute
+
+// recentPushes holds the IDs of the messages handled within the dedupe window.
+var recentPushes = newRecentSet(pushDedupeWindow)
+
+// Reads PUBSUB_PUSH_AUDIENCE, the audience the push subscriptions' tokens are
+// minted for, and PUBSUB_PUSH_SERVICE_ACCOUNTS, the comma-separated accounts
+// they're minted as.
+func preparePubSubPush() error {
+	PushAuth = nil
+	audience := os.Getenv("PUBSUB_PUSH_AUDIENCE")
+	if audience == "" {
+		return nil
+	}
+	var accounts []string
+	for _, account := range strings.Split(os.Getenv("PUBSUB_PUSH_SERVICE_ACCOUNTS"), ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			accounts = append(accounts, account)
+		}
+	}
+	if len(accounts) == 0 {
+		return errors.New("PUBSUB_PUSH_AUDIENCE requires PUBSUB_PUSH_SERVICE_ACCOUNTS")
+	}
+	PushAuth = newOIDCVerifier(newJWKSCache(googleCertsURL), audience, accounts)
+	return nil
+}
+
+// A PushEnvelope is the body Pub/Sub posts to push endpoints. The message's
+// data is base64-encoded, which encoding/json decodes into a []byte.
+type PushEnvelope struct {
+	Message struct {
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// A DeleteMessage is what the delete topics carried before messages were
+// enveloped: an object's key, for delete-single-faceclaim, or a charid, for
+// delete-faceclaim-group. Journals and subscriptions may still hold them.
+type DeleteMessage struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	CharID string `json:"charid"`
+}
+
+// Returns the character the message deletes from.
+func (m DeleteMessage) charid() string {
+	if m.CharID != "" {
+		return m.CharID
+	}
+	charid, _, _ := strings.Cut(m.Key, "/")
+	return charid
+}
+
+// Returns the typed message a legacy one stands for.
+func (m DeleteMessage) message() (Message, error) {
+	switch {
+	case m.Key != "":
+		return DeleteSingle{Bucket: m.Bucket, Key: m.Key}, nil
+	case m.CharID != "":
+		return DeleteGroup{Bucket: m.Bucket, CharID: m.CharID}, nil
+	}
+	return nil, &invalidDeleteError{"the message names neither a key nor a charid"}
+}
+
+// Handles a push delivery from the delete topics' subscriptions. A 2xx
+// acknowledges the message; anything else has Pub/Sub redeliver it. Messages
+// that can never succeed, like ones naming invalid objects, are acknowledged
+// and logged rather than redelivered forever. Deleting is idempotent, so
+// duplicate deliveries are harmless, and recent ones are skipped outright.
+func handleDeletePush(c *gin.Context) {
+	if PushAuth == nil {
+		abortWith(c, http.StatusServiceUnavailable, gin.H{"error": "Push deliveries aren't configured"})
+		return
+	}
+	header := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header {
+		abortWith(c, http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if _, err := PushAuth.scopes(c.Request.Context(), token); err != nil {
+		log.Println("Rejected push delivery:", err)
+		abortWith(c, http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var envelope PushEnvelope
+	if err := c.ShouldBindJSON(&envelope); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id := envelope.Message.MessageID
+	if id == "" {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "message.messageId is required"})
+		return
+	}
+	if !recentPushes.add(id) {
+		respond(c, http.StatusOK, gin.H{"message_id": id, "status": "duplicate"})
+		return
+	}
+
+	var deleted int
+	message, err := decodeMessage(envelope.Message.Data)
+	if err == nil {
+		bucket, charid := message.target()
+		tagRequest(c, "bucket", bucket)
+		tagRequest(c, "charid", charid)
+		deleted, err = applyMessage(c.Request.Context(), message)
+	}
+	var invalid *invalidDeleteError
+	if errors.As(err, &invalid) {
+		log.Printf("Discarding push message %v: %v\n", id, err)
+		respond(c, http.StatusOK, gin.H{"message_id": id, "status": "discarded", "error": err.Error()})
+		return
+	}
+	var unsupported *unsupportedMessageError
+	if errors.As(err, &unsupported) {
+		// Left for a consumer that understands it
+		log.Printf("Can't handle push message %v: %v\n", id, err)
+		recentPushes.remove(id)
+		abortWith(c, http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": "unsupported_message"})
+		return
+	}
+	if err != nil {
+		// Let a redelivery try again
+		recentPushes.remove(id)
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"message_id": id, "status": "deleted", "deleted": deleted})
+}
+
+// An invalidDeleteError means a delete message can't be carried out, however
+// many times it's delivered.
+type invalidDeleteError struct {
+	reason string
+}
+
+func (e *invalidDeleteError) Error() string {
+	return e.reason
+}
+
+// Deletes the object a DeleteSingle names, returning 1, or 0 if it's held.
+// Objects already gone count as deleted.
+func applyDeleteSingle(ctx context.Context, message DeleteSingle) (int, error) {
+	if err := validateBucket(message.Bucket); err != nil {
+		return 0, &invalidDeleteError{err.Error()}
+	}
+	charid, key, _ := strings.Cut(message.Key, "/")
+	if err := validateCharID(charid); err != nil {
+		return 0, &invalidDeleteError{err.Error()}
+	}
+	if err := validateKey(key); err != nil {
+		return 0, &invalidDeleteError{err.Error()}
+	}
+	if attrs, err := getObjectAttrs(ctx, message.Bucket, message.Key); err == nil && isHeld(attrs) {
+		log.Println("Not deleting", message.Key, "from", message.Bucket, "because it's held")
+		return 0, nil
+	}
+	if err := deleteObject(ctx, message.Bucket, message.Key); err != nil {
+		return 0, fmt.Errorf("applyDeleteSingle: %w", err)
+	}
+	guildUsage.invalidate(message.Bucket)
+	return 1, nil
+}
+
+// Deletes a character's objects, except held ones, returning how many were
+// deleted.
+func applyDeleteGroup(ctx context.Context, message DeleteGroup) (int, error) {
+	if err := validateBucket(message.Bucket); err != nil {
+		return 0, &invalidDeleteError{err.Error()}
+	}
+	if err := validateCharID(message.CharID); err != nil {
+		return 0, &invalidDeleteError{err.Error()}
+	}
+	// Uploads wait until the character's objects are gone
+	deletionLocks.acquire(message.Bucket, message.CharID)
+	defer deletionLocks.release(message.Bucket, message.CharID)
+	objects, err := Store.List(ctx, message.Bucket, message.CharID+"/")
+	if err != nil {
+		return 0, fmt.Errorf("applyDeleteGroup: %w", err)
+	}
+	deleted := 0
+	for _, attrs := range objects {
+		if isHeld(attrs) {
+			log.Println("Not deleting", attrs.Name, "from", message.Bucket, "because it's held")
+			continue
+		}
+		if err := deleteObject(ctx, message.Bucket, attrs.Name); err != nil {
+			return 0, fmt.Errorf("applyDeleteGroup: %w", err)
+		}
+		deleted++
+	}
+	guildUsage.invalidate(message.Bucket)
+	return deleted, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Accept push deliveries signed with the key instead of Google's
+func usePushAuth(t *testing.T) *rsa.PrivateKey {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server, _ := serveJWKS(key)
+	PushAuth = newOIDCVerifier(newJWKSCache(server.URL), testServiceURL, []string{testBotAccount})
+	t.Cleanup(func() {
+		server.Close()
+		PushAuth = nil
+	})
+	return key
+}
+
+// Deliver a message the way a push subscription would
+func pushMessage(r http.Handler, token, id string, message interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(message)
+	var envelope PushEnvelope
+	envelope.Message.Data = data
+	envelope.Message.MessageID = id
+	envelope.Subscription = "projects/inconnu/subscriptions/delete-single-faceclaim-push"
+	body, _ := json.Marshal(envelope)
+
+	req, _ := http.NewRequest("POST", "/internal/pubsub/push", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPushDeletesObject(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	key := usePushAuth(t)
+	router := setupRouter(false)
+	for _, name := range []string{"__test/abc.webp", "__test/abc_256.webp", "__test/abc.orig.png"} {
+		store.Upload(context.Background(), testBucket, name, strings.NewReader("x"), UploadOptions{})
+	}
+	token := signRS256(key, "key-1", identityClaims(testBotAccount))
+
+	// Kept originals and variants are deleted by their own messages
+	for i, name := range []string{"__test/abc.webp", "__test/abc_256.webp", "__test/abc.orig.png"} {
+		w := pushMessage(router, token, string(rune('a'+i)), DeleteMessage{Bucket: testBucket, Key: name})
+		assert.Equal(t, http.StatusOK, w.Code, name)
+		assert.Contains(t, w.Body.String(), `"status":"deleted"`, name)
+		assert.False(t, store.exists(testBucket, name), name)
+	}
+
+	// Deleting an object that's already gone still acknowledges the message
+	w := pushMessage(router, token, "d", DeleteMessage{Bucket: testBucket, Key: "__test/abc.webp"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestPushDeletesGroup(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	key := usePushAuth(t)
+	router := setupRouter(false)
+	for _, name := range []string{"__test/a.webp", "__test/b.webp", "other/c.webp"} {
+		store.Upload(context.Background(), testBucket, name, strings.NewReader("x"), UploadOptions{})
+	}
+	token := signRS256(key, "key-1", identityClaims(testBotAccount))
+
+	w := pushMessage(router, token, "1", DeleteMessage{Bucket: testBucket, CharID: "__test"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"deleted":2`)
+	assert.Equal(t, []string{"other/c.webp"}, store.keys(testBucket))
+}
+
+func TestPushRejectsBadTokens(t *testing.T) {
+	useFakeBackends(t)
+	key := usePushAuth(t)
+	router := setupRouter(false)
+	message := DeleteMessage{Bucket: testBucket, Key: "__test/abc.webp"}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for name, token := range map[string]string{
+		"wrong key":     signRS256(other, "key-1", identityClaims(testBotAccount)),
+		"wrong account": signRS256(key, "key-1", identityClaims("someone@example.com")),
+		"missing":       "",
+	} {
+		w := pushMessage(router, token, "1", message)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+	}
+}
+
+func TestPushUnconfigured(t *testing.T) {
+	useFakeBackends(t)
+	router := setupRouter(false)
+
+	w := pushMessage(router, "token", "1", DeleteMessage{Bucket: testBucket, Key: "__test/abc.webp"})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestPushDuplicateDelivery(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	key := usePushAuth(t)
+	router := setupRouter(false)
+	token := signRS256(key, "key-1", identityClaims(testBotAccount))
+	message := DeleteMessage{Bucket: testBucket, Key: "__test/abc.webp"}
+
+	assert.Equal(t, http.StatusOK, pushMessage(router, token, "1", message).Code)
+
+	// Even if storage is failing, a redelivery is acknowledged without
+	// trying again
+	store.err = errors.New("storage is down")
+	w := pushMessage(router, token, "1", message)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"duplicate"`)
+}
+
+func TestPushStorageFailure(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	key := usePushAuth(t)
+	router := setupRouter(false)
+	token := signRS256(key, "key-1", identityClaims(testBotAccount))
+	message := DeleteMessage{Bucket: testBucket, Key: "__test/abc.webp"}
+
+	store.err = errors.New("storage is down")
+	assert.Equal(t, http.StatusInternalServerError, pushMessage(router, token, "1", message).Code)
+
+	// The failed delivery isn't remembered, so its redelivery is retried
+	store.err = nil
+	w := pushMessage(router, token, "1", message)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"deleted"`)
+}
+
+func TestPushDiscardsInvalidMessages(t *testing.T) {
+	useFakeBackends(t)
+	key := usePushAuth(t)
+	router := setupRouter(false)
+	token := signRS256(key, "key-1", identityClaims(testBotAccount))
+
+	for i, message := range []interface{}{
+		"not an object",
+		DeleteMessage{Bucket: testBucket},
+		DeleteMessage{Bucket: testBucket, Key: "__test/../secret"},
+		DeleteMessage{Bucket: "Not A Bucket", Key: "__test/abc.webp"},
+	} {
+		w := pushMessage(router, token, string(rune('a'+i)), message)
+		assert.Equal(t, http.StatusOK, w.Code, message)
+		assert.Contains(t, w.Body.String(), `"status":"discarded"`, message)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2/google"
+)
+
+// DeleteSubscriptions are the Pub/Sub subscriptions that consume deletions,
+// whose backlogs are reported. Read from DELETE_SUBSCRIPTIONS.
+var DeleteSubscriptions []string
+
+// DeleteBacklogMax and DeleteBacklogMaxAge make /readyz report that the
+// server isn't ready when a delete subscription has more undelivered messages,
+// or an older one, than they allow. Zero disables each. Read from
+// DELETE_BACKLOG_MAX and DELETE_BACKLOG_MAX_AGE.
+var (
+	DeleteBacklogMax    int64
+	DeleteBacklogMaxAge time.Duration
+)
+
+// How long subscription stats are reused before they're fetched again. Cloud
+// Monitoring only samples them once a minute.
+const queueStatsTTL = 30 * time.Second
+
+// Reads DELETE_SUBSCRIPTIONS, DELETE_BACKLOG_MAX, and DELETE_BACKLOG_MAX_AGE.
+func prepareQueueStatus() error {
+	DeleteSubscriptions, DeleteBacklogMax, DeleteBacklogMaxAge = nil, 0, 0
+	for _, subscription := range strings.Split(os.Getenv("DELETE_SUBSCRIPTIONS"), ",") {
+		if subscription = strings.TrimSpace(subscription); subscription != "" {
+			DeleteSubscriptions = append(DeleteSubscriptions, subscription)
+		}
+	}
+	if value, ok := os.LookupEnv("DELETE_BACKLOG_MAX"); ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return errors.New("DELETE_BACKLOG_MAX must be a non-negative integer")
+		}
+		DeleteBacklogMax = n
+	}
+	if value, ok := os.LookupEnv("DELETE_BACKLOG_MAX_AGE"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return errors.New("DELETE_BACKLOG_MAX_AGE must be a duration, e.g. \"5m\"")
+		}
+		DeleteBacklogMaxAge = d
+	}
+	queueStatus = newQueueStatusCache()
+	return nil
+}
+
+// A SubscriptionBacklog is how far behind a delete subscription's consumer is.
+type SubscriptionBacklog struct {
+	Subscription string `json:"subscription"`
+	Undelivered  int64  `json:"undelivered"`
+
+	// The age of the oldest unacknowledged message, in seconds
+	OldestUnacked int64 `json:"oldest_unacked_seconds"`
+
+	// Set, and the counts left at zero, if the stats couldn't be fetched
+	Error string `json:"error,omitempty"`
+}
+
+// A QueueStatsSource reports a subscription's backlog.
+type QueueStatsSource interface {
+	Backlog(ctx context.Context, subscription string) (SubscriptionBacklog, error)
+}
+
+// QueueStats is where subscription backlogs are read from.
+var QueueStats QueueStatsSource = &monitoringQueueStats{}
+
+// A QueueStatus is the response body for /admin/queue-status.
+type QueueStatus struct {
+	Subscriptions []SubscriptionBacklog `json:"subscriptions"`
+	Journal       JournalStatus         `json:"journal"`
+
+	// Whether a backlog is over DELETE_BACKLOG_MAX or DELETE_BACKLOG_MAX_AGE
+	Backlogged bool      `json:"backlogged"`
+	Checked    time.Time `json:"checked"`
+}
+
+// A JournalStatus describes the local delete journal, which holds deletions
+// that couldn't be published.
+type JournalStatus struct {
+	Enabled  bool `json:"enabled"`
+	Depth    int  `json:"depth"`
+	Capacity int  `json:"capacity"`
+}
+
+// Reports whether a backlog is over the configured thresholds.
+func (b SubscriptionBacklog) backlogged() bool {
+	return DeleteBacklogMax > 0 && b.Undelivered > DeleteBacklogMax ||
+		DeleteBacklogMaxAge > 0 && time.Duration(b.OldestUnacked)*time.Second > DeleteBacklogMaxAge
+}
+
+// Caches the subscriptions' backlogs for queueStatsTTL, so probes and
+// dashboards don't each query Cloud Monitoring.
+type queueStatusCache struct {
+	sync.Mutex
+	backlogs []SubscriptionBacklog
+	checked  time.Time
+}
+
+func newQueueStatusCache() *queueStatusCache {
+	return &queueStatusCache{}
+}
+
+var queueStatus = newQueueStatusCache()
+
+// Returns the delete pipeline's status, fetching the subscriptions' backlogs
+// if the cached ones are stale. A subscription whose stats can't be fetched is
+// reported with the error, and doesn't count as backlogged.
+func (q *queueStatusCache) get(ctx context.Context) QueueStatus {
+	q.Lock()
+	defer q.Unlock()
+	if q.backlogs == nil || time.Since(q.checked) > queueStatsTTL {
+		q.backlogs = make([]SubscriptionBacklog, 0, len(DeleteSubscriptions))
+		for _, subscription := range DeleteSubscriptions {
+			backlog, err := QueueStats.Backlog(ctx, subscription)
+			if err != nil {
+				log.Printf("Unable to check %v's backlog: %v\n", subscription, err)
+				backlog = SubscriptionBacklog{Subscription: subscription, Error: err.Error()}
+			} else {
+				setDeleteBacklog(backlog.Subscription, backlog.Undelivered, backlog.OldestUnacked)
+			}
+			q.backlogs = append(q.backlogs, backlog)
+		}
+		q.checked = time.Now()
+	}
+
+	status := QueueStatus{
+		Subscriptions: append([]SubscriptionBacklog(nil), q.backlogs...),
+		Journal:       JournalStatus{Enabled: deleteJournal != nil, Capacity: DeleteJournalSize},
+		Checked:       q.checked,
+	}
+	if deleteJournal != nil {
+		status.Journal.Depth = deleteJournal.len()
+	}
+	for _, backlog := range status.Subscriptions {
+		status.Backlogged = status.Backlogged || backlog.backlogged()
+	}
+	return status
+}
+
+// Reports the async delete pipeline's backlog: each delete subscription's
+// undelivered messages and the age of its oldest, and the local journal's
+// depth.
+func getQueueStatus(c *gin.Context) {
+	respond(c, http.StatusOK, queueStatus.get(c.Request.Context()))
+}
+
+// Checks the delete subscriptions' backlogs every queueStatsTTL until the
+// context is cancelled, so the metrics stay current.
+func watchQueueStatus(ctx context.Context) {
+	ticker := time.NewTicker(queueStatsTTL)
+	defer ticker.Stop()
+	for {
+		queueStatus.get(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reports whether readiness depends on the delete backlog.
+func backlogChecked() bool {
+	return len(DeleteSubscriptions) > 0 && (DeleteBacklogMax > 0 || DeleteBacklogMaxAge > 0)
+}
+
+// monitoringQueueStats reads subscription stats from the Cloud Monitoring
+// API. The HTTP client is created on first use, so a deployment that doesn't
+// report backlogs never needs Monitoring credentials.
+type monitoringQueueStats struct {
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+const monitoringTimeSeriesURL = "https://monitoring.googleapis.com/v3/projects/%v/timeSeries"
+
+func (m *monitoringQueueStats) Backlog(ctx context.Context, subscription string) (SubscriptionBacklog, error) {
+	m.once.Do(func() {
+		m.client, m.err = google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/monitoring.read")
+	})
+	if m.err != nil {
+		return SubscriptionBacklog{}, fmt.Errorf("google.DefaultClient: %v", m.err)
+	}
+
+	backlog := SubscriptionBacklog{Subscription: subscription}
+	undelivered, err := m.latest(ctx, "num_undelivered_messages", subscription)
+	if err != nil {
+		return SubscriptionBacklog{}, err
+	}
+	oldest, err := m.latest(ctx, "oldest_unacked_message_age", subscription)
+	if err != nil {
+		return SubscriptionBacklog{}, err
+	}
+	backlog.Undelivered, backlog.OldestUnacked = undelivered, oldest
+	return backlog, nil
+}
+
+// Returns a subscription metric's latest value from the last five minutes,
+// or 0 if there isn't one, as there isn't for idle subscriptions.
+func (m *monitoringQueueStats) latest(ctx context.Context, metric, subscription string) (int64, error) {
+	now := time.Now().UTC()
+	query := url.Values{
+		"filter": {fmt.Sprintf(`metric.type = "pubsub.googleapis.com/subscription/%v" AND resource.labels.subscription_id = "%v"`,
+			metric, subscription)},
+		"interval.startTime": {now.Add(-5 * time.Minute).Format(time.RFC3339)},
+		"interval.endTime":   {now.Format(time.RFC3339)},
+	}
+	endpoint := fmt.Sprintf(monitoringTimeSeriesURL, ProjectID) + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, fmt.Errorf("http.NewRequest: %v", err)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("monitoring: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("monitoring: unexpected status %v", resp.Status)
+	}
+
+	// Points come newest first
+	var result struct {
+		TimeSeries []struct {
+			Points []struct {
+				Value struct {
+					Int64Value string `json:"int64Value"`
+				} `json:"value"`
+			} `json:"points"`
+		} `json:"timeSeries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("json.Decode: %v", err)
+	}
+	if len(result.TimeSeries) == 0 || len(result.TimeSeries[0].Points) == 0 {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(result.TimeSeries[0].Points[0].Value.Int64Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("monitoring: %v", err)
+	}
+	return value, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeQueueStats reports fixed backlogs, counting how often it's asked
+type fakeQueueStats struct {
+	backlogs map[string]SubscriptionBacklog
+	calls    int32
+}
+
+func (f *fakeQueueStats) Backlog(ctx context.Context, subscription string) (SubscriptionBacklog, error) {
+	atomic.AddInt32(&f.calls, 1)
+	backlog, ok := f.backlogs[subscription]
+	if !ok {
+		return SubscriptionBacklog{}, errors.New("fakeQueueStats: no such subscription")
+	}
+	backlog.Subscription = subscription
+	return backlog, nil
+}
+
+// Report the given backlogs for the duration of a test, with the thresholds
+// given
+func useQueueStats(t *testing.T, max int64, backlogs map[string]SubscriptionBacklog) *fakeQueueStats {
+	stats := &fakeQueueStats{backlogs: backlogs}
+	QueueStats, queueStatus = stats, newQueueStatusCache()
+	DeleteSubscriptions = nil
+	for subscription := range backlogs {
+		DeleteSubscriptions = append(DeleteSubscriptions, subscription)
+	}
+	DeleteBacklogMax = max
+	t.Cleanup(func() {
+		QueueStats, queueStatus = &monitoringQueueStats{}, newQueueStatusCache()
+		DeleteSubscriptions, DeleteBacklogMax, DeleteBacklogMaxAge = nil, 0, 0
+	})
+	return stats
+}
+
+func TestQueueStatus(t *testing.T) {
+	useFakeBackends(t)
+	useDeleteJournal(t, 10)
+	stats := useQueueStats(t, 0, map[string]SubscriptionBacklog{
+		"delete-single-faceclaim-sub": {Undelivered: 12, OldestUnacked: 90},
+	})
+	r := setupRouter(false)
+
+	w := performRequest(r, "GET", "/admin/queue-status", nil)
+	assert.Equal(t, 200, w.Code)
+	var status QueueStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	assert.Equal(t, []SubscriptionBacklog{
+		{Subscription: "delete-single-faceclaim-sub", Undelivered: 12, OldestUnacked: 90},
+	}, status.Subscriptions)
+	assert.Equal(t, JournalStatus{Enabled: true, Depth: 0, Capacity: DeleteJournalSize}, status.Journal)
+	assert.False(t, status.Backlogged, "No threshold is set")
+	assert.Equal(t, float64(12), testutil.ToFloat64(deleteBacklogMessages.WithLabelValues("delete-single-faceclaim-sub")))
+	assert.Equal(t, float64(90), testutil.ToFloat64(deleteBacklogOldestSeconds.WithLabelValues("delete-single-faceclaim-sub")))
+
+	// The stats are cached
+	performRequest(r, "GET", "/admin/queue-status", nil)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stats.calls))
+}
+
+func TestQueueStatusSourceFails(t *testing.T) {
+	useFakeBackends(t)
+	useQueueStats(t, 5, map[string]SubscriptionBacklog{})
+	DeleteSubscriptions = []string{"missing-sub"}
+
+	status := queueStatus.get(context.Background())
+	if assert.Len(t, status.Subscriptions, 1) {
+		assert.NotEmpty(t, status.Subscriptions[0].Error)
+	}
+	assert.False(t, status.Backlogged, "Unknown backlogs don't count against readiness")
+	code, _ := getReadyz(t)
+	assert.Equal(t, 200, code)
+}
+
+func TestReadyzDegradesWithBacklog(t *testing.T) {
+	useFakeBackends(t)
+	useQueueStats(t, 100, map[string]SubscriptionBacklog{
+		"delete-faceclaim-group-sub": {Undelivered: 101, OldestUnacked: 30},
+	})
+
+	w := performRequest(setupRouter(false), "GET", "/readyz", nil)
+	assert.Equal(t, 503, w.Code)
+	assert.Contains(t, w.Body.String(), `"delete_backlog"`)
+	assert.Contains(t, w.Body.String(), `"not_ready"`)
+
+	// Under the count, but too old
+	useQueueStats(t, 1000, map[string]SubscriptionBacklog{
+		"delete-faceclaim-group-sub": {Undelivered: 101, OldestUnacked: 600},
+	})
+	code, _ := getReadyz(t)
+	assert.Equal(t, 200, code)
+	DeleteBacklogMaxAge = 5 * time.Minute
+	code, _ = getReadyz(t)
+	assert.Equal(t, 503, code)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// A GuildQuota caps a guild's storage within a bucket. Zero means unlimited.
+type GuildQuota struct {
+	MaxImages int64 `json:"max_images"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+// GuildUsage is a guild's storage within a bucket. Images counts faceclaims,
+// while Bytes includes kept originals and size variants.
+type GuildUsage struct {
+	Images int64 `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// A QuotaError is returned when an upload would exceed a guild's quota.
+type QuotaError struct {
+	Guild string
+	Usage GuildUsage
+	Limit GuildQuota
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("guild %v has reached its storage quota", e.Guild)
+}
+
+// Reads GUILD_MAX_IMAGES, GUILD_MAX_BYTES, and the per-guild overrides in
+// QUOTAS_JSON, e.g. {"123": {"max_images": 500, "max_bytes": 0}}. The
+// default quota applies to guilds without an override.
+func loadQuotas(cfg *Config) error {
+	limits := map[string]*int64{
+		"GUILD_MAX_IMAGES": &cfg.DefaultQuota.MaxImages,
+		"GUILD_MAX_BYTES":  &cfg.DefaultQuota.MaxBytes,
+	}
+	for name, limit := range limits {
+		if value, ok := os.LookupEnv(name); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%v must be a non-negative integer", name)
+			}
+			*limit = n
+		}
+	}
+
+	if raw, ok := os.LookupEnv("QUOTAS_JSON"); ok {
+		quotas := make(map[string]GuildQuota)
+		if err := json.Unmarshal([]byte(raw), &quotas); err != nil {
+			return fmt.Errorf("QUOTAS_JSON: %v", err)
+		}
+		cfg.GuildQuotas = quotas
+	}
+	return nil
+}
+
+// Returns the quota that applies to a guild.
+func quotaFor(guild string) GuildQuota {
+	cfg := currentConfig()
+	if quota, ok := cfg.GuildQuotas[guild]; ok {
+		return quota
+	}
+	return cfg.DefaultQuota
+}
+
+// Usage is tallied per bucket from a full listing, which is expensive, so
+// tallies are cached and adjusted as uploads happen. Deletions are processed
+// in the background, so they invalidate the bucket's tally instead.
+const usageTTL = 10 * time.Minute
+
+var guildUsage = newUsageTally()
+
+// The tally isn't locked while a bucket is listed, so quota checks on other
+// buckets, or on fresh tallies, don't wait on it. Each bucket is listed by one
+// caller at a time, and the others wait for its result.
+type usageTally struct {
+	sync.Mutex
+	buckets  map[string]*bucketUsage
+	listings map[string]*usageListing // Listings in progress, by bucket
+	flights  singleflight.Group
+}
+
+type bucketUsage struct {
+	computed time.Time
+	guilds   map[string]GuildUsage
+}
+
+// A usageListing records what happened to a bucket's usage while it was being
+// listed, so the new tally can catch up.
+type usageListing struct {
+	added       map[string]GuildUsage
+	invalidated bool
+}
+
+func newUsageTally() *usageTally {
+	return &usageTally{
+		buckets:  make(map[string]*bucketUsage),
+		listings: make(map[string]*usageListing),
+	}
+}
+
+// Returns a guild's usage in a bucket, listing the bucket if its tally is
+// missing or stale.
+func (t *usageTally) get(bucket, guild string) (GuildUsage, error) {
+	t.Lock()
+	tally, ok := t.buckets[bucket]
+	t.Unlock()
+
+	if !ok || time.Since(tally.computed) > usageTTL {
+		result, err, _ := t.flights.Do(bucket, func() (interface{}, error) {
+			return t.recount(bucket)
+		})
+		if err != nil {
+			return GuildUsage{}, err
+		}
+		tally = result.(*bucketUsage)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	return tally.guilds[guild], nil
+}
+
+// Lists a bucket and swaps in its new tally, with any usage added during the
+// listing. If the bucket was invalidated meanwhile, the tally is returned but
+// not kept.
+func (t *usageTally) recount(bucket string) (*bucketUsage, error) {
+	listing := &usageListing{added: make(map[string]GuildUsage)}
+	t.Lock()
+	t.listings[bucket] = listing
+	t.Unlock()
+
+	tally, err := computeBucketUsage(bucket)
+
+	t.Lock()
+	defer t.Unlock()
+	delete(t.listings, bucket)
+	if err != nil {
+		return nil, err
+	}
+	for guild, delta := range listing.added {
+		addUsage(tally.guilds, guild, delta)
+	}
+	if !listing.invalidated {
+		t.buckets[bucket] = tally
+	}
+	return tally, nil
+}
+
+// Adds to a guild's usage. Buckets without a tally are left alone; the upload
+// will be counted when the bucket is listed.
+func (t *usageTally) add(bucket, guild string, delta GuildUsage) {
+	t.Lock()
+	defer t.Unlock()
+
+	if tally, ok := t.buckets[bucket]; ok {
+		addUsage(tally.guilds, guild, delta)
+	}
+	if listing, ok := t.listings[bucket]; ok {
+		addUsage(listing.added, guild, delta)
+	}
+}
+
+// Adds to a guild's entry in a map of usage.
+func addUsage(guilds map[string]GuildUsage, guild string, delta GuildUsage) {
+	usage := guilds[guild]
+	usage.Images += delta.Images
+	usage.Bytes += delta.Bytes
+	guilds[guild] = usage
+}
+
+// Discards a bucket's tally, forcing a recount on next use.
+func (t *usageTally) invalidate(bucket string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.buckets, bucket)
+	if listing, ok := t.listings[bucket]; ok {
+		listing.invalidated = true
+	}
+}
+
+// Lists a bucket and tallies usage by each object's "guild" metadata.
+func computeBucketUsage(bucket string) (*bucketUsage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	objects, err := Store.List(ctx, bucket, "")
+	if err != nil {
+		return nil, fmt.Errorf("computeBucketUsage: %v", err)
+	}
+
+	tally := &bucketUsage{computed: time.Now(), guilds: make(map[string]GuildUsage)}
+	for _, attrs := range objects {
+		guild, ok := attrs.Metadata["guild"]
+		if !ok {
+			continue
+		}
+		usage := tally.guilds[guild]
+		usage.Bytes += attrs.Size
+		if isFaceclaim(attrs) {
+			usage.Images++
+		}
+		tally.guilds[guild] = usage
+	}
+	return tally, nil
+}
+
+// Whether an object is a faceclaim itself rather than a kept original or a
+// size variant.
+func isFaceclaim(attrs *storage.ObjectAttrs) bool {
+	return attrs.Metadata["variant"] == "" && !strings.Contains(attrs.Name, ".orig.")
+}
+
+// Checks whether a guild can store another image of the given size in the
+// bucket. When the guild has no quota, the bucket isn't listed at all.
+func checkQuota(bucket, guild string, size int64) error {
+	quota := quotaFor(guild)
+	if quota.MaxImages == 0 && quota.MaxBytes == 0 {
+		return nil
+	}
+
+	usage, err := guildUsage.get(bucket, guild)
+	if err != nil {
+		return err
+	}
+	if quota.MaxImages > 0 && usage.Images+1 > quota.MaxImages ||
+		quota.MaxBytes > 0 && usage.Bytes+size > quota.MaxBytes {
+		return &QuotaError{Guild: guild, Usage: usage, Limit: quota}
+	}
+	return nil
+}
+
+// Returns a guild's usage in a bucket alongside its quota.
+func getGuildUsage(c *gin.Context) {
+	bucket := c.Param("bucket")
+	guild := c.Param("guild")
+
+	usage, err := guildUsage.get(bucket, guild)
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{
+		"guild":  guild,
+		"bucket": bucket,
+		"usage":  usage,
+		"limit":  quotaFor(guild),
+	})
+}
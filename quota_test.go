@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Apply a default quota for the duration of a test
+func useQuota(t *testing.T, quota GuildQuota) {
+	useConfig(t, func(cfg *Config) { cfg.DefaultQuota = quota })
+}
+
+func TestQuotaRejectsUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useQuota(t, GuildQuota{MaxImages: 2})
+	r := setupRouter(false)
+
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+
+	assert.Equal(t, 429, w.Code)
+	assert.Len(t, store.keys(testBucket), 2)
+
+	var response struct {
+		Usage GuildUsage `json:"usage"`
+		Limit GuildQuota `json:"limit"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, int64(2), response.Usage.Images)
+	assert.Equal(t, int64(2), response.Limit.MaxImages)
+}
+
+func TestQuotaCountsExistingObjects(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	// Uploaded before any quota applied, so the tally must come from a listing
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	request.Variants = []string{"16"}
+	uploadTestImage(t, r, request)
+
+	guild := fmt.Sprint(request.Guild)
+	path := fmt.Sprintf("/faceclaim/usage/%v/%v", testBucket, guild)
+	w := performRequest(r, "GET", path, nil)
+	assert.Equal(t, 200, w.Code)
+
+	var response struct {
+		Usage GuildUsage `json:"usage"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, int64(1), response.Usage.Images, "Originals and variants shouldn't count as images")
+	assert.Positive(t, response.Usage.Bytes)
+
+	useQuota(t, GuildQuota{MaxBytes: response.Usage.Bytes})
+	assert.IsType(t, &QuotaError{}, checkQuota(testBucket, guild, 1))
+	assert.Nil(t, checkQuota(testBucket, "another guild", 1))
+}
+
+func TestUsageListingDoesNotBlockOthers(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	ctx := context.Background()
+	for _, bucket := range []string{testBucket, "other.inconnu.app"} {
+		store.Upload(ctx, bucket, "1/a.webp", strings.NewReader("webp"), UploadOptions{
+			ContentType: "image/webp",
+			Metadata:    map[string]string{"guild": "123"},
+		})
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	store.beforeList = func(bucket string) {
+		if bucket == testBucket {
+			close(started)
+			<-release
+		}
+	}
+
+	// Two quota checks wait on the slow bucket's listing...
+	usages := make([]GuildUsage, 2)
+	var wg sync.WaitGroup
+	for i := range usages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			usage, err := guildUsage.get(testBucket, "123")
+			assert.NoError(t, err)
+			usages[i] = usage
+		}(i)
+	}
+	<-started
+
+	// ...while another bucket is tallied regardless
+	usage, err := guildUsage.get("other.inconnu.app", "123")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Images)
+
+	// An upload made during the listing is added to the new tally
+	guildUsage.add(testBucket, "123", GuildUsage{Images: 1, Bytes: 4})
+	close(release)
+	wg.Wait()
+	for _, usage := range usages {
+		assert.Equal(t, GuildUsage{Images: 2, Bytes: 8}, usage)
+	}
+	assert.Equal(t, 2, store.lists, "Each bucket is only listed once")
+}
+
+func TestUsageInvalidatedDuringListing(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	store.beforeList = func(bucket string) {
+		if store.lists == 0 {
+			close(started)
+			<-release
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		guildUsage.get(testBucket, "123")
+	}()
+	<-started
+	guildUsage.invalidate(testBucket)
+	close(release)
+	<-done
+
+	// The listing may have missed the change, so its tally isn't kept
+	guildUsage.get(testBucket, "123")
+	assert.Equal(t, 2, store.lists)
+}
+
+func TestQuotaDisabledSkipsListing(t *testing.T) {
+	oldStore := Store
+	Store = nil // Listing would panic
+	defer func() { Store = oldStore }()
+
+	assert.Nil(t, checkQuota(testBucket, "123", 1<<30))
+}
+
+func TestLoadQuotas(t *testing.T) {
+	defer os.Unsetenv("GUILD_MAX_IMAGES")
+	defer os.Unsetenv("QUOTAS_JSON")
+
+	os.Setenv("GUILD_MAX_IMAGES", "100")
+	os.Setenv("QUOTAS_JSON", `{"42": {"max_images": 500, "max_bytes": 1048576}}`)
+	useConfig(t, func(cfg *Config) {
+		assert.Nil(t, loadQuotas(cfg))
+	})
+	assert.Equal(t, GuildQuota{MaxImages: 100}, quotaFor("1"))
+	assert.Equal(t, GuildQuota{MaxImages: 500, MaxBytes: 1048576}, quotaFor("42"))
+
+	os.Setenv("GUILD_MAX_IMAGES", "-1")
+	assert.NotNil(t, loadQuotas(newConfig()))
+
+	os.Unsetenv("GUILD_MAX_IMAGES")
+	os.Setenv("QUOTAS_JSON", "nope")
+	assert.NotNil(t, loadQuotas(newConfig()))
+}
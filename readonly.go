@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// While in read-only mode, requests that would modify storage are refused, as
+// in maintenance mode, but it's meant to last through an outage: clients are
+// told the service is read-only rather than to retry, and reads stay up.
+var readOnlyMode atomic.Bool
+
+// Routes that take a body but don't modify storage, or that manage the
+// service itself, which read-only mode lets through.
+var readOnlyRoutes = map[string]bool{
+	"/faceclaim/inspect": true,
+	"/faceclaim/audit":   true,
+	"/admin/read-only":   true,
+	"/admin/maintenance": true,
+	"/admin/reload":      true,
+	"/admin/debug-dump":  true,
+}
+
+// Reads READ_ONLY, which starts the service in read-only mode.
+func prepareReadOnly() error {
+	enabled := false
+	if value, ok := os.LookupEnv("READ_ONLY"); ok {
+		var err error
+		if enabled, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("READ_ONLY: %v", err)
+		}
+	}
+	readOnlyMode.Store(enabled)
+	return nil
+}
+
+// ReadOnly refuses POST, PUT, PATCH, and DELETE requests with a 503 while
+// read-only mode is on, save for those to readOnlyRoutes.
+func ReadOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !readOnlyMode.Load() || readOnlyRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			abortWith(c, http.StatusServiceUnavailable, gin.H{
+				"error": "The service is read-only for now. Faceclaims and logs can be read but not changed.",
+				"code":  "read_only",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// A ReadOnlyRequest is the POST body for /admin/read-only.
+type ReadOnlyRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// Turns read-only mode on or off.
+func setReadOnly(c *gin.Context) {
+	var request ReadOnlyRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	readOnlyMode.Store(*request.Enabled)
+	respond(c, http.StatusOK, gin.H{"read_only": *request.Enabled})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Flip read-only mode through the admin route
+func setReadOnlyMode(t *testing.T, r http.Handler, enabled bool) {
+	body := bytes.NewBufferString(fmt.Sprintf(`{"enabled": %v}`, enabled))
+	w := performRequest(r, "POST", "/admin/read-only", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	t.Cleanup(func() { readOnlyMode.Store(false) })
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	key := objectKey(testBucket, response.URL)
+
+	setReadOnlyMode(t, r, true)
+
+	w := performRequest(r, "GET", "/healthz", nil)
+	assert.JSONEq(t, `{"status": "ok", "maintenance": false, "read_only": true}`, w.Body.String())
+
+	// Writes are refused
+	w = postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, "read_only", body["code"])
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	w = performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v", testBucket, key), nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.True(t, store.exists(testBucket, key))
+
+	w = performRequest(r, "PATCH", fmt.Sprintf("/faceclaim/%v/%v", testBucket, key), bytes.NewBufferString(`{"metadata": {"tag": "x"}}`))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// Reads, including those that take a body, still work
+	w = performRequest(r, "GET", fmt.Sprintf("/faceclaim/metadata/%v/%v", testBucket, key), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(r, "GET", fmt.Sprintf("/faceclaim/list/%v/%v", testBucket, testCharID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	setReadOnlyMode(t, r, false)
+
+	w = performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v", testBucket, key), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, store.exists(testBucket, key))
+}
+
+func TestPrepareReadOnly(t *testing.T) {
+	t.Cleanup(func() { readOnlyMode.Store(false) })
+
+	assert.NoError(t, prepareReadOnly())
+	assert.False(t, readOnlyMode.Load())
+
+	t.Setenv("READ_ONLY", "true")
+	assert.NoError(t, prepareReadOnly())
+	assert.True(t, readOnlyMode.Load())
+
+	t.Setenv("READ_ONLY", "maybe")
+	assert.Error(t, prepareReadOnly())
+}
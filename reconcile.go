@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// A ReconcileRequest is the POST body for /faceclaim/reconcile. The known keys
+// come from KnownKeys, the newline-delimited manifest at Manifest, or both.
+type ReconcileRequest struct {
+	Bucket string `json:"bucket"`
+
+	// Faceclaims that should be kept, as object names ("charid/key.webp") or
+	// the URLs returned by /faceclaim/upload
+	KnownKeys []string `json:"known_keys"`
+
+	// A gs://bucket/object path to a manifest of known keys, one per line,
+	// for sets too large to send in the request
+	Manifest string `json:"manifest"`
+
+	// If given, only these characters' objects are considered
+	CharIDs []string `json:"charids"`
+}
+
+// A ReconcileResult is the response body for /faceclaim/reconcile.
+type ReconcileResult struct {
+	Bucket         string   `json:"bucket"`
+	DryRun         bool     `json:"dry_run"`
+	Scanned        int      `json:"scanned"`
+	Orphans        []string `json:"orphans"`
+	OrphanCount    int      `json:"orphan_count"`
+	BytesReclaimed int64    `json:"bytes_reclaimed"`
+	Queued         int      `json:"queued"`
+
+	// Each orphan's deletion, unless it's a dry run
+	BatchResult
+}
+
+// Finds the objects in a bucket that aren't in a manifest of known faceclaims,
+// such as those of characters deleted without going through this API. Orphans
+// are only reported unless ?dry_run=false, in which case their deletion is
+// queued.
+func reconcileFaceclaims(c *gin.Context) {
+	var request ReconcileRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "true"))
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+		return
+	}
+	if request.Bucket == "" {
+		request.Bucket = currentConfig().FaceclaimBucket
+	}
+	tagRequest(c, "bucket", request.Bucket)
+	for _, charid := range request.CharIDs {
+		if err := validateCharID(charid); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Manifest != "" {
+		if _, _, err := parseGCSPath(request.Manifest); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	known, err := knownKeys(c.Request.Context(), request)
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, errNoKnownKeys) {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := reconcileBucket(c.Request.Context(), request.Bucket, known, request.CharIDs, dryRun)
+	if abortIfTimedOut(c) || abortIfJournalFull(c, err) {
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, result.httpStatus(http.StatusOK), result)
+}
+
+// An empty manifest would mark every object an orphan, which is never what's
+// meant.
+var errNoKnownKeys = errors.New("known_keys or manifest must list at least one key")
+
+// Returns the set of object names named by the request's known keys and
+// manifest.
+func knownKeys(ctx context.Context, request ReconcileRequest) (map[string]bool, error) {
+	keys := request.KnownKeys
+	if request.Manifest != "" {
+		bucket, object, err := parseGCSPath(request.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		data, err := downloadObject(ctx, bucket, object)
+		if err != nil {
+			return nil, fmt.Errorf("manifest: %w", err)
+		}
+		keys = append(keys, strings.Split(string(data), "\n")...)
+	}
+
+	known := make(map[string]bool)
+	for _, key := range keys {
+		if object := objectName(request.Bucket, key); object != "" {
+			known[object] = true
+		}
+	}
+	if len(known) == 0 {
+		return nil, errNoKnownKeys
+	}
+	return known, nil
+}
+
+// Returns the object name for a key given either as an object name or as the
+// URL of an object in the bucket, as its profile builds them or as
+// https://<bucket>/<object>.
+func objectName(bucket, key string) string {
+	key = strings.TrimSpace(key)
+	for _, prefix := range []string{objectURL(bucket, ""), fmt.Sprintf("https://%v/", bucket)} {
+		if strings.HasPrefix(key, prefix) {
+			return strings.TrimPrefix(key, prefix)
+		}
+	}
+	return key
+}
+
+// Lists the bucket, or just the given characters' objects, and returns the
+// objects not accounted for by the known keys. A known faceclaim's kept
+// original and size variants are kept with it. Unless dryRun is set, the
+// orphans' deletions are queued.
+func reconcileBucket(ctx context.Context, bucket string, known map[string]bool, charids []string, dryRun bool) (ReconcileResult, error) {
+	var objects []*storage.ObjectAttrs
+	if len(charids) == 0 {
+		listed, err := Store.List(ctx, bucket, "")
+		if err != nil {
+			return ReconcileResult{}, fmt.Errorf("reconcileBucket: %v", err)
+		}
+		objects = listed
+	} else {
+		for _, charid := range charids {
+			listed, err := Store.List(ctx, bucket, charid+"/")
+			if err != nil {
+				return ReconcileResult{}, fmt.Errorf("reconcileBucket: %v", err)
+			}
+			objects = append(objects, listed...)
+		}
+	}
+
+	keep, held := make(map[string]bool), make(map[string]bool)
+	for _, attrs := range objects {
+		held[attrs.Name] = isHeld(attrs)
+		if known[attrs.Name] {
+			for _, name := range faceclaimObjects(attrs.Name, attrs.Metadata) {
+				keep[name] = true
+			}
+		}
+	}
+
+	result := ReconcileResult{
+		Bucket:      bucket,
+		DryRun:      dryRun,
+		Scanned:     len(objects),
+		Orphans:     []string{},
+		BatchResult: BatchResult{Results: []BatchItem{}},
+	}
+	for _, attrs := range objects {
+		// Jobs may share the faceclaim bucket
+		if keep[attrs.Name] || (bucket == Jobs.bucket && strings.HasPrefix(attrs.Name, "jobs/")) {
+			continue
+		}
+		result.Orphans = append(result.Orphans, attrs.Name)
+		result.BytesReclaimed += attrs.Size
+	}
+	result.OrphanCount = len(result.Orphans)
+	if dryRun {
+		return result, nil
+	}
+
+	// A deletion that fails doesn't stop the rest, unless the journal is full,
+	// since the rest would only fill it further. Held orphans are left alone.
+	for _, name := range result.Orphans {
+		if held[name] {
+			result.succeed(name, "held")
+			continue
+		}
+		dedupeKey := fmt.Sprintf("%v/%v", bucket, name)
+		if !recentDeletes.add(dedupeKey) {
+			result.succeed(name, "already_queued")
+			continue
+		}
+		err := publishMessage(ctx, DeleteSingle{Bucket: bucket, Key: name}, map[string]string{"dedupe_key": dedupeKey})
+		recordDelete(bucket, "reconcile", err)
+		if err != nil {
+			recentDeletes.remove(dedupeKey)
+			var journalErr *JournalFullError
+			if errors.As(err, &journalErr) {
+				return result, err
+			}
+			result.fail(name, "failed", err)
+			continue
+		}
+		result.succeed(name, "queued")
+		result.Queued++
+	}
+	if result.Queued > 0 {
+		guildUsage.invalidate(bucket)
+	}
+	log.Printf("Queued deletion of %v orphans in %v, %v failed\n", result.Queued, bucket, result.Failed)
+	return result, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Seed a known faceclaim, with its original and a variant, alongside orphans
+// belonging to the same and another character. Returns the known faceclaim's
+// URL.
+func seedReconcile(t *testing.T, r http.Handler, store *memStorage) string {
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	request.Variants = []string{"16"}
+	response := uploadTestImage(t, r, request)
+
+	ctx := context.Background()
+	store.Upload(ctx, testBucket, "__test/aaaa.webp", strings.NewReader("orphan"), UploadOptions{ContentType: "image/webp"})
+	store.Upload(ctx, testBucket, "__gone/bbbb.webp", strings.NewReader("orphan too"), UploadOptions{ContentType: "image/webp"})
+	return response.URL
+}
+
+func postReconcile(r http.Handler, query string, request ReconcileRequest) (*httptest.ResponseRecorder, ReconcileResult) {
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/reconcile"+query, bytes.NewReader(body))
+	var result ReconcileResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w, result
+}
+
+func TestReconcileDryRunFlagsOnlyOrphans(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	r := setupRouter(false)
+	url := seedReconcile(t, r, store)
+	before := store.keys(testBucket)
+
+	w, result := postReconcile(r, "", ReconcileRequest{KnownKeys: []string{url}})
+
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, 5, result.Scanned)
+	assert.ElementsMatch(t, []string{"__test/aaaa.webp", "__gone/bbbb.webp"}, result.Orphans)
+	assert.Equal(t, 2, result.OrphanCount)
+	assert.Equal(t, int64(len("orphan")+len("orphan too")), result.BytesReclaimed)
+	assert.Zero(t, result.Queued)
+	assert.Empty(t, publisher.published())
+	assert.Equal(t, before, store.keys(testBucket))
+}
+
+func TestReconcileDeletesOrphans(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	url := seedReconcile(t, r, store)
+	object := objectKey(testBucket, url)
+
+	w, result := postReconcile(r, "?dry_run=false", ReconcileRequest{KnownKeys: []string{object}})
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 2, result.Queued)
+	assert.False(t, store.exists(testBucket, "__test/aaaa.webp"))
+	assert.False(t, store.exists(testBucket, "__gone/bbbb.webp"))
+	assert.Len(t, store.keys(testBucket), 3, "The known faceclaim, original, and variant should remain")
+	assert.True(t, store.exists(testBucket, object))
+}
+
+func TestReconcilePartialFailure(t *testing.T) {
+	store, publisher := useFakeBackends(t)
+	r := setupRouter(false)
+	url := seedReconcile(t, r, store)
+	publisher.reject = func(msg map[string]string) bool { return msg["key"] == "__gone/bbbb.webp" }
+
+	w, result := postReconcile(r, "?dry_run=false", ReconcileRequest{KnownKeys: []string{url}})
+
+	assert.Equal(t, 207, w.Code)
+	assert.Equal(t, 1, result.Queued)
+	assert.Equal(t, 1, result.Succeeded)
+	assert.Equal(t, 1, result.Failed)
+	assert.ElementsMatch(t, []BatchItem{
+		{Key: "__test/aaaa.webp", Status: "queued"},
+		{Key: "__gone/bbbb.webp", Status: "failed", Code: "publish_failed", Message: "fakePublisher: rejected"},
+	}, result.Results)
+	assert.True(t, store.exists(testBucket, "__gone/bbbb.webp"))
+
+	// The failed deletion can be retried at once. When every deletion fails,
+	// Pub/Sub is to blame.
+	w, result = postReconcile(r, "?dry_run=false", ReconcileRequest{KnownKeys: []string{url}})
+	assert.Equal(t, 502, w.Code)
+	assert.Zero(t, result.Succeeded)
+	assert.Equal(t, 1, result.Failed)
+}
+
+func TestReconcileScopedToCharacters(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	url := seedReconcile(t, r, store)
+
+	w, result := postReconcile(r, "", ReconcileRequest{KnownKeys: []string{url}, CharIDs: []string{"__test"}})
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 4, result.Scanned)
+	assert.Equal(t, []string{"__test/aaaa.webp"}, result.Orphans)
+}
+
+func TestReconcileReadsManifest(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	url := seedReconcile(t, r, store)
+	manifest := objectKey(testBucket, url) + "\n\n__test/aaaa.webp\n"
+	store.Upload(context.Background(), "manifests", "known.txt", strings.NewReader(manifest), UploadOptions{ContentType: "text/plain"})
+
+	w, result := postReconcile(r, "", ReconcileRequest{Manifest: "gs://manifests/known.txt"})
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"__gone/bbbb.webp"}, result.Orphans)
+}
+
+func TestReconcileRejectsBadRequests(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	tests := map[string]struct {
+		query   string
+		request ReconcileRequest
+	}{
+		"no known keys":    {"", ReconcileRequest{KnownKeys: []string{" "}}},
+		"bad manifest":     {"", ReconcileRequest{Manifest: "manifests/known.txt"}},
+		"missing manifest": {"", ReconcileRequest{Manifest: "gs://manifests/missing.txt"}},
+		"bad dry_run":      {"?dry_run=maybe", ReconcileRequest{KnownKeys: []string{"__test/abc.webp"}}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w, _ := postReconcile(r, tc.query, tc.request)
+			assert.Equal(t, 400, w.Code)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// ErrCharacterNotFound is returned for charids with no character record.
+var ErrCharacterNotFound = errors.New("character not found")
+
+// CharacterRecords are the bot's character documents, which list the URLs of
+// each character's faceclaims.
+type CharacterRecords interface {
+	// Returns a character's faceclaim URLs, or ErrCharacterNotFound
+	Images(ctx context.Context, charid string) ([]string, error)
+
+	// Removes a URL from a character's faceclaims, returning whether it was
+	// listed
+	RemoveImage(ctx context.Context, charid, url string) (bool, error)
+}
+
+// Records is the bot's database. It's nil unless MONGO_URL is set, in which
+// case GCS notifications keep it in step with the faceclaim bucket.
+var Records CharacterRecords
+
+// The database the bot keeps its characters in, unless MONGO_DATABASE says
+// otherwise.
+const defaultMongoDatabase = "inconnu"
+
+// Reads MONGO_URL and MONGO_DATABASE.
+func prepareRecords() error {
+	Records = nil
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		return nil
+	}
+	database := os.Getenv("MONGO_DATABASE")
+	if database == "" {
+		database = defaultMongoDatabase
+	}
+	records, err := newMongoRecords(url, database)
+	if err != nil {
+		return err
+	}
+	Records = records
+	return nil
+}
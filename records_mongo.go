@@ -0,0 +1,63 @@
+//go:build mongo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoRecords reads and updates the bot's characters collection, where each
+// document lists its faceclaim URLs under profile.images.
+type mongoRecords struct {
+	characters *mongo.Collection
+}
+
+func newMongoRecords(url, database string) (CharacterRecords, error) {
+	// Connecting doesn't contact the server, so a bad URL is caught here but
+	// an unreachable server isn't noticed until the first notification
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, fmt.Errorf("mongo.Connect: %v", err)
+	}
+	return mongoRecords{client.Database(database).Collection("characters")}, nil
+}
+
+func (r mongoRecords) Images(ctx context.Context, charid string) ([]string, error) {
+	id, err := primitive.ObjectIDFromHex(charid)
+	if err != nil {
+		return nil, ErrCharacterNotFound
+	}
+	var character struct {
+		Profile struct {
+			Images []string `bson:"images"`
+		} `bson:"profile"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"profile.images": 1})
+	err = r.characters.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&character)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrCharacterNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FindOne: %v", err)
+	}
+	return character.Profile.Images, nil
+}
+
+func (r mongoRecords) RemoveImage(ctx context.Context, charid, url string) (bool, error) {
+	id, err := primitive.ObjectIDFromHex(charid)
+	if err != nil {
+		return false, nil
+	}
+	result, err := r.characters.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$pull": bson.M{"profile.images": url}})
+	if err != nil {
+		return false, fmt.Errorf("UpdateOne: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
@@ -0,0 +1,10 @@
+//go:build !mongo
+
+package main
+
+import "errors"
+
+// Mongo support pulls in the full driver, so it's only built with -tags mongo.
+func newMongoRecords(url, database string) (CharacterRecords, error) {
+	return nil, errors.New("MONGO_URL is set, but this binary was built without -tags mongo")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Matches a query parameter anywhere in a line of log output, including inside
+// JSON, where encoding/json escapes "&" as \u0026. A value doesn't end in
+// punctuation, which belongs to the text after the URL, as in "...?sig=abc: EOF".
+var queryParamPattern = regexp.MustCompile(`([?&]|\\u0026)([\w.-]+)=((?:[^&\s"'<>\\#]*[^&\s"'<>\\#:,).])?)`)
+
+// Matches bearer credentials, in case an Authorization header is ever logged.
+var bearerPattern = regexp.MustCompile(`(?i)\b(bearer\s+)[\w.~+/=-]+`)
+
+// Returns whether a query parameter, e.g. X-Goog-Signature, might carry a
+// credential.
+func sensitiveParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretQueryParams {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// Masks the values of sensitive query parameters and bearer tokens in s, so
+// signed URLs can be logged without the signature.
+func redact(s string) string {
+	s = queryParamPattern.ReplaceAllStringFunc(s, func(param string) string {
+		parts := queryParamPattern.FindStringSubmatch(param)
+		if !sensitiveParam(parts[2]) {
+			return param
+		}
+		return parts[1] + parts[2] + "=[redacted]"
+	})
+	return bearerPattern.ReplaceAllString(s, "${1}[redacted]")
+}
+
+// redactingWriter redacts everything written through it. Every logger writes
+// through one, so nothing reaches the logs unredacted.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(data []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Returns a logger whose output is redacted.
+func newLogger(w io.Writer, prefix string, flags int) *log.Logger {
+	return log.New(redactingWriter{w}, prefix, flags)
+}
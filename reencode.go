@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// MinSavingsPercent is how much smaller, as a percentage, a re-encoded object
+// must be to replace the stored one.
+var MinSavingsPercent = 10
+
+// How many objects a re-encode converts at once.
+const reencodeConcurrency = 4
+
+// Reads MIN_SAVINGS_PERCENT, which defaults to 10.
+func prepareReencode() error {
+	MinSavingsPercent = 10
+	if value, ok := os.LookupEnv("MIN_SAVINGS_PERCENT"); ok {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent > 100 {
+			return errors.New("MIN_SAVINGS_PERCENT must be between 0 and 100")
+		}
+		MinSavingsPercent = percent
+	}
+	return nil
+}
+
+// A ReencodeRequest is the POST body for /admin/reencode.
+type ReencodeRequest struct {
+	Bucket string `json:"bucket"`
+
+	// If given, only this character's faceclaims are re-encoded
+	CharID string `json:"charid"`
+
+	Quality int `json:"quality" binding:"required,min=1,max=100"`
+
+	// Report the sizes without rewriting anything
+	DryRun bool `json:"dry_run"`
+}
+
+// A ReencodeEntry is the outcome of re-encoding one faceclaim: "rewritten",
+// "kept" (the savings were too small), "pending" (would be rewritten, in a dry
+// run), or "failed". Source is what it was re-encoded from: "original" (the
+// kept original), "original_url", or "stored".
+type ReencodeEntry struct {
+	Object    string `json:"object"`
+	Status    string `json:"status"`
+	Source    string `json:"source,omitempty"`
+	Before    int64  `json:"before"`
+	After     int64  `json:"after"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// A ReencodeResult summarizes a re-encode. Results and Objects are only
+// filled in once it's finished; Objects adds each object's sizes and source.
+type ReencodeResult struct {
+	Bucket      string          `json:"bucket"`
+	Quality     int             `json:"quality"`
+	DryRun      bool            `json:"dry_run"`
+	Total       int             `json:"total"`
+	Processed   int             `json:"processed"`
+	Rewritten   int             `json:"rewritten"`
+	BytesBefore int64           `json:"bytes_before"`
+	BytesAfter  int64           `json:"bytes_after"`
+	Objects     []ReencodeEntry `json:"objects,omitempty"`
+	BatchResult
+}
+
+// Starts a job re-encoding a bucket's faceclaims, or one character's, at a new
+// quality. Objects are only replaced when that saves at least
+// MinSavingsPercent; their names and metadata don't change.
+func reencodeBucket(c *gin.Context) {
+	var request ReencodeRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Bucket == "" {
+		request.Bucket = currentConfig().FaceclaimBucket
+	}
+	if request.CharID != "" {
+		if err := validateCharID(request.CharID); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	job := startTrackedJob(func(progress func(interface{})) (interface{}, error) {
+		// Re-encoding a bucket can take a long time, so the job isn't given
+		// a deadline
+		return reencodeObjects(context.Background(), request, progress)
+	})
+	respond(c, http.StatusAccepted, job)
+}
+
+// Re-encodes the request's faceclaims, reencodeConcurrency at a time,
+// reporting the running totals after each one.
+func reencodeObjects(ctx context.Context, request ReencodeRequest, progress func(interface{})) (ReencodeResult, error) {
+	prefix := ""
+	if request.CharID != "" {
+		prefix = request.CharID + "/"
+	}
+	listed, err := Store.List(ctx, request.Bucket, prefix)
+	if err != nil {
+		return ReencodeResult{}, fmt.Errorf("reencodeObjects: %v", err)
+	}
+	var objects []*storage.ObjectAttrs
+	for _, attrs := range listed {
+		if isFaceclaim(attrs) && strings.HasSuffix(attrs.Name, ".webp") {
+			objects = append(objects, attrs)
+		}
+	}
+
+	result := ReencodeResult{
+		Bucket:  request.Bucket,
+		Quality: request.Quality,
+		DryRun:  request.DryRun,
+		Total:   len(objects),
+	}
+	entries := make([]ReencodeEntry, len(objects))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	pending := make(chan int)
+	for i := 0; i < reencodeConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				entry := reencodeObject(ctx, request, objects[i])
+
+				mu.Lock()
+				entries[i] = entry
+				result.Processed++
+				switch entry.Status {
+				case "rewritten":
+					result.Rewritten++
+				}
+				if entry.ErrorCode != "" {
+					result.Failed++
+				} else {
+					result.Succeeded++
+				}
+				result.BytesBefore += entry.Before
+				if entry.Status == "rewritten" || entry.Status == "pending" {
+					result.BytesAfter += entry.After
+				} else {
+					result.BytesAfter += entry.Before
+				}
+				progress(result)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range objects {
+		pending <- i
+	}
+	close(pending)
+	wg.Wait()
+
+	if result.Rewritten > 0 {
+		guildUsage.invalidate(request.Bucket)
+	}
+	log.Printf("Re-encoded %v at quality %v: %v of %v rewritten, %v failed\n",
+		request.Bucket, request.Quality, result.Rewritten, result.Total, result.Failed)
+	result.Objects = entries
+	result.Results = make([]BatchItem, len(entries))
+	for i, entry := range entries {
+		result.Results[i] = BatchItem{Key: entry.Object, Status: entry.Status, Code: entry.ErrorCode, Message: entry.Error}
+	}
+	return result, nil
+}
+
+// Re-encodes a faceclaim, replacing it if the savings are big enough.
+func reencodeObject(ctx context.Context, request ReencodeRequest, attrs *storage.ObjectAttrs) ReencodeEntry {
+	entry := ReencodeEntry{Object: attrs.Name, Before: attrs.Size}
+	fail := func(err error) ReencodeEntry {
+		entry.Status = "failed"
+		entry.Error, entry.ErrorCode = err.Error(), batchErrorCode(err)
+		return entry
+	}
+
+	source, from, err := reencodeSource(ctx, request.Bucket, attrs)
+	if err != nil {
+		return fail(err)
+	}
+	entry.Source = from
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := ImageConverter.Convert(ctx, bytes.NewReader(source), buf, request.Quality); err != nil {
+		return fail(err)
+	}
+	entry.After = int64(buf.Len())
+
+	if entry.After > attrs.Size*int64(100-MinSavingsPercent)/100 {
+		entry.Status = "kept"
+		return entry
+	}
+	if request.DryRun {
+		entry.Status = "pending"
+		return entry
+	}
+
+	metadata := make(map[string]string, len(attrs.Metadata)+1)
+	for k, v := range attrs.Metadata {
+		metadata[k] = v
+	}
+	encoderSettings(request.Quality, "none").stamp(metadata)
+	// Only replace the version that was re-encoded
+	err = uploadObject(ctx, buf, request.Bucket, attrs.Name, UploadOptions{
+		ContentType:   "image/webp",
+		Metadata:      metadata,
+		StorageClass:  attrs.StorageClass,
+		Preconditions: Preconditions{IfGenerationMatch: attrs.Generation},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	entry.Status = "rewritten"
+	return entry
+}
+
+// Returns the best source to re-encode a faceclaim from, and where it came
+// from: its kept original if it has one, then the URL it was uploaded from,
+// then the stored WebP itself. Originals are watermarked again if the
+// faceclaim was, falling back to the stored WebP if that fails.
+func reencodeSource(ctx context.Context, bucket string, attrs *storage.ObjectAttrs) ([]byte, string, error) {
+	var original []byte
+	var from string
+	if name := attrs.Metadata["original_object"]; name != "" {
+		data, err := downloadObject(ctx, bucket, name)
+		if err == nil {
+			original, from = data, "original"
+		} else {
+			log.Println("Unable to download original", name, err)
+		}
+	}
+	if original == nil && attrs.Metadata["original"] != "" {
+		// Signed Discord URLs expire, and there's no point fetching those
+		var fetched *FetchedImage
+		imageURL, err := normalizeImageURL(attrs.Metadata["original"], time.Now())
+		if err == nil {
+			fetched, err = ImageFetcher.Fetch(ctx, imageURL)
+		}
+		if err == nil {
+			original, from = fetched.Data, "original_url"
+		} else {
+			log.Println("Unable to fetch original for", attrs.Name, err)
+		}
+	}
+
+	if original != nil {
+		restored, err := restoreSource(original, attrs.Metadata)
+		if err == nil {
+			return restored, from, nil
+		}
+		log.Println("Unable to prepare original for", attrs.Name, err)
+	}
+
+	data, err := downloadObject(ctx, bucket, attrs.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("reencodeSource: %v", err)
+	}
+	return data, "stored", nil
+}
+
+// Prepares a faceclaim's original the way its upload did. Kept originals are
+// stored as uploaded: sideways or not, in their own color space, uncropped,
+// and without a watermark.
+func restoreSource(original []byte, metadata map[string]string) ([]byte, error) {
+	if err := checkImageSize(original); err != nil {
+		return nil, err
+	}
+	upright, _, err := correctOrientation(original)
+	if err != nil {
+		return nil, fmt.Errorf("correctOrientation: %v", err)
+	}
+	if upright, _, err = convertToSRGB(upright, embeddedProfile(original)); err != nil {
+		return nil, fmt.Errorf("convertToSRGB: %v", err)
+	}
+	if metadata["crop"] != "" {
+		crop, err := parseCrop(metadata["crop"])
+		if err != nil {
+			return nil, err
+		}
+		if upright, err = cropImage(upright, crop); err != nil {
+			return nil, err
+		}
+	}
+	if metadata["fit"] == fitSquare {
+		if upright, err = squareImage(upright); err != nil {
+			return nil, err
+		}
+	}
+	if watermark := metadata["watermark"]; watermark != "" {
+		return applyWatermark(upright, watermark)
+	}
+	return upright, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/jpeg"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// jpegConverter encodes as JPEG, so the requested quality affects the output
+// size the way it does with cwebp.
+type jpegConverter struct{}
+
+func (jpegConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(dst, img, &jpeg.Options{Quality: quality})
+}
+
+// Install the JPEG converter for the duration of a test
+func useJPEGConverter(t *testing.T) {
+	ImageConverter = jpegConverter{}
+	t.Cleanup(func() { ImageConverter = fakeConverter{} })
+}
+
+// Store the gradient fixture as a faceclaim encoded at quality 100, returning
+// its size
+func seedReencode(t *testing.T, store *memStorage, object string, metadata map[string]string) int64 {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, gradientImage(), &jpeg.Options{Quality: 100})
+	size := int64(buf.Len())
+	assert.NoError(t, store.Upload(context.Background(), testBucket, object, &buf, UploadOptions{ContentType: "image/webp", Metadata: metadata}))
+	return size
+}
+
+// Run a re-encode job to completion, returning its result
+func runReencode(t *testing.T, r *gin.Engine, request ReencodeRequest) ReencodeResult {
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/admin/reencode", bytes.NewReader(body))
+	if !assert.Equal(t, 202, w.Code) {
+		return ReencodeResult{}
+	}
+
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	status := waitForJob(t, r, job.ID)
+	assert.Equal(t, string(JobSucceeded), status["status"])
+
+	var result ReencodeResult
+	data, _ := json.Marshal(status["result"])
+	json.Unmarshal(data, &result)
+	return result
+}
+
+func TestReencodeShrinksObject(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useJPEGConverter(t)
+	r := setupRouter(false)
+	before := seedReencode(t, store, "__test/a.webp", map[string]string{"charid": "__test"})
+	seedReencode(t, store, "__other/b.webp", nil)
+
+	result := runReencode(t, r, ReencodeRequest{CharID: "__test", Quality: 10})
+
+	assert.Equal(t, 1, result.Total)
+	assert.Equal(t, 1, result.Rewritten)
+	if assert.Len(t, result.Objects, 1) {
+		entry := result.Objects[0]
+		assert.Equal(t, "__test/a.webp", entry.Object)
+		assert.Equal(t, "rewritten", entry.Status)
+		assert.Equal(t, "stored", entry.Source)
+		assert.Equal(t, before, entry.Before)
+		assert.Less(t, entry.After, before)
+	}
+
+	attrs, err := store.Attrs(context.Background(), testBucket, "__test/a.webp")
+	assert.NoError(t, err, "The key shouldn't change")
+	assert.Less(t, attrs.Size, before)
+	assert.Equal(t, "10", attrs.Metadata["quality"])
+	assert.Equal(t, "__test", attrs.Metadata["charid"], "Metadata should be kept")
+
+	other, _ := store.Attrs(context.Background(), testBucket, "__other/b.webp")
+	assert.Equal(t, before, other.Size, "Other characters shouldn't be touched")
+}
+
+func TestReencodeKeepsSmallSavings(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useJPEGConverter(t)
+	MinSavingsPercent = 100
+	t.Cleanup(func() { MinSavingsPercent = 10 })
+	r := setupRouter(false)
+	before := seedReencode(t, store, "__test/a.webp", nil)
+
+	result := runReencode(t, r, ReencodeRequest{Quality: 10})
+
+	assert.Equal(t, 0, result.Rewritten)
+	assert.Equal(t, "kept", result.Objects[0].Status)
+	attrs, _ := store.Attrs(context.Background(), testBucket, "__test/a.webp")
+	assert.Equal(t, before, attrs.Size)
+}
+
+func TestReencodeDryRun(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useJPEGConverter(t)
+	r := setupRouter(false)
+	before := seedReencode(t, store, "__test/a.webp", nil)
+
+	result := runReencode(t, r, ReencodeRequest{Quality: 10, DryRun: true})
+
+	assert.Equal(t, "pending", result.Objects[0].Status)
+	assert.Less(t, result.BytesAfter, result.BytesBefore)
+	attrs, _ := store.Attrs(context.Background(), testBucket, "__test/a.webp")
+	assert.Equal(t, before, attrs.Size)
+}
+
+func TestReencodePrefersKeptOriginal(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useJPEGConverter(t)
+	r := setupRouter(false)
+	seedReencode(t, store, "__test/a.orig.jpg", nil)
+	seedReencode(t, store, "__test/a.webp", map[string]string{"original_object": "__test/a.orig.jpg"})
+
+	result := runReencode(t, r, ReencodeRequest{Quality: 10})
+
+	assert.Equal(t, 1, result.Total, "Originals shouldn't be re-encoded themselves")
+	assert.Equal(t, "original", result.Objects[0].Source)
+}
+
+func TestReencodeRejectsBadQuality(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := performRequest(r, "POST", "/admin/reencode", strings.NewReader(`{"quality": 101}`))
+	assert.Equal(t, 400, w.Code)
+}
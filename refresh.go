@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// A RefreshResponse describes a refreshed faceclaim. If its source hadn't
+// changed, only its URL is given.
+type RefreshResponse struct {
+	URL         string            `json:"url"`
+	Unchanged   bool              `json:"unchanged"`
+	CRC32C      string            `json:"crc32c,omitempty"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	InputBytes  int64             `json:"input_bytes,omitempty"`
+	OutputBytes int64             `json:"output_bytes,omitempty"`
+	Variants    map[string]string `json:"variants,omitempty"`
+}
+
+// Fetches a faceclaim's source image again and, if it's changed, re-encodes
+// it in place, along with its kept original and variants. The fetch is
+// conditional on the validators recorded at upload, so an unchanged source
+// isn't downloaded at all.
+func refreshFaceclaim(c *gin.Context) {
+	ctx := c.Request.Context()
+	bucket := c.Param("bucket")
+	object := fmt.Sprintf("%v/%v", c.Param("charid"), c.Param("key"))
+
+	attrs, err := getObjectAttrs(ctx, bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) || (err == nil && !isFaceclaim(attrs)) {
+		abortWith(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("%v does not exist", object)})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if attrs.Metadata["original"] == "" {
+		abortWith(c, http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("%v has no source URL to refresh from", object),
+			"code":  "no_source",
+		})
+		return
+	}
+	var expiredErr *ExpiredURLError
+	if _, err := normalizeImageURL(attrs.Metadata["original"], time.Now()); errors.As(err, &expiredErr) {
+		abortWith(c, http.StatusBadRequest, gin.H{
+			"error":      err.Error(),
+			"code":       "expired_url",
+			"expired_at": expiredErr.Expired,
+		})
+		return
+	}
+
+	response, err := refreshObject(ctx, bucket, attrs)
+	if abortIfTimedOut(c) {
+		return
+	}
+	if abortWithUploadError(c, err) {
+		return
+	}
+	respond(c, http.StatusOK, response)
+}
+
+// Refreshes a faceclaim from its source URL. Its WebP is only replaced if it
+// hasn't changed meanwhile; its original and variants are overwritten after.
+func refreshObject(ctx context.Context, bucket string, attrs *storage.ObjectAttrs) (RefreshResponse, error) {
+	response := RefreshResponse{URL: objectURL(bucket, attrs.Name)}
+	imageURL, err := normalizeImageURL(attrs.Metadata["original"], time.Now())
+	if err != nil {
+		return RefreshResponse{}, err
+	}
+	fetched, err := fetchIfChanged(ctx, imageURL, Validators{
+		ETag:         attrs.Metadata["upstream_etag"],
+		LastModified: attrs.Metadata["upstream_last_modified"],
+	})
+	if err != nil {
+		return RefreshResponse{}, err
+	}
+	if fetched.NotModified {
+		log.Println("Source of", attrs.Name, "is unchanged")
+		response.Unchanged = true
+		return response, nil
+	}
+
+	original := fetched.Data
+	contentType, err := checkImageType(original)
+	if err != nil {
+		return RefreshResponse{}, err
+	}
+	if err := checkColorSpace(original); err != nil {
+		return RefreshResponse{}, err
+	}
+	moderation, err := moderateImage(ctx, original)
+	if err != nil {
+		return RefreshResponse{}, err
+	}
+	source, err := restoreSource(original, attrs.Metadata)
+	if err != nil {
+		return RefreshResponse{}, err
+	}
+
+	profile := currentConfig().bucketProfile(bucket)
+	quality, err := strconv.Atoi(attrs.Metadata["quality"])
+	if err != nil {
+		quality = profile.Quality
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := ImageConverter.Convert(ctx, bytes.NewReader(source), buf, quality); err != nil {
+		return RefreshResponse{}, err
+	}
+	width, height, err := checkConverted(buf.Bytes())
+	if err != nil {
+		return RefreshResponse{}, err
+	}
+
+	// Whatever the last fetch recorded is replaced by this one's
+	metadata := make(map[string]string, len(attrs.Metadata))
+	for k, v := range attrs.Metadata {
+		metadata[k] = v
+	}
+	for _, key := range []string{"upstream_content_type", "upstream_last_modified", "upstream_etag", "redirects", "redirect_hosts", "moderation"} {
+		delete(metadata, key)
+	}
+	fetched.stamp(metadata)
+	metadata["resolved_url"] = fetched.URL
+	metadata["blurhash"], metadata["dominant_color"] = analyzeImage(source)
+	if moderation != "" {
+		metadata["moderation"] = moderation
+	}
+	encoderSettings(quality, "none").stamp(metadata)
+
+	err = uploadObject(ctx, buf, bucket, attrs.Name, UploadOptions{
+		ContentType:   "image/webp",
+		Metadata:      metadata,
+		StorageClass:  attrs.StorageClass,
+		CacheControl:  attrs.CacheControl,
+		Preconditions: Preconditions{IfGenerationMatch: attrs.Generation},
+	})
+	if err != nil {
+		return RefreshResponse{}, fmt.Errorf("refreshObject: %w", err)
+	}
+	guildUsage.invalidate(bucket)
+	crc, _ := checksums(buf.Bytes())
+	response.CRC32C = encodeCRC32C(crc)
+	response.Width, response.Height = width, height
+	response.InputBytes, response.OutputBytes = int64(len(original)), int64(buf.Len())
+
+	if name := metadata["original_object"]; name != "" {
+		err := uploadObject(ctx, bytes.NewReader(original), bucket, name, UploadOptions{
+			ContentType:  contentType,
+			Metadata:     map[string]string{"guild": metadata["guild"], "user": metadata["user"], "charid": metadata["charid"]},
+			StorageClass: attrs.StorageClass,
+			CacheControl: attrs.CacheControl,
+		})
+		if err != nil {
+			log.Println("Unable to refresh original", name, err)
+		}
+	}
+	if sizes := metadata["variants"]; sizes != "" {
+		response.Variants, err = refreshVariants(ctx, bucket, attrs, source, strings.Split(sizes, ","), metadata, profile.Quality)
+		if err != nil {
+			log.Println("Unable to refresh variants of", attrs.Name, err)
+		}
+	}
+	log.Println("Refreshed", attrs.Name, "from", fetched.URL)
+	return response, nil
+}
+
+// Re-renders a refreshed faceclaim's variants at the sizes it has, returning
+// the URLs of those that were rewritten.
+func refreshVariants(ctx context.Context, bucket string, attrs *storage.ObjectAttrs, source []byte, sizes []string, metadata map[string]string, quality int) (map[string]string, error) {
+	img, err := decodeImage(source)
+	if err != nil {
+		return nil, fmt.Errorf("refreshVariants: %v", err)
+	}
+	rendered, err := renderVariants(ctx, img, sizes, quality)
+	if err != nil {
+		return nil, fmt.Errorf("refreshVariants: %w", err)
+	}
+	defer func() {
+		for _, buf := range rendered {
+			putBuffer(buf)
+		}
+	}()
+
+	urls := make(map[string]string, len(sizes))
+	for i, size := range sizes {
+		variantMetadata := map[string]string{"variant": size}
+		for k, v := range metadata {
+			variantMetadata[k] = v
+		}
+		encoderSettings(quality, "fit:"+size).stamp(variantMetadata)
+		name := variantObjectName(attrs.Name, size)
+		err := uploadObject(ctx, rendered[i], bucket, name, UploadOptions{
+			ContentType:  "image/webp",
+			Metadata:     variantMetadata,
+			StorageClass: attrs.StorageClass,
+			CacheControl: attrs.CacheControl,
+		})
+		if err != nil {
+			log.Println("Unable to refresh variant", name, err)
+			continue
+		}
+		urls[size] = objectURL(bucket, name)
+	}
+	return urls, nil
+}
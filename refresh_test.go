@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// An image host whose image can be swapped out, and which honors the
+// validators it's sent if it has an ETag
+type changingHost struct {
+	sync.Mutex
+	data        []byte
+	etag        string
+	conditional []string
+	downloads   int
+}
+
+func (h *changingHost) set(img image.Image, etag string) {
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	h.Lock()
+	defer h.Unlock()
+	h.data, h.etag = buf.Bytes(), etag
+}
+
+func (h *changingHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	h.conditional = append(h.conditional, r.Header.Get("If-None-Match"))
+	if h.etag != "" {
+		w.Header().Set("ETag", h.etag)
+		if r.Header.Get("If-None-Match") == h.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	h.downloads++
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(h.data)
+}
+
+// Upload a faceclaim from the host, returning its key
+func uploadFromHost(t *testing.T, r http.Handler, server *httptest.Server, variants ...string) string {
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	request.Variants = variants
+	w := postUpload(r, request)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	return objectKey(testBucket, getFaceclaimResponse(w.Body).URL)
+}
+
+// Refresh a faceclaim
+func refresh(t *testing.T, r http.Handler, key string) RefreshResponse {
+	w := performRequest(r, "POST", fmt.Sprintf("/faceclaim/refresh/%v/%v", testBucket, key), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response RefreshResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response
+}
+
+func TestRefreshFaceclaim(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	host := &changingHost{}
+	host.set(gradientImage(), `"v1"`)
+	server := httptest.NewServer(host)
+	defer server.Close()
+
+	key := uploadFromHost(t, r, server, "16")
+	before, _ := store.Attrs(context.Background(), testBucket, key)
+	assert.Equal(t, `"v1"`, before.Metadata["upstream_etag"])
+
+	// An unchanged source isn't downloaded, and nothing is rewritten
+	writes := countWrites(store)
+	response := refresh(t, r, key)
+	assert.True(t, response.Unchanged)
+	assert.Equal(t, objectURL(testBucket, key), response.URL)
+	assert.Zero(t, response.OutputBytes)
+	assert.Zero(t, *writes)
+	assert.Equal(t, `"v1"`, host.conditional[len(host.conditional)-1])
+	assert.Equal(t, 1, host.downloads)
+
+	// A changed one is re-encoded in place, variants and all
+	host.set(image.NewRGBA(image.Rect(0, 0, 20, 40)), `"v2"`)
+	response = refresh(t, r, key)
+	assert.False(t, response.Unchanged)
+	assert.Equal(t, 20, response.Width)
+	assert.Equal(t, 40, response.Height)
+	assert.Equal(t, 2, host.downloads)
+	assert.Equal(t, 2, *writes, "The WebP and its variant")
+	assert.Contains(t, response.Variants, "16")
+
+	after, _ := store.Attrs(context.Background(), testBucket, key)
+	assert.Equal(t, `"v2"`, after.Metadata["upstream_etag"])
+	assert.NotEqual(t, before.CRC32C, after.CRC32C)
+	assert.Equal(t, before.Metadata["original"], after.Metadata["original"])
+	assert.Equal(t, before.Metadata["charid"], after.Metadata["charid"])
+	variant, _ := store.Attrs(context.Background(), testBucket, variantObjectName(key, "16"))
+	assert.Equal(t, `"v2"`, variant.Metadata["upstream_etag"])
+}
+
+func TestRefreshWithoutValidators(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	host := &changingHost{}
+	host.set(gradientImage(), "")
+	server := httptest.NewServer(host)
+	defer server.Close()
+
+	key := uploadFromHost(t, r, server)
+	writes := countWrites(store)
+
+	// With nothing to validate against, the source is always fetched
+	response := refresh(t, r, key)
+	assert.False(t, response.Unchanged)
+	assert.Equal(t, 32, response.Width)
+	assert.Equal(t, []string{"", ""}, host.conditional)
+	assert.Equal(t, 2, host.downloads)
+	assert.Equal(t, 1, *writes)
+
+	w := performRequest(r, "POST", fmt.Sprintf("/faceclaim/refresh/%v/%v/%v", testBucket, testCharID, "0123456789abcdef01234567.webp"), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
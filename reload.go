@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rereads the settings and swaps in the new Config, returning the keys that
+// changed. The server is already listening, so a new PORT is ignored with a
+// warning, and reported as ignored. If the new settings don't validate,
+// nothing changes.
+func reloadConfig() (changed, ignored []string, err error) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	old := currentConfig()
+	if cfg.Port != old.Port {
+		log.Printf("WARNING: PORT changed from %v to %v; restart to listen there\n", old.Port, cfg.Port)
+		cfg.Port = old.Port
+		ignored = append(ignored, "port")
+	}
+	changed = changedSettings(old, cfg)
+	setConfig(cfg)
+
+	if len(changed) == 0 {
+		log.Println("Reloaded the config; nothing changed")
+	} else {
+		log.Println("Reloaded the config; changed:", strings.Join(changed, ", "))
+	}
+	return changed, ignored, nil
+}
+
+// Reloads the config whenever reload fires (SIGHUP, in production), until
+// the context is cancelled.
+func watchConfigReload(ctx context.Context, reload <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			if _, _, err := reloadConfig(); err != nil {
+				log.Println("Unable to reload the config; keeping the current one:", err)
+			}
+		}
+	}
+}
+
+// Reloads the config from the environment, reporting which settings changed.
+// Invalid settings are a 400 and leave the current config in place.
+func reloadSettings(c *gin.Context) {
+	changed, ignored, err := reloadConfig()
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_config"})
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	if ignored == nil {
+		ignored = []string{}
+	}
+	respond(c, http.StatusOK, gin.H{"changed": changed, "ignored": ignored})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Reload the config from the environment for the duration of a test, putting
+// the current one back afterwards
+func useReloadableEnv(t *testing.T, env map[string]string) {
+	useRequiredEnv(t)
+	useConfig(t, func(cfg *Config) {})
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	t.Cleanup(func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+type reloadResponse struct {
+	Changed []string `json:"changed"`
+	Ignored []string `json:"ignored"`
+	Code    string   `json:"code"`
+}
+
+func TestReloadChangesLimit(t *testing.T) {
+	useFakeBackends(t)
+	useReloadableEnv(t, map[string]string{"CHAR_MAX_IMAGES": "1", "WEBP_QUALITY": "80"})
+	r := setupRouter(false)
+
+	w := performRequest(r, "POST", "/admin/reload", nil)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	var response reloadResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, []string{"char_max_images", "webp_quality"}, response.Changed)
+	assert.Empty(t, response.Ignored)
+
+	// The next uploads see the new settings
+	first := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 80, first.Quality)
+	w = postTestImage(r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, 409, w.Code, "The reloaded limit should apply")
+
+	// Reloading again changes nothing
+	w = performRequest(r, "POST", "/admin/reload", nil)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Empty(t, response.Changed)
+}
+
+func TestReloadIgnoresPort(t *testing.T) {
+	useFakeBackends(t)
+	useReloadableEnv(t, map[string]string{"PORT": "9999"})
+	r := setupRouter(false)
+
+	w := performRequest(r, "POST", "/admin/reload", nil)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	var response reloadResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, []string{"port"}, response.Ignored)
+	assert.Equal(t, "8080", currentConfig().Port)
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	useFakeBackends(t)
+	useReloadableEnv(t, map[string]string{"CHAR_MAX_IMAGES": "5", "WEBP_QUALITY": "500"})
+	r := setupRouter(false)
+	before := currentConfig()
+
+	w := performRequest(r, "POST", "/admin/reload", nil)
+	assert.Equal(t, 400, w.Code)
+	var response reloadResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, "invalid_config", response.Code)
+	assert.Same(t, before, currentConfig(), "Nothing should change, even the valid settings")
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	useReloadableEnv(t, map[string]string{"ALLOWED_BUCKETS": "other.inconnu.app"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reload := make(chan os.Signal, 1)
+	go watchConfigReload(ctx, reload)
+	reload <- syscall.SIGHUP
+	assert.Eventually(t, func() bool {
+		return len(currentConfig().AllowedBuckets) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, validateBucket("other.inconnu.app"))
+	assert.Error(t, validateBucket("elsewhere.inconnu.app"))
+}
+
+func TestChangedSettings(t *testing.T) {
+	old, new := newConfig(), newConfig()
+	assert.Empty(t, changedSettings(old, new))
+
+	new.GuildQuotas = map[string]GuildQuota{"42": {MaxImages: 5}}
+	new.AllowedBuckets = []string{"other.inconnu.app"}
+	new.Port = "9999" // Not reloadable, so not reported
+	assert.Equal(t, []string{"allowed_buckets", "guild_quotas"}, changedSettings(old, new))
+}
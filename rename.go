@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Renames of characters with more objects than this run as jobs.
+const renameAsyncThreshold = 20
+
+// A RenameRequest is the POST body for /faceclaim/rename.
+type RenameRequest struct {
+	Bucket    string `json:"bucket"`
+	OldCharID string `json:"old_charid" binding:"required"`
+	NewCharID string `json:"new_charid" binding:"required"`
+}
+
+// A RenameResult is the response body for /faceclaim/rename, or a rename
+// job's result. URLs maps each renamed object's old URL to its new one. Each
+// object's status is renamed, or failed, conflict, or held.
+type RenameResult struct {
+	Bucket    string            `json:"bucket"`
+	OldCharID string            `json:"old_charid"`
+	NewCharID string            `json:"new_charid"`
+	Total     int               `json:"total"`
+	URLs      map[string]string `json:"urls"`
+	BatchResult
+}
+
+// Moves a character's objects to a new charid, as when characters are merged
+// and the survivor gets a new ObjectID. Each object is copied under the new
+// prefix with the same filename, its copy is verified and its metadata
+// updated, and then it's deleted. Characters with many objects are renamed in
+// a job. Objects already moved are left where they are, so a rename that's
+// interrupted can simply be run again.
+func renameCharacter(c *gin.Context) {
+	var request RenameRequest
+	if err := c.BindJSON(&request); err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Bucket == "" {
+		request.Bucket = currentConfig().FaceclaimBucket
+	}
+	tagRequest(c, "bucket", request.Bucket)
+	tagRequest(c, "charid", request.OldCharID)
+	if err := validateBucket(request.Bucket); err != nil {
+		abortWith(c, bucketErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	for _, charid := range []string{request.OldCharID, request.NewCharID} {
+		if err := validateCharID(charid); err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.OldCharID == request.NewCharID {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "old_charid and new_charid must differ"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	objects, err := Store.List(ctx, request.Bucket, request.OldCharID+"/")
+	if abortIfTimedOut(c) {
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(objects) > renameAsyncThreshold {
+		job := startTrackedJob(func(progress func(interface{})) (interface{}, error) {
+			// The job outlives the request, and may take a while
+			return renameObjects(context.Background(), request, objects, progress), nil
+		})
+		respond(c, http.StatusAccepted, job)
+		return
+	}
+	result := renameObjects(ctx, request, objects, func(interface{}) {})
+	respond(c, result.httpStatus(http.StatusOK), result)
+}
+
+// Renames the listed objects one at a time, calling progress with the running
+// totals after each. Failures are recorded and the rename carries on.
+func renameObjects(ctx context.Context, request RenameRequest, objects []*storage.ObjectAttrs, progress func(interface{})) RenameResult {
+	// Uploads to either character wait for the rename. The locks are taken in
+	// order, so two renames between the same characters can't deadlock.
+	keys := []string{request.Bucket + "/" + request.OldCharID, request.Bucket + "/" + request.NewCharID}
+	sort.Strings(keys)
+	for _, key := range keys {
+		defer characterLocks.lock(key)()
+	}
+
+	result := RenameResult{
+		Bucket:      request.Bucket,
+		OldCharID:   request.OldCharID,
+		NewCharID:   request.NewCharID,
+		Total:       len(objects),
+		URLs:        map[string]string{},
+		BatchResult: BatchResult{Results: []BatchItem{}},
+	}
+	for _, attrs := range objects {
+		name := renamedObject(attrs.Name, request.OldCharID, request.NewCharID)
+		if err := renameObject(ctx, request, attrs, name); err != nil {
+			item := BatchItem{Key: attrs.Name, Status: "failed", Code: batchErrorCode(err), Message: err.Error()}
+			var heldErr *heldObjectError
+			switch {
+			case errors.As(err, &heldErr):
+				item.Status, item.Code = "held", "held"
+			case item.Code == "conflict":
+				item.Status = "conflict"
+			}
+			result.add(item)
+		} else {
+			result.succeed(attrs.Name, "renamed")
+			result.URLs[objectURL(request.Bucket, attrs.Name)] = objectURL(request.Bucket, name)
+		}
+		progress(result)
+	}
+	log.Printf("Renamed %v to %v in %v: %v renamed, %v failed\n",
+		request.OldCharID, request.NewCharID, request.Bucket, result.Succeeded, result.Failed)
+	return result
+}
+
+// A heldObjectError means an object can't be moved because it's held.
+type heldObjectError struct {
+	Object string
+}
+
+func (e *heldObjectError) Error() string {
+	return fmt.Sprintf("%v is held, so it can't be moved", e.Object)
+}
+
+// Returns an object's name under the new charid.
+func renamedObject(name, oldCharID, newCharID string) string {
+	return newCharID + "/" + strings.TrimPrefix(name, oldCharID+"/")
+}
+
+// Copies an object to its new name, verifies the copy's CRC32C, points its
+// metadata at the new charid, and deletes the original. A copy left by an
+// earlier attempt is reused if it matches.
+func renameObject(ctx context.Context, request RenameRequest, src *storage.ObjectAttrs, name string) error {
+	bucket := request.Bucket
+	if isHeld(src) {
+		return &heldObjectError{Object: src.Name}
+	}
+
+	dst, err := getObjectAttrs(ctx, bucket, name)
+	switch {
+	case err == nil && dst.CRC32C == src.CRC32C:
+		// Copied before the last attempt was interrupted
+	case err == nil:
+		return &ConflictError{Bucket: bucket, Key: name, Generation: dst.Generation}
+	case !errors.Is(err, storage.ErrObjectNotExist):
+		return err
+	default:
+		dst, err = Store.Copy(ctx, bucket, src.Name, bucket, name, Preconditions{DoesNotExist: true})
+		attrCache.invalidate(bucket, name)
+		listCache.invalidate(bucket, name)
+		if err != nil {
+			return conflictError(ctx, err, bucket, name)
+		}
+		if dst.CRC32C != src.CRC32C {
+			deleteObject(ctx, bucket, name)
+			return fmt.Errorf("CRC32C mismatch: source %08x, copy %08x", src.CRC32C, dst.CRC32C)
+		}
+	}
+
+	// The charid, and the kept original's name, are recorded in the metadata
+	patch := map[string]string{}
+	if _, ok := src.Metadata["charid"]; ok {
+		patch["charid"] = request.NewCharID
+	}
+	if original := src.Metadata["original_object"]; original != "" {
+		patch["original_object"] = renamedObject(original, request.OldCharID, request.NewCharID)
+	}
+	if len(patch) > 0 {
+		_, err := Store.UpdateMetadata(ctx, bucket, name, patch)
+		attrCache.invalidate(bucket, name)
+		listCache.invalidate(bucket, name)
+		if err != nil {
+			return fmt.Errorf("copied, but the metadata wasn't updated: %w", err)
+		}
+	}
+
+	if err := deleteObject(ctx, bucket, src.Name); err != nil {
+		return fmt.Errorf("copied, but the original wasn't deleted: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The charid characters are renamed to
+const renamedCharID = "5f1d7c0e8a3b2c4d5e6f7a8b"
+
+func postRename(r http.Handler, request RenameRequest) (*httptest.ResponseRecorder, RenameResult) {
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/rename", bytes.NewReader(body))
+	var result RenameResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w, result
+}
+
+func TestRenameCharacter(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	response := uploadTestImage(t, r, request)
+	object := objectKey(testBucket, response.URL)
+
+	w, result := postRename(r, RenameRequest{OldCharID: testCharID, NewCharID: renamedCharID})
+
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, 2, result.Total)
+	assert.Equal(t, 2, result.Succeeded)
+	newURL := strings.Replace(response.URL, testCharID+"/", renamedCharID+"/", 1)
+	assert.Equal(t, newURL, result.URLs[response.URL])
+	assert.Len(t, result.URLs, 2)
+
+	for _, key := range store.keys(testBucket) {
+		assert.False(t, strings.HasPrefix(key, testCharID+"/"), "%v should have moved", key)
+	}
+	attrs, err := store.Attrs(context.Background(), testBucket, objectKey(testBucket, newURL))
+	if assert.NoError(t, err) {
+		assert.Equal(t, renamedCharID, attrs.Metadata["charid"])
+		assert.True(t, strings.HasPrefix(attrs.Metadata["original_object"], renamedCharID+"/"))
+		assert.Equal(t, attrs.Metadata["original_object"], objectKey(testBucket, result.URLs[response.OriginalURL]))
+	}
+	_, err = store.Attrs(context.Background(), testBucket, object)
+	assert.Error(t, err)
+}
+
+func TestRenameResumes(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	first := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	second := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+
+	// An earlier attempt copied the first object before it was interrupted
+	ctx := context.Background()
+	store.Copy(ctx, testBucket, first, testBucket, renamedObject(first, testCharID, renamedCharID), Preconditions{})
+
+	w, result := postRename(r, RenameRequest{OldCharID: testCharID, NewCharID: renamedCharID})
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, 2, result.Succeeded)
+	assert.ElementsMatch(t, []string{
+		renamedObject(first, testCharID, renamedCharID),
+		renamedObject(second, testCharID, renamedCharID),
+	}, store.keys(testBucket))
+
+	// A different object in the way is a conflict, and the original stays
+	third := objectKey(testBucket, uploadTestImage(t, r, createFaceclaimRequest(testBucket)).URL)
+	store.Upload(ctx, testBucket, renamedObject(third, testCharID, renamedCharID), strings.NewReader("other"), UploadOptions{})
+	w, result = postRename(r, RenameRequest{OldCharID: testCharID, NewCharID: renamedCharID})
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, "conflict", result.Results[0].Status)
+	assert.True(t, store.exists(testBucket, third))
+}
+
+func TestRenameLargeCharacterAsync(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	ctx := context.Background()
+	for i := 0; i <= renameAsyncThreshold; i++ {
+		store.Upload(ctx, testBucket, testObjectKey(uint64(i)), strings.NewReader("x"), UploadOptions{})
+	}
+
+	body, _ := json.Marshal(RenameRequest{OldCharID: testCharID, NewCharID: renamedCharID})
+	w := performRequest(r, "POST", "/faceclaim/rename", bytes.NewReader(body))
+	assert.Equal(t, 202, w.Code)
+
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	status := waitForJob(t, r, job.ID)
+	assert.Equal(t, string(JobSucceeded), status["status"])
+	result := status["result"].(map[string]interface{})
+	assert.Equal(t, float64(renameAsyncThreshold+1), result["succeeded"])
+	assert.Len(t, store.keys(testBucket), renameAsyncThreshold+1)
+	for _, key := range store.keys(testBucket) {
+		assert.True(t, strings.HasPrefix(key, renamedCharID+"/"))
+	}
+}
+
+func TestRenameRejectsBadRequests(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	for name, request := range map[string]RenameRequest{
+		"same":       {OldCharID: testCharID, NewCharID: testCharID},
+		"bad charid": {OldCharID: testCharID, NewCharID: "../x"},
+		"missing":    {OldCharID: testCharID},
+	} {
+		w, _ := postRename(r, request)
+		assert.Equal(t, 400, w.Code, name)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/secretmanager/v1"
+)
+
+// A SecretSource reads the latest value of a secret.
+type SecretSource interface {
+	Latest(ctx context.Context, name string) (string, error)
+}
+
+// Secrets is the SecretSource the API token is read from.
+var Secrets SecretSource = secretManagerSource{}
+
+// secretManagerSource reads secrets from Secret Manager.
+type secretManagerSource struct{}
+
+func (secretManagerSource) Latest(ctx context.Context, name string) (string, error) {
+	service, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("secretmanager.NewService: %v", err)
+	}
+	version, err := service.Projects.Secrets.Versions.Access(secretVersion(name)).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Versions.Access: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(version.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("base64: %v", err)
+	}
+	// Secrets created with `echo` end in a newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Returns the version of a secret to read: the one named, or the latest if
+// only the secret is named.
+func secretVersion(name string) string {
+	if strings.Contains(name, "/versions/") {
+		return name
+	}
+	return name + "/versions/latest"
+}
+
+// APITokenSecret names the Secret Manager secret holding the API token, e.g.
+// projects/inconnu-357402/secrets/api-token. When it's empty, API_TOKEN is
+// used instead.
+var APITokenSecret string
+
+// How often the API token is reread from Secret Manager.
+var APITokenRefresh = 5 * time.Minute
+
+// The API token last read from Secret Manager.
+var secretToken atomic.Value
+
+// Reads API_TOKEN_SECRET and API_TOKEN_REFRESH, then loads the token if it's
+// kept in Secret Manager.
+func prepareAPIToken() error {
+	APITokenSecret = os.Getenv("API_TOKEN_SECRET")
+	APITokenRefresh = 5 * time.Minute
+	if value, ok := os.LookupEnv("API_TOKEN_REFRESH"); ok {
+		refresh, err := time.ParseDuration(value)
+		if err != nil || refresh <= 0 {
+			return errors.New("API_TOKEN_REFRESH: must be a positive duration, e.g. 5m")
+		}
+		APITokenRefresh = refresh
+	}
+	if APITokenSecret == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := refreshAPIToken(ctx); err != nil {
+		return fmt.Errorf("API_TOKEN_SECRET: %v", err)
+	}
+	return nil
+}
+
+// Rereads the API token from Secret Manager. On failure, the current token
+// stays in use.
+func refreshAPIToken(ctx context.Context) error {
+	token, err := Secrets.Latest(ctx, APITokenSecret)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("the secret is empty")
+	}
+	secretToken.Store(token)
+	return nil
+}
+
+// Returns the primary API token: the one from Secret Manager if configured,
+// or else API_TOKEN_PRIMARY, or else API_TOKEN.
+func currentAPIToken() string {
+	if APITokenSecret != "" {
+		token, _ := secretToken.Load().(string)
+		return token
+	}
+	if token, ok := os.LookupEnv("API_TOKEN_PRIMARY"); ok {
+		return token
+	}
+	return os.Getenv("API_TOKEN")
+}
+
+// Returns which token an Authorization header matches: the primary, or
+// API_TOKEN_SECONDARY, which is accepted while clients move off it. A token
+// from Secret Manager is never empty, so failing to load one locks everyone
+// out rather than letting everyone in.
+func matchAPIToken(header string) (string, bool) {
+	token := currentAPIToken()
+	if (APITokenSecret == "" || token != "") && header == token {
+		return credentialPrimary, true
+	}
+	if secondary := os.Getenv("API_TOKEN_SECONDARY"); secondary != "" && header == secondary {
+		return credentialSecondary, true
+	}
+	return "", false
+}
+
+// Rereads the API token every APITokenRefresh, and whenever reload fires
+// (SIGHUP, in production), until the context is cancelled.
+func watchAPIToken(ctx context.Context, reload <-chan os.Signal) {
+	ticker := time.NewTicker(APITokenRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-reload:
+			log.Println("Reloading the API token")
+		}
+		refreshCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := refreshAPIToken(refreshCtx); err != nil {
+			log.Println("Unable to refresh the API token:", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTokenSecret = "projects/inconnu/secrets/api-token"
+
+// fakeSecrets serves secret values that can be changed mid-test.
+type fakeSecrets struct {
+	sync.Mutex
+	values map[string]string
+	err    error
+}
+
+func (s *fakeSecrets) Latest(ctx context.Context, name string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.values[name], nil
+}
+
+func (s *fakeSecrets) set(name, value string) {
+	s.Lock()
+	defer s.Unlock()
+	s.values[name] = value
+}
+
+// Keep the API token in a fake secret for the duration of a test
+func useSecretToken(t *testing.T, token string) *fakeSecrets {
+	secrets := &fakeSecrets{values: map[string]string{testTokenSecret: token}}
+	Secrets = secrets
+	os.Setenv("API_TOKEN_SECRET", testTokenSecret)
+	t.Cleanup(func() {
+		Secrets = secretManagerSource{}
+		os.Unsetenv("API_TOKEN_SECRET")
+		APITokenSecret = ""
+		secretToken = atomic.Value{}
+	})
+	assert.NoError(t, prepareAPIToken())
+	return secrets
+}
+
+func TestSecretToken(t *testing.T) {
+	useSecretToken(t, "hunter2")
+	r := setupRouter(false)
+	path := "/faceclaim/job/deadbeef"
+
+	assert.Equal(t, 404, requestWithAuth(r, "GET", path, "hunter2").Code)
+	assert.Equal(t, 401, requestWithAuth(r, "GET", path, "").Code)
+}
+
+func TestSecretTokenRotation(t *testing.T) {
+	secrets := useSecretToken(t, "old")
+	r := setupRouter(false)
+
+	// A request that's authenticated with the old token, then stalls
+	started, release := make(chan struct{}), make(chan struct{})
+	r.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusOK)
+	})
+	inFlight := make(chan int)
+	go func() { inFlight <- requestWithAuth(r, "GET", "/slow", "old").Code }()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal, 1)
+	go watchAPIToken(ctx, reload)
+
+	secrets.set(testTokenSecret, "new")
+	reload <- os.Interrupt
+	assert.Eventually(t, func() bool { return currentAPIToken() == "new" }, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 404, requestWithAuth(r, "GET", "/faceclaim/job/deadbeef", "new").Code)
+	assert.Equal(t, 401, requestWithAuth(r, "GET", "/faceclaim/job/deadbeef", "old").Code)
+
+	close(release)
+	assert.Equal(t, 200, <-inFlight, "Requests already in flight should finish")
+}
+
+func TestSecretTokenRefreshFailure(t *testing.T) {
+	secrets := useSecretToken(t, "hunter2")
+
+	secrets.err = errors.New("secret manager is down")
+	assert.Error(t, refreshAPIToken(context.Background()))
+	assert.Equal(t, "hunter2", currentAPIToken(), "The last good token should stay in use")
+
+	secrets.err = nil
+	secrets.set(testTokenSecret, "")
+	assert.Error(t, refreshAPIToken(context.Background()))
+	assert.Equal(t, "hunter2", currentAPIToken())
+}
+
+func TestPrepareAPIToken(t *testing.T) {
+	Secrets = &fakeSecrets{err: errors.New("permission denied")}
+	t.Cleanup(func() {
+		Secrets = secretManagerSource{}
+		os.Unsetenv("API_TOKEN_SECRET")
+		os.Unsetenv("API_TOKEN_REFRESH")
+		prepareAPIToken()
+	})
+
+	os.Setenv("API_TOKEN_SECRET", testTokenSecret)
+	assert.Error(t, prepareAPIToken())
+	_, ok := matchAPIToken("")
+	assert.False(t, ok, "An unloaded secret token shouldn't match anything")
+
+	os.Unsetenv("API_TOKEN_SECRET")
+	os.Setenv("API_TOKEN_REFRESH", "soon")
+	assert.Error(t, prepareAPIToken())
+	os.Setenv("API_TOKEN_REFRESH", "1m")
+	assert.NoError(t, prepareAPIToken())
+	assert.Equal(t, time.Minute, APITokenRefresh)
+}
+
+func TestSecretVersion(t *testing.T) {
+	assert.Equal(t, testTokenSecret+"/versions/latest", secretVersion(testTokenSecret))
+	assert.Equal(t, testTokenSecret+"/versions/3", secretVersion(testTokenSecret+"/versions/3"))
+}
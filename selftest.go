@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// SelfTest runs an end-to-end upload check when the server starts, read from
+// SELF_TEST.
+var SelfTest bool
+
+// The prefix self-test objects are uploaded under, in the faceclaim bucket.
+const selfTestPrefix = "selftest/"
+
+// Reads SELF_TEST.
+func prepareSelfTest() error {
+	SelfTest = false
+	if value, ok := os.LookupEnv("SELF_TEST"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("SELF_TEST: %v", err)
+		}
+		SelfTest = enabled
+	}
+	selfTest = newSelfTestState()
+	return nil
+}
+
+// The self-test's result. Status is pending until it's run, then passed or
+// failed; when it fails, Stage names the step that did.
+type SelfTestResult struct {
+	Status   string     `json:"status"`
+	Stage    string     `json:"stage,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type selfTestState struct {
+	sync.Mutex
+	result SelfTestResult
+}
+
+func newSelfTestState() *selfTestState {
+	return &selfTestState{result: SelfTestResult{Status: "pending"}}
+}
+
+// The latest self-test result, reported by /readyz.
+var selfTest = newSelfTestState()
+
+func (s *selfTestState) get() SelfTestResult {
+	s.Lock()
+	defer s.Unlock()
+	return s.result
+}
+
+func (s *selfTestState) set(result SelfTestResult) {
+	s.Lock()
+	defer s.Unlock()
+	s.result = result
+}
+
+// Runs the self-test and records its result. A failure is logged, and makes
+// the server report that it isn't ready, but it keeps serving.
+func runSelfTest(ctx context.Context) SelfTestResult {
+	result := SelfTestResult{Status: "passed"}
+	if stage, err := selfTestPipeline(ctx); err != nil {
+		result = SelfTestResult{Status: "failed", Stage: stage, Error: err.Error()}
+		log.Printf("Self-test failed at %v: %v\n", stage, err)
+	} else {
+		log.Println("Self-test passed")
+	}
+	finished := time.Now()
+	result.Finished = &finished
+	selfTest.set(result)
+	recordSelfTest(result.Stage, result.Status == "passed")
+	return result
+}
+
+// Encodes a small image, uploads it, reads it back, and deletes it, as an
+// upload and a later delete would. Returns the stage that failed, if one did.
+func selfTestPipeline(ctx context.Context) (stage string, err error) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, selfTestImage()); err != nil {
+		return "encode", fmt.Errorf("png.Encode: %v", err)
+	}
+	var webp bytes.Buffer
+	if err := ImageConverter.Convert(ctx, &src, &webp, currentConfig().WebPQuality); err != nil {
+		return "encode", err
+	}
+	if webp.Len() == 0 {
+		return "encode", errors.New("the converter produced no output")
+	}
+	expected := append([]byte(nil), webp.Bytes()...)
+
+	bucket := currentConfig().FaceclaimBucket
+	object := fmt.Sprintf("%v%v.webp", selfTestPrefix, newObjectID().Hex())
+	opts := UploadOptions{ContentType: "image/webp", Metadata: map[string]string{"self_test": "true"}}
+	if err := uploadObject(ctx, &webp, bucket, object, opts); err != nil {
+		return "upload", err
+	}
+
+	data, err := downloadObject(ctx, bucket, object)
+	if err != nil {
+		deleteObject(ctx, bucket, object)
+		return "readback", err
+	}
+	if !bytes.Equal(data, expected) {
+		deleteObject(ctx, bucket, object)
+		return "readback", fmt.Errorf("read back %v bytes that don't match the %v uploaded", len(data), len(expected))
+	}
+
+	if err := deleteObject(ctx, bucket, object); err != nil {
+		return "delete", err
+	}
+	if _, err := getObjectAttrs(ctx, bucket, object); !errors.Is(err, storage.ErrObjectNotExist) {
+		if err == nil {
+			err = errors.New("the object still exists")
+		}
+		return "delete", err
+	}
+	return "", nil
+}
+
+// A small gradient to push through the pipeline.
+func selfTestImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// Reports whether the server is ready for traffic: a 200 once the self-test
+// has passed, or at once if it's disabled, and a 503 naming the failed stage
+// if it failed. It's a 503 while the self-test is pending, too, and while the
+// delete backlog is over its thresholds, if they're set.
+func readyz(c *gin.Context) {
+	body := gin.H{}
+	ready := true
+	if SelfTest {
+		result := selfTest.get()
+		body["self_test"] = result
+		ready = result.Status == "passed"
+	}
+	if backlogChecked() {
+		status := queueStatus.get(c.Request.Context())
+		body["delete_backlog"] = status.Subscriptions
+		ready = ready && !status.Backlogged
+	}
+
+	if ready {
+		body["status"] = "ready"
+		respond(c, http.StatusOK, body)
+		return
+	}
+	body["status"] = "not_ready"
+	respond(c, http.StatusServiceUnavailable, body)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Enable the self-test for the duration of a test, with no result yet
+func useSelfTest(t *testing.T) {
+	SelfTest, selfTest = true, newSelfTestState()
+	t.Cleanup(func() { SelfTest, selfTest = false, newSelfTestState() })
+}
+
+type readyzResponse struct {
+	Status   string         `json:"status"`
+	SelfTest SelfTestResult `json:"self_test"`
+}
+
+func getReadyz(t *testing.T) (int, readyzResponse) {
+	w := performRequest(setupRouter(false), "GET", "/readyz", nil)
+	var response readyzResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return w.Code, response
+}
+
+func TestReadyWithoutSelfTest(t *testing.T) {
+	code, response := getReadyz(t)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ready", response.Status)
+}
+
+func TestSelfTestPasses(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useSelfTest(t)
+
+	code, response := getReadyz(t)
+	assert.Equal(t, 503, code, "Not ready until the self-test has run")
+	assert.Equal(t, "pending", response.SelfTest.Status)
+
+	result := runSelfTest(context.Background())
+	assert.Equal(t, "passed", result.Status)
+	assert.Equal(t, float64(1), testutil.ToFloat64(selfTestPassed))
+
+	code, response = getReadyz(t)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ready", response.Status)
+	assert.NotNil(t, response.SelfTest.Finished)
+	for _, key := range store.keys(testBucket) {
+		assert.False(t, strings.HasPrefix(key, selfTestPrefix), "The test object should be deleted: %v", key)
+	}
+}
+
+func TestSelfTestFailures(t *testing.T) {
+	tests := map[string]func(store *memStorage){
+		"encode": func(store *memStorage) { ImageConverter = brokenConverter{} },
+		"upload": func(store *memStorage) {
+			store.rejectUpload = func(bucket, object string) bool { return true }
+		},
+	}
+	for stage, breakIt := range tests {
+		t.Run(stage, func(t *testing.T) {
+			store, _ := useFakeBackends(t)
+			useSelfTest(t)
+			breakIt(store)
+			failures := testutil.ToFloat64(selfTestFailuresTotal.WithLabelValues(stage))
+
+			result := runSelfTest(context.Background())
+			assert.Equal(t, "failed", result.Status)
+			assert.Equal(t, stage, result.Stage)
+			assert.Equal(t, float64(0), testutil.ToFloat64(selfTestPassed))
+			assert.Equal(t, failures+1, testutil.ToFloat64(selfTestFailuresTotal.WithLabelValues(stage)))
+
+			code, response := getReadyz(t)
+			assert.Equal(t, 503, code)
+			assert.Equal(t, "not_ready", response.Status)
+			assert.Equal(t, stage, response.SelfTest.Stage)
+			assert.NotEmpty(t, response.SelfTest.Error)
+
+			// The server itself keeps working
+			w := performRequest(setupRouter(false), "GET", "/healthz", nil)
+			assert.Equal(t, 200, w.Code)
+		})
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// Storage is the object store that faceclaims and logs are kept in. Missing
+// objects are reported with storage.ErrObjectNotExist, regardless of backend.
+type Storage interface {
+	Upload(ctx context.Context, bucket, object string, data io.Reader, opts UploadOptions) error
+	Download(ctx context.Context, bucket, object string) ([]byte, error)
+	Attrs(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error)
+	Delete(ctx context.Context, bucket, object string) error
+	List(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error)
+
+	// Lists the objects under prefix whose names sort before end
+	ListBefore(ctx context.Context, bucket, prefix, end string) ([]*storage.ObjectAttrs, error)
+
+	// Lists up to size objects under prefix, starting from a page token, and
+	// returns the token of the next page, which is empty after the last
+	ListPage(ctx context.Context, bucket, prefix, token string, size int) ([]*storage.ObjectAttrs, string, error)
+
+	// Copies an object server-side, metadata included, returning the copy's
+	// attributes. The preconditions apply to the destination.
+	Copy(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string, cond Preconditions) (*storage.ObjectAttrs, error)
+
+	// Returns an error if the bucket doesn't exist or can't be accessed
+	CheckBucket(ctx context.Context, bucket string) error
+
+	// Reports whether anyone, signed in or not, can read the bucket's objects
+	IsPublic(ctx context.Context, bucket string) (bool, error)
+
+	// Returns a URL that allows GETting the object until it expires
+	SignURL(ctx context.Context, bucket, object string, expires time.Duration) (string, error)
+
+	// Sets or clears the object's temporary hold, which keeps it from being
+	// deleted or overwritten, returning its updated attributes
+	SetHold(ctx context.Context, bucket, object string, held bool) (*storage.ObjectAttrs, error)
+
+	// Merges metadata into the object's, leaving other keys as they are, and
+	// returns its updated attributes
+	UpdateMetadata(ctx context.Context, bucket, object string, metadata map[string]string) (*storage.ObjectAttrs, error)
+
+	// Sets the object's Content-Type in place, returning its updated
+	// attributes
+	SetContentType(ctx context.Context, bucket, object, contentType string) (*storage.ObjectAttrs, error)
+}
+
+// UploadOptions describe an object being written.
+type UploadOptions struct {
+	ContentType string
+	Metadata    map[string]string
+
+	// Empty uses the bucket's default
+	StorageClass string
+
+	// Empty leaves it unset
+	CacheControl string
+
+	// If set, the write is rejected if the data doesn't match
+	CRC32C uint32
+	MD5    []byte
+
+	Preconditions
+}
+
+// Preconditions on a write. With DoesNotExist, the write fails if the object
+// already exists; with IfGenerationMatch, it fails unless the object is at
+// that generation. Failures wrap ErrPreconditionFailed.
+type Preconditions struct {
+	DoesNotExist      bool
+	IfGenerationMatch int64
+}
+
+// Returns the GCS conditions to write an object under, and whether there are
+// any.
+func (p Preconditions) conditions() (storage.Conditions, bool) {
+	switch {
+	case p.DoesNotExist:
+		return storage.Conditions{DoesNotExist: true}, true
+	case p.IfGenerationMatch != 0:
+		return storage.Conditions{GenerationMatch: p.IfGenerationMatch}, true
+	}
+	return storage.Conditions{}, false
+}
+
+// ErrPreconditionFailed is returned when a write's precondition isn't met.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// A ConflictError is returned when a write is refused because of the object
+// already at its destination: one that exists when none was expected, or one
+// another writer changed in the meantime. Generation is the existing object's
+// generation, or 0 if it no longer exists, so the client can decide whether
+// to overwrite it explicitly.
+type ConflictError struct {
+	Bucket     string
+	Key        string
+	Generation int64
+}
+
+func (e *ConflictError) Error() string {
+	if e.Generation == 0 {
+		return fmt.Sprintf("%v was modified concurrently and no longer exists", e.Key)
+	}
+	return fmt.Sprintf("%v conflicts with an existing object at generation %v", e.Key, e.Generation)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrPreconditionFailed
+}
+
+// Turns a failed precondition on a write to bucket/key into a ConflictError
+// giving the existing object's generation. Other errors are returned as is.
+func conflictError(ctx context.Context, err error, bucket, key string) error {
+	if !errors.Is(err, ErrPreconditionFailed) {
+		return err
+	}
+	conflict := &ConflictError{Bucket: bucket, Key: key}
+	if attrs, err := Store.Attrs(ctx, bucket, key); err == nil {
+		conflict.Generation = attrs.Generation
+	}
+	return conflict
+}
+
+// Responds with a 409 if err is a ConflictError, giving the existing object's
+// bucket, key, and generation. Returns whether it did.
+func abortIfConflict(c *gin.Context, err error) bool {
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	abortWith(c, http.StatusConflict, gin.H{
+		"error":      err.Error(),
+		"code":       "conflict",
+		"bucket":     conflict.Bucket,
+		"key":        conflict.Key,
+		"generation": conflict.Generation,
+	})
+	return true
+}
+
+// Store is the Storage used by the handlers.
+var Store Storage = gcsStorage{}
+
+// The storage classes objects can be written with.
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// The default storage classes for faceclaims and logs. Empty means the
+// bucket's default.
+var (
+	FaceclaimStorageClass string
+	LogStorageClass       string
+)
+
+// Reads FACECLAIM_STORAGE_CLASS and LOG_STORAGE_CLASS.
+func prepareStorageClasses() error {
+	var err error
+	if FaceclaimStorageClass, err = parseStorageClass(os.Getenv("FACECLAIM_STORAGE_CLASS")); err != nil {
+		return fmt.Errorf("FACECLAIM_STORAGE_CLASS: %v", err)
+	}
+	if LogStorageClass, err = parseStorageClass(os.Getenv("LOG_STORAGE_CLASS")); err != nil {
+		return fmt.Errorf("LOG_STORAGE_CLASS: %v", err)
+	}
+	return nil
+}
+
+// Returns the canonical name of a storage class, or an error if it isn't one
+// of storageClasses. Empty stays empty.
+func parseStorageClass(class string) (string, error) {
+	if class == "" {
+		return "", nil
+	}
+	upper := strings.ToUpper(class)
+	for _, known := range storageClasses {
+		if upper == known {
+			return upper, nil
+		}
+	}
+	return "", fmt.Errorf("unknown storage class %q; must be one of %v", class, strings.Join(storageClasses, ", "))
+}
+
+// gcsStorage stores objects in Google Cloud Storage.
+type gcsStorage struct{}
+
+// Adapted from https://cloud.google.com/storage/docs/uploading-objects-from-memory
+func (gcsStorage) Upload(ctx context.Context, bucket, object string, data io.Reader, opts UploadOptions) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	obj := client.Bucket(bucket).Object(object)
+	if conds, ok := opts.conditions(); ok {
+		obj = obj.If(conds)
+	}
+
+	// Upload an object with storage.Writer
+	wc := obj.NewWriter(ctx)
+	wc.ContentType = opts.ContentType
+	wc.ChunkSize = 0
+	wc.Metadata = opts.Metadata
+	wc.StorageClass = opts.StorageClass
+	wc.CacheControl = opts.CacheControl
+	if opts.CRC32C != 0 {
+		wc.CRC32C = opts.CRC32C
+		wc.SendCRC32C = true
+	}
+	wc.MD5 = opts.MD5
+
+	if _, err = copyBuffered(wc, data); err != nil {
+		return fmt.Errorf("io.Copy: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return fmt.Errorf("Writer.Close: %w", ErrPreconditionFailed)
+		}
+		return fmt.Errorf("Writer.Close: %v", err)
+	}
+	return nil
+}
+
+func (gcsStorage) Download(ctx context.Context, bucket, object string) ([]byte, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Object.NewReader: %w", err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll: %v", err)
+	}
+	return data, nil
+}
+
+func (gcsStorage) Attrs(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	attrs, err := client.Bucket(bucket).Object(object).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Object.Attrs: %w", err)
+	}
+	return attrs, nil
+}
+
+func (gcsStorage) Delete(ctx context.Context, bucket, object string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Bucket(bucket).Object(object).Delete(ctx); err != nil {
+		return fmt.Errorf("Object.Delete: %w", err)
+	}
+	return nil
+}
+
+func (s gcsStorage) List(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error) {
+	return s.list(ctx, bucket, &storage.Query{Prefix: prefix})
+}
+
+func (s gcsStorage) ListBefore(ctx context.Context, bucket, prefix, end string) ([]*storage.ObjectAttrs, error) {
+	return s.list(ctx, bucket, &storage.Query{Prefix: prefix, EndOffset: end})
+}
+
+func (gcsStorage) ListPage(ctx context.Context, bucket, prefix, token string, size int) ([]*storage.ObjectAttrs, string, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	var objects []*storage.ObjectAttrs
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	next, err := iterator.NewPager(it, size, token).NextPage(&objects)
+	if err != nil {
+		return nil, "", fmt.Errorf("Bucket.Objects: %v", err)
+	}
+	return objects, next, nil
+}
+
+func (gcsStorage) list(ctx context.Context, bucket string, query *storage.Query) ([]*storage.ObjectAttrs, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	var objects []*storage.ObjectAttrs
+	it := client.Bucket(bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bucket.Objects: %v", err)
+		}
+		objects = append(objects, attrs)
+	}
+	return objects, nil
+}
+
+func (gcsStorage) Copy(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string, cond Preconditions) (*storage.ObjectAttrs, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	src := client.Bucket(srcBucket).Object(srcObject)
+	dst := client.Bucket(dstBucket).Object(dstObject)
+	if conds, ok := cond.conditions(); ok {
+		dst = dst.If(conds)
+	}
+	attrs, err := dst.CopierFrom(src).Run(ctx)
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return nil, fmt.Errorf("Copier.Run: %w", ErrPreconditionFailed)
+		}
+		return nil, fmt.Errorf("Copier.Run: %w", err)
+	}
+	return attrs, nil
+}
+
+func (gcsStorage) CheckBucket(ctx context.Context, bucket string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Bucket(bucket).Attrs(ctx); err != nil {
+		return fmt.Errorf("Bucket.Attrs: %w", err)
+	}
+	return nil
+}
+
+// A bucket is public if its IAM policy lets allUsers view objects or, for
+// buckets with fine-grained access, its default object ACL does.
+func (gcsStorage) IsPublic(ctx context.Context, bucket string) (bool, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return false, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	handle := client.Bucket(bucket)
+	policy, err := handle.IAM().Policy(ctx)
+	if err != nil {
+		return false, fmt.Errorf("IAM.Policy: %v", err)
+	}
+	for _, role := range []iam.RoleName{"roles/storage.objectViewer", "roles/storage.legacyObjectReader"} {
+		if policy.HasRole(iam.AllUsers, role) {
+			return true, nil
+		}
+	}
+
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Bucket.Attrs: %v", err)
+	}
+	if attrs.UniformBucketLevelAccess.Enabled {
+		return false, nil
+	}
+	for _, rule := range attrs.DefaultObjectACL {
+		if rule.Entity == storage.AllUsers && (rule.Role == storage.RoleReader || rule.Role == storage.RoleOwner) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (gcsStorage) SignURL(ctx context.Context, bucket, object string, expires time.Duration) (string, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	url, err := client.Bucket(bucket).SignedURL(object, &storage.SignedURLOptions{
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(expires),
+		Scheme:  storage.SigningSchemeV4,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Bucket.SignedURL: %v", err)
+	}
+	return url, nil
+}
+
+func (gcsStorage) SetHold(ctx context.Context, bucket, object string, held bool) (*storage.ObjectAttrs, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	attrs, err := client.Bucket(bucket).Object(object).Update(ctx, storage.ObjectAttrsToUpdate{TemporaryHold: held})
+	if err != nil {
+		return nil, fmt.Errorf("Object.Update: %w", err)
+	}
+	return attrs, nil
+}
+
+func (gcsStorage) UpdateMetadata(ctx context.Context, bucket, object string, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	// GCS patches metadata key by key
+	attrs, err := client.Bucket(bucket).Object(object).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+	if err != nil {
+		return nil, fmt.Errorf("Object.Update: %w", err)
+	}
+	return attrs, nil
+}
+
+func (gcsStorage) SetContentType(ctx context.Context, bucket, object, contentType string) (*storage.ObjectAttrs, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	attrs, err := client.Bucket(bucket).Object(object).Update(ctx, storage.ObjectAttrsToUpdate{ContentType: contentType})
+	if err != nil {
+		return nil, fmt.Errorf("Object.Update: %w", err)
+	}
+	return attrs, nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// An IntegrityError is returned when a stored object doesn't match the data
+// that was uploaded.
+type IntegrityError struct {
+	Object string
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%v failed its integrity check: %v", e.Object, e.Reason)
+}
+
+// Returns the CRC32C and MD5 checksums of data.
+func checksums(data []byte) (uint32, []byte) {
+	sum := md5.Sum(data)
+	return crc32.Checksum(data, crc32cTable), sum[:]
+}
+
+// Encodes a CRC32C the way GCS does: big-endian and base64-encoded.
+func encodeCRC32C(crc uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc)
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// Uploads an object as it's read, without buffering it, returning its size.
+// Its checksums can't be sent ahead of the data, so they're computed along
+// the way and verified afterwards.
+func streamObject(ctx context.Context, data io.Reader, bucket, object string, opts UploadOptions) (int64, error) {
+	// A write abandoned partway is only discarded once its context ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	release, err := uploads.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	crc := crc32.New(crc32cTable)
+	md5sum := md5.New()
+	opts.Metadata = sanitizeMetadata(opts.Metadata)
+	counted := &countingReader{ReadCloser: io.NopCloser(data)}
+	err = Store.Upload(ctx, bucket, object, io.TeeReader(counted, io.MultiWriter(crc, md5sum)), opts)
+	return counted.n, finishUpload(ctx, bucket, object, err, crc.Sum32(), md5sum.Sum(nil))
+}
+
+// Reads back an uploaded object's checksums and compares them with what was
+// sent. Objects without an MD5, such as composites, are checked by CRC32C
+// alone.
+func verifyUpload(ctx context.Context, bucket, object string, crc uint32, md5sum []byte) error {
+	attrs, err := Store.Attrs(ctx, bucket, object)
+	if err != nil {
+		return fmt.Errorf("verifyUpload: %w", err)
+	}
+	if attrs.CRC32C != crc {
+		return &IntegrityError{object, fmt.Sprintf("CRC32C is %v, expected %v", encodeCRC32C(attrs.CRC32C), encodeCRC32C(crc))}
+	}
+	if len(attrs.MD5) > 0 && !bytes.Equal(attrs.MD5, md5sum) {
+		return &IntegrityError{object, "MD5 mismatch"}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadStorageClass(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.StorageClass = "nearline"
+	request.KeepOriginal = &keep
+	request.Variants = []string{"16"}
+	response := uploadTestImage(t, r, request)
+
+	object := objectKey(testBucket, response.URL)
+	w := performRequest(r, "GET", fmt.Sprintf("/faceclaim/metadata/%v/%v", testBucket, object), nil)
+	assert.Equal(t, 200, w.Code)
+
+	var metadata FaceclaimMetadata
+	json.Unmarshal(w.Body.Bytes(), &metadata)
+	assert.Equal(t, "NEARLINE", metadata.StorageClass)
+
+	for _, key := range store.keys(testBucket) {
+		attrs, _ := store.Attrs(context.Background(), testBucket, key)
+		assert.Equal(t, "NEARLINE", attrs.StorageClass, "%v should share the faceclaim's class", key)
+	}
+}
+
+func TestUploadDefaultStorageClass(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	FaceclaimStorageClass = "COLDLINE"
+	t.Cleanup(func() { FaceclaimStorageClass = "" })
+	r := setupRouter(false)
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Equal(t, "COLDLINE", attrs.StorageClass)
+}
+
+func TestUploadRejectsUnknownStorageClass(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.StorageClass = "REGIONAL"
+	w := postTestImage(r, request)
+
+	assert.Equal(t, 400, w.Code)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestLogUploadStorageClass(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	var b bytes.Buffer
+	m := multipart.NewWriter(&b)
+	fw, _ := m.CreateFormFile("log_file", "bot.log")
+	fw.Write([]byte("log line"))
+	m.WriteField("storage_class", "ARCHIVE")
+	m.Close()
+
+	req := httptest.NewRequest("POST", "/log/upload", &b)
+	req.Header.Set("Content-Type", m.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 201, w.Code)
+	attrs, err := store.Attrs(context.Background(), logBucket, "bot.log")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ARCHIVE", attrs.StorageClass)
+	}
+}
+
+func TestPrepareStorageClasses(t *testing.T) {
+	os.Setenv("LOG_STORAGE_CLASS", "coldline")
+	t.Cleanup(func() {
+		os.Unsetenv("LOG_STORAGE_CLASS")
+		os.Unsetenv("FACECLAIM_STORAGE_CLASS")
+		prepareStorageClasses()
+	})
+
+	assert.NoError(t, prepareStorageClasses())
+	assert.Equal(t, "COLDLINE", LogStorageClass)
+	assert.Equal(t, "", FaceclaimStorageClass)
+
+	os.Setenv("FACECLAIM_STORAGE_CLASS", "MULTI_REGIONAL")
+	assert.Error(t, prepareStorageClasses())
+}
+
+func TestUploadReturnsCRC32C(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	response := uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.NotEmpty(t, response.CRC32C)
+	assert.Equal(t, encodeCRC32C(attrs.CRC32C), response.CRC32C)
+}
+
+func TestCorruptUploadIsRemoved(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	store.corrupt = true
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.KeepOriginal = &keep
+	w := postTestImage(r, request)
+
+	assert.Equal(t, 502, w.Code)
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, "storage_error", response["code"])
+	assert.Empty(t, store.keys(testBucket), "Corrupt objects should be deleted")
+}
+
+func TestVerifyUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	data := []byte("faceclaim")
+	crc, md5sum := checksums(data)
+	store.Upload(context.Background(), testBucket, "__test/a.webp", bytes.NewReader(data), UploadOptions{})
+
+	assert.NoError(t, verifyUpload(context.Background(), testBucket, "__test/a.webp", crc, md5sum))
+
+	err := verifyUpload(context.Background(), testBucket, "__test/a.webp", crc+1, md5sum)
+	var integrityErr *IntegrityError
+	assert.ErrorAs(t, err, &integrityErr)
+
+	err = verifyUpload(context.Background(), testBucket, "__test/a.webp", crc, []byte("nope"))
+	assert.ErrorAs(t, err, &integrityErr)
+}
+
+// Post a log file through the log route
+func postLog(r http.Handler, name, contents string) *httptest.ResponseRecorder {
+	var b bytes.Buffer
+	m := multipart.NewWriter(&b)
+	fw, _ := m.CreateFormFile("log_file", name)
+	fw.Write([]byte(contents))
+	m.Close()
+
+	req := httptest.NewRequest("POST", "/log/upload", &b)
+	req.Header.Set("Content-Type", m.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLogOverwrite(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	assert.Equal(t, 201, postLog(r, "bot.log", "first").Code)
+	assert.Equal(t, 201, postLog(r, "bot.log", "second").Code)
+
+	data, _ := store.Download(context.Background(), logBucket, "bot.log")
+	assert.Equal(t, "second", string(data))
+}
+
+func TestLogUploadLocation(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := postLog(r, "bot.log", "log line")
+	assert.Equal(t, 201, w.Code)
+	assert.Equal(t, "gs://"+logBucket+"/bot.log", w.Header().Get("Location"))
+}
+
+func TestLogOverwriteConflict(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	assert.Equal(t, 201, postLog(r, "bot.log", "first").Code)
+
+	// Another writer gets in between the generation lookup and the write
+	store.beforeUpload = func(bucket, object string) {
+		store.Upload(context.Background(), bucket, object, strings.NewReader("theirs"), UploadOptions{})
+	}
+	w := postLog(r, "bot.log", "ours")
+
+	assert.Equal(t, 409, w.Code)
+	response := conflictResponse(t, w)
+	attrs, _ := store.Attrs(context.Background(), logBucket, "bot.log")
+	assert.Equal(t, attrs.Generation, response.Generation)
+	assert.Equal(t, logBucket, response.Bucket)
+	assert.Equal(t, "bot.log", response.Key)
+
+	data, _ := store.Download(context.Background(), logBucket, "bot.log")
+	assert.Equal(t, "theirs", string(data), "The other writer's log shouldn't be clobbered")
+}
+
+func TestLogCreateConflict(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	store.beforeUpload = func(bucket, object string) {
+		store.Upload(context.Background(), bucket, object, strings.NewReader("theirs"), UploadOptions{})
+	}
+	w := postLog(r, "bot.log", "ours")
+
+	assert.Equal(t, 409, w.Code)
+	response := conflictResponse(t, w)
+	assert.Equal(t, "bot.log", response.Key)
+	assert.NotZero(t, response.Generation)
+}
+
+func TestFaceclaimCreateConflict(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useDeterministicIDs(t, 1)
+	r := setupRouter(false)
+
+	store.beforeUpload = func(bucket, object string) {
+		store.Upload(context.Background(), bucket, object, strings.NewReader("theirs"), UploadOptions{})
+	}
+	w := postTestImage(r, createFaceclaimRequest(testBucket))
+
+	assert.Equal(t, 409, w.Code)
+	response := conflictResponse(t, w)
+	attrs, _ := store.Attrs(context.Background(), testBucket, testObjectKey(1))
+	assert.Equal(t, testBucket, response.Bucket)
+	assert.Equal(t, testObjectKey(1), response.Key)
+	assert.Equal(t, attrs.Generation, response.Generation)
+}
+
+type conflictBody struct {
+	Code       string `json:"code"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Generation int64  `json:"generation"`
+}
+
+// Decode a 409's body, checking it's a conflict
+func conflictResponse(t *testing.T, w *httptest.ResponseRecorder) conflictBody {
+	var response conflictBody
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "conflict", response.Code)
+	return response
+}
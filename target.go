@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+)
+
+// Encoding to a target size tries at most this many qualities.
+const maxTargetPasses = 4
+
+// Reads WEBP_QUALITY_FLOOR, the lowest quality uploads with a target_bytes
+// are encoded at, however far over the target that leaves them. It defaults
+// to 50 and can't exceed WEBP_QUALITY.
+func loadTargetSize(cfg *Config) error {
+	if value, ok := os.LookupEnv("WEBP_QUALITY_FLOOR"); ok {
+		floor, err := strconv.Atoi(value)
+		if err != nil || floor < 1 || floor > 100 {
+			return errors.New("WEBP_QUALITY_FLOOR must be between 1 and 100")
+		}
+		cfg.WebPQualityFloor = floor
+	}
+	if cfg.WebPQualityFloor > cfg.WebPQuality {
+		return errors.New("WEBP_QUALITY_FLOOR can't be above WEBP_QUALITY")
+	}
+	return nil
+}
+
+// Encodes source into dst at the highest quality, from top down to
+// WEBP_QUALITY_FLOOR, that comes in at or under target bytes. The search is
+// bounded to maxTargetPasses encodes, so the quality found may be a little
+// below the best possible. If even the floor is too big, it's used anyway,
+// and missed is true. Returns the quality used.
+func encodeToTarget(ctx context.Context, source []byte, dst *bytes.Buffer, target int64, top int) (quality int, missed bool, err error) {
+	cfg := currentConfig()
+	best := getBuffer()
+	defer func() { putBuffer(best) }()
+	scratch := getBuffer()
+	defer func() { putBuffer(scratch) }()
+
+	// Encodes at q into scratch, returning whether it fits
+	encode := func(q int) (bool, error) {
+		scratch.Reset()
+		if err := ImageConverter.Convert(ctx, bytes.NewReader(source), scratch, q); err != nil {
+			return false, err
+		}
+		return int64(scratch.Len()) <= target, nil
+	}
+	// Keeps what's in scratch as the best so far
+	keep := func(q int) {
+		best, scratch = scratch, best
+		quality = q
+	}
+
+	floor := cfg.WebPQualityFloor
+	if floor > top {
+		floor = top
+	}
+
+	fits, err := encode(top)
+	if err != nil {
+		return 0, false, err
+	}
+	keep(top)
+	if !fits && floor < top {
+		if fits, err = encode(floor); err != nil {
+			return 0, false, err
+		}
+		keep(floor)
+	}
+	if !fits {
+		missed = true
+	} else if quality == floor {
+		// The best fitting quality lies between the floor, which fits, and
+		// the top, which doesn't
+		lo, hi := floor, top
+		for pass := 2; pass < maxTargetPasses && hi-lo > 1; pass++ {
+			mid := (lo + hi) / 2
+			ok, err := encode(mid)
+			if err != nil {
+				return 0, false, err
+			}
+			if ok {
+				lo = mid
+				keep(mid)
+			} else {
+				hi = mid
+			}
+		}
+	}
+
+	dst.Reset()
+	dst.Write(best.Bytes())
+	return quality, missed, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// paddedConverter encodes like fakeConverter, padded with an extra RIFF chunk
+// of perQuality bytes for every point of quality, so size tracks quality the
+// way a real encoder's does. It records the qualities it's asked for.
+type paddedConverter struct {
+	sync.Mutex
+	perQuality int
+	qualities  []int
+}
+
+func (p *paddedConverter) Convert(ctx context.Context, src io.Reader, dst io.Writer, quality int) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	p.qualities = append(p.qualities, quality)
+	p.Unlock()
+
+	webp := encodeLosslessWebP(img)
+	padding := make([]byte, 8+quality*p.perQuality)
+	copy(padding, "PADD")
+	binary.LittleEndian.PutUint32(padding[4:], uint32(quality*p.perQuality))
+	webp = append(webp, padding...)
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(webp)-8))
+	_, err = dst.Write(webp)
+	return err
+}
+
+// Install a padded converter for the duration of a test
+func usePaddedConverter(t *testing.T, perQuality int) *paddedConverter {
+	converter := &paddedConverter{perQuality: perQuality}
+	ImageConverter = converter
+	t.Cleanup(func() { ImageConverter = fakeConverter{} })
+	return converter
+}
+
+func TestUploadTargetBytes(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	converter := usePaddedConverter(t, 4000)
+	r := setupRouter(false)
+
+	// At the default quality of 99, the WebP is over 400 KB
+	request := createFaceclaimRequest(testBucket)
+	request.TargetBytes = 300_000
+	response := uploadTestImage(t, r, request)
+
+	assert.LessOrEqual(t, response.OutputBytes, request.TargetBytes)
+	assert.False(t, response.TargetMissed)
+	assert.Greater(t, response.Quality, currentConfig().WebPQualityFloor, "The search should improve on the floor")
+	assert.Less(t, response.Quality, currentConfig().WebPQuality)
+	assert.LessOrEqual(t, len(converter.qualities), maxTargetPasses)
+	assert.Contains(t, converter.qualities, response.Quality)
+
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Equal(t, response.OutputBytes, attrs.Size)
+	assert.Equal(t, strconv.Itoa(response.Quality), attrs.Metadata["quality"])
+}
+
+func TestUploadTargetMissed(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	usePaddedConverter(t, 4000)
+	useConfig(t, func(cfg *Config) { cfg.WebPQualityFloor = 60 })
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.TargetBytes = 100_000
+	response := uploadTestImage(t, r, request)
+
+	assert.True(t, response.TargetMissed)
+	assert.Equal(t, 60, response.Quality, "The floor should be stored rather than failing")
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Equal(t, "true", attrs.Metadata["target_missed"])
+}
+
+func TestUploadWithinTargetKeepsQuality(t *testing.T) {
+	useFakeBackends(t)
+	converter := usePaddedConverter(t, 10)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.TargetBytes = 200_000
+	response := uploadTestImage(t, r, request)
+
+	assert.Equal(t, currentConfig().WebPQuality, response.Quality)
+	assert.Equal(t, []int{currentConfig().WebPQuality}, converter.qualities, "Nothing should be re-encoded")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestTimeout bounds the total time spent on a request. Uploads, which
+// download and convert an image, get UploadTimeout instead.
+var RequestTimeout = 60 * time.Second
+var UploadTimeout = 180 * time.Second
+
+// Reads REQUEST_TIMEOUT and UPLOAD_TIMEOUT as durations, e.g. "90s".
+func prepareTimeouts() error {
+	RequestTimeout = 60 * time.Second
+	UploadTimeout = 180 * time.Second
+
+	timeouts := map[string]*time.Duration{
+		"REQUEST_TIMEOUT": &RequestTimeout,
+		"UPLOAD_TIMEOUT":  &UploadTimeout,
+	}
+	for name, timeout := range timeouts {
+		if value, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%v must be a positive duration, e.g. \"60s\"", name)
+			}
+			*timeout = d
+		}
+	}
+	return nil
+}
+
+// Returns the timeout for a route. Reconciliation and migration work through
+// whole buckets, and raw logs can be huge, so they get the upload timeout too.
+func routeTimeout(route string) time.Duration {
+	switch route {
+	case "/faceclaim/upload", "/faceclaim/refresh/:bucket/:charid/:key", "/faceclaim/reconcile", "/admin/migrate", "/log/raw/:name":
+		return UploadTimeout
+	}
+	return RequestTimeout
+}
+
+// The routes that accept X-Deadline-Ms.
+var clientDeadlineRoutes = map[string]bool{
+	"/faceclaim/upload":  true,
+	"/faceclaim/inspect": true,
+	"/log/upload":        true,
+	"/log/raw/:name":     true,
+}
+
+// How long before a client's deadline the request is given up on, so the 504
+// reaches the client in time.
+const clientDeadlineMargin = 250 * time.Millisecond
+
+// Returns how long the client will wait for a response, less
+// clientDeadlineMargin, from its X-Deadline-Ms header. ok is false if there's
+// no header, or it isn't a positive number of milliseconds, in which case
+// the request is warned about it.
+func clientDeadline(c *gin.Context) (timeout time.Duration, ok bool) {
+	value := c.GetHeader("X-Deadline-Ms")
+	if value == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		warnRequest(c, "ignored_deadline", fmt.Sprintf("Ignored X-Deadline-Ms %q: it must be a positive number of milliseconds", value))
+		return 0, false
+	}
+	timeout = time.Duration(ms)*time.Millisecond - clientDeadlineMargin
+	if timeout < 0 {
+		timeout = 0
+	}
+	return timeout, true
+}
+
+// Timeout puts a deadline on each request's context. Handlers pass the context
+// down so stuck work is cancelled; if the deadline passes before a response is
+// written, the request fails with a 504. Upload routes give up sooner if the
+// client's X-Deadline-Ms says it won't wait that long.
+func Timeout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := routeTimeout(c.FullPath())
+		if clientDeadlineRoutes[c.FullPath()] {
+			if client, ok := clientDeadline(c); ok && client < timeout {
+				timeout = client
+			}
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		abortIfTimedOut(c)
+	}
+}
+
+// Responds with a 504 if the request's deadline has passed and nothing has
+// been written yet. Returns whether the request timed out.
+func abortIfTimedOut(c *gin.Context) bool {
+	if c.Request.Context().Err() != context.DeadlineExceeded {
+		return false
+	}
+	if !c.Writer.Written() {
+		abortWith(c, http.StatusGatewayTimeout, gin.H{"error": "The request timed out", "code": "deadline_exceeded"})
+	}
+	return true
+}
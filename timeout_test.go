@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingFetcher never finishes a download until its context is cancelled.
+type hangingFetcher struct{}
+
+func (hangingFetcher) Fetch(ctx context.Context, url string) (*FetchedImage, error) {
+	<-ctx.Done()
+	return nil, fmt.Errorf("hangingFetcher: %w", ctx.Err())
+}
+
+// Shorten the upload timeout for the duration of a test
+func useUploadTimeout(t *testing.T, timeout time.Duration) {
+	UploadTimeout = timeout
+	t.Cleanup(func() { UploadTimeout = 180 * time.Second })
+}
+
+func TestUploadTimesOut(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useUploadTimeout(t, 100*time.Millisecond)
+	ImageFetcher = hangingFetcher{}
+	defer func() { ImageFetcher = httpFetcher{} }()
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = "https://example.com/stuck.png"
+	body, _ := json.Marshal(request)
+
+	r := setupRouter(false)
+	start := time.Now()
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+
+	assert.Equal(t, 504, w.Code)
+	assert.Less(t, time.Since(start), time.Second, "The 504 should arrive at the deadline")
+	assert.Contains(t, w.Body.String(), "timed out")
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestRouteTimeout(t *testing.T) {
+	assert.Equal(t, UploadTimeout, routeTimeout("/faceclaim/upload"))
+	assert.Equal(t, RequestTimeout, routeTimeout("/faceclaim/metadata/:bucket/:charid/:key"))
+}
+
+func TestPrepareTimeouts(t *testing.T) {
+	defer os.Unsetenv("REQUEST_TIMEOUT")
+	defer os.Unsetenv("UPLOAD_TIMEOUT")
+
+	assert.Nil(t, prepareTimeouts())
+	assert.Equal(t, 60*time.Second, RequestTimeout)
+	assert.Equal(t, 180*time.Second, UploadTimeout)
+
+	os.Setenv("REQUEST_TIMEOUT", "30s")
+	os.Setenv("UPLOAD_TIMEOUT", "5m")
+	assert.Nil(t, prepareTimeouts())
+	assert.Equal(t, 30*time.Second, RequestTimeout)
+	assert.Equal(t, 5*time.Minute, UploadTimeout)
+
+	os.Setenv("UPLOAD_TIMEOUT", "forever")
+	assert.NotNil(t, prepareTimeouts())
+
+	os.Unsetenv("REQUEST_TIMEOUT")
+	os.Unsetenv("UPLOAD_TIMEOUT")
+	prepareTimeouts()
+}
+
+func TestClientDeadline(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	ImageFetcher = hangingFetcher{}
+	defer func() { ImageFetcher = httpFetcher{} }()
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = "https://example.com/stuck.png"
+	body, _ := json.Marshal(request)
+
+	r := setupRouter(false)
+	req, _ := http.NewRequest("POST", "/faceclaim/upload", bytes.NewReader(body))
+	req.Header.Set("X-Deadline-Ms", "300")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 504, w.Code)
+	assert.Less(t, time.Since(start), 300*time.Millisecond, "The 504 should come before the client's deadline")
+	assert.Contains(t, w.Body.String(), "deadline_exceeded")
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestClientDeadlineInvalid(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	defer server.Close()
+
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest("POST", "/faceclaim/upload", bytes.NewReader(body))
+	req.Header.Set("X-Deadline-Ms", "soon")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 201, w.Code, "The header is ignored")
+	assert.Contains(t, w.Header().Get("Warning"), "X-Deadline-Ms")
+	var response FaceclaimResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if assert.Len(t, response.Warnings, 1) {
+		assert.Equal(t, "ignored_deadline", response.Warnings[0].Code)
+		assert.Contains(t, response.Warnings[0].Message, `Ignored X-Deadline-Ms "soon"`)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingEnabled is whether requests are traced. When they are, each request
+// continues the trace in its incoming traceparent header, and messages
+// published on its behalf carry the trace to their consumers.
+var TracingEnabled bool
+
+var tracer = otel.Tracer("inconnu-api")
+
+// Trace context travels in W3C traceparent headers and message attributes.
+var traceContext = propagation.TraceContext{}
+
+// Reads TRACING, which enables tracing.
+func prepareTracing() error {
+	TracingEnabled = false
+	if value, ok := os.LookupEnv("TRACING"); ok {
+		var err error
+		if TracingEnabled, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("TRACING: %v", err)
+		}
+	}
+	if TracingEnabled {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		))
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+// Returns the ID of the request a context belongs to, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestContext gives each request an ID, taken from the X-Request-ID header
+// if the client sent one, and echoes it in the response. If tracing is
+// enabled, the request is also wrapped in a span.
+func RequestContext() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" {
+			id = primitive.NewObjectID().Hex()
+		}
+		c.Header("X-Request-ID", id)
+		ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+
+		if TracingEnabled {
+			ctx = traceContext.Extract(ctx, propagation.HeaderCarrier(c.Request.Header))
+			var span trace.Span
+			ctx, span = tracer.Start(ctx, c.Request.Method+" "+c.FullPath(),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attribute.String("request_id", id)),
+			)
+			defer func() {
+				span.SetAttributes(attribute.Int("http.status_code", c.Writer.Status()))
+				span.End()
+			}()
+		}
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// Adds the request ID and trace context, if any, to a message's attributes.
+// The caller's attributes are left untouched.
+func messageAttributes(ctx context.Context, attributes map[string]string) map[string]string {
+	combined := make(map[string]string, len(attributes)+2)
+	for k, v := range attributes {
+		combined[k] = v
+	}
+	if id := requestID(ctx); id != "" {
+		combined["request_id"] = id
+	}
+	// Only injects a traceparent if there's an active span
+	traceContext.Inject(ctx, propagation.MapCarrier(combined))
+	return combined
+}
+
+// Recovers the request ID and trace context from a message's attributes, so a
+// consumer can continue the trace that published it.
+func messageContext(ctx context.Context, attributes map[string]string) context.Context {
+	if id := attributes["request_id"]; id != "" {
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+	}
+	return traceContext.Extract(ctx, propagation.MapCarrier(attributes))
+}
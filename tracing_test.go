@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var traceparentPattern = regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-0[01]$`)
+
+// Enable tracing for the duration of a test
+func useTracing(t *testing.T) {
+	provider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	TracingEnabled = true
+	t.Cleanup(func() {
+		TracingEnabled = false
+		otel.SetTracerProvider(provider)
+	})
+}
+
+func TestTraceparentPublished(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	useTracing(t)
+	r := setupRouter(false)
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest("DELETE", "/faceclaim/delete/"+testBucket+"/__test/all", nil)
+	req.Header.Set("traceparent", incoming)
+	req.Header.Set("X-Request-ID", "req-123")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "req-123", w.Header().Get("X-Request-ID"))
+
+	attributes := publisher.published()[0].Attributes
+	assert.Equal(t, "req-123", attributes["request_id"])
+	assert.Regexp(t, traceparentPattern, attributes["traceparent"])
+
+	// The message continues the caller's trace in a new span
+	assert.Contains(t, attributes["traceparent"], "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.NotEqual(t, incoming, attributes["traceparent"])
+
+	// A consumer picks the trace back up from the attributes
+	ctx := messageContext(context.Background(), attributes)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.SpanContextFromContext(ctx).TraceID().String())
+	assert.Equal(t, "req-123", requestID(ctx))
+}
+
+func TestTraceparentAbsentWhenDisabled(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := performRequest(r, "DELETE", "/faceclaim/delete/"+testBucket+"/__test/all", nil)
+	assert.Equal(t, 200, w.Code)
+
+	attributes := publisher.published()[0].Attributes
+	assert.NotContains(t, attributes, "traceparent")
+	assert.Equal(t, w.Header().Get("X-Request-ID"), attributes["request_id"])
+	assert.NotEmpty(t, attributes["request_id"], "A request ID should be generated")
+}
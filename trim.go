@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A TrimResult is the response body for /faceclaim/trim. Removed and Skipped
+// are faceclaims' URLs; their kept originals and variants go with them.
+type TrimResult struct {
+	Kept    int      `json:"kept"`
+	Removed []string `json:"removed"`
+	Skipped []string `json:"skipped,omitempty"`
+	Queued  bool     `json:"queued"`
+}
+
+// Trims a character to its newest faceclaims, keeping ?keep=N of them. Older
+// ones are deleted, or with ?queue=true, queued for deletion like single
+// deletes. Held faceclaims are never removed, and don't make up for others.
+func trimFaceclaims(c *gin.Context) {
+	bucket, charid := c.Param("bucket"), c.Param("charid")
+	keep, err := strconv.Atoi(c.Query("keep"))
+	if err != nil || keep < 1 {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "keep must be a positive integer"})
+		return
+	}
+	queue, err := strconv.ParseBool(c.DefaultQuery("queue", "false"))
+	if err != nil {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "queue must be true or false"})
+		return
+	}
+
+	result, err := trimCharacter(c.Request.Context(), bucket, charid, keep, queue)
+	recordDelete(bucket, "trim", err)
+	if abortIfJournalFull(c, err) {
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abortWith(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, result)
+}
+
+// Removes all but a character's newest keep faceclaims, except those that are
+// held. Uploads to the character wait until it's done.
+func trimCharacter(ctx context.Context, bucket, charid string, keep int, queue bool) (TrimResult, error) {
+	defer characterLocks.lock(bucket + "/" + charid)()
+
+	result := TrimResult{Removed: []string{}, Queued: queue}
+	faceclaims, err := characterFaceclaims(bucket, charid)
+	if err != nil {
+		return result, err
+	}
+	excess := len(faceclaims) - keep
+	if excess <= 0 {
+		result.Kept = len(faceclaims)
+		return result, nil
+	}
+
+	for _, attrs := range faceclaims[:excess] {
+		url := objectURL(bucket, attrs.Name)
+		if isHeld(attrs) {
+			result.Skipped = append(result.Skipped, url)
+			continue
+		}
+		if queue {
+			key := strings.TrimPrefix(attrs.Name, charid+"/")
+			if _, err := queueFaceclaimDeletion(ctx, bucket, charid, key); err != nil {
+				return result, fmt.Errorf("trim: %w", err)
+			}
+		} else {
+			for _, name := range faceclaimObjects(attrs.Name, attrs.Metadata) {
+				if err := deleteObject(ctx, bucket, name); err != nil {
+					return result, fmt.Errorf("trim: %w", err)
+				}
+			}
+		}
+		log.Println("Trimmed", attrs.Name)
+		result.Removed = append(result.Removed, url)
+	}
+	result.Kept = len(faceclaims) - len(result.Removed)
+	guildUsage.invalidate(bucket)
+	return result, nil
+}
+
+// Trims a character to the upload's trim_to once its faceclaim is stored. The
+// upload stands even if that fails, with a warning saying so.
+func trimAfterUpload(ctx context.Context, request FaceclaimRequest, response *FaceclaimResponse) {
+	bucket := request.Bucket
+	if bucket == "" {
+		bucket = currentConfig().FaceclaimBucket
+	}
+	result, err := trimCharacter(ctx, bucket, request.CharID, request.TrimTo, false)
+	recordDelete(bucket, "trim", err)
+	response.Trimmed = result.Removed
+	if err != nil {
+		log.Println("Unable to trim", request.CharID, "after upload:", err)
+		response.warn("trim_failed", fmt.Sprintf("Unable to trim to %v faceclaims: %v", request.TrimTo, err))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Upload five faceclaims, the first with a variant, and backdate them so
+// they're oldest first in an order that isn't the upload order. Returns their
+// names, oldest first.
+func seedTrim(t *testing.T, r http.Handler, store *memStorage) []string {
+	var names []string
+	for i := 0; i < 5; i++ {
+		request := createFaceclaimRequest(testBucket)
+		if i == 0 {
+			request.Variants = []string{"16"}
+		}
+		names = append(names, objectKey(testBucket, uploadTestImage(t, r, request).URL))
+	}
+	oldestFirst := []string{names[3], names[0], names[4], names[1], names[2]}
+	start := time.Now().Add(-time.Hour)
+	store.Lock()
+	for i, name := range oldestFirst {
+		store.objects[testBucket+"/"+name].attrs.Created = start.Add(time.Duration(i) * time.Minute)
+	}
+	store.Unlock()
+	return oldestFirst
+}
+
+func postTrim(r http.Handler, query string) (*httptest.ResponseRecorder, TrimResult) {
+	w := performRequest(r, "POST", fmt.Sprintf("/faceclaim/trim/%v/%v%v", testBucket, testCharID, query), nil)
+	var result TrimResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w, result
+}
+
+func TestTrimFaceclaims(t *testing.T) {
+	for _, query := range []string{"", "&queue=true"} {
+		t.Run(query, func(t *testing.T) {
+			store, publisher := useFakeBackends(t)
+			r := setupRouter(false)
+			names := seedTrim(t, r, store)
+
+			w, result := postTrim(r, "?keep=2"+query)
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, 2, result.Kept)
+			assert.Equal(t, query != "", result.Queued)
+			var removed []string
+			for _, name := range names[:3] {
+				removed = append(removed, objectURL(testBucket, name))
+			}
+			assert.Equal(t, removed, result.Removed)
+			assert.ElementsMatch(t, names[3:], store.keys(testBucket), "The variant went with its faceclaim")
+			assert.Equal(t, query != "", len(publisher.published()) > 0)
+
+			// Trimming again changes nothing
+			_, result = postTrim(r, "?keep=2"+query)
+			assert.Empty(t, result.Removed)
+			assert.Equal(t, 2, result.Kept)
+		})
+	}
+}
+
+func TestTrimSkipsHeld(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	names := seedTrim(t, r, store)
+	store.SetHold(context.Background(), testBucket, names[1], true)
+
+	_, result := postTrim(r, "?keep=2")
+	assert.Equal(t, []string{objectURL(testBucket, names[1])}, result.Skipped)
+	assert.Len(t, result.Removed, 2)
+	assert.Equal(t, 3, result.Kept)
+	assert.ElementsMatch(t, []string{names[1], variantObjectName(names[1], "16"), names[3], names[4]}, store.keys(testBucket))
+
+	for _, query := range []string{"", "?keep=0", "?keep=two", "?keep=2&queue=maybe"} {
+		w, _ := postTrim(r, query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestUploadTrimTo(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+	names := seedTrim(t, r, store)
+
+	request := createFaceclaimRequest(testBucket)
+	request.TrimTo = 3
+	response := uploadTestImage(t, r, request)
+	var trimmed []string
+	for _, name := range names[:3] {
+		trimmed = append(trimmed, objectURL(testBucket, name))
+	}
+	assert.Equal(t, trimmed, response.Trimmed)
+	assert.ElementsMatch(t, append(names[3:], objectKey(testBucket, response.URL)), store.keys(testBucket))
+
+	request.TrimTo = -1
+	w := postTestImage(r, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
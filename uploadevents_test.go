@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Turn on upload events for the duration of a test
+func usePublishUploadEvents(t *testing.T) {
+	PublishUploadEvents = true
+	t.Cleanup(func() { PublishUploadEvents = false })
+}
+
+// The upload events a fake publisher has recorded
+func uploadEvents(publisher *fakePublisher) []publishedMessage {
+	var events []publishedMessage
+	for _, message := range publisher.published() {
+		if message.Topic == "faceclaim-uploaded" {
+			events = append(events, message)
+		}
+	}
+	return events
+}
+
+func TestUploadEvent(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	usePublishUploadEvents(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Guild, request.User = 123, 456
+	response := uploadTestImage(t, r, request)
+
+	events := uploadEvents(publisher)
+	if assert.Len(t, events, 1) {
+		data := events[0].Data
+		assert.Equal(t, testBucket, data["bucket"])
+		assert.Equal(t, objectName(testBucket, response.URL), data["key"])
+		assert.Equal(t, testCharID, data["charid"])
+		assert.Equal(t, "123", data["guild"])
+		assert.Equal(t, "456", data["user"])
+		assert.Equal(t, fmt.Sprint(response.OutputBytes), data["bytes"])
+		assert.Equal(t, fmt.Sprint(response.Width), data["width"])
+		assert.Equal(t, fmt.Sprint(response.Height), data["height"])
+	}
+}
+
+func TestUploadEventsBackground(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	usePublishUploadEvents(t)
+	r := setupRouter(false)
+
+	// Background uploads are published like direct ones, once apiece
+	var keys []string
+	for i := 0; i < 3; i++ {
+		job := startAsyncUpload(t, r)
+		status := waitForJob(t, r, job.ID)
+		assert.Equal(t, string(JobSucceeded), status["status"], status["error"])
+
+		result, _ := json.Marshal(status["result"])
+		var response FaceclaimResponse
+		json.Unmarshal(result, &response)
+		keys = append(keys, objectName(testBucket, response.URL))
+	}
+
+	events := uploadEvents(publisher)
+	if assert.Len(t, events, 3) {
+		for i, event := range events {
+			assert.Equal(t, keys[i], event.Data["key"])
+			assert.Equal(t, testCharID, event.Data["charid"])
+		}
+	}
+}
+
+func TestUploadEventFailure(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	usePublishUploadEvents(t)
+	publisher.err = errors.New("pubsub is down")
+	r := setupRouter(false)
+
+	failures := testutil.ToFloat64(uploadEventsTotal.WithLabelValues("failure"))
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.Equal(t, failures+1, testutil.ToFloat64(uploadEventsTotal.WithLabelValues("failure")))
+}
+
+func TestUploadEventsOff(t *testing.T) {
+	_, publisher := useFakeBackends(t)
+	r := setupRouter(false)
+
+	uploadTestImage(t, r, createFaceclaimRequest(testBucket))
+	assert.Empty(t, uploadEvents(publisher))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// At most UploadConcurrency writes to GCS run at once. Up to UploadQueueSize
+// more wait their turn, in the order they arrived, for at most
+// UploadQueueWait; past that, uploads are refused with an UploadPoolError.
+var (
+	UploadConcurrency = 4
+	UploadQueueSize   = 16
+	UploadQueueWait   = 10 * time.Second
+)
+
+// uploads is the pool every upload to GCS goes through: faceclaims, their
+// variants and originals, and logs.
+var uploads = newUploadPool(UploadConcurrency, UploadQueueSize, UploadQueueWait)
+
+// Reads UPLOAD_CONCURRENCY, UPLOAD_QUEUE_SIZE, and UPLOAD_QUEUE_WAIT.
+func prepareUploadPool() error {
+	UploadConcurrency, UploadQueueSize, UploadQueueWait = 4, 16, 10*time.Second
+
+	if value, ok := os.LookupEnv("UPLOAD_CONCURRENCY"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return errors.New("UPLOAD_CONCURRENCY must be a positive integer")
+		}
+		UploadConcurrency = n
+	}
+	if value, ok := os.LookupEnv("UPLOAD_QUEUE_SIZE"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("UPLOAD_QUEUE_SIZE must be a non-negative integer")
+		}
+		UploadQueueSize = n
+	}
+	if value, ok := os.LookupEnv("UPLOAD_QUEUE_WAIT"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.New("UPLOAD_QUEUE_WAIT must be a positive duration, e.g. \"10s\"")
+		}
+		UploadQueueWait = d
+	}
+	uploads = newUploadPool(UploadConcurrency, UploadQueueSize, UploadQueueWait)
+	return nil
+}
+
+// An UploadPoolError means an upload couldn't get a turn: the queue was full,
+// or it waited too long.
+type UploadPoolError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *UploadPoolError) Error() string {
+	return "unable to start the upload: " + e.Reason
+}
+
+// An uploadPool limits concurrent uploads, queueing the overflow.
+type uploadPool struct {
+	sync.Mutex
+	limit     int
+	queueSize int
+	wait      time.Duration
+	active    int
+	queue     []chan struct{} // Closed when it's the waiter's turn
+}
+
+func newUploadPool(limit, queueSize int, wait time.Duration) *uploadPool {
+	return &uploadPool{limit: limit, queueSize: queueSize, wait: wait}
+}
+
+// Waits for a turn to upload, returning a function that ends it.
+func (p *uploadPool) acquire(ctx context.Context) (func(), error) {
+	p.Lock()
+	if p.active < p.limit && len(p.queue) == 0 {
+		p.active++
+		p.Unlock()
+		recordUploadWait(0)
+		return p.release, nil
+	}
+	if len(p.queue) >= p.queueSize {
+		p.Unlock()
+		recordUploadRejection()
+		return nil, &UploadPoolError{Reason: "too many uploads are queued", RetryAfter: p.wait}
+	}
+	turn := make(chan struct{})
+	p.queue = append(p.queue, turn)
+	setUploadQueueDepth(len(p.queue))
+	p.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(p.wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-turn:
+		recordUploadWait(time.Since(start))
+		return p.release, nil
+	case <-timer.C:
+		err = &UploadPoolError{Reason: fmt.Sprintf("no turn within %v", p.wait), RetryAfter: p.wait}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for i, waiting := range p.queue {
+		if waiting == turn {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			setUploadQueueDepth(len(p.queue))
+			recordUploadRejection()
+			return nil, err
+		}
+	}
+	// Our turn came as we gave up, so pass it on
+	p.handOff()
+	return nil, err
+}
+
+// Ends an upload's turn, handing it to the next in the queue.
+func (p *uploadPool) release() {
+	p.Lock()
+	defer p.Unlock()
+	p.handOff()
+}
+
+// Passes a finished turn to the first waiter, if there is one. The caller
+// holds the lock.
+func (p *uploadPool) handOff() {
+	if len(p.queue) == 0 {
+		p.active--
+		return
+	}
+	next := p.queue[0]
+	p.queue = p.queue[1:]
+	setUploadQueueDepth(len(p.queue))
+	close(next)
+}
+
+// Returns the number of uploads running and waiting.
+func (p *uploadPool) stats() (active, queued int) {
+	p.Lock()
+	defer p.Unlock()
+	return p.active, len(p.queue)
+}
+
+// Responds with a 503 and a Retry-After header if err is an UploadPoolError.
+// Returns whether it did.
+func abortIfUploadsBusy(c *gin.Context, err error) bool {
+	var poolErr *UploadPoolError
+	if !errors.As(err, &poolErr) {
+		return false
+	}
+	seconds := int((poolErr.RetryAfter + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	abortWith(c, http.StatusServiceUnavailable, gin.H{"error": err.Error(), "code": "uploads_busy"})
+	return true
+}
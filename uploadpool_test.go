@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Install an upload pool for the duration of a test
+func useUploadPool(t *testing.T, limit, queueSize int, wait time.Duration) *uploadPool {
+	pool := newUploadPool(limit, queueSize, wait)
+	old := uploads
+	uploads = pool
+	t.Cleanup(func() { uploads = old })
+	return pool
+}
+
+// slowStorage holds uploads until its gate opens, tracking how many run at
+// once.
+type slowStorage struct {
+	*memStorage
+	gate    chan struct{}
+	running atomic.Int32
+	most    atomic.Int32
+}
+
+func (s *slowStorage) Upload(ctx context.Context, bucket, object string, data io.Reader, opts UploadOptions) error {
+	running := s.running.Add(1)
+	defer s.running.Add(-1)
+	for {
+		most := s.most.Load()
+		if running <= most || s.most.CompareAndSwap(most, running) {
+			break
+		}
+	}
+	<-s.gate
+	return s.memStorage.Upload(ctx, bucket, object, data, opts)
+}
+
+// Wait for a condition to hold, failing the test if it doesn't soon
+func eventually(t *testing.T, condition func() bool) {
+	assert.Eventually(t, condition, time.Second, time.Millisecond)
+}
+
+func TestUploadPoolOrder(t *testing.T) {
+	pool := newUploadPool(1, 3, time.Second)
+	release, err := pool.acquire(context.Background())
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := pool.acquire(context.Background())
+			if !assert.NoError(t, err) {
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			release()
+		}()
+		// Queue them one at a time, so their order is known
+		eventually(t, func() bool { _, queued := pool.stats(); return queued == i })
+	}
+
+	release()
+	wg.Wait()
+	assert.Equal(t, []int{1, 2, 3}, order)
+	active, queued := pool.stats()
+	assert.Equal(t, 0, active)
+	assert.Equal(t, 0, queued)
+}
+
+func TestUploadPoolGivesUp(t *testing.T) {
+	pool := newUploadPool(1, 1, 20*time.Millisecond)
+	release, _ := pool.acquire(context.Background())
+
+	_, err := pool.acquire(context.Background())
+	var poolErr *UploadPoolError
+	assert.ErrorAs(t, err, &poolErr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = pool.acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Nobody's left waiting, so the turn goes back to the pool
+	release()
+	active, queued := pool.stats()
+	assert.Equal(t, 0, active)
+	assert.Equal(t, 0, queued)
+}
+
+func TestUploadPoolUnderLoad(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	slow := &slowStorage{memStorage: store, gate: make(chan struct{})}
+	Store = slow
+	pool := useUploadPool(t, 2, 1, 200*time.Millisecond)
+	r := setupRouter(false)
+
+	upload := func(name string) chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			done <- performRequest(r, "PUT", "/log/raw/"+name, strings.NewReader("log line"))
+		}()
+		return done
+	}
+
+	// Two uploads run, and a third waits
+	first, second := upload("1.log"), upload("2.log")
+	eventually(t, func() bool { return slow.running.Load() == 2 })
+	third := upload("3.log")
+	eventually(t, func() bool { _, queued := pool.stats(); return queued == 1 })
+
+	// With the queue full, a fourth is refused outright
+	w := performRequest(r, "PUT", "/log/raw/4.log", strings.NewReader("log line"))
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// The third gives up after waiting its limit
+	w = <-third
+	assert.Equal(t, 503, w.Code)
+	assert.Contains(t, w.Body.String(), "uploads_busy")
+
+	close(slow.gate)
+	assert.Equal(t, 201, (<-first).Code)
+	assert.Equal(t, 201, (<-second).Code)
+	assert.Equal(t, int32(2), slow.most.Load())
+	assert.ElementsMatch(t, []string{"1.log", "2.log"}, store.keys(logBucket))
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Usage is counted by the hour, so that's the finest a report can be
+// filtered to. Hours older than usageRetention are dropped from snapshots.
+const (
+	usageGranularity = time.Hour
+	usageRetention   = 90 * 24 * time.Hour
+)
+
+// UsageSnapshotInterval is how often each credential's usage is saved to GCS,
+// so it survives restarts; zero keeps it in memory only. Read from
+// USAGE_SNAPSHOT_INTERVAL.
+var UsageSnapshotInterval = 5 * time.Minute
+
+// UsageBucket and UsageObject are where usage is saved. An empty bucket means
+// FACECLAIM_BUCKET. Read from USAGE_BUCKET and USAGE_OBJECT.
+var (
+	UsageBucket string
+	UsageObject = "stats/usage.json"
+)
+
+// Reads USAGE_SNAPSHOT_INTERVAL, USAGE_BUCKET, and USAGE_OBJECT.
+func prepareUsage() error {
+	UsageSnapshotInterval, UsageBucket, UsageObject = 5*time.Minute, "", "stats/usage.json"
+	if value, ok := os.LookupEnv("USAGE_SNAPSHOT_INTERVAL"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return errors.New("USAGE_SNAPSHOT_INTERVAL must be a duration, e.g. \"5m\"")
+		}
+		UsageSnapshotInterval = d
+	}
+	if UsageBucket = os.Getenv("USAGE_BUCKET"); UsageBucket != "" {
+		if err := validateBucketName(UsageBucket); err != nil {
+			return fmt.Errorf("USAGE_BUCKET: %v", err)
+		}
+	}
+	if value, ok := os.LookupEnv("USAGE_OBJECT"); ok {
+		if value == "" {
+			return errors.New("USAGE_OBJECT must be an object name")
+		}
+		UsageObject = value
+	}
+	return nil
+}
+
+// TokenUsage is what a credential has done: its requests by route, e.g.
+// "POST /faceclaim/upload"; the bytes it wrote to GCS; the objects it deleted
+// or queued for deletion; and the character deletions it queued, whose
+// objects aren't known until they're carried out.
+type TokenUsage struct {
+	Requests       map[string]int64 `json:"requests"`
+	BytesUploaded  int64            `json:"bytes_uploaded"`
+	ObjectsDeleted int64            `json:"objects_deleted"`
+	GroupsDeleted  int64            `json:"groups_deleted"`
+}
+
+// Adds another credential's usage to this one.
+func (u *TokenUsage) merge(other *TokenUsage) {
+	if u.Requests == nil {
+		u.Requests = make(map[string]int64)
+	}
+	for route, n := range other.Requests {
+		u.Requests[route] += n
+	}
+	u.BytesUploaded += other.BytesUploaded
+	u.ObjectsDeleted += other.ObjectsDeleted
+	u.GroupsDeleted += other.GroupsDeleted
+}
+
+// usageLedger counts each credential's usage by the hour.
+type usageLedger struct {
+	sync.Mutex
+	hours map[time.Time]map[string]*TokenUsage
+	dirty bool
+}
+
+func newUsageLedger() *usageLedger {
+	return &usageLedger{hours: make(map[time.Time]map[string]*TokenUsage)}
+}
+
+var tokenUsage = newUsageLedger()
+
+// Updates a credential's usage for the hour containing now. Work done
+// without a credential, such as background retries, isn't counted.
+func (l *usageLedger) add(credential string, now time.Time, update func(*TokenUsage)) {
+	if credential == "" {
+		return
+	}
+	hour := now.UTC().Truncate(usageGranularity)
+	l.Lock()
+	defer l.Unlock()
+	credentials, ok := l.hours[hour]
+	if !ok {
+		credentials = make(map[string]*TokenUsage)
+		l.hours[hour] = credentials
+	}
+	usage, ok := credentials[credential]
+	if !ok {
+		usage = &TokenUsage{Requests: make(map[string]int64)}
+		credentials[credential] = usage
+	}
+	update(usage)
+	l.dirty = true
+}
+
+// Returns each credential's usage over the hours that start in [since, until).
+func (l *usageLedger) report(since, until time.Time) map[string]*TokenUsage {
+	since = since.UTC().Truncate(usageGranularity)
+	totals := make(map[string]*TokenUsage)
+	l.Lock()
+	defer l.Unlock()
+	for hour, credentials := range l.hours {
+		if hour.Before(since) || !hour.Before(until) {
+			continue
+		}
+		for credential, usage := range credentials {
+			if totals[credential] == nil {
+				totals[credential] = &TokenUsage{Requests: make(map[string]int64)}
+			}
+			totals[credential].merge(usage)
+		}
+	}
+	return totals
+}
+
+// A usageSnapshot is the ledger as it's saved to GCS.
+type usageSnapshot struct {
+	Saved time.Time           `json:"saved"`
+	Hours []usageSnapshotHour `json:"hours"`
+}
+
+type usageSnapshotHour struct {
+	Hour        time.Time              `json:"hour"`
+	Credentials map[string]*TokenUsage `json:"credentials"`
+}
+
+// Encodes the ledger's hours since the retention cutoff, oldest first, and
+// marks it clean. Older hours are dropped. Returns nothing if the ledger
+// hasn't changed since it was last encoded.
+func (l *usageLedger) encode(now time.Time) ([]byte, error) {
+	cutoff := now.Add(-usageRetention)
+	l.Lock()
+	defer l.Unlock()
+	if !l.dirty {
+		return nil, nil
+	}
+	snapshot := usageSnapshot{Saved: now.UTC()}
+	for hour, credentials := range l.hours {
+		if hour.Before(cutoff) {
+			delete(l.hours, hour)
+			continue
+		}
+		snapshot.Hours = append(snapshot.Hours, usageSnapshotHour{Hour: hour, Credentials: credentials})
+	}
+	sort.Slice(snapshot.Hours, func(i, j int) bool { return snapshot.Hours[i].Hour.Before(snapshot.Hours[j].Hour) })
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	l.dirty = false
+	return data, nil
+}
+
+// Adds a saved snapshot's counts to the ledger.
+func (l *usageLedger) restore(snapshot usageSnapshot) {
+	l.Lock()
+	defer l.Unlock()
+	for _, hour := range snapshot.Hours {
+		hour.Hour = hour.Hour.UTC()
+		if l.hours[hour.Hour] == nil {
+			l.hours[hour.Hour] = make(map[string]*TokenUsage)
+		}
+		for credential, usage := range hour.Credentials {
+			if l.hours[hour.Hour][credential] == nil {
+				l.hours[hour.Hour][credential] = &TokenUsage{Requests: make(map[string]int64)}
+			}
+			l.hours[hour.Hour][credential].merge(usage)
+		}
+	}
+}
+
+// Returns where usage snapshots are saved.
+func usageLocation() (string, string) {
+	if UsageBucket != "" {
+		return UsageBucket, UsageObject
+	}
+	return currentConfig().FaceclaimBucket, UsageObject
+}
+
+// Returns where usage is saved, for the config summary, or "" if it isn't.
+func usageObjectSummary() string {
+	if UsageSnapshotInterval == 0 {
+		return ""
+	}
+	bucket, object := usageLocation()
+	return fmt.Sprintf("gs://%v/%v", bucket, object)
+}
+
+// Saves the ledger to GCS, if it's changed since it was last saved.
+func saveUsage(ctx context.Context, l *usageLedger, now time.Time) error {
+	data, err := l.encode(now)
+	if err != nil {
+		return fmt.Errorf("saveUsage: %v", err)
+	}
+	if data == nil {
+		return nil
+	}
+	bucket, object := usageLocation()
+	err = uploadObject(ctx, bytes.NewBuffer(data), bucket, object, UploadOptions{ContentType: "application/json"})
+	if err != nil {
+		// Saved again next time
+		l.Lock()
+		l.dirty = true
+		l.Unlock()
+		return fmt.Errorf("saveUsage: %w", err)
+	}
+	return nil
+}
+
+// Adds the last saved snapshot, if there is one, to the ledger.
+func loadUsage(ctx context.Context, l *usageLedger) error {
+	bucket, object := usageLocation()
+	data, err := Store.Download(ctx, bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loadUsage: %v", err)
+	}
+	var snapshot usageSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("loadUsage: %v", err)
+	}
+	l.restore(snapshot)
+	return nil
+}
+
+// Restores the last snapshot, then saves the ledger every
+// UsageSnapshotInterval until the context is cancelled. Nothing is saved until
+// the snapshot has been restored, so it's never overwritten by a partial one.
+func watchUsage(ctx context.Context) {
+	restored := true
+	if err := loadUsage(ctx, tokenUsage); err != nil {
+		log.Println("Unable to restore token usage:", err)
+		restored = false
+	}
+	ticker := time.NewTicker(UsageSnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !restored {
+			if err := loadUsage(ctx, tokenUsage); err != nil {
+				log.Println("Unable to restore token usage:", err)
+				continue
+			}
+			restored = true
+		}
+		if err := saveUsage(ctx, tokenUsage, time.Now()); err != nil {
+			log.Println("Unable to save token usage:", err)
+		}
+	}
+}
+
+type credentialCtxKey struct{}
+
+// Returns a context carrying the credential work is done on behalf of, so
+// it's counted against it.
+func withCredential(ctx context.Context, credential string) context.Context {
+	return context.WithValue(ctx, credentialCtxKey{}, credential)
+}
+
+// Returns the credential a context's work is done on behalf of, if any.
+func contextCredential(ctx context.Context) string {
+	credential, _ := ctx.Value(credentialCtxKey{}).(string)
+	return credential
+}
+
+// Records bytes written to GCS on behalf of a context's credential.
+func recordBytesUploaded(ctx context.Context, n int64) {
+	tokenUsage.add(contextCredential(ctx), time.Now(), func(u *TokenUsage) { u.BytesUploaded += n })
+}
+
+// Records a deletion made or queued on behalf of a context's credential.
+func recordDeletion(ctx context.Context, objects, groups int64) {
+	tokenUsage.add(contextCredential(ctx), time.Now(), func(u *TokenUsage) {
+		u.ObjectsDeleted += objects
+		u.GroupsDeleted += groups
+	})
+}
+
+// Records a deletion message queued on behalf of a context's credential.
+func recordQueuedDeletion(ctx context.Context, message Message) {
+	switch message.(type) {
+	case DeleteSingle:
+		recordDeletion(ctx, 1, 0)
+	case DeleteGroup:
+		recordDeletion(ctx, 0, 1)
+	}
+}
+
+// TrackUsage counts each authenticated request against its credential, and
+// passes the credential on in the request's context.
+func TrackUsage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential := requestCredential(c)
+		if credential == "" {
+			c.Next()
+			return
+		}
+		c.Request = c.Request.WithContext(withCredential(c.Request.Context(), credential))
+		c.Next()
+		if route := c.FullPath(); route != "" {
+			key := c.Request.Method + " " + route
+			tokenUsage.add(credential, time.Now(), func(u *TokenUsage) { u.Requests[key]++ })
+		}
+	}
+}
+
+// A UsageReport is the response body for /admin/usage.
+type UsageReport struct {
+	Since       *time.Time             `json:"since,omitempty"`
+	Until       time.Time              `json:"until"`
+	Credentials map[string]*TokenUsage `json:"credentials"`
+}
+
+// Reports each credential's usage, optionally limited to the hours from
+// ?since= until ?until=, both RFC 3339 times.
+func getUsage(c *gin.Context) {
+	report := UsageReport{Until: time.Now().UTC()}
+	var since time.Time
+	if value := c.Query("since"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": "since must be an RFC 3339 time"})
+			return
+		}
+		since = t.UTC()
+		report.Since = &since
+	}
+	if value := c.Query("until"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			abortWith(c, http.StatusBadRequest, gin.H{"error": "until must be an RFC 3339 time"})
+			return
+		}
+		report.Until = t.UTC()
+	}
+	if report.Since != nil && !report.Until.After(since) {
+		abortWith(c, http.StatusBadRequest, gin.H{"error": "until must be after since"})
+		return
+	}
+	report.Credentials = tokenUsage.report(since, report.Until)
+	respond(c, http.StatusOK, report)
+}
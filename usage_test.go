@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Forget all usage, in place, since background jobs left over from other
+// tests may still be counting
+func (l *usageLedger) reset() {
+	l.Lock()
+	defer l.Unlock()
+	l.hours = make(map[time.Time]map[string]*TokenUsage)
+	l.dirty = false
+}
+
+// Make a request with a token and an optional body
+func requestAs(r http.Handler, token, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, body)
+	req.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// Fetch the usage report with a query
+func fetchUsage(t *testing.T, r http.Handler, query string) UsageReport {
+	w := requestAs(r, "token-a", "GET", "/admin/usage"+query, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var report UsageReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	return report
+}
+
+func TestTokenUsage(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useTokenPair(t, "token-a", "token-b")
+	r := setupRouter(false)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, gradientImage())
+	server := serveImage(buf.Bytes())
+	defer server.Close()
+	request := createFaceclaimRequest(testBucket)
+	request.ImageURL = server.URL
+	body, _ := json.Marshal(request)
+
+	// The primary token uploads and reads; the secondary one deletes
+	w := requestAs(r, "token-a", "POST", "/faceclaim/upload", bytes.NewReader(body))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	response := getFaceclaimResponse(w.Body)
+	key := objectKey(testBucket, response.URL)
+	var stored int64
+	objects, _ := store.List(context.Background(), testBucket, "")
+	for _, attrs := range objects {
+		stored += attrs.Size
+	}
+	w = requestAs(r, "token-a", "GET", fmt.Sprintf("/faceclaim/metadata/%v/%v", testBucket, key), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = requestAs(r, "token-b", "GET", fmt.Sprintf("/faceclaim/list/%v/%v", testBucket, testCharID), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = requestAs(r, "token-b", "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v", testBucket, key), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(r, "token-b", "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v/all", testBucket, otherCharID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	report := fetchUsage(t, r, "")
+	primary, secondary := report.Credentials[credentialPrimary], report.Credentials[credentialSecondary]
+	if assert.NotNil(t, primary) && assert.NotNil(t, secondary) {
+		assert.Equal(t, map[string]int64{
+			"POST /faceclaim/upload":                       1,
+			"GET /faceclaim/metadata/:bucket/:charid/:key": 1,
+		}, primary.Requests)
+		assert.Equal(t, stored, primary.BytesUploaded)
+		assert.Zero(t, primary.ObjectsDeleted)
+
+		assert.Equal(t, map[string]int64{
+			"GET /faceclaim/list/:bucket/:charid":           2,
+			"DELETE /faceclaim/delete/:bucket/:charid/:key": 1,
+			"DELETE /faceclaim/delete/:bucket/:charid/all":  1,
+		}, secondary.Requests)
+		assert.Zero(t, secondary.BytesUploaded)
+		assert.Equal(t, int64(1), secondary.ObjectsDeleted)
+		assert.Equal(t, int64(1), secondary.GroupsDeleted)
+	}
+
+	// The report counts the hours in its range
+	later := time.Now().Add(time.Hour).UTC()
+	report = fetchUsage(t, r, "?since="+later.Format(time.RFC3339)+"&until="+later.Add(time.Hour).Format(time.RFC3339))
+	assert.Empty(t, report.Credentials)
+	report = fetchUsage(t, r, "?until="+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	assert.Empty(t, report.Credentials)
+	report = fetchUsage(t, r, "?since="+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	assert.Len(t, report.Credentials, 2)
+
+	w = requestAs(r, "token-a", "GET", "/admin/usage?since=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = requestAs(r, "token-a", "GET", "/admin/usage?since="+later.Format(time.RFC3339), nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "until defaults to now")
+}
+
+func TestTokenUsageSnapshot(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	ctx := withCredential(context.Background(), credentialPrimary)
+	recordBytesUploaded(ctx, 100)
+	recordDeletion(withCredential(context.Background(), credentialSecondary), 2, 0)
+	recordBytesUploaded(context.Background(), 50)
+
+	now := time.Now()
+	if err := saveUsage(context.Background(), tokenUsage, now); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, store.exists(testBucket, UsageObject))
+
+	// A restarted instance picks up where the snapshot left off
+	restarted := newUsageLedger()
+	if err := loadUsage(context.Background(), restarted); err != nil {
+		t.Fatal(err)
+	}
+	restarted.add(credentialPrimary, now, func(u *TokenUsage) { u.BytesUploaded += 1 })
+	usage := restarted.report(time.Time{}, now.Add(time.Hour))
+	if assert.Len(t, usage, 2) {
+		assert.Equal(t, int64(101), usage[credentialPrimary].BytesUploaded)
+		assert.Equal(t, int64(2), usage[credentialSecondary].ObjectsDeleted)
+	}
+
+	// Unchanged usage isn't saved again
+	writes := countWrites(store)
+	assert.NoError(t, saveUsage(context.Background(), tokenUsage, now))
+	assert.Zero(t, *writes)
+}
+
+func TestPrepareUsage(t *testing.T) {
+	t.Cleanup(func() { prepareUsage() })
+
+	t.Setenv("USAGE_SNAPSHOT_INTERVAL", "1m")
+	t.Setenv("USAGE_OBJECT", "usage/tokens.json")
+	assert.NoError(t, prepareUsage())
+	assert.Equal(t, time.Minute, UsageSnapshotInterval)
+	assert.Equal(t, "usage/tokens.json", UsageObject)
+
+	t.Setenv("USAGE_SNAPSHOT_INTERVAL", "often")
+	assert.Error(t, prepareUsage())
+	t.Setenv("USAGE_SNAPSHOT_INTERVAL", "1m")
+	t.Setenv("USAGE_BUCKET", "Bad_Bucket")
+	assert.Error(t, prepareUsage())
+}
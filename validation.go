@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The charid the tests upload to, so test objects are easy to find.
+const testCharID = "__test"
+
+// AllowTestCharID permits testCharID alongside real ObjectIDs.
+var AllowTestCharID bool
+
+// Matches the keys this service creates: <ObjectId>.webp, its size variants
+// (<ObjectId>_<size>.webp), and its kept original (<ObjectId>.orig.<ext>).
+const defaultKeyPattern = `^[0-9a-fA-F]+(_[0-9]+)?(\.orig)?\.[a-z]+$`
+
+// KeyPattern is what faceclaim keys must match.
+var KeyPattern = regexp.MustCompile(defaultKeyPattern)
+
+// The note sent when a bucket is given as a gs:// URL.
+const gsPrefixDeprecation = "gs:// bucket prefixes are deprecated; send the bucket name alone"
+
+// Reads ALLOW_TEST_CHARID and KEY_PATTERN.
+func prepareValidation() error {
+	if value, ok := os.LookupEnv("ALLOW_TEST_CHARID"); ok {
+		allow, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("ALLOW_TEST_CHARID: %v", err)
+		}
+		AllowTestCharID = allow
+	}
+
+	KeyPattern = regexp.MustCompile(defaultKeyPattern)
+	if value, ok := os.LookupEnv("KEY_PATTERN"); ok {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("KEY_PATTERN: %v", err)
+		}
+		KeyPattern = pattern
+	}
+	return nil
+}
+
+// Reads ALLOWED_BUCKETS, a comma-separated list.
+func loadAllowedBuckets(cfg *Config) error {
+	for _, bucket := range strings.Split(os.Getenv("ALLOWED_BUCKETS"), ",") {
+		if bucket = strings.TrimSpace(bucket); bucket == "" {
+			continue
+		}
+		if err := validateBucketName(bucket); err != nil {
+			return fmt.Errorf("ALLOWED_BUCKETS: %v", err)
+		}
+		cfg.AllowedBuckets = append(cfg.AllowedBuckets, bucket)
+	}
+	return nil
+}
+
+// Checks that a value is safe to use as a single segment of an object name.
+// Whatever the patterns allow, slashes, "..", and control characters never
+// are.
+func checkSegment(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("%v is required", name)
+	}
+	if strings.Contains(value, "/") || strings.Contains(value, "..") {
+		return fmt.Errorf("%v may not contain / or ..", name)
+	}
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%v may not contain control characters", name)
+	}
+	return nil
+}
+
+// Checks that a charid is a hex ObjectID, or the test charid if allowed.
+func validateCharID(charid string) error {
+	if err := checkSegment("charid", charid); err != nil {
+		return err
+	}
+	if AllowTestCharID && charid == testCharID {
+		return nil
+	}
+	if _, err := primitive.ObjectIDFromHex(charid); err != nil {
+		return errors.New("charid must be a hex ObjectID")
+	}
+	return nil
+}
+
+// Strips a leading gs:// from a bucket, reporting whether there was one.
+func normalizeBucket(bucket string) (string, bool) {
+	if strings.HasPrefix(bucket, "gs://") {
+		return strings.TrimSuffix(strings.TrimPrefix(bucket, "gs://"), "/"), true
+	}
+	return bucket, false
+}
+
+// A BucketNotAllowedError means a well-formed bucket isn't one this server
+// accepts: FACECLAIM_BUCKET, or one in ALLOWED_BUCKETS or BUCKETS_JSON.
+type BucketNotAllowedError struct {
+	Bucket string
+}
+
+func (e *BucketNotAllowedError) Error() string {
+	return fmt.Sprintf("bucket %q isn't allowed", e.Bucket)
+}
+
+// Returns the status for a bucket that failed validateBucket: 403 if it isn't
+// allowed, and 400 if it's malformed.
+func bucketErrorStatus(err error) int {
+	var notAllowed *BucketNotAllowedError
+	if errors.As(err, &notAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// Checks that a bucket follows GCS's naming rules and is allowed.
+func validateBucket(bucket string) error {
+	if err := validateBucketName(bucket); err != nil {
+		return err
+	}
+	cfg := currentConfig()
+	if len(cfg.AllowedBuckets) == 0 && len(cfg.Buckets) == 0 || bucket == cfg.FaceclaimBucket {
+		return nil
+	}
+	if _, ok := cfg.Buckets[bucket]; ok {
+		return nil
+	}
+	for _, allowed := range cfg.AllowedBuckets {
+		if bucket == allowed {
+			return nil
+		}
+	}
+	return &BucketNotAllowedError{Bucket: bucket}
+}
+
+// Checks that a bucket follows GCS's naming rules. Faceclaims are served from
+// https://<bucket>/, so the name must also be a valid hostname, which rules
+// out underscores.
+func validateBucketName(bucket string) error {
+	invalid := func(rule string) error {
+		return fmt.Errorf("bucket %q is invalid: %v", bucket, rule)
+	}
+
+	if bucket == "" {
+		return errors.New("bucket is required")
+	}
+	maxLength := 63
+	if strings.Contains(bucket, ".") {
+		maxLength = 222
+	}
+	if len(bucket) < 3 || len(bucket) > maxLength {
+		return invalid(fmt.Sprintf("it must be between 3 and %v characters long", maxLength))
+	}
+	for _, r := range bucket {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return invalid("it must be lowercase")
+		case r == '_':
+			return invalid("it may not contain underscores, since it's used as a hostname")
+		case (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '.':
+			return invalid("it may only contain lowercase letters, digits, dashes, and dots")
+		}
+	}
+	for _, part := range strings.Split(bucket, ".") {
+		if part == "" || len(part) > 63 {
+			return invalid("each dot-separated part must be between 1 and 63 characters long")
+		}
+		if part[0] == '-' || part[len(part)-1] == '-' {
+			return invalid("it must start and end with a letter or digit, as must each dot-separated part")
+		}
+	}
+	if net.ParseIP(bucket) != nil {
+		return invalid("it may not be an IP address")
+	}
+	if strings.HasPrefix(bucket, "goog") || strings.Contains(bucket, "google") {
+		return invalid(`it may not start with "goog" or contain "google"`)
+	}
+	return nil
+}
+
+// Marks a response as having used a deprecated gs:// bucket prefix.
+func warnDeprecatedBucket(c *gin.Context) {
+	warnRequest(c, "deprecated_bucket_prefix", gsPrefixDeprecation)
+}
+
+// The context key the request's warnings are kept under.
+const requestWarningsKey = "warnings"
+
+// Adds a Warning header about something wrong, but not fatal, with the
+// request. Handlers whose responses carry warnings or notes include it there.
+func warnRequest(c *gin.Context, code, message string) {
+	c.Writer.Header().Add("Warning", fmt.Sprintf("299 - %q", message))
+	c.Set(requestWarningsKey, append(requestWarnings(c), Warning{Code: code, Message: message}))
+}
+
+// Returns the warnings given about the request.
+func requestWarnings(c *gin.Context) []Warning {
+	value, _ := c.Get(requestWarningsKey)
+	warnings, _ := value.([]Warning)
+	return warnings
+}
+
+// Checks that a faceclaim key matches KeyPattern.
+func validateKey(key string) error {
+	if err := checkSegment("key", key); err != nil {
+		return err
+	}
+	if !KeyPattern.MatchString(key) {
+		return fmt.Errorf("key %q isn't a faceclaim key", key)
+	}
+	return nil
+}
+
+// Checks that a log name, which may span several segments (e.g.
+// logs/2024/01/02/bot-20240102T030405.000Z.log), is made of safe ones.
+func validateLogName(name string) error {
+	for _, segment := range strings.Split(name, "/") {
+		if err := checkSegment("name", segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateParams rejects requests whose route parameters could address
+// objects outside the intended prefix. Buckets, charids, and keys are held to
+// their formats, and log names may span segments; everything else just has
+// to be a safe segment. Buckets given as gs:// URLs are stripped to their
+// names, with a warning.
+func ValidateParams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for i, param := range c.Params {
+			var err error
+			switch param.Key {
+			case "bucket":
+				bucket, prefixed := normalizeBucket(param.Value)
+				if prefixed {
+					c.Params[i].Value = bucket
+					warnDeprecatedBucket(c)
+				}
+				err = validateBucket(bucket)
+			case "charid":
+				err = validateCharID(param.Value)
+			case "key":
+				err = validateKey(param.Value)
+			case "name":
+				err = validateLogName(strings.TrimPrefix(param.Value, "/"))
+			default:
+				err = checkSegment(param.Key, param.Value)
+			}
+			if err != nil {
+				abortWith(c, bucketErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Route parameter payloads that try to escape the character's prefix
+var traversalPayloads = []string{
+	"..%2Fother",
+	"%2e%2e",
+	"%2e%2e%2Fother",
+	"abc%2F..%2Fdef",
+	"abc%00",
+	"abc%0A",
+}
+
+func TestRoutesRejectTraversal(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	routes := []struct{ method, format string }{
+		{"DELETE", "/faceclaim/delete/%v/%v/all"},
+		{"DELETE", "/faceclaim/delete/%v/%v/abc.webp"},
+		{"GET", "/faceclaim/metadata/%v/%v/abc.webp"},
+		{"GET", "/faceclaim/image/%v/%v/abc.webp"},
+	}
+	for _, route := range routes {
+		for _, payload := range traversalPayloads {
+			path := fmt.Sprintf(route.format, testBucket, payload)
+			w := performRequest(r, route.method, path, nil)
+			assert.Equal(t, 400, w.Code, "%v %v", route.method, path)
+		}
+	}
+
+	keyRoutes := []struct{ method, format string }{
+		{"DELETE", "/faceclaim/delete/%v/__test/%v"},
+		{"GET", "/faceclaim/metadata/%v/__test/%v"},
+		{"GET", "/faceclaim/image/%v/__test/%v"},
+	}
+	for _, route := range keyRoutes {
+		for _, payload := range append(traversalPayloads, "..%2F..%2Fjobs%2Fabc.json") {
+			path := fmt.Sprintf(route.format, testBucket, payload)
+			w := performRequest(r, route.method, path, nil)
+			assert.Equal(t, 400, w.Code, "%v %v", route.method, path)
+		}
+	}
+
+	for _, path := range []string{"/faceclaim/job/..%2Fjobs", "/faceclaim/usage/%2e%2e/1", "/faceclaim/usage/" + testBucket + "/..%2F1"} {
+		w := performRequest(r, "GET", path, nil)
+		assert.Equal(t, 400, w.Code, path)
+	}
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestUploadRejectsTraversal(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	for _, charid := range []string{"../otherchar", "abc/def", "..", "abc\x00", "notanobjectid", ""} {
+		request := createFaceclaimRequest(testBucket)
+		request.CharID = charid
+		w := postTestImage(r, request)
+		assert.Equal(t, 400, w.Code, "%q", charid)
+	}
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestAdminRejectsTraversal(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	body, _ := json.Marshal(MigrateRequest{Source: testBucket, Destination: "elsewhere", CharID: "../other"})
+	w := performRequest(r, "POST", "/admin/migrate", bytes.NewReader(body))
+	assert.Equal(t, 400, w.Code)
+
+	body, _ = json.Marshal(ReencodeRequest{CharID: "../other", Quality: 50})
+	w = performRequest(r, "POST", "/admin/reencode", bytes.NewReader(body))
+	assert.Equal(t, 400, w.Code)
+
+	body, _ = json.Marshal(ReconcileRequest{KnownKeys: []string{"__test/abc.webp"}, CharIDs: []string{"__test", "../other"}})
+	w = performRequest(r, "POST", "/faceclaim/reconcile", bytes.NewReader(body))
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestValidCharIDs(t *testing.T) {
+	assert.NoError(t, validateCharID("63b1e5d6e3d1c1a2b3c4d5e6"))
+	assert.NoError(t, validateCharID(testCharID))
+
+	AllowTestCharID = false
+	t.Cleanup(func() { AllowTestCharID = true })
+	assert.Error(t, validateCharID(testCharID))
+}
+
+func TestValidKeys(t *testing.T) {
+	for _, key := range []string{"63b1e5d6e3d1c1a2b3c4d5e6.webp", "63b1e5d6e3d1c1a2b3c4d5e6_256.webp", "63b1e5d6e3d1c1a2b3c4d5e6.orig.png"} {
+		assert.NoError(t, validateKey(key), key)
+	}
+	for _, key := range []string{"", "missing.webp", "../abc.webp", "abc..webp", "abc\t.webp"} {
+		assert.Error(t, validateKey(key), "%q", key)
+	}
+}
+
+func TestPrepareValidation(t *testing.T) {
+	t.Cleanup(func() {
+		os.Unsetenv("KEY_PATTERN")
+		os.Unsetenv("ALLOW_TEST_CHARID")
+		prepareValidation()
+		AllowTestCharID = true
+	})
+
+	os.Setenv("KEY_PATTERN", `^[a-z]+\.webp$`)
+	os.Setenv("ALLOW_TEST_CHARID", "false")
+	assert.NoError(t, prepareValidation())
+	assert.NoError(t, validateKey("missing.webp"))
+	assert.Error(t, validateKey("../missing.webp"), "Unsafe keys are rejected whatever the pattern")
+	assert.False(t, AllowTestCharID)
+
+	os.Setenv("KEY_PATTERN", "(")
+	assert.Error(t, prepareValidation())
+}
+
+func TestValidBuckets(t *testing.T) {
+	for _, bucket := range []string{"pcs.inconnu.app", "inconnu-logs", "abc", "a1.b2-c3"} {
+		assert.NoError(t, validateBucket(bucket), bucket)
+	}
+	rules := map[string]string{
+		"":                  "required",
+		"ab":                "between 3 and 63",
+		"PCS.inconnu.app":   "lowercase",
+		"pcs_inconnu":       "underscores",
+		"pcs inconnu":       "lowercase letters, digits, dashes, and dots",
+		"pcs..inconnu.app":  "dot-separated part",
+		"-pcs.inconnu.app":  "start and end",
+		"pcs-.inconnu.app":  "start and end",
+		"192.168.5.4":       "IP address",
+		"google-faceclaims": "google",
+		"goog-faceclaims":   "goog",
+	}
+	for bucket, rule := range rules {
+		assert.ErrorContains(t, validateBucket(bucket), rule, "%q", bucket)
+	}
+}
+
+func TestInvalidBucketParamRejected(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	for _, bucket := range []string{"PCS.inconnu.app", "pcs_inconnu"} {
+		w := performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/__test/abc.webp", bucket), nil)
+		assert.Equal(t, 400, w.Code, bucket)
+		assert.Contains(t, w.Body.String(), "is invalid", bucket)
+	}
+}
+
+func TestGSPrefixStripped(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest("gs://" + testBucket)
+	w := postTestImage(r, request)
+	assert.Equal(t, 201, w.Code)
+	assert.Contains(t, w.Header().Get("Warning"), "deprecated")
+
+	response := getFaceclaimResponse(w.Body)
+	assert.Contains(t, response.Warnings, Warning{Code: "deprecated_bucket_prefix", Message: gsPrefixDeprecation})
+	assert.True(t, strings.HasPrefix(response.URL, "https://"+testBucket+"/"))
+	assert.True(t, store.exists(testBucket, objectKey(testBucket, response.URL)))
+}
+
+func TestInvalidUploadBucketRejected(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	w := postTestImage(r, createFaceclaimRequest("Faceclaims_Bucket"))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "lowercase")
+}
+
+func TestAllowedBuckets(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	os.Setenv("ALLOWED_BUCKETS", "other.inconnu.app, another.inconnu.app")
+	defer os.Unsetenv("ALLOWED_BUCKETS")
+	useConfig(t, func(cfg *Config) {
+		assert.NoError(t, loadAllowedBuckets(cfg))
+	})
+	r := setupRouter(false)
+
+	store.Upload(context.Background(), "other.inconnu.app", "__test/abc.webp", strings.NewReader("x"), UploadOptions{})
+	w := performRequest(r, "GET", "/faceclaim/metadata/other.inconnu.app/__test/abc.webp", nil)
+	assert.Equal(t, 200, w.Code)
+
+	// The default bucket is always allowed
+	w = performRequest(r, "GET", "/faceclaim/metadata/"+testBucket+"/__test/abc.webp", nil)
+	assert.Equal(t, 404, w.Code)
+
+	// Buckets that aren't allowed are forbidden, in routes and bodies alike
+	w = performRequest(r, "GET", "/faceclaim/metadata/third.inconnu.app/__test/abc.webp", nil)
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), "isn't allowed")
+	w = postTestImage(r, createFaceclaimRequest("third.inconnu.app"))
+	assert.Equal(t, 403, w.Code)
+	assert.Empty(t, store.keys("third.inconnu.app"))
+
+	// Malformed ones are still bad requests
+	w = performRequest(r, "GET", "/faceclaim/metadata/Third_Bucket/__test/abc.webp", nil)
+	assert.Equal(t, 400, w.Code)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// Limits on requested size variants, so a single upload can't fan out into an
+// unbounded amount of work.
+const (
+	maxVariants    = 4
+	maxVariantSize = 4096
+)
+
+// Checks that the requested variants are distinct sizes within bounds.
+func validateVariants(variants []string) error {
+	if len(variants) > maxVariants {
+		return fmt.Errorf("at most %v variants may be requested", maxVariants)
+	}
+	seen := make(map[string]bool)
+	for _, v := range variants {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 || size > maxVariantSize || strconv.Itoa(size) != v {
+			return fmt.Errorf("invalid variant %q: must be a size between 1 and %v", v, maxVariantSize)
+		}
+		if seen[v] {
+			return fmt.Errorf("duplicate variant %q", v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+// Splits the requested variants into the sizes to generate and notes about
+// the ones skipped because they would upscale the image.
+func planVariants(variants []string, img image.Image) (sizes []string, notes []string) {
+	bounds := img.Bounds()
+	longest := bounds.Dx()
+	if bounds.Dy() > longest {
+		longest = bounds.Dy()
+	}
+
+	for _, v := range variants {
+		size, _ := strconv.Atoi(v) // Already validated
+		if size > longest {
+			notes = append(notes, fmt.Sprintf("Skipped variant %v: the image is only %vx%v", v, bounds.Dx(), bounds.Dy()))
+			continue
+		}
+		sizes = append(sizes, v)
+	}
+	return sizes, notes
+}
+
+// Returns the object name of a size variant: <charid>/<ObjectId()>_<size>.webp
+func variantObjectName(objectName, size string) string {
+	return fmt.Sprintf("%v_%v.webp", strings.TrimSuffix(objectName, ".webp"), size)
+}
+
+// Returns the object names of the variants listed in a faceclaim's metadata.
+func variantObjectNames(objectName string, metadata map[string]string) []string {
+	var names []string
+	if variants := metadata["variants"]; variants != "" {
+		for _, size := range strings.Split(variants, ",") {
+			names = append(names, variantObjectName(objectName, size))
+		}
+	}
+	return names
+}
+
+// Resizes and converts each variant concurrently at the given quality,
+// returning the WebPs in the same order as sizes. The buffers come from the pool, so the caller must
+// return them with putBuffer.
+func renderVariants(ctx context.Context, img image.Image, sizes []string, quality int) ([]*bytes.Buffer, error) {
+	var wg sync.WaitGroup
+	rendered := make([]*bytes.Buffer, len(sizes))
+	errs := make([]error, len(sizes))
+
+	for i, v := range sizes {
+		rendered[i] = getBuffer()
+		wg.Add(1)
+		go func(i int, v string) {
+			defer wg.Done()
+
+			size, _ := strconv.Atoi(v)
+			resized := getBuffer()
+			defer putBuffer(resized)
+			if err := png.Encode(resized, scaleToFit(img, size, draw.CatmullRom)); err != nil {
+				errs[i] = fmt.Errorf("variant %v: png.Encode: %v", v, err)
+				return
+			}
+			if err := ImageConverter.Convert(ctx, resized, rendered[i], quality); err != nil {
+				errs[i] = fmt.Errorf("variant %v: %v", v, err)
+			}
+		}(i, v)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			for _, buf := range rendered {
+				putBuffer(buf)
+			}
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateVariants(t *testing.T) {
+	assert.Nil(t, validateVariants(nil))
+	assert.Nil(t, validateVariants([]string{"256", "512", "1024"}))
+
+	assert.NotNil(t, validateVariants([]string{"big"}))
+	assert.NotNil(t, validateVariants([]string{"0"}))
+	assert.NotNil(t, validateVariants([]string{"0256"}))
+	assert.NotNil(t, validateVariants([]string{"99999"}))
+	assert.NotNil(t, validateVariants([]string{"256", "256"}))
+	assert.NotNil(t, validateVariants([]string{"1", "2", "3", "4", "5"}))
+}
+
+func TestUploadVariants(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	// The gradient fixture is 32x24, so the 64px variant would be an upscale
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16", "24", "64"}
+	response := uploadTestImage(t, r, request)
+
+	assert.Len(t, response.Variants, 2)
+	assert.Equal(t, []string{"variant_skipped"}, warningCodes(response))
+
+	expected := map[string]image.Point{"16": {16, 12}, "24": {24, 18}}
+	for size, dims := range expected {
+		key := objectKey(testBucket, response.Variants[size])
+		assert.Equal(t, variantObjectName(objectKey(testBucket, response.URL), size), key)
+
+		data, err := store.Download(context.Background(), testBucket, key)
+		assert.Nil(t, err)
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		assert.Nil(t, err)
+		assert.Equal(t, dims, image.Point{config.Width, config.Height}, fmt.Sprintf("%v variant has the wrong size", size))
+	}
+
+	// The full-size object lists its variants
+	attrs, _ := store.Attrs(context.Background(), testBucket, objectKey(testBucket, response.URL))
+	assert.Equal(t, "16,24", attrs.Metadata["variants"])
+}
+
+func TestInvalidVariantsRejected(t *testing.T) {
+	useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"huge"}
+	body, _ := json.Marshal(request)
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestSingleDeleteRemovesVariants(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16", "24"}
+	response := uploadTestImage(t, r, request)
+	assert.Len(t, store.keys(testBucket), 3)
+
+	path := fmt.Sprintf("/faceclaim/delete/%v/%v", testBucket, objectKey(testBucket, response.URL))
+	w := performRequest(r, "DELETE", path, nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+func TestGroupDeleteRemovesVariants(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	r := setupRouter(false)
+
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16"}
+	uploadTestImage(t, r, request)
+	assert.Len(t, store.keys(testBucket), 2)
+
+	w := performRequest(r, "DELETE", fmt.Sprintf("/faceclaim/delete/%v/%v/all", testBucket, request.CharID), nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, store.keys(testBucket))
+}
+
+// Retry failed derived uploads immediately, rather than after a delay
+func useImmediateRetries(t *testing.T) {
+	derivedRetryDelay = 0
+	t.Cleanup(func() {
+		derivedRetries.Wait()
+		derivedRetryDelay = 30 * time.Second
+	})
+}
+
+func TestFailedVariantDoesNotFailUpload(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useImmediateRetries(t)
+	r := setupRouter(false)
+
+	attempts := 0
+	store.rejectUpload = func(bucket, object string) bool {
+		if strings.HasSuffix(object, "_16.webp") {
+			attempts++
+			return true
+		}
+		return false
+	}
+
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16", "24"}
+	response := uploadTestImage(t, r, request)
+
+	assert.Equal(t, []string{"16"}, response.Failed)
+	assert.Len(t, response.Variants, 1)
+	assert.Contains(t, response.Variants, "24")
+	object := objectKey(testBucket, response.URL)
+	assert.True(t, store.exists(testBucket, object))
+	assert.True(t, store.exists(testBucket, variantObjectName(object, "24")))
+
+	// The failed variant is retried once, and stays listed so deleting the
+	// faceclaim would clean it up
+	derivedRetries.Wait()
+	store.Lock()
+	assert.Equal(t, 2, attempts)
+	store.Unlock()
+	assert.False(t, store.exists(testBucket, variantObjectName(object, "16")))
+	attrs, _ := store.Attrs(context.Background(), testBucket, object)
+	assert.Equal(t, "16,24", attrs.Metadata["variants"])
+}
+
+func TestFailedVariantRetried(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	useImmediateRetries(t)
+	r := setupRouter(false)
+
+	failed := false
+	store.rejectUpload = func(bucket, object string) bool {
+		if strings.HasSuffix(object, "_16.webp") && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}
+
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16"}
+	response := uploadTestImage(t, r, request)
+	assert.Equal(t, []string{"16"}, response.Failed)
+
+	derivedRetries.Wait()
+	object := objectKey(testBucket, response.URL)
+	assert.True(t, store.exists(testBucket, variantObjectName(object, "16")))
+}
+
+// primaryLastStorage fails faceclaims' WebPs, but only once their derived
+// objects have been written, so there's something to clean up.
+type primaryLastStorage struct {
+	*memStorage
+	derived sync.WaitGroup
+}
+
+func (s *primaryLastStorage) Upload(ctx context.Context, bucket, object string, data io.Reader, opts UploadOptions) error {
+	if name := path.Base(object); strings.Contains(name, "_") || strings.Contains(name, ".orig.") {
+		defer s.derived.Done()
+		return s.memStorage.Upload(ctx, bucket, object, data, opts)
+	}
+	s.derived.Wait()
+	return errors.New("storage is down")
+}
+
+func TestFailedPrimaryCleansUpDerived(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	primaryLast := &primaryLastStorage{memStorage: store}
+	primaryLast.derived.Add(3)
+	Store = primaryLast
+	r := setupRouter(false)
+
+	keep := true
+	request := createFaceclaimRequest(testBucket)
+	request.Variants = []string{"16", "24"}
+	request.KeepOriginal = &keep
+	w := postTestImage(r, request)
+
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "storage is down")
+	assert.Empty(t, store.keys(testBucket))
+}
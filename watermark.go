@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/sync/singleflight"
+)
+
+// A Watermark is a pre-registered overlay that partner guilds can have
+// composited onto their faceclaims.
+type Watermark struct {
+	Path    string  `json:"path"`    // gs://bucket/object
+	Corner  string  `json:"corner"`  // top-left, top-right, bottom-left, or bottom-right
+	Opacity float64 `json:"opacity"` // 0 < opacity <= 1
+}
+
+// Watermarks maps watermark names, as given in upload requests, to overlays.
+var Watermarks map[string]Watermark
+
+const (
+	defaultWatermarkCorner  = "bottom-right"
+	defaultWatermarkOpacity = 0.5
+
+	// Overlays are scaled down to at most this fraction of the image's
+	// width and height so they stay subtle.
+	watermarkMaxFraction = 4
+)
+
+var watermarkCorners = map[string]bool{"top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true}
+
+// Overlays are cached after their first fetch, keyed by GCS path.
+var overlayCache = struct {
+	sync.Mutex
+	images map[string]image.Image
+}{images: make(map[string]image.Image)}
+
+// Overlay fetches in progress, by GCS path, so uploads waiting on the same
+// overlay share one download.
+var overlayFlights singleflight.Group
+
+// Loads the watermark registry from WATERMARKS_JSON, which maps names to
+// overlay definitions, e.g. {"partner": {"path": "gs://bucket/emblem.png"}}.
+// Watermarks are disabled if it isn't set.
+func prepareWatermarks() error {
+	Watermarks = make(map[string]Watermark)
+	raw, ok := os.LookupEnv("WATERMARKS_JSON")
+	if !ok {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(raw), &Watermarks); err != nil {
+		return fmt.Errorf("WATERMARKS_JSON: %v", err)
+	}
+	for name, w := range Watermarks {
+		if _, _, err := parseGCSPath(w.Path); err != nil {
+			return fmt.Errorf("WATERMARKS_JSON: %v: %v", name, err)
+		}
+		if w.Corner == "" {
+			w.Corner = defaultWatermarkCorner
+		}
+		if !watermarkCorners[w.Corner] {
+			return fmt.Errorf("WATERMARKS_JSON: %v: unknown corner %q", name, w.Corner)
+		}
+		if w.Opacity == 0 {
+			w.Opacity = defaultWatermarkOpacity
+		}
+		if w.Opacity < 0 || w.Opacity > 1 {
+			return fmt.Errorf("WATERMARKS_JSON: %v: opacity must be between 0 and 1", name)
+		}
+		Watermarks[name] = w
+	}
+	return nil
+}
+
+// Splits a gs://bucket/object path into its bucket and object names.
+func parseGCSPath(path string) (bucket, object string, err error) {
+	trimmed := strings.TrimPrefix(path, "gs://")
+	bucket, object, found := strings.Cut(trimmed, "/")
+	if trimmed == path || !found || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("%q is not a gs://bucket/object path", path)
+	}
+	return bucket, object, nil
+}
+
+// Composites the named watermark onto the image data, returning the result as
+// a PNG for the WebP converter. Animated images are flattened to their first
+// frame.
+func applyWatermark(data []byte, name string) ([]byte, error) {
+	watermark, ok := Watermarks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown watermark %q", name)
+	}
+	overlay, err := loadOverlay(watermark.Path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, compositeWatermark(img, overlay, watermark.Corner, watermark.Opacity)); err != nil {
+		return nil, fmt.Errorf("png.Encode: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Fetches an overlay image from GCS, or from the cache if it's been fetched
+// before. The cache isn't locked during the download, so a slow one doesn't
+// hold up uploads using other overlays.
+func loadOverlay(path string) (image.Image, error) {
+	overlayCache.Lock()
+	overlay, ok := overlayCache.images[path]
+	overlayCache.Unlock()
+	if ok {
+		return overlay, nil
+	}
+
+	result, err, _ := overlayFlights.Do(path, func() (interface{}, error) {
+		// Another fetch may have finished since the cache was checked
+		overlayCache.Lock()
+		overlay, ok := overlayCache.images[path]
+		overlayCache.Unlock()
+		if ok {
+			return overlay, nil
+		}
+		bucket, object, err := parseGCSPath(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := downloadObject(context.Background(), bucket, object)
+		if err != nil {
+			return nil, fmt.Errorf("loadOverlay: %v", err)
+		}
+		if overlay, err = decodeImage(data); err != nil {
+			return nil, fmt.Errorf("loadOverlay: %v", err)
+		}
+		overlayCache.Lock()
+		overlayCache.images[path] = overlay
+		overlayCache.Unlock()
+		return overlay, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(image.Image), nil
+}
+
+// Draws the overlay onto a copy of the image in the given corner. Overlays
+// too large for the image are scaled down first.
+func compositeWatermark(img, overlay image.Image, corner string, opacity float64) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Copy(dst, image.Point{}, img, bounds, draw.Src, nil)
+
+	// Fit the overlay within the allowed fraction of the image
+	ob := overlay.Bounds()
+	width, height := ob.Dx(), ob.Dy()
+	maxWidth, maxHeight := dst.Bounds().Dx()/watermarkMaxFraction, dst.Bounds().Dy()/watermarkMaxFraction
+	if width > maxWidth || height > maxHeight {
+		scale := float64(maxWidth) / float64(width)
+		if s := float64(maxHeight) / float64(height); s < scale {
+			scale = s
+		}
+		width, height = int(float64(width)*scale), int(float64(height)*scale)
+		if width == 0 || height == 0 {
+			// The image is too small to carry a watermark
+			return dst
+		}
+	}
+
+	// Inset the overlay from the edges by a small margin
+	margin := dst.Bounds().Dx() / 50
+	if m := dst.Bounds().Dy() / 50; m < margin {
+		margin = m
+	}
+	x, y := margin, margin
+	if strings.HasSuffix(corner, "right") {
+		x = dst.Bounds().Dx() - width - margin
+	}
+	if strings.HasPrefix(corner, "bottom") {
+		y = dst.Bounds().Dy() - height - margin
+	}
+
+	target := image.Rect(x, y, x+width, y+height)
+	mask := &image.Uniform{color.Alpha{uint8(opacity * 255)}}
+	draw.BiLinear.Scale(dst, target, overlay, ob, draw.Over, &draw.Options{SrcMask: mask})
+
+	return dst
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Register a tiny white overlay as the "test" watermark, bypassing GCS
+func useTestWatermark(t *testing.T, corner string) {
+	path := "gs://watermarks.test/overlay.png"
+	overlayCache.Lock()
+	overlayCache.images[path] = solidImage(color.RGBA{255, 255, 255, 255}).SubImage(image.Rect(0, 0, 8, 8))
+	overlayCache.Unlock()
+
+	Watermarks = map[string]Watermark{"test": {Path: path, Corner: corner, Opacity: 1}}
+	t.Cleanup(func() { Watermarks = nil })
+}
+
+func TestPrepareWatermarks(t *testing.T) {
+	defer os.Unsetenv("WATERMARKS_JSON")
+
+	assert.Nil(t, prepareWatermarks())
+	assert.Empty(t, Watermarks)
+
+	os.Setenv("WATERMARKS_JSON", `{"partner": {"path": "gs://bucket/emblem.png"}}`)
+	assert.Nil(t, prepareWatermarks())
+	assert.Equal(t, Watermark{Path: "gs://bucket/emblem.png", Corner: "bottom-right", Opacity: 0.5}, Watermarks["partner"])
+
+	os.Setenv("WATERMARKS_JSON", `{"partner": {"path": "https://bucket/emblem.png"}}`)
+	assert.NotNil(t, prepareWatermarks(), "prepareWatermarks() should reject non-GCS paths")
+
+	os.Setenv("WATERMARKS_JSON", `{"partner": {"path": "gs://bucket/emblem.png", "corner": "middle"}}`)
+	assert.NotNil(t, prepareWatermarks(), "prepareWatermarks() should reject unknown corners")
+
+	os.Setenv("WATERMARKS_JSON", `{"partner": {"path": "gs://bucket/emblem.png", "opacity": 2}}`)
+	assert.NotNil(t, prepareWatermarks(), "prepareWatermarks() should reject invalid opacities")
+
+	Watermarks = nil
+}
+
+func TestApplyWatermark(t *testing.T) {
+	useTestWatermark(t, "bottom-right")
+
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(color.RGBA{255, 0, 0, 255}))
+	original, _ := decodeImage(buf.Bytes())
+
+	data, err := applyWatermark(buf.Bytes(), "test")
+	assert.Nil(t, err)
+	watermarked, err := decodeImage(data)
+	assert.Nil(t, err)
+	assert.Equal(t, original.Bounds(), watermarked.Bounds())
+
+	// The overlay should only appear in the bottom-right corner
+	assert.NotEqual(t, rgba(original.At(58, 58)), rgba(watermarked.At(58, 58)))
+	assert.Equal(t, rgba(original.At(5, 5)), rgba(watermarked.At(5, 5)))
+	assert.Equal(t, rgba(original.At(58, 5)), rgba(watermarked.At(58, 5)))
+	assert.Equal(t, rgba(original.At(5, 58)), rgba(watermarked.At(5, 58)))
+}
+
+func TestApplyWatermarkTopLeft(t *testing.T) {
+	useTestWatermark(t, "top-left")
+
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(color.RGBA{255, 0, 0, 255}))
+
+	data, _ := applyWatermark(buf.Bytes(), "test")
+	watermarked, _ := decodeImage(data)
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, rgba(watermarked.At(3, 3)))
+	assert.Equal(t, color.RGBA{255, 0, 0, 255}, rgba(watermarked.At(58, 58)))
+}
+
+func TestLoadOverlayDoesNotBlockOthers(t *testing.T) {
+	store, _ := useFakeBackends(t)
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(color.RGBA{255, 255, 255, 255}))
+	for _, name := range []string{"slow.png", "fast.png"} {
+		store.Upload(context.Background(), "watermarks.test", name, bytes.NewReader(buf.Bytes()), UploadOptions{ContentType: "image/png"})
+	}
+	slow, fast := "gs://watermarks.test/slow.png", "gs://watermarks.test/fast.png"
+	t.Cleanup(func() {
+		overlayCache.Lock()
+		delete(overlayCache.images, slow)
+		delete(overlayCache.images, fast)
+		overlayCache.Unlock()
+	})
+
+	var downloads int32
+	started, release := make(chan struct{}), make(chan struct{})
+	store.beforeDownload = func(bucket, object string) {
+		if object == "slow.png" && atomic.AddInt32(&downloads, 1) == 1 {
+			close(started)
+			<-release
+		}
+	}
+
+	// Two uploads wait on the slow overlay...
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := loadOverlay(slow)
+			assert.NoError(t, err)
+		}()
+	}
+	<-started
+
+	// ...while another overlay loads regardless
+	_, err := loadOverlay(fast)
+	assert.NoError(t, err)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads), "The slow overlay is only downloaded once")
+}
+
+func TestUnknownWatermark(t *testing.T) {
+	useTestWatermark(t, "bottom-right")
+
+	request := createFaceclaimRequest(testBucket)
+	request.Watermark = "nonexistent"
+	body, _ := json.Marshal(request)
+
+	r := setupRouter(false)
+	w := performRequest(r, "POST", "/faceclaim/upload", bytes.NewBuffer(body))
+	assert.Equal(t, 400, w.Code)
+}
+
+// Convert any color to RGBA for comparison
+func rgba(c color.Color) color.RGBA {
+	return color.RGBAModel.Convert(c).(color.RGBA)
+}